@@ -0,0 +1,156 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// acceptQueue bounds the number of WebSocket connections, or of other operations such as broadcasts, processed
+// at once. The ones beyond the limit wait in a FIFO queue for one to end, and are rejected once the queue is full.
+type acceptQueue struct {
+	lock    sync.Mutex
+	active  int
+	waiters []chan struct{}
+
+	rejected int
+	waits    int
+	waitSum  time.Duration
+}
+
+// acceptQueueStats is the state of the accept queue shown in the status report.
+type acceptQueueStats struct {
+	Active   int     `json:"active"`
+	Depth    int     `json:"depth"`
+	Rejected int     `json:"rejected"`
+	Waits    int     `json:"waits"`
+	WaitMs   float64 `json:"waitms"`
+}
+
+// acquire takes a processing slot, waiting in the queue if all |max| slots are taken. It returns false if
+// the |size| places of the queue are taken too, or if |ctx| is done while waiting. A |max| of 0 means
+// unlimited.
+func (aq *acceptQueue) acquire(ctx context.Context, max int, size int) bool {
+	aq.lock.Lock()
+	if max <= 0 || aq.active < max {
+		aq.active += 1
+		aq.lock.Unlock()
+		return true
+	}
+	if len(aq.waiters) >= size {
+		aq.rejected += 1
+		aq.lock.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	aq.waiters = append(aq.waiters, ch)
+	aq.lock.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ch:
+		aq.lock.Lock()
+		aq.waits += 1
+		aq.waitSum += time.Since(start)
+		aq.lock.Unlock()
+		return true
+	case <-ctx.Done():
+	}
+
+	aq.lock.Lock()
+	defer aq.lock.Unlock()
+	for i, w := range aq.waiters {
+		if w == ch {
+			aq.waiters = append(aq.waiters[:i], aq.waiters[i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over while giving up, so it is passed on.
+	aq.releaseLocked()
+	return false
+}
+
+// release frees a processing slot, handing it over to the first waiting connection if any.
+func (aq *acceptQueue) release() {
+	aq.lock.Lock()
+	defer aq.lock.Unlock()
+
+	aq.releaseLocked()
+}
+
+func (aq *acceptQueue) releaseLocked() {
+	if len(aq.waiters) == 0 {
+		aq.active -= 1
+		return
+	}
+	close(aq.waiters[0])
+	aq.waiters = aq.waiters[1:]
+}
+
+func (aq *acceptQueue) stats() acceptQueueStats {
+	aq.lock.Lock()
+	defer aq.lock.Unlock()
+
+	return acceptQueueStats{
+		Active:   aq.active,
+		Depth:    len(aq.waiters),
+		Rejected: aq.rejected,
+		Waits:    aq.waits,
+		WaitMs:   aq.waitSum.Seconds() * 1000,
+	}
+}
+
+// How long a connection may wait in the accept queue when AcceptQueueTimeout is not set.
+const defaultAcceptQueueTimeout = 10 * time.Second
+
+// acceptSlot is held by a WebSocket connection from its handshake until it registers or closes.
+type acceptSlot struct {
+	aq   *acceptQueue
+	once sync.Once
+}
+
+func (s *acceptSlot) release() {
+	s.once.Do(s.aq.release)
+}
+
+type acceptSlotKey struct{}
+
+// acceptQueued wraps the WebSocket handler so that at most MaxActiveConns connections are accepted at once, i.e.
+// between their handshake and their registration, with up to AcceptQueueSize more waiting for their turn for up to
+// AcceptQueueTimeout. Beyond that, connections are rejected with 503.
+func (c *Collider) acceptQueued(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), c.acceptQueueTimeout())
+		ok := c.accept.acquire(ctx, c.MaxActiveConns, c.AcceptQueueSize)
+		cancel()
+		if !ok {
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		s := &acceptSlot{aq: &c.accept}
+		defer s.release()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), acceptSlotKey{}, s)))
+	})
+}
+
+// releaseAccepted frees the accept slot held by the request of a connection once it has registered, if it holds
+// one.
+func releaseAccepted(r *http.Request) {
+	if s, ok := r.Context().Value(acceptSlotKey{}).(*acceptSlot); ok {
+		s.release()
+	}
+}
+
+// acceptQueueTimeout returns how long a connection may wait in the accept queue.
+func (c *Collider) acceptQueueTimeout() time.Duration {
+	if c.AcceptQueueTimeout > 0 {
+		return c.AcceptQueueTimeout
+	}
+	return defaultAcceptQueueTimeout
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Tests that the connections beyond MaxActiveConns wait in the queue, those beyond the queue are rejected
+// with 503, and that the queue is reported in the status.
+func TestAcceptQueueSaturated(t *testing.T) {
+	c := createNewCollider()
+	c.MaxActiveConns, c.AcceptQueueSize = 1, 1
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(c.acceptQueued(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})))
+	defer srv.Close()
+
+	codes := make(chan int, 2)
+	get := func() {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Errorf("http.Get(%q) got error: %v, want nil", srv.URL, err)
+			codes <- 0
+			return
+		}
+		resp.Body.Close()
+		codes <- resp.StatusCode
+	}
+	// One connection is processed and one waits.
+	go get()
+	waitForCondition(func() bool { return c.accept.stats().Active == 1 })
+	go get()
+	waitForCondition(func() bool { return c.accept.stats().Depth == 1 })
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("http.Get(%q) got error: %v, want nil", srv.URL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("With the accept queue full, the status is %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	r := c.dash.getReport(c.roomTable)
+	if aq := r.AcceptQueue; aq.Active != 1 || aq.Depth != 1 || aq.Rejected != 1 {
+		t.Errorf("db.getReport().AcceptQueue is %+v, want 1 active, 1 waiting and 1 rejected", aq)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("A queued connection got status %d, want %d", code, http.StatusOK)
+		}
+	}
+	r = c.dash.getReport(c.roomTable)
+	if aq := r.AcceptQueue; aq.Active != 0 || aq.Depth != 0 || aq.Waits != 1 || aq.WaitMs < 10 {
+		t.Errorf("After the connections ended, db.getReport().AcceptQueue is %+v, want none active or waiting "+
+			"and one wait of at least 10ms", aq)
+	}
+}
+
+// Tests that a connection giving up while queued leaves the queue.
+func TestAcceptQueueCanceledWait(t *testing.T) {
+	var aq acceptQueue
+	if !aq.acquire(context.Background(), 1, 1) {
+		t.Fatalf("acceptQueue.acquire() with a free slot = false, want true")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- aq.acquire(ctx, 1, 1) }()
+	waitForCondition(func() bool { return aq.stats().Depth == 1 })
+	cancel()
+	if <-done {
+		t.Errorf("acceptQueue.acquire() canceled while queued = true, want false")
+	}
+	aq.release()
+	if s := aq.stats(); s.Active != 0 || s.Depth != 0 {
+		t.Errorf("After the release, acceptQueue.stats() = %+v, want empty", s)
+	}
+}
+
+// Tests that a connection waiting in the queue longer than AcceptQueueTimeout is rejected with 503.
+func TestAcceptQueueTimeout(t *testing.T) {
+	c := createNewCollider()
+	c.MaxActiveConns, c.AcceptQueueSize, c.AcceptQueueTimeout = 1, 1, 20*time.Millisecond
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(c.acceptQueued(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})))
+	defer srv.Close()
+	defer close(release)
+
+	go http.Get(srv.URL)
+	waitForCondition(func() bool { return c.accept.stats().Active == 1 })
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("http.Get(%q) got error: %v, want nil", srv.URL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("After waiting %v in the queue, the status is %d, want %d", c.AcceptQueueTimeout, resp.StatusCode,
+			http.StatusServiceUnavailable)
+	}
+	if s := c.accept.stats(); s.Active != 1 || s.Depth != 0 {
+		t.Errorf("After the wait timed out, c.accept.stats() = %+v, want 1 active and none waiting", s)
+	}
+}
+
+// Tests that a connection frees its slot once it registers rather than when it closes, letting the next
+// connection in while it stays open.
+func TestAcceptQueueReleasedOnRegister(t *testing.T) {
+	c := createNewCollider()
+	c.MaxActiveConns, c.AcceptQueueSize = 1, 1
+
+	entered, release := make(chan struct{}, 2), make(chan struct{})
+	srv := httptest.NewServer(c.acceptQueued(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stands for a connection registering and staying open; a second release is harmless.
+		releaseAccepted(r)
+		releaseAccepted(r)
+		entered <- struct{}{}
+		<-release
+	})))
+	defer srv.Close()
+	defer close(release)
+
+	for i := 0; i < 2; i++ {
+		go http.Get(srv.URL)
+		select {
+		case <-entered:
+		case <-time.After(time.Second):
+			t.Fatalf("Connection %d was not let in while the previous one stays open after registering", i+1)
+		}
+	}
+	if s := c.accept.stats(); s.Active != 0 || s.Depth != 0 {
+		t.Errorf("With both connections registered, c.accept.stats() = %+v, want none active or waiting", s)
+	}
+}
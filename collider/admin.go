@@ -0,0 +1,299 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The maximum number of bytes of a queued message shown in the admin room detail.
+const maxQueuedPreviewLen = 100
+
+// Patterns of sensitive data redacted from the queued message previews: IP addresses and ICE credentials.
+var previewRedactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`), "[redacted]"},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{1,4}(:[0-9a-fA-F]{0,4}){3,7}\b`), "[redacted]"},
+	{regexp.MustCompile(`(ice-(ufrag|pwd):)[^\s\\"]+`), "${1}[redacted]"},
+}
+
+// queuedPreview is a redacted and truncated view of a queued message.
+type queuedPreview struct {
+	Type      string `json:"type,omitempty"`
+	Preview   string `json:"preview"`
+	Size      int    `json:"size"`
+	Truncated bool   `json:"truncated"`
+}
+
+// clientDetail describes a client in the admin room detail.
+type clientDetail struct {
+	ClientID   string `json:"clientid"`
+	ConnID     string `json:"connid,omitempty"`
+	Registered bool   `json:"registered"`
+	QueuedMsgs int    `json:"queuedmsgs"`
+	BytesIn    int64  `json:"bytesin"`
+	BytesOut   int64  `json:"bytesout"`
+	// LastActivity is the time the client last sent or received data, only included in the verbose detail.
+	LastActivity *time.Time `json:"lastactivity,omitempty"`
+	// Queued is only included in the verbose detail when queue previews are enabled.
+	Queued []queuedPreview `json:"queued,omitempty"`
+}
+
+// connDetail describes a connection of a client ID in the admin connection list.
+type connDetail struct {
+	ConnID         string    `json:"connid"`
+	RoomID         string    `json:"roomid"`
+	ConnectedSince time.Time `json:"connectedsince"`
+	RemoteIP       string    `json:"remoteip"`
+}
+
+// queuedMsgDetail describes a queued message in the admin queue detail.
+type queuedMsgDetail struct {
+	Type  string `json:"type,omitempty"`
+	Size  int    `json:"size"`
+	AgeMs int64  `json:"agems"`
+	// Preview and Truncated are only included when queue previews are enabled.
+	Preview   string `json:"preview,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// queueDetail describes the messages queued by a client for the admin queue detail.
+type queueDetail struct {
+	RoomID   string            `json:"roomid"`
+	ClientID string            `json:"clientid"`
+	Count    int               `json:"count"`
+	Messages []queuedMsgDetail `json:"messages"`
+}
+
+// roomDetail describes a room and its clients for the admin room detail.
+type roomDetail struct {
+	RoomID  string         `json:"roomid"`
+	Clients []clientDetail `json:"clients"`
+}
+
+// adminOnly wraps the handler so that it is only reachable with the configured admin token,
+// passed either as "Authorization: Bearer $TOKEN" or as the "token" query parameter.
+// All admin endpoints are disabled when no admin token is configured.
+func (c *Collider) adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.isAdmin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin returns true if the request carries the admin token.
+func (c *Collider) isAdmin(r *http.Request) bool {
+	if c.AdminToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) == 1
+}
+
+// wsAdminEventsHandler streams the lifecycle and error events to an admin as JSON frames.
+// The admin may narrow the stream at any time by sending { 'roomid': $ROOM, 'types': [$TYPE...] }.
+// A subscriber that does not keep up with the events is disconnected.
+func (c *Collider) wsAdminEventsHandler(ws *websocket.Conn) {
+	c.audit(ws.Request(), AuditEntry{Action: auditSubscribeEvents, Result: "ok"})
+	s := c.events.subscribe()
+
+	go func() {
+		defer c.events.unsubscribe(s)
+		for {
+			var m adminSubscribeMsg
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				return
+			}
+			c.events.setFilter(s, m.RoomID, m.Types)
+		}
+	}()
+
+	for e := range s.ch {
+		if err := send(ws, e); err != nil {
+			c.events.unsubscribe(s)
+			break
+		}
+	}
+	ws.Close()
+}
+
+// newQueuedPreview returns the redacted preview of the queued message, truncated to maxQueuedPreviewLen bytes.
+// The type is taken from the "type" field if the message is a JSON object, e.g. an SDP offer.
+func newQueuedPreview(msg string) queuedPreview {
+	p := queuedPreview{Size: len(msg)}
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal([]byte(msg), &typed) == nil {
+		p.Type = typed.Type
+	}
+
+	redacted := msg
+	for _, r := range previewRedactions {
+		redacted = r.re.ReplaceAllString(redacted, r.repl)
+	}
+	if len(redacted) > maxQueuedPreviewLen {
+		redacted = redacted[:maxQueuedPreviewLen]
+		for !utf8.ValidString(redacted) {
+			redacted = redacted[:len(redacted)-1]
+		}
+		p.Truncated = true
+	}
+	p.Preview = redacted
+	return p
+}
+
+// httpAdminRoomHandler is a HTTP handler that handles GET requests to "/admin/rooms/$ROOMID"
+// and returns the detail of the room and its clients.
+// With "verbose=1", the detail includes the last activity of each client and, with QueuePreviews enabled,
+// previews the messages queued by each client.
+// DELETE requests close the room, disconnecting its clients and discarding their queued messages.
+// GET requests to "/admin/rooms/$ROOMID/$CLIENTID/queue" return the messages queued by the client, with their
+// age and type, without delivering them. With QueuePreviews enabled, the detail previews the messages.
+func (c *Collider) httpAdminRoomHandler(w http.ResponseWriter, r *http.Request) {
+	rid := strings.TrimPrefix(r.URL.Path, "/admin/rooms/")
+	if p := strings.Split(rid, "/"); len(p) == 3 && p[0] != "" && p[1] != "" && p[2] == "queue" && r.Method == "GET" {
+		c.httpAdminQueueHandler(w, p[0], p[1])
+		return
+	}
+	if rid == "" || strings.Contains(rid, "/") {
+		c.httpErrorCode(http.StatusBadRequest, "Invalid path: "+r.URL.Path, w)
+		return
+	}
+	if r.Method == "DELETE" {
+		if !c.roomTable.closeRoom(rid) {
+			c.audit(r, AuditEntry{Action: auditCloseRoom, RoomID: rid, Result: "not_found"})
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		c.audit(r, AuditEntry{Action: auditCloseRoom, RoomID: rid, Result: "ok"})
+		c.httpReturnSuccess(w)
+		return
+	}
+	verbose := r.URL.Query().Get("verbose") == "1"
+	d := c.roomTable.roomDetail(rid, verbose, verbose && c.QueuePreviews)
+	if d == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(d); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
+
+// httpAdminQueueHandler returns the messages queued by the client |cid| of the room |rid|.
+func (c *Collider) httpAdminQueueHandler(w http.ResponseWriter, rid string, cid string) {
+	d := c.roomTable.queueDetail(rid, cid, c.QueuePreviews)
+	if d == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(d); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
+
+// httpAdminConnHandler is a HTTP handler that handles POST requests to "/admin/conns/$CONNID" and sends the
+// request body to the client of that connection, even if other connections share its client ID.
+// The connection IDs are listed in the admin room detail.
+func (c *Collider) httpAdminConnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/conns/")
+	if id == "" || strings.Contains(id, "/") {
+		c.httpErrorCode(http.StatusBadRequest, "Invalid path: "+r.URL.Path, w)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.httpErrorCode(http.StatusBadRequest, "Failed to read request body: "+err.Error(), w)
+		return
+	}
+	if len(body) == 0 {
+		c.httpErrorCode(http.StatusBadRequest, "Empty request body", w)
+		return
+	}
+	found, err := c.roomTable.sendToConn(id, "send", string(body))
+	if !found {
+		c.audit(r, AuditEntry{Action: auditSendToConn, ConnID: id, Result: "not_found"})
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.audit(r, AuditEntry{Action: auditSendToConn, ConnID: id, Result: "error: " + err.Error()})
+		c.httpError("Failed to send the message: "+err.Error(), w)
+		return
+	}
+	c.audit(r, AuditEntry{Action: auditSendToConn, ConnID: id, Result: "ok"})
+	c.httpReturnSuccess(w)
+}
+
+// kickResult is the JSON body of the response of httpKickHandler.
+type kickResult struct {
+	Kicked bool `json:"kicked"`
+}
+
+// httpKickHandler is a HTTP handler that handles POST requests to "/kick/$ROOMID/$CLIENTID", notifying the client
+// with { 'cmd': 'kicked' } and removing it from the room without affecting the other clients. It answers
+// { 'kicked': true|false } whether the client was found.
+func (c *Collider) httpKickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.Split(strings.TrimPrefix(r.URL.Path, "/kick/"), "/")
+	if len(p) != 2 || p[0] == "" || p[1] == "" {
+		c.httpErrorCode(http.StatusBadRequest, "Invalid path: "+r.URL.Path, w)
+		return
+	}
+	rid, cid := p[0], p[1]
+	kicked := c.roomTable.kick(rid, cid)
+	result := "ok"
+	if !kicked {
+		result = "not_found"
+	}
+	c.audit(r, AuditEntry{Action: auditKickClient, RoomID: rid, ClientID: cid, Result: result})
+	w.Header().Set("Content-Type", "application/json")
+	send(w, kickResult{Kicked: kicked})
+}
+
+// httpAdminClientHandler is a HTTP handler that handles GET requests to "/admin/clients/$CLIENTID/connections"
+// and lists the connections registered with that client ID, in any room, oldest first.
+func (c *Collider) httpAdminClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/clients/"), "/")
+	if len(p) != 2 || p[0] == "" || p[1] != "connections" {
+		c.httpErrorCode(http.StatusBadRequest, "Invalid path: "+r.URL.Path, w)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c.roomTable.clientConns(p[0])); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the queued messages are previewed with their type, redacted and truncated.
+func TestRoomDetailQueuedPreviews(t *testing.T) {
+	c := createNewCollider()
+	rid, cid := "a", "1"
+	candidate := `{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 192.168.1.7 54321 typ host"}`
+	long := `{"type":"offer","sdp":"a=ice-ufrag:F7gI\na=ice-pwd:x9cml/YzichV2+XlhiMu8g\na=` + strings.Repeat("x", 200) + `"}`
+	c.roomTable.send(rid, cid, "send", candidate)
+	c.roomTable.send(rid, cid, "send", long)
+
+	if d := c.roomTable.roomDetail(rid, true, false); d.Clients[0].Queued != nil {
+		t.Errorf("roomTable.roomDetail(%q, true, false) queued = %v, want nil", rid, d.Clients[0].Queued)
+	}
+
+	q := c.roomTable.roomDetail(rid, true, true).Clients[0].Queued
+	if len(q) != 2 {
+		t.Fatalf("roomTable.roomDetail(%q, true, true) queued = %v, want 2 previews", rid, q)
+	}
+	if q[0].Type != "candidate" || strings.Contains(q[0].Preview, "192.168.1.7") || q[0].Truncated {
+		t.Errorf("Preview of the candidate = %+v, want type candidate, the IP redacted and not truncated", q[0])
+	}
+	if q[1].Type != "offer" || strings.Contains(q[1].Preview, "F7gI") || strings.Contains(q[1].Preview, "x9cml") {
+		t.Errorf("Preview of the offer = %+v, want type offer and the ICE credentials redacted", q[1])
+	}
+	if !q[1].Truncated || len(q[1].Preview) > maxQueuedPreviewLen || q[1].Size != len(long) {
+		t.Errorf("Preview of the offer = %+v, want truncated to %d bytes with size %d", q[1], maxQueuedPreviewLen, len(long))
+	}
+}
+
+// Tests that the admin queue detail of a client matches its queued messages, oldest first, and leaves them
+// queued.
+func TestAdminQueueDetail(t *testing.T) {
+	c := createNewCollider()
+	c.QueuePreviews = true
+	rid, cid := "a", "1"
+	offer := `{"type":"offer","sdp":"a=ice-pwd:x9cml/YzichV2+XlhiMu8g"}`
+	candidate := `{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 192.168.1.7 54321 typ host"}`
+	c.roomTable.send(rid, cid, "send", offer)
+	time.Sleep(20 * time.Millisecond)
+	c.roomTable.send(rid, cid, "send", candidate)
+
+	rec := httptest.NewRecorder()
+	c.httpAdminRoomHandler(rec, httptest.NewRequest("GET", "/admin/rooms/"+rid+"/"+cid+"/queue", nil))
+	var d queueDetail
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatalf("Decoding the queue detail got error: %v, want nil", err)
+	}
+	if d.RoomID != rid || d.ClientID != cid || d.Count != 2 || len(d.Messages) != 2 {
+		t.Fatalf("The queue detail is %+v, want the 2 messages queued by client %s of room %s", d, cid, rid)
+	}
+	first, second := d.Messages[0], d.Messages[1]
+	if first.Type != "offer" || first.Size != len(offer) || strings.Contains(first.Preview, "x9cml") {
+		t.Errorf("The first queued message is %+v, want the offer with its ICE password redacted", first)
+	}
+	if second.Type != "candidate" || second.Size != len(candidate) || strings.Contains(second.Preview, "192.168.1.7") {
+		t.Errorf("The second queued message is %+v, want the candidate with its IP redacted", second)
+	}
+	if first.AgeMs < 20 || first.AgeMs < second.AgeMs {
+		t.Errorf("The queued messages are %d and %d ms old, want the offer at least 20 ms older", first.AgeMs, second.AgeMs)
+	}
+	if n := len(c.roomTable.lookupRoom(rid).clients[cid].msgs); n != 2 {
+		t.Errorf("After reading the queue detail, %d messages are queued, want 2", n)
+	}
+
+	rec = httptest.NewRecorder()
+	c.httpAdminRoomHandler(rec, httptest.NewRequest("GET", "/admin/rooms/"+rid+"/nobody/queue", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("The queue detail of an unknown client got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// kick posts to /kick/$ROOMID/$CLIENTID with the admin token and returns whether the client was kicked.
+func kick(t *testing.T, rid string, cid string) bool {
+	req, _ := http.NewRequest("POST", "http://"+serverAddr+"/kick/"+rid+"/"+cid, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /kick/%s/%s got error: %v, want nil", rid, cid, err)
+	}
+	defer resp.Body.Close()
+	var res kickResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Decoding the response to POST /kick/%s/%s got error: %v, want nil", rid, cid, err)
+	}
+	return res.Kicked
+}
+
+// Tests that kicking a connected client notifies and disconnects it while the other client stays, that a
+// client with only queued messages can be kicked, and that kicking an unknown client reports it.
+func TestWsKick(t *testing.T) {
+	setup()
+	rid := "kick"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+
+	if !kick(t, rid, "2") {
+		t.Errorf("Kicking client 2 of %s got false, want true", rid)
+	}
+	var m wsServerMsg
+	if err := json.Unmarshal([]byte(read(t, c2)), &m); err != nil || m.Cmd != "kicked" {
+		t.Errorf("Client 2 received %+v with error %v, want the kicked notice", m, err)
+	}
+	expectConnectionClose(t, c2)
+	if !cl.roomTable.isRegistered(rid, "1") || cl.roomTable.roomSize(rid) != 1 {
+		t.Errorf("After kicking client 2, room %s has %d clients, want client 1 only", rid, cl.roomTable.roomSize(rid))
+	}
+
+	cl.roomTable.send("kick-queued", "1", "send", "hi")
+	if !kick(t, "kick-queued", "1") {
+		t.Error("Kicking a client with only queued messages got false, want true")
+	}
+	if cl.roomTable.roomSize("kick-queued") != 0 {
+		t.Error("After kicking its only client, room kick-queued still exists")
+	}
+	if kick(t, rid, "nobody") {
+		t.Error("Kicking an unknown client got true, want false")
+	}
+}
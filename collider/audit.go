@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Admin actions recorded in the audit log.
+const (
+	auditCloseRoom       = "close_room"
+	auditRemoveClient    = "remove_client"
+	auditKickClient      = "kick_client"
+	auditClearQueue      = "clear_queue"
+	auditSendToConn      = "send_to_conn"
+	auditSubscribeEvents = "subscribe_events"
+	auditMaintenance     = "maintenance"
+)
+
+// AuditEntry records an admin operation: who did what to which room or client, and how it went.
+type AuditEntry struct {
+	Time time.Time `json:"t"`
+	// Actor identifies the caller by a fingerprint of its admin token, or is "anonymous" for the
+	// unauthenticated legacy endpoints.
+	Actor      string `json:"actor"`
+	RemoteAddr string `json:"remoteaddr"`
+	Action     string `json:"action"`
+	RoomID     string `json:"roomid,omitempty"`
+	ClientID   string `json:"clientid,omitempty"`
+	ConnID     string `json:"connid,omitempty"`
+	Result     string `json:"result"`
+}
+
+// NewJSONAuditSink returns an audit sink writing each entry to |w| as a line of JSON.
+func NewJSONAuditSink(w io.Writer) func(AuditEntry) {
+	var lock sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e AuditEntry) {
+		lock.Lock()
+		defer lock.Unlock()
+		enc.Encode(e)
+	}
+}
+
+// audit sends the entry of an admin operation requested by |r| to the Audit sink, if any.
+func (c *Collider) audit(r *http.Request, e AuditEntry) {
+	if c.Audit == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Actor = c.actor(r)
+	e.RemoteAddr = r.RemoteAddr
+	c.Audit(e)
+}
+
+// actor identifies the caller of an admin operation without revealing its token.
+func (c *Collider) actor(r *http.Request) string {
+	if !c.isAdmin(r) {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(c.AdminToken))
+	return "admin:" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests that the actor is identified by a fingerprint of the admin token, never the token itself.
+func TestAuditActor(t *testing.T) {
+	c := createNewCollider()
+	c.AdminToken = "secret"
+	var got []AuditEntry
+	c.Audit = func(e AuditEntry) { got = append(got, e) }
+
+	r := httptest.NewRequest("DELETE", "/admin/rooms/a", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	c.audit(r, AuditEntry{Action: auditCloseRoom, RoomID: "a", Result: "ok"})
+	c.audit(httptest.NewRequest("DELETE", "/a/ALL", nil), AuditEntry{Action: auditCloseRoom, RoomID: "a", Result: "ok"})
+
+	if len(got) != 2 {
+		t.Fatalf("Audited %d entries, want 2", len(got))
+	}
+	if !strings.HasPrefix(got[0].Actor, "admin:") || strings.Contains(got[0].Actor, "secret") {
+		t.Errorf("Actor with the admin token = %q, want an admin fingerprint", got[0].Actor)
+	}
+	if got[1].Actor != "anonymous" {
+		t.Errorf("Actor without the admin token = %q, want anonymous", got[1].Actor)
+	}
+	if got[0].Time.IsZero() || got[0].RemoteAddr == "" {
+		t.Errorf("Audit entry %+v, want the time and the remote address set", got[0])
+	}
+}
+
+// Tests that the JSON sink writes one entry per line.
+func TestJSONAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+	sink(AuditEntry{Action: auditCloseRoom, RoomID: "a", Result: "ok"})
+	sink(AuditEntry{Action: auditRemoveClient, RoomID: "a", ClientID: "1", Result: "ok"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("The sink wrote %q, want 2 lines", buf.String())
+	}
+	var e AuditEntry
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.Action != auditRemoveClient || e.ClientID != "1" {
+		t.Errorf("The second line decodes to %+v, %v, want the remove_client entry", e, err)
+	}
+}
@@ -11,10 +11,18 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"io"
 	"log"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const maxQueuedMsgCount = 1024
+// defaultMaxQueuedMsgs and defaultMaxQueuedBytes are the caps of the queue of a client when MaxQueuedMessages
+// and MaxQueuedBytes are zero.
+const (
+	defaultMaxQueuedMsgs  = 1024
+	defaultMaxQueuedBytes = 1 << 20
+)
 
 const (
 	OFFLINE = "OFFLINE"
@@ -23,22 +31,54 @@ const (
 	LEAVE   = "LEAVE"
 )
 
+// errQueueFull is returned by enqueue when the queue holds MaxQueuedMessages messages or MaxQueuedBytes bytes.
+var errQueueFull = errors.New("Too many messages queued for the client")
+
+// errPeerOffline is returned by sendByID when the other client is known but has no connection.
+var errPeerOffline = errors.New("Peer offline")
+
 type client struct {
 	id string
+	// parent is the room of the client, or nil if the client is used standalone.
+	parent *room
+	// connLock guards rwc and others, which the clients of the other rooms write to without the lock of the
+	// shard of this room.
+	connLock sync.Mutex
 	// rwc is the interface to access the websocket connection.
 	// It is set after the client registers with the server.
 	rwc io.ReadWriteCloser
-	// msgs is the queued messages sent from this client.
-	msgs []string
+	// others are the connections of the other devices of the client under DuplicateMultiDevice, oldest first.
+	others []io.ReadWriteCloser
+	// msgs is the queued messages sent from this client, and queuedAt the times they were queued.
+	msgs     []string
+	queuedAt []time.Time
+	// overflowed is the number of messages refused since the queue filled up, until it is emptied.
+	overflowed int
 	// timer is used to remove this client if unregistered after a timeout.
 	timer    *time.Timer
 	contact_ *contact
 	//状态
 	state string
+	// bytesIn and bytesOut count the bytes received from and written to the connection. Accessed atomically.
+	bytesIn  int64
+	bytesOut int64
+	// caps is the set of relayed commands the client declared support for, or nil if it supports all.
+	caps map[string]bool
+	// registeredAt is the UnixNano time of the last register, reset to 0 once the first routed message
+	// is sent or received. Accessed atomically.
+	registeredAt int64
+	// lastActivity is the UnixNano time of the last read from or write to the connection. Accessed atomically.
+	lastActivity int64
+	// connectedAt is the time of the last register.
+	connectedAt time.Time
+	// stallTimer reports the client as stalled if it routes no message CallStallTimeout after registering.
+	stallTimer *time.Timer
+	// queuedBytes is the size of the queued messages.
+	queuedBytes int
+	// resumeToken lets the client resume its registration within ResumeGrace of disconnecting, or is empty.
+	resumeToken string
 }
 
-var registeredClients map[string]*client
-
 func newClient(id string, t *time.Timer) *client {
 	c := client{id: id, timer: t}
 	c.contact_ = newContact(id)
@@ -52,16 +92,29 @@ func (c *client) setTimer(t *time.Timer) {
 	c.timer = t
 }
 
+func (c *client) setStallTimer(t *time.Timer) {
+	if c.stallTimer != nil {
+		c.stallTimer.Stop()
+	}
+	c.stallTimer = t
+}
+
 // register binds the ReadWriteCloser to the client if it's not done yet.
 func (c *client) register(rwc io.ReadWriteCloser) error {
+	c.connLock.Lock()
 	if c.rwc != nil {
-		log.Printf("Not registering because the client %s already has a connection", c.id)
-		return errors.New("Duplicated registration")
+		c.connLock.Unlock()
+		c.logger().Printf("Not registering because the client %s already has a connection", c.id)
+		return ErrClientExists
 	}
+	c.rwc = rwc
+	c.connLock.Unlock()
 
-	registeredClients[c.id] = c
+	c.table().storeClient(c)
+	c.table().bindRoom(c)
 	c.setTimer(nil)
-	c.rwc = rwc
+	c.connectedAt = time.Now()
+	atomic.StoreInt64(&c.registeredAt, c.connectedAt.UnixNano())
 
 	//set state
 	c.state = ONLINE
@@ -73,41 +126,294 @@ func (c *client) register(rwc io.ReadWriteCloser) error {
 }
 
 // deregister closes the ReadWriteCloser if it exists.
-func (c *client) deregister() {
+func (c *client) deregister(r DisconnectReason) {
+	c.setStallTimer(nil)
 	c.state = OFFLINE
 	c.informState()
 
+	for _, rwc := range c.detachConns() {
+		closeFor(rwc, r)
+	}
+	c.table().deleteClient(c)
+	c.table().releaseRoom(c)
+}
+
+// Write writes to the client's connection and accounts for the bytes written.
+func (c *client) Write(p []byte) (int, error) {
+	c.connLock.Lock()
+	rwc, others := c.rwc, c.others
+	c.connLock.Unlock()
+	if rwc == nil {
+		return 0, errors.New("Client not registered")
+	}
+	rt := c.table()
+	rt.beginWrite()
+	defer rt.endWrite()
+
+	n, err := rwc.Write(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	if n > 0 {
+		c.touch()
+	}
+	// The other devices get the same frame. A device whose write fails is closed and deregisters itself.
+	for _, o := range others {
+		on, oerr := o.Write(p)
+		atomic.AddInt64(&c.bytesOut, int64(on))
+		closeOnWriteErr(c.logger(), o, oerr)
+	}
+	return n, err
+}
+
+// addConn registers the connection of another device of the client.
+func (c *client) addConn(rwc io.ReadWriteCloser) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	c.others = append(c.others, rwc)
+}
+
+// hasConn returns true if |rwc| is one of the connections of the client.
+func (c *client) hasConn(rwc io.ReadWriteCloser) bool {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.rwc == rwc {
+		return rwc != nil
+	}
+	for _, o := range c.others {
+		if o == rwc {
+			return true
+		}
+	}
+	return false
+}
+
+// removeConn closes the connection |rwc| of the client and returns true if the client has other connections
+// left, the oldest of which replaces |rwc| if it was the main one. It returns false, leaving the connection
+// alone, if |rwc| is the last connection of the client.
+func (c *client) removeConn(rwc io.ReadWriteCloser) bool {
+	if !c.dropConn(rwc) {
+		return false
+	}
+	rwc.Close()
+	return true
+}
+
+// dropConn removes |rwc| from the connections of the client, unless it is the last one, and returns true if it
+// was removed.
+func (c *client) dropConn(rwc io.ReadWriteCloser) bool {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if len(c.others) == 0 {
+		return false
+	}
+	if c.rwc == rwc {
+		c.rwc, c.others = c.others[0], c.others[1:]
+		return true
+	}
+	for i, o := range c.others {
+		if o == rwc {
+			c.others = append(c.others[:i:i], c.others[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// conns returns all the connections of the client.
+func (c *client) conns() []io.ReadWriteCloser {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.rwc == nil {
+		return nil
+	}
+	return append([]io.ReadWriteCloser{c.rwc}, c.others...)
+}
+
+// detachConns takes all the connections away from the client without closing them and returns them, so that
+// the caller may write to them and close them once it releases the lock of the shard of the room.
+func (c *client) detachConns() []io.ReadWriteCloser {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	var conns []io.ReadWriteCloser
 	if c.rwc != nil {
-		c.rwc.Close()
-		c.rwc = nil
+		conns = append([]io.ReadWriteCloser{c.rwc}, c.others...)
+	}
+	c.rwc, c.others = nil, nil
+	return conns
+}
+
+// conn returns the main connection of the client, or nil if it has not registered.
+func (c *client) conn() io.ReadWriteCloser {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.rwc
+}
+
+// serializer returns the serializer of the client's connection.
+func (c *client) serializer() serializer {
+	return serializerOf(c.conn())
+}
+
+// connID returns the server-side ID of the client's connection, or "" if it has none.
+func (c *client) connID() string {
+	return connIDOf(c.conn())
+}
+
+// connIDOf returns the server-side ID of the connection, or "" if it has none.
+func connIDOf(rwc io.ReadWriteCloser) string {
+	if sc, ok := rwc.(*serialConn); ok {
+		return sc.id
+	}
+	return ""
+}
+
+// connectedAtOf returns the time the connection of the client |c| was accepted, or the time the client last
+// registered if it is unknown.
+func connectedAtOf(c *client, rwc io.ReadWriteCloser) time.Time {
+	if sc, ok := rwc.(*serialConn); ok && !sc.connectedAt.IsZero() {
+		return sc.connectedAt
+	}
+	return c.connectedAt
+}
+
+// remoteIPOf returns the IP address the connection comes from, behind TrustedProxies that of the client, or ""
+// if it is unknown.
+func remoteIPOf(rwc io.ReadWriteCloser) string {
+	sc, ok := rwc.(*serialConn)
+	if !ok {
+		return ""
+	}
+	if sc.remoteIP != "" {
+		return sc.remoteIP
+	}
+	if sc.Request() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(sc.Request().RemoteAddr)
+	if err != nil {
+		return sc.Request().RemoteAddr
+	}
+	return host
+}
+
+// table returns the room table the client belongs to, or nil.
+func (c *client) table() *roomTable {
+	if c.parent == nil {
+		return nil
 	}
-	delete(registeredClients, c.id)
+	return c.parent.parent
+}
+
+// logger returns the logger of the Collider owning the client.
+func (c *client) logger() *log.Logger {
+	return c.table().logger()
+}
+
+// debugf logs to the logger of the Collider owning the client if its Debug is on.
+func (c *client) debugf(format string, v ...interface{}) {
+	c.table().debugf(format, v...)
+}
+
+// onRead accounts for |n| bytes received from the client's connection.
+func (c *client) onRead(n int) {
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	c.touch()
+}
+
+// touch records activity on the client's connection.
+func (c *client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// lastActive returns the time of the last activity on the client's connection, or the zero time if none.
+func (c *client) lastActive() time.Time {
+	if t := atomic.LoadInt64(&c.lastActivity); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// bytes returns the number of bytes received from and written to the client's connection.
+func (c *client) bytes() (in int64, out int64) {
+	return atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut)
+}
+
+// setCaps records the relayed commands the client supports. An empty list means all commands.
+func (c *client) setCaps(caps []string) {
+	c.caps = nil
+	if len(caps) > 0 {
+		c.caps = make(map[string]bool)
+		for _, cmd := range caps {
+			c.caps[cmd] = true
+		}
+	}
+}
+
+// supports returns true if the client accepts the relayed command.
+func (c *client) supports(cmd string) bool {
+	return c.caps == nil || c.caps[cmd]
 }
 
 // registered returns true if the client has registered.
 func (c *client) registered() bool {
-	return c.rwc != nil
+	return c.conn() != nil
 }
 
-// enqueue adds a message to the client's message queue.
+// enqueue adds a message to the client's message queue. The newest message is refused rather than an older
+// one dropped, so that the sender learns of it.
 func (c *client) enqueue(msg string) error {
-	if len(c.msgs) >= maxQueuedMsgCount {
-		return errors.New("Too many messages queued for the client")
+	maxMsgs, maxBytes := c.table().queueLimits()
+	if len(c.msgs) >= maxMsgs || c.queuedBytes+len(msg) > maxBytes {
+		c.overflowed += 1
+		return errQueueFull
+	}
+	if c.table().sheds(shedQueueing) {
+		return errors.New("Not queueing the message while shedding load")
 	}
 	c.msgs = append(c.msgs, msg)
+	c.queuedAt = append(c.queuedAt, time.Now())
+	c.queuedBytes += len(msg)
 	return nil
 }
 
-// sendQueued the queued messages to the other client.
+// discardQueued drops the queued messages and returns how many were dropped.
+func (c *client) discardQueued() int {
+	n := len(c.msgs)
+	c.msgs, c.queuedAt, c.overflowed, c.queuedBytes = nil, nil, 0, 0
+	return n
+}
+
+// onRouted records the register-to-first-message latency if this is the first message the client sent or
+// received since it registered.
+func (c *client) onRouted() {
+	if t := atomic.SwapInt64(&c.registeredAt, 0); t != 0 {
+		c.table().onFirstMsg(time.Since(time.Unix(0, t)))
+	}
+}
+
+// sendQueued sends the queued messages to the other client in the order they were queued, each written before
+// the next. If a write fails, the messages from the failed one on stay queued and the write error is returned.
 func (c *client) sendQueued(other *client) error {
-	if c.id == other.id || other.rwc == nil {
+	if c.id == other.id || !other.registered() {
 		return errors.New("Invalid client")
 	}
-	for _, m := range c.msgs {
-		sendServerMsg(other.rwc, "", m)
+	for i, m := range c.msgs {
+		if err := sendServerMsg(other, "", m); err != nil {
+			c.msgs, c.queuedAt = c.msgs[i:], c.queuedAt[i:]
+			c.queuedBytes = 0
+			for _, m := range c.msgs {
+				c.queuedBytes += len(m)
+			}
+			c.logger().Printf("Failed to send the queued messages from %s to %s, %d left: %v", c.id, other.id,
+				len(c.msgs), err)
+			return err
+		}
+		if i == 0 {
+			c.onRouted()
+			other.onRouted()
+		}
 	}
-	c.msgs = nil
-	log.Printf("Sent queued messages from %s to %s", c.id, other.id)
+	c.msgs, c.queuedAt, c.overflowed, c.queuedBytes = nil, nil, 0, 0
+	c.debugf("Sent queued messages from %s to %s", c.id, other.id)
 	return nil
 }
 
@@ -116,53 +422,69 @@ func (c *client) sendQueued(other *client) error {
 func (c *client) send(other *client, cmd string, msg string) error {
 	if c.id == other.id {
 		return errors.New("Invalid client")
-		log.Printf("Invalid client")
+		c.logger().Printf("Invalid client")
 	}
-	if other.rwc != nil {
-		log.Printf("sending %s to %s from %s, cmd is %s", msg, other.id, c.id, cmd)
-		return sendServerMsg(other.rwc, cmd, msg)
+	if other.registered() {
+		c.debugf("sending %s to %s from %s, cmd is %s", msg, other.id, c.id, cmd)
+		c.onRouted()
+		other.onRouted()
+		return sendServerMsg(other, cmd, msg)
 	}
 	return c.enqueue(msg)
 }
 
 //通过ClientID发送信息
-func (c *client) sendByID(OtherClientID string, cmd string, msg string) error {
-	if other := registeredClients[OtherClientID]; other != nil {
-		if other.rwc != nil {
-			log.Printf("sending %s to %s from %s, cmd is %s", msg, other.id, c.id, cmd)
-			m := wsServerMsg{
-				Msg:  msg,
-				Cmd:  cmd,
-				From: c.id,
-				Time: JSONTime(time.Now().Local()),
-			}
-			return send(other.rwc, m)
+// If the other client has no connection, the message is stored for the offline delivery and true is returned
+// along with the reason it was not relayed: errPeerOffline if the other client is registered without a
+// connection or is in the room of the client without having registered, and ErrClientNotFound if it is neither.
+// Any other error means the message was neither relayed nor stored.
+func (c *client) sendByID(OtherClientID string, cmd string, msg string) (bool, error) {
+	other := c.table().lookupClient(OtherClientID)
+	if other != nil && other.registered() {
+		c.debugf("sending %s to %s from %s, cmd is %s", msg, other.id, c.id, cmd)
+		m := wsServerMsg{
+			Msg:  msg,
+			Cmd:  cmd,
+			From: c.id,
+			Time: JSONTime(time.Now().Local()),
 		}
-	} else {
-		log.Println("The receiver is offline now")
+		c.onRouted()
+		other.onRouted()
+		return false, send(other, m)
+	}
+	c.debugf("The receiver is offline now")
+	if err := c.storeOffline(OtherClientID, cmd, msg); err != nil {
+		c.logger().Printf("Failed to store the message from %s to %s for the offline delivery: %v", c.id,
+			OtherClientID, err)
+		return false, err
+	}
+	if other != nil || (c.parent != nil && c.table().hasClient(c.parent.id, OtherClientID)) {
+		return true, errPeerOffline
+	}
+	return true, ErrClientNotFound
+}
 
-		db, err := sql.Open("mysql", MYSQL_CONNECT_STRING)
-		if err != nil {
-			return err
-		}
+// storeOffline stores the message to the client |to| for the offline delivery.
+func (c *client) storeOffline(to string, cmd string, msg string) error {
+	db, err := sql.Open("mysql", MYSQL_CONNECT_STRING)
+	if err != nil {
+		return err
+	}
 
-		stmt, err := db.Prepare("INSERT INTO offlineMessage(cmd,fromid,toid,msg,created) VALUES (?,?,?,?,?)")
-		if err != nil {
-			return err
-		}
-		res, err := stmt.Exec(cmd, c.id, OtherClientID, msg, time.Now())
-		if err != nil {
-			log.Println("Error,exec", err)
-			return nil
-		}
-		affect, err := res.RowsAffected()
-		if err != nil {
-			log.Println("Affect,exec")
-			return err
-		}
-		if affect != 0 {
-			log.Printf("insert offlineMessage successfully")
-		}
+	stmt, err := db.Prepare("INSERT INTO offlineMessage(cmd,fromid,toid,msg,created) VALUES (?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	res, err := stmt.Exec(cmd, c.id, to, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	affect, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affect != 0 {
+		c.debugf("insert offlineMessage successfully")
 	}
 	return nil
 }
@@ -174,8 +496,11 @@ func (c *client) informState() {
 		From: c.id,
 	}
 	for _, contact_ := range c.contact_.clientsID {
-		if client_ := registeredClients[contact_]; client_ != nil {
-			send(client_.rwc, m)
+		if client_ := c.table().lookupClient(contact_); client_ != nil {
+			if c.table().sheds(shedBestEffort) {
+				continue
+			}
+			send(client_, m)
 		}
 	}
 
@@ -185,20 +510,23 @@ func (c *client) getContactState() {
 	for _, contact_ := range c.contact_.clientsID {
 		state, client_ := c.getOneStateByID(contact_)
 		if client_ != nil {
+			if c.table().sheds(shedBestEffort) {
+				continue
+			}
 			m := wsServerMsg{
 				Cmd:  "contact_state",
 				From: contact_,
 				Msg:  state,
 			}
-			log.Printf("m.Msg:%s", m.Msg)
-			send(c.rwc, m)
+			c.debugf("m.Msg:%s", m.Msg)
+			send(c, m)
 
 		}
 	}
 }
 
 func (c *client) getOneStateByID(ClientID string) (string, *client) {
-	if client_ := registeredClients[ClientID]; client_ != nil {
+	if client_ := c.table().lookupClient(ClientID); client_ != nil {
 		return client_.state, client_
 	} else {
 		return "OFFLINE", nil
@@ -228,8 +556,8 @@ func (c *client) getOfflineMessage() {
 			Cmd:  "offlinemessage",
 			Time: JSONTime(msgTime.Local()),
 		}
-		log.Printf("%+v\n", m)
-		send(c.rwc, m)
+		c.debugf("%+v", m)
+		send(c, m)
 	}
 	stmt, err := db.Prepare("DELETE FROM offlineMessage WHERE toid=?")
 	checkErr(err)
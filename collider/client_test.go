@@ -7,6 +7,10 @@ package collider
 
 import (
 	"collidertest"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -61,6 +65,47 @@ func TestClientSendQueued(t *testing.T) {
 	}
 }
 
+// flakyReadWriteCloser accepts |ok| writes, recording them, and fails the later ones.
+type flakyReadWriteCloser struct {
+	collidertest.MockReadWriteCloser
+	ok     int
+	writes []string
+}
+
+func (f *flakyReadWriteCloser) Write(p []byte) (int, error) {
+	if len(f.writes) >= f.ok {
+		return 0, errors.New("broken pipe")
+	}
+	f.writes = append(f.writes, string(p))
+	return len(p), nil
+}
+
+// Tests that sendQueued writes the queued messages in order and, if a write fails, keeps the messages from the
+// failed one on queued.
+func TestClientSendQueuedPartially(t *testing.T) {
+	src := newClient("abc", nil)
+	for _, m := range []string{"1", "2", "3", "4", "5"} {
+		src.enqueue(m)
+	}
+	dest := newClient("def", nil)
+	rwc := &flakyReadWriteCloser{ok: 2}
+	dest.register(rwc)
+
+	if err := src.sendQueued(dest); err == nil {
+		t.Error("src.sendQueued(dest) with the third write failing got nil, want the write error")
+	}
+	for i, w := range rwc.writes {
+		var m wsServerMsg
+		if err := json.Unmarshal([]byte(w), &m); err != nil || m.Msg != strconv.Itoa(i+1) {
+			t.Errorf("Write #%d of src.sendQueued(dest) = %q, want message %d", i+1, w, i+1)
+		}
+	}
+	if strings.Join(src.msgs, ",") != "3,4,5" || len(src.queuedAt) != 3 || src.queuedBytes != 3 {
+		t.Errorf("After the third write failed, src.msgs = %v with %d bytes, want [3 4 5] with 3 bytes",
+			src.msgs, src.queuedBytes)
+	}
+}
+
 // Tests that messages are queued when the other client is not registered, or delivered immediately otherwise.
 func TestClientSend(t *testing.T) {
 	src := newClient("abc", nil)
@@ -68,7 +113,7 @@ func TestClientSend(t *testing.T) {
 
 	// The message should be queued since dest has not registered.
 	m := "hello"
-	if err := src.send(dest, m); err != nil {
+	if err := src.send(dest, "send", m); err != nil {
 		t.Errorf("When dest is not registered, src.send(dest, %q) got error: %s, want nil", m, err.Error())
 	}
 	if len(src.msgs) != 1 || src.msgs[0] != m {
@@ -80,7 +125,7 @@ func TestClientSend(t *testing.T) {
 
 	// The message should be sent this time.
 	m2 := "hi"
-	src.send(dest, m2)
+	src.send(dest, "send", m2)
 
 	if rwc.Msg == "" {
 		t.Errorf("When dest is registered, after src.send(dest, %q), dest.rwc.Msg = %v, want %q", m2, rwc.Msg, m2)
@@ -90,13 +135,30 @@ func TestClientSend(t *testing.T) {
 	}
 }
 
+// Tests that sendByID stores the message to a client without a connection for the offline delivery, telling
+// why it was not relayed.
+func TestClientSendByIDStoresOffline(t *testing.T) {
+	c := createNewCollider()
+	src, _ := c.roomTable.room("offline").client("offline-src")
+	// The other client is known by ID but has no connection, e.g. while it registers.
+	dst := newClient("offline-dst", nil)
+	c.roomTable.storeClient(dst)
+
+	if stored, err := src.sendByID(dst.id, "chat", "hi"); !stored || err != errPeerOffline {
+		t.Errorf("src.sendByID(%q, ...) got (%v, %v), want (true, %v)", dst.id, stored, err, errPeerOffline)
+	}
+	if stored, err := src.sendByID("offline-nobody", "chat", "hi"); !stored || err != ErrClientNotFound {
+		t.Errorf("src.sendByID(offline-nobody, ...) got (%v, %v), want (true, %v)", stored, err, ErrClientNotFound)
+	}
+}
+
 // Tests that deregistering the client will close the ReadWriteCloser.
 func TestClientDeregister(t *testing.T) {
 	c := newClient("abc", nil)
 	rwc := collidertest.MockReadWriteCloser{Closed: false}
 
 	c.register(&rwc)
-	c.deregister()
+	c.deregister(DisconnectKicked)
 	if !rwc.Closed {
 		t.Errorf("After client.close(), rwc.Closed = %t, want true", rwc.Closed)
 	}
@@ -104,12 +166,12 @@ func TestClientDeregister(t *testing.T) {
 
 func TestClientMaxQueuedMsg(t *testing.T) {
 	c := newClient("abc", nil)
-	for i := 0; i < maxQueuedMsgCount; i++ {
+	for i := 0; i < defaultMaxQueuedMsgs; i++ {
 		if err := c.enqueue("msg"); err != nil {
 			t.Errorf("client.enqueue(...) got error %v after %d calls, want nil", err, i)
 		}
 	}
 	if err := c.enqueue("msg"); err == nil {
-		t.Error("client.enqueue(...) got no error after maxQueuedMsgCount + 1 calls, want error")
+		t.Error("client.enqueue(...) got no error after defaultMaxQueuedMsgs + 1 calls, want error")
 	}
 }
@@ -7,7 +7,10 @@
 package collider
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +21,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,294 +35,1488 @@ const wsReadTimeoutSec = 60 * 60 * 24
 
 //const wsReadTimeoutSec = 5
 
+// The default read timeout of a connection before it registers, unless the read timeout is shorter.
+const unregisteredReadTimeoutSec = 10
+
+// The content type of the Prometheus text exposition format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// The default and maximum number of rooms listed per page of the verbose status.
+const (
+	defaultStatusRoomLimit = 100
+	maxStatusRoomLimit     = 1000
+)
+
+// The maximum nesting depth of the incoming messages when MaxJSONDepth is not set.
+const defaultMaxJSONDepth = 32
+
+// The commands relayed to the client 'to' when RelayCommands is not set.
+var defaultRelayCommands = []string{"chat", "video_chat", "audio_chat"}
+
+// The maximum size of the incoming frames when MaxMessageBytes is not set.
+const defaultMaxMessageBytes = 256 << 10
+
+// SlowMessagePolicy decides what happens to a message whose processing exceeds MessageTimeout.
+type SlowMessagePolicy string
+
+const (
+	// SlowMessageSkip rejects the message with a MESSAGE_TIMEOUT error, keeping the connection open.
+	SlowMessageSkip SlowMessagePolicy = "skip"
+	// SlowMessageClose also closes the connection.
+	SlowMessageClose SlowMessagePolicy = "close"
+)
+
+// errMessageTimeout is returned by authorize when the Authorizer exceeds MessageTimeout.
+var errMessageTimeout = errors.New("Message processing timed out")
+
+// How often Stop checks whether the in-flight writes have drained.
+const drainPollInterval = 10 * time.Millisecond
+
 type Collider struct {
 	*roomTable
-	dash *dashboard
+	dash   *dashboard
+	events *eventBus
+	// server is the HTTP server started by Run.
+	server *http.Server
+	// stopping is set to 1 once Stop is called. Accessed atomically.
+	stopping int32
+	// stopSweep stops the sweeper of the idle rooms started by Run when closed, once.
+	stopSweep     chan struct{}
+	stopSweepOnce sync.Once
+	// middleware wraps every handler, the first added by Use outermost.
+	middleware []func(http.Handler) http.Handler
+	// draining is set to 1 while the server rejects new WebSocket connections. Accessed atomically.
+	draining int32
+	// pending is the number of WebSocket connections that have not registered yet. Accessed atomically.
+	pending int64
+	// accept queues the WebSocket connections beyond MaxActiveConns.
+	accept acceptQueue
+	// broadcasts queues the broadcasts beyond MaxBroadcasts.
+	broadcasts acceptQueue
+	// mem tracks the heap usage against MaxHeapBytes.
+	mem memGuard
+	// connSeq numbers the WebSocket connections. Accessed atomically.
+	connSeq uint64
+	// conns holds the open WebSocket connections by ID, guarded by connsLock.
+	connsLock sync.Mutex
+	conns     map[string]*serialConn
+	// handshakes holds the TLS versions offered by the clients during their handshake.
+	handshakes tlsHandshakes
+	// statusLock guards the status report cached for StatusCacheInterval and the time it was taken.
+	statusLock sync.Mutex
+	statusRp   statusReport
+	statusAt   time.Time
+	// serializers maps the WebSocket subprotocols to the serializers of their frames.
+	serializers map[string]serializer
+	// tenants tracks the usage of the tenants against their limits.
+	tenants tenantTable
+	// deflaters maps the deflate subprotocols to their serializers, built once CompressionDictionary is set.
+	deflateOnce sync.Once
+	deflaters   map[string]serializer
+
+	// Logger receives the logs of the server, e.g. to capture them or to silence the per-message logs with a
+	// logger writing to ioutil.Discard. NewCollider sets it to the standard logger, which nil also means.
+	Logger *log.Logger
+	// Debug logs every frame received and the registrations and messages routed, the message bodies included.
+	// It is off by default, as those logs flood production and the bodies are private.
+	Debug bool
+
+	// AdminToken guards the admin endpoints. They are disabled when it is empty.
+	AdminToken string
+	// MaxSessionBytes is the number of bytes a client may send and receive over one connection before it is
+	// disconnected. Zero means unlimited.
+	MaxSessionBytes int64
+	// InstanceID identifies this server in a multi-instance deployment. NewCollider generates a random one.
+	InstanceID string
+	// IncludeInstanceID adds the InstanceID as the X-Collider-Instance header of every HTTP response and
+	// sends it to the clients in a 'registered' frame once they register.
+	IncludeInstanceID bool
+	// EnforceCapabilities rejects direct relays (chat, video_chat, audio_chat) to a peer that declared
+	// capabilities at register without the relayed command among them.
+	EnforceCapabilities bool
+	// QueuePreviews includes redacted and truncated previews of the queued messages in the verbose
+	// admin room detail.
+	QueuePreviews bool
+	// Presence sends the registered clients of a room a { 'cmd': 'presence', 'event': 'join' } frame, with the
+	// 'clientid' of the client, when another client registers in the room, and an 'event': 'leave' one when it
+	// deregisters or leaves.
+	Presence bool
+	// StrictRelayTarget answers direct relays whose 'to' is missing, or not another client of the sender's room,
+	// with an error instead of silently dropping them.
+	StrictRelayTarget bool
+	// LandingPage is the body returned for GET "/". An empty value returns "OK".
+	LandingPage string
+	// AllowedOrigins lists the origins the browsers may call the HTTP endpoints from: the Origin of a request
+	// is echoed back in Access-Control-Allow-Origin only if it is in the list, and the WebSocket handshakes from
+	// other origins are rejected with 403. Empty allows every origin.
+	AllowedOrigins []string
+	// ReconnectGrace returns the time a client of the room |rid| may take to reconnect before it is removed.
+	// It is called once when the room is created. A nil func, or a zero result, uses RegisterTimeout.
+	ReconnectGrace func(rid string) time.Duration
+	// RegisterTimeout is how long a client of a room, e.g. one that messages were sent from over HTTP, may take
+	// to register before it is removed, along with the room if it was the only client. Zero means 10 seconds.
+	RegisterTimeout time.Duration
+	// Authorizer is called before each command is executed, with the sending client or nil before it registers.
+	// A non-nil error rejects the command with a PERMISSION_DENIED error, keeping the connection open.
+	// A nil Authorizer allows every command.
+	Authorizer func(cl *client, cmd string, msg *wsClientMsg) error
+	// Authenticate is called with the room ID, the client ID and the token of each register request. A non-nil
+	// error rejects the registration with an AUTH_FAILED error and closes the connection. A nil Authenticate
+	// lets anyone register any client ID.
+	Authenticate func(roomID string, clientID string, token string) error
+	// ConnIDFunc generates the IDs of the WebSocket connections, e.g. to embed the region of the server.
+	// An empty ID, or one already in use by an open connection, is replaced with a default one.
+	// Nil numbers the connections after the InstanceID.
+	ConnIDFunc func() string
+	// OnQueueOverflow is called when a message is refused because the queue of the sender, waiting for the
+	// other client of the room |rid| to join, is full. |dropped| counts the messages refused since the queue
+	// filled up. It may e.g. disconnect the slow room. Nil only refuses the messages.
+	OnQueueOverflow func(cl *client, rid string, dropped int)
+	// MaxQueuedMessages and MaxQueuedBytes cap the messages a client queues while waiting for the other
+	// client of the room. Further messages are refused with a QUEUE_FULL error. Zero means 1024 messages and
+	// 1 MiB.
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+	// MaxPendingConns is the number of WebSocket connections allowed to be open without having registered.
+	// Further handshakes are rejected with 503 until some of them register or close. Zero means unlimited.
+	MaxPendingConns int
+	// StatusCacheInterval is how long a /status report is reused, so that frequent polling under load does not
+	// rebuild it for every request. Zero builds a fresh report each time.
+	StatusCacheInterval time.Duration
+	// MaxRoomsPerClient is the number of rooms a client ID may be registered in at the same time.
+	// Registering in one more room is rejected with a TOO_MANY_ROOMS error. Zero means unlimited.
+	MaxRoomsPerClient int
+	// Audit receives an entry for every admin operation, such as closing a room or removing a client.
+	// Nothing is audited when it is nil. See NewJSONAuditSink.
+	Audit func(AuditEntry)
+	// PingInterval is how often the WebSocket connections are pinged. Zero disables the pings.
+	PingInterval time.Duration
+	// MaxMissedPings is the number of consecutive pings a client may leave unanswered, without sending any
+	// frame, before it is disconnected with a PING_TIMEOUT error. Zero means 3.
+	MaxMissedPings int
+	// RoomMessagesPerSecond limits the aggregate rate of the messages sent by the clients of a room, over
+	// WebSocket or HTTP. Messages beyond the limit are rejected with a ROOM_RATE_LIMITED error. Zero means unlimited.
+	RoomMessagesPerSecond float64
+	// RoomMessageBurst is the number of messages a room may send at once above RoomMessagesPerSecond.
+	RoomMessageBurst int
+	// MessagesPerSecond limits the rate of the room messages sent by each WebSocket connection, so that one
+	// client cannot starve the others. Messages beyond the limit are dropped with a RATE_LIMITED error, leaving
+	// the connection open. Zero means unlimited.
+	MessagesPerSecond float64
+	// MessageBurst is the number of messages a connection may send at once above MessagesPerSecond.
+	MessageBurst int
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies in front of the server, e.g.
+	// "10.0.0.0/8". A connection from one of them is attributed to the client address they forwarded in the
+	// X-Forwarded-For or X-Real-IP header, e.g. in the subnet report. Empty attributes each connection to its peer.
+	TrustedProxies []string
+	// PathPrefix is prepended to the paths of every handler, e.g. "/signal" to serve the WebSockets at
+	// "/signal/ws", to mount the server under a subpath. Empty serves them at the root.
+	PathPrefix string
+	// EnabledCommands lists the WebSocket commands the clients may use; the others are rejected with a
+	// COMMAND_DISABLED error. "register" is always enabled. Nil enables every command.
+	EnabledCommands []string
+	// RelayCommands lists the WebSocket commands relayed with their 'msg' to the client 'to', as custom
+	// signaling channels such as "screenshare". The commands with another meaning, such as "send", are not
+	// affected. Nil relays "chat", "video_chat" and "audio_chat"; a list replaces them.
+	RelayCommands []string
+	// RoomTypes is the set of room types the clients may register rooms with, labelling the per-type metrics.
+	// Other types are labelled "other" to keep the number of labels bounded.
+	RoomTypes []string
+	// MaxActiveConns is the number of WebSocket connections accepted at once, from their handshake until they
+	// register or close. Further connections wait for one to register or close, in a queue of AcceptQueueSize
+	// places, for up to AcceptQueueTimeout; once the queue is full or the wait is over they are rejected with
+	// 503. Zero means unlimited, and a zero AcceptQueueTimeout 10 seconds.
+	MaxActiveConns     int
+	AcceptQueueSize    int
+	AcceptQueueTimeout time.Duration
+	// MaxBroadcasts is the number of broadcasts to every client sent at once. Further broadcasts wait for one
+	// to end, in a queue of BroadcastQueueSize places; once it is full they are rejected. Zero means unlimited.
+	MaxBroadcasts      int
+	BroadcastQueueSize int
+	// ReadBufferSize and WriteBufferSize are the sizes in bytes of the buffers of each WebSocket connection.
+	// Zero means 4096. A read buffer large enough for a burst of frames, such as the ICE candidates gathered
+	// at once, reads it in fewer syscalls, and a write buffer larger than the frames writes each of them in one;
+	// but the buffers are allocated for every connection, busy or idle, so they cost their size times the
+	// number of connections in memory.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// ReadTimeout is how long a registered client may go without sending a frame before it is disconnected.
+	// Zero means one day.
+	ReadTimeout time.Duration
+	// UnregisteredReadTimeout is how long a connection may stay open before it registers, whatever frames it
+	// sends meanwhile, so that the connections that never register are reaped quickly, counted as
+	// never_registered disconnects.
+	// Zero means 10 seconds, or ReadTimeout if shorter.
+	UnregisteredReadTimeout time.Duration
+	// CallStallTimeout detects the half-open calls: a client that has neither sent nor received a relayed
+	// message CallStallTimeout after registering, whatever other frames it sends, is reported to the clients
+	// of its room in a call_stalled frame. Zero disables the detection.
+	CallStallTimeout time.Duration
+	// CloseStalledRooms disconnects the clients of a room and removes it once a call_stalled frame is sent.
+	CloseStalledRooms bool
+	// RoomTTL removes the rooms without a register or a message for RoomTTL, e.g. those left behind by crashed
+	// clients, after sending their clients a ROOM_EXPIRED error and disconnecting them. The rooms are checked
+	// in the background by Run every 10 seconds, or every RoomTTL/2 if shorter. Zero keeps the idle rooms.
+	RoomTTL time.Duration
+	// ResumeGrace keeps a disconnected client and the messages queued by and for it for ResumeGrace, or the
+	// reconnect grace period if longer. The 'registered' frame then carries a 'resumetoken', which a register
+	// from a new connection sends back to resume the registration with the queued messages rather than start
+	// afresh. Zero disables the resumption.
+	ResumeGrace time.Duration
+	// IdleWarning is how long before the read timeout a silent connection is sent an idle_warning frame, so
+	// that the client may send a heartbeat to stay connected. Zero sends no warning.
+	IdleWarning time.Duration
+	// MaxHeapBytes guards against running out of memory by shedding load as the heap grows towards it:
+	// from 80% the messages are no longer queued for the clients whose peer has not joined, from 90% the new
+	// WebSocket connections are also rejected with 503, and from 100% the presence notifications are also
+	// dropped. Zero disables the guard.
+	MaxHeapBytes uint64
+	// MemoryCheckInterval is how often the heap usage is read for MaxHeapBytes. Zero means one second.
+	MemoryCheckInterval time.Duration
+	// QuickDisconnectWindow is the time after registering within which a client that disconnects while alone
+	// in its room is removed at once, along with the room, instead of being kept for the reconnect grace
+	// period. Zero always keeps the client for the grace period.
+	QuickDisconnectWindow time.Duration
+	// FieldNames renames the fields of the frames relayed to the clients, mapping their default names ("cmd",
+	// "from", "msg", "error", "code", "time" and "instance") to those an existing client protocol expects,
+	// e.g. {"cmd": "type", "msg": "data"}. The fields it does not map keep their default names.
+	FieldNames map[string]string
+	// RoomServerTimeout bounds the calls to the room server, which are made in the background so that signaling
+	// proceeds whether or not the room server is available. Zero means 5 seconds.
+	RoomServerTimeout time.Duration
+	// TenantFunc returns the tenant of a WebSocket connection, e.g. from the claims of its request or the namespace
+	// of its room, for the limits of Tenants. It is called with an empty room ID when the connection is accepted,
+	// and with the room ID when it registers, the connection being counted against the tenant returned last.
+	// An empty tenant has no limits. Nil puts every connection in the empty tenant.
+	TenantFunc func(r *http.Request, rid string) string
+	// Tenants maps the tenants to their limits. The tenants it does not map have DefaultTenantLimits.
+	Tenants             map[string]TenantLimits
+	DefaultTenantLimits TenantLimits
+	// MaxRoomCapacity is the number of clients a room may hold; further registers are rejected with a ROOM_FULL
+	// error. In a room of more than two, the messages sent without a recipient reach every other client.
+	// Zero means 2.
+	MaxRoomCapacity int
+	// DuplicateClients is the policy for a connection registering a client ID already registered in the room:
+	// DuplicateTakeover, DuplicateReject or DuplicateMultiDevice. Empty means DuplicateTakeover.
+	DuplicateClients DuplicateClientPolicy
+	// CompressionDictionary is the preset dictionary of the connections negotiating the "collider.deflate-dict"
+	// subprotocol, whose frames are deflated one by one in binary frames; the client inflates them with the same
+	// dictionary. Those negotiating "collider.deflate" do without one. Nil means a dictionary tuned for the
+	// frames relaying the SDP and the ICE candidates, which improves on plain deflate the most for small frames.
+	CompressionDictionary []byte
+	// MaxJSONDepth is the number of levels objects and arrays may be nested in an incoming message, and in the
+	// JSON carried by its 'msg'. Deeper messages are rejected with a TOO_DEEP error before they are decoded.
+	// Zero means 32.
+	MaxJSONDepth int
+	// MaxMessageBytes is the size of the largest incoming frame. A larger frame is not read: the connection is
+	// sent a MESSAGE_TOO_LARGE error and closed. Zero means 256 KiB.
+	MaxMessageBytes int
+	// MessageTimeout bounds the time the Authorizer may take on a message, so that a hanging one cannot wedge
+	// the connection. Slow messages are counted, and handled per SlowMessages. Zero means no timeout.
+	MessageTimeout time.Duration
+	// SlowMessages is what happens to a message whose processing exceeds MessageTimeout. Empty means
+	// SlowMessageSkip.
+	SlowMessages SlowMessagePolicy
+	// LockHoldWarning is the time the room table lock may be held by an operation before the operation is
+	// logged and counted in the status report, to diagnose contention. Zero reports nothing.
+	LockHoldWarning time.Duration
+	// CertFile and KeyFile are the paths of the TLS certificate and key when Run serves TLS. Empty means
+	// /cert/cert.pem and /cert/key.pem, unless TLSConfig supplies the certificates.
+	CertFile string
+	KeyFile  string
+	// TLSConfig is the TLS configuration when Run serves TLS, e.g. to apply another cipher policy. Nil means
+	// the forward-secret ciphers only.
+	TLSConfig *tls.Config
 }
 
 func NewCollider(rs string) *Collider {
-	registeredClients = make(map[string]*client)
-	return &Collider{
-		roomTable: newRoomTable(time.Second*registerTimeoutSec, rs),
-		dash:      newDashboard(),
+	c := &Collider{
+		roomTable:  newRoomTable(time.Second*registerTimeoutSec, rs),
+		dash:       newDashboard(),
+		events:     newEventBus(),
+		InstanceID: newInstanceID(),
+		Logger:     log.Default(),
+		stopSweep:  make(chan struct{}),
+	}
+	c.roomTable.parent = c
+	return c
+}
+
+// newInstanceID returns a random identifier for the server instance.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate the instance ID: %v", err)
+		return "collider"
 	}
+	return hex.EncodeToString(b)
 }
 
-// Run starts the collider server and blocks the thread until the program exits.
-func (c *Collider) Run(p int, useTls bool) {
-	http.Handle("/ws", websocket.Handler(c.wsHandler))
-	http.HandleFunc("/status", c.httpStatusHandler)
-	http.HandleFunc("/", c.httpHandler)
-	http.HandleFunc("/deregister", c.httpDeregister)
+// addConn gives the new WebSocket connection |sc| its ID, from ConnIDFunc or prefixed by the instance ID, and
+// holds it as open until releaseConn is called.
+func (c *Collider) addConn(sc *serialConn) {
+	id := ""
+	if c.ConnIDFunc != nil {
+		id = c.ConnIDFunc()
+	}
 
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[string]*serialConn)
+	}
+	if c.ConnIDFunc != nil && (id == "" || c.conns[id] != nil) {
+		c.logger().Printf("ConnIDFunc returned the empty or duplicate connection ID %q, using a default one", id)
+		id = ""
+	}
+	for id == "" || c.conns[id] != nil {
+		id = fmt.Sprintf("%s-%d", c.InstanceID, atomic.AddUint64(&c.connSeq, 1))
+	}
+	sc.id = id
+	c.conns[id] = sc
+}
+
+// releaseConn frees the ID of a closed WebSocket connection.
+func (c *Collider) releaseConn(sc *serialConn) {
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+	delete(c.conns, sc.id)
+}
+
+// openConns returns the open WebSocket connections, registered or not.
+func (c *Collider) openConns() []io.ReadWriteCloser {
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+	conns := make([]io.ReadWriteCloser, 0, len(c.conns))
+	for _, sc := range c.conns {
+		conns = append(conns, sc)
+	}
+	return conns
+}
+
+// registerHandlers registers the handlers of the server on |mux|, under PathPrefix and wrapped in the middleware.
+// The handlers see the paths with the prefix stripped, and the middleware the paths as matched.
+func (c *Collider) registerHandlers(mux *http.ServeMux) {
+	prefix := strings.TrimSuffix(c.PathPrefix, "/")
+	handle := func(pattern string, h http.Handler) {
+		if prefix != "" {
+			h = http.StripPrefix(prefix, h)
+		}
+		for i := len(c.middleware) - 1; i >= 0; i-- {
+			h = c.middleware[i](h)
+		}
+		mux.Handle(prefix+pattern, h)
+	}
+	handle("/ws", c.refuseDraining(c.shedConnections(c.limitTenants(c.acceptQueued(c.limitPending(c.trackActivity(websocket.Server{Handler: c.wsHandler, Handshake: c.wsHandshake})))))))
+	handle("/status", http.HandlerFunc(c.httpStatusHandler))
+	handle("/metrics", http.HandlerFunc(c.httpMetricsHandler))
+	handle("/rooms", http.HandlerFunc(c.httpRoomsHandler))
+	handle("/", http.HandlerFunc(c.httpHandler))
+	handle("/deregister", http.HandlerFunc(c.httpDeregister))
+	handle("/admin/events", c.adminOnly(websocket.Handler(c.wsAdminEventsHandler)))
+	handle("/admin/rooms/", c.adminOnly(http.HandlerFunc(c.httpAdminRoomHandler)))
+	handle("/admin/conns/", c.adminOnly(http.HandlerFunc(c.httpAdminConnHandler)))
+	handle("/admin/clients/", c.adminOnly(http.HandlerFunc(c.httpAdminClientHandler)))
+	handle("/kick/", c.adminOnly(http.HandlerFunc(c.httpKickHandler)))
+	handle("/admin/subnets", c.adminOnly(http.HandlerFunc(c.httpAdminSubnetsHandler)))
+	handle("/admin/tenants", c.adminOnly(http.HandlerFunc(c.httpAdminTenantsHandler)))
+	handle("/admin/config", c.adminOnly(http.HandlerFunc(c.httpAdminConfigHandler)))
+	handle("/admin/maintenance", c.adminOnly(http.HandlerFunc(c.httpAdminMaintenanceHandler)))
+	handle("/healthz", http.HandlerFunc(c.httpHealthHandler))
+	handle("/health", http.HandlerFunc(c.httpHealthHandler))
+	handle("/version", http.HandlerFunc(c.httpVersionHandler))
+}
+
+// Use adds a middleware wrapping every handler in the order added, which sees the requests once they are
+// routed and may answer them without calling the handler, e.g. to reject unauthenticated requests. It must be
+// called before Handler or Run.
+func (c *Collider) Use(mw func(http.Handler) http.Handler) {
+	c.middleware = append(c.middleware, mw)
+}
+
+// Handler returns the handler serving the endpoints of the server on a mux of its own, for the users to wrap it
+// in their middleware or mount it in their server instead of calling Run.
+func (c *Collider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	c.registerHandlers(mux)
+	return c.withInstanceID(mux)
+}
+
+// Run starts the collider server serving Handler() and blocks the thread until the program exits or Stop is
+// called. It returns the error the server failed with, or nil once stopped by Stop.
+func (c *Collider) Run(p int, useTls bool) error {
 	var e error
 
+	if c.RoomTTL > 0 {
+		go c.sweepRooms(c.RoomTTL, c.stopSweep)
+	}
+
 	pstr := ":" + strconv.Itoa(p)
+	c.server = &http.Server{Addr: pstr, Handler: c.Handler(), ErrorLog: c.logger()}
 	if useTls {
-		config := &tls.Config{
-			// Only allow ciphers that support forward secrecy for iOS9 compatibility:
-			// https://developer.apple.com/library/prerelease/ios/technotes/App-Transport-Security-Technote/
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-				//tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			},
-			PreferServerCipherSuites: true,
-		}
-		server := &http.Server{Addr: pstr, Handler: nil, TLSConfig: config}
-
-		e = server.ListenAndServeTLS("/cert/cert.pem", "/cert/key.pem")
+		c.server.TLSConfig = c.newTLSConfig()
+		c.server.ErrorLog = c.tlsErrorLog()
+		c.server.ConnState = c.tlsConnState
+
+		cert, key := c.certFiles()
+		if e = checkCertFiles(cert, key); e != nil {
+			return e
+		}
+		e = c.server.ListenAndServeTLS(cert, key)
+	} else {
+		e = c.server.ListenAndServe()
+	}
+
+	if e == http.ErrServerClosed {
+		return nil
+	}
+	return e
+}
+
+// MustRun is Run, exiting the program if the server fails.
+func (c *Collider) MustRun(p int, useTls bool) {
+	if err := c.Run(p, useTls); err != nil {
+		c.logger().Fatal("Run: " + err.Error())
+	}
+}
+
+// Stop shuts the server down gracefully. It stops accepting connections and registrations and waits, up to
+// the deadline of |ctx|, for the in-flight writes to the clients to complete, logging what is left to deliver
+// meanwhile. The clients and the connections yet to register are then sent a SHUTTING_DOWN error and
+// disconnected, and Run returns.
+func (c *Collider) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&c.stopping, 1)
+	if c.stopSweep != nil {
+		c.stopSweepOnce.Do(func() { close(c.stopSweep) })
+	}
+	err := c.drain(ctx)
+
+	// A client stuck in a write blocks its disconnection, so Stop does not wait for it past the deadline.
+	closed := make(chan bool)
+	go func() {
+		c.roomTable.closeAll(c.openConns(), errCodeShuttingDown, "Server is shutting down")
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// drain shuts the HTTP server down and waits for the in-flight writes to complete.
+func (c *Collider) drain(ctx context.Context) error {
+	if c.server != nil {
+		if err := c.server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	last := drainReport{InFlight: -1}
+	for {
+		rp := c.drainReport()
+		if rp != last {
+			c.logger().Printf("Stopping: %d queued and %d in-flight messages remaining", rp.Queued, rp.InFlight)
+			last = rp
+		}
+		if rp.InFlight == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// isStopping returns true once Stop has been called.
+func (c *Collider) isStopping() bool {
+	return atomic.LoadInt32(&c.stopping) == 1
+}
+
+// drainReport returns the number of queued and in-flight messages.
+func (c *Collider) drainReport() drainReport {
+	return drainReport{
+		Stopping: c.isStopping(),
+		Draining: c.isDraining(),
+		Queued:   c.roomTable.queuedCount(),
+		InFlight: c.roomTable.inflightCount(),
+	}
+}
+
+// httpHealthHandler is a HTTP handler that returns 200 while the server is running and 503 once it is stopping
+// or draining, with a one-word body. It takes no lock of the room table, so that the probes stay fast under
+// load. With "verbose=1", it returns the drain report as JSON, which counts the queued messages under the locks.
+func (c *Collider) httpHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if c.isStopping() || c.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.URL.Query().Get("verbose") == "1" {
+		send(w, c.drainReport())
+		return
+	}
+	if c.isStopping() {
+		io.WriteString(w, "STOPPING\n")
+	} else if c.isDraining() {
+		io.WriteString(w, "DRAINING\n")
 	} else {
-		e = http.ListenAndServe(pstr, nil)
+		io.WriteString(w, "OK\n")
+	}
+}
+
+// httpLandingHandler answers GET requests to "/" with the LandingPage, so that load balancers and health
+// checkers probing the root get a 200.
+func (c *Collider) httpLandingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.LandingPage == "" {
+		io.WriteString(w, "OK\n")
+		return
 	}
+	io.WriteString(w, c.LandingPage)
+}
+
+// withInstanceID wraps the handler to add the X-Collider-Instance header if IncludeInstanceID is set.
+func (c *Collider) withInstanceID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.IncludeInstanceID {
+			w.Header().Set("X-Collider-Instance", c.InstanceID)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// pendingSlot is held by a WebSocket connection from its handshake until it registers or closes.
+type pendingSlot struct {
+	c    *Collider
+	once sync.Once
+}
+
+func (s *pendingSlot) release() {
+	s.once.Do(func() { atomic.AddInt64(&s.c.pending, -1) })
+}
+
+type pendingSlotKey struct{}
+
+// limitPending wraps the WebSocket handler to reject the handshake with 503 once MaxPendingConns connections
+// are waiting to register.
+func (c *Collider) limitPending(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt64(&c.pending, 1); c.MaxPendingConns > 0 && n > int64(c.MaxPendingConns) {
+			atomic.AddInt64(&c.pending, -1)
+			http.Error(w, "Too many pending connections", http.StatusServiceUnavailable)
+			return
+		}
+		s := &pendingSlot{c: c}
+		defer s.release()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pendingSlotKey{}, s)))
+	})
+}
 
-	if e != nil {
-		log.Fatal("Run: " + e.Error())
+// releasePending frees the pending slot of the connection, if it holds one.
+func releasePending(ws *websocket.Conn) {
+	if s, ok := ws.Request().Context().Value(pendingSlotKey{}).(*pendingSlot); ok {
+		s.release()
 	}
 }
 
+// pendingCount returns the number of WebSocket connections that have not registered yet.
+func (c *Collider) pendingCount() int {
+	return int(atomic.LoadInt64(&c.pending))
+}
+
+// pageParams returns the "offset" and "limit" query parameters of the request, limit defaulting to
+// defaultStatusRoomLimit and capped at maxStatusRoomLimit.
+func pageParams(r *http.Request) (int, int, error) {
+	offset, limit := 0, defaultStatusRoomLimit
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("Invalid offset: " + v)
+		}
+		offset = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, errors.New("Invalid limit: " + v)
+		}
+		limit = n
+	}
+	if limit > maxStatusRoomLimit {
+		limit = maxStatusRoomLimit
+	}
+	return offset, limit, nil
+}
+
+// statusReport returns the status report, reusing the cached one if it is younger than StatusCacheInterval.
+func (c *Collider) statusReport() statusReport {
+	if c.StatusCacheInterval <= 0 {
+		return c.dash.getReport(c.roomTable)
+	}
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+
+	if time.Since(c.statusAt) >= c.StatusCacheInterval {
+		c.statusRp, c.statusAt = c.dash.getReport(c.roomTable), time.Now()
+	}
+	return c.statusRp
+}
+
 // httpStatusHandler is a HTTP handler that handles GET requests to get the
-// status of collider.
+// status of collider. The format follows the Accept header: JSON by default, a human-readable summary
+// for "text/plain" and the Prometheus exposition format for "text/prometheus".
+// With "verbose=1", the JSON report also lists the rooms a page at a time, as selected by the "offset" and
+// "limit" query parameters; "nextoffset" is the offset of the next page, absent on the last one.
+// With "roomid=$ROOMID", only the JSON report of that room is returned, or 404 if it does not exist.
 func (c *Collider) httpStatusHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Access-Control-Allow-Origin", "*")
+	c.allowOrigin(w, r)
 	w.Header().Add("Access-Control-Allow-Methods", "GET")
 
-	rp := c.dash.getReport(c.roomTable)
+	if rid := r.URL.Query().Get("roomid"); rid != "" {
+		c.httpRoomStatus(w, rid)
+		return
+	}
+	rp := c.statusReport()
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/prometheus"):
+		w.Header().Set("Content-Type", prometheusContentType)
+		rp.writePrometheus(w)
+		return
+	case strings.Contains(accept, "text/plain"):
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rp.writeText(w)
+		return
+	}
+
+	var v interface{} = rp
+	if r.URL.Query().Get("verbose") == "1" {
+		offset, limit, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vr := verboseStatusReport{statusReport: rp}
+		vr.Rooms, vr.NextOffset = c.roomTable.roomPage(offset, limit)
+		v = vr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(rp); err != nil {
+	if err := enc.Encode(v); err != nil {
 		err = errors.New("Failed to encode to JSON: err=" + err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		c.dash.onHttpErr(err)
 	}
 }
 
+// httpRoomStatus answers with the status report of the room |rid|, or { 'result': 'ERROR', 'message': $MSG }
+// with 404 if it does not exist. A room that is gone is not counted as an error.
+func (c *Collider) httpRoomStatus(w http.ResponseWriter, rid string) {
+	w.Header().Set("Content-Type", "application/json")
+	st := c.roomTable.roomStatus(rid)
+	if st == nil {
+		w.WriteHeader(http.StatusNotFound)
+		send(w, httpResult{Result: "ERROR", Message: "Room not found: " + rid})
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(st); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
+
+// httpMetricsHandler is a HTTP handler that returns the status report in the Prometheus text exposition format
+// whatever the Accept header, for the scrapers that cannot set it.
+func (c *Collider) httpMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	c.statusReport().writePrometheus(w)
+}
+
+// deregisterResult is the JSON body of the response of httpDeregister.
+type deregisterResult struct {
+	Removed bool   `json:"removed"`
+	RoomID  string `json:"roomid"`
+}
+
+// httpDeregister is a HTTP handler that removes the room /$ROOMID, answering with
+// { 'removed': true|false, 'roomid': $ROOMID } whether the room existed or not.
 func (c *Collider) httpDeregister(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	p := strings.Split(r.URL.Path, "/")
-	if len(p) != 2 {
-		c.httpError("Invalid path: "+r.URL.Path, w)
+	c.allowOrigin(w, r)
+	p := pathSegments(r.URL.Path)
+	if len(p) != 1 {
+		c.httpErrorCode(http.StatusBadRequest, "Invalid path: "+r.URL.Path, w)
+		return
+	}
+	rid := p[0]
+	removed := c.roomTable.removeRoom(rid)
+	result := "ok"
+	if !removed {
+		result = "not_found"
+	}
+	c.audit(r, AuditEntry{Action: auditCloseRoom, RoomID: rid, Result: result})
+	w.Header().Set("Content-Type", "application/json")
+	send(w, deregisterResult{Removed: removed, RoomID: rid})
+}
+
+// allowOrigin sets the Access-Control-Allow-Origin header of the response: "*" if AllowedOrigins is empty,
+// the Origin of the request if it is in AllowedOrigins, and nothing otherwise.
+func (c *Collider) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	if len(c.AllowedOrigins) == 0 {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
 		return
 	}
-	rid := p[1]
-	c.roomTable.removeRoom(rid)
-	io.WriteString(w, "OK\n")
+	// The header depends on the Origin, so that caches must not share the response across origins.
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); c.originAllowed(origin) {
+		w.Header().Add("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// originAllowed returns true if AllowedOrigins is empty or lists |origin|.
+func (c *Collider) originAllowed(origin string) bool {
+	if len(c.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if origin != "" && o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWsOrigin checks the Origin of a WebSocket handshake, rejecting it with 403 before the connection is
+// handed to wsHandler if the Origin is missing, like websocket.Handler does, or not in AllowedOrigins.
+func (c *Collider) checkWsOrigin(config *websocket.Config, r *http.Request) error {
+	var err error
+	if config.Origin, err = websocket.Origin(config, r); err != nil {
+		return err
+	}
+	if config.Origin == nil {
+		return errors.New("null origin")
+	}
+	if origin := r.Header.Get("Origin"); !c.originAllowed(origin) {
+		c.logger().Printf("Rejecting the WebSocket handshake from origin %q", origin)
+		return errors.New("Origin not allowed: " + origin)
+	}
+	return nil
+}
+
+// isUpgrade returns true if the request asks to upgrade the connection, e.g. to a WebSocket.
+func isUpgrade(r *http.Request) bool {
+	for _, v := range r.Header["Connection"] {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathSegments returns the segments of the path |path|, ignoring the leading, trailing and repeated slashes.
+func pathSegments(path string) []string {
+	var p []string
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			p = append(p, seg)
+		}
+	}
+	return p
 }
 
 // httpHandler is a HTTP handler that handles GET/POST/DELETE requests.
+// GET request to path "/" returns the landing page.
 // POST request to path "/$ROOMID/$CLIENTID" is used to send a message to the other client of the room.
 // $CLIENTID is the source client ID.
 // The request must have a form value "msg", which is the message to send.
 // DELETE request to path "/$ROOMID/$CLIENTID" is used to delete all records of a client, including the queued message from the client.
-// "OK" is returned if the request is valid.
+// With "queueOnly=true", it only drops the messages queued by the client, answering
+// { 'result': 'SUCCESS', 'dropped': $COUNT }.
+// { 'result': 'SUCCESS' } is returned if the request succeeds, and { 'result': 'ERROR', 'message': $MSG } with
+// 400 for an invalid request or 500 otherwise.
 func (c *Collider) httpHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Access-Control-Allow-Origin", "*")
+	c.allowOrigin(w, r)
 	w.Header().Add("Access-Control-Allow-Methods", "POST, DELETE")
 
-	p := strings.Split(r.URL.Path, "/")
-	if len(p) != 3 {
-		c.httpError("Invalid path: "+r.URL.Path, w)
+	if r.URL.Path == "/" {
+		c.httpLandingHandler(w, r)
+		return
+	}
+	if isUpgrade(r) {
+		// A WebSocket client connecting to the wrong path, not a room or client operation.
+		http.Error(w, "WebSocket connections are only accepted at /ws", http.StatusNotFound)
+		return
+	}
+
+	p := pathSegments(r.URL.Path)
+	if len(p) != 2 {
+		c.httpErrorCode(http.StatusBadRequest, "Invalid path: "+r.URL.Path, w)
 		return
 	}
-	rid, cid := p[1], p[2]
+	rid, cid := p[0], p[1]
 
 	switch r.Method {
 	case "POST":
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			c.httpError("Failed to read request body: "+err.Error(), w)
+			c.httpErrorCode(http.StatusBadRequest, "Failed to read request body: "+err.Error(), w)
 			return
 		}
 		m := string(body)
 		if m == "" {
-			c.httpError("Empty request body", w)
+			c.httpErrorCode(http.StatusBadRequest, "Empty request body", w)
+			return
+		}
+		if !c.roomTable.allowMessage(rid) {
+			c.httpErrorCode(http.StatusTooManyRequests, "Room message rate exceeded", w)
 			return
 		}
 		if err := c.roomTable.send(rid, cid, "POST", m); err != nil {
-			c.httpError("Failed to send the message: "+err.Error(), w)
+			c.httpErrorOf("Failed to send the message: ", err, w)
 			return
 		}
-		c.httpReturnSuccess(w)
 	case "DELETE":
-		log.Println(r.URL.Path)
+		c.debugf("%v", r.URL.Path)
 		if cid == "ALL" {
-			log.Printf("DELETE ALL METHOD!")
+			c.debugf("DELETE ALL METHOD!")
 			c.roomTable.removeRoom(rid)
-			log.Printf("remove room id == %s", rid)
+			c.debugf("remove room id == %s", rid)
+			c.audit(r, AuditEntry{Action: auditCloseRoom, RoomID: rid, Result: "ok"})
+		} else if r.URL.Query().Get("queueOnly") == "true" {
+			n := c.roomTable.clearQueue(rid, cid)
+			c.audit(r, AuditEntry{Action: auditClearQueue, RoomID: rid, ClientID: cid, Result: "ok"})
+			w.Header().Set("Content-Type", "application/json")
+			send(w, clearQueueResult{Result: "SUCCESS", Dropped: n})
+			return
 		} else {
-			log.Printf("DELETE %s", cid)
+			c.debugf("DELETE %s", cid)
 			//c.sendDeleteError(cid, "YOU_ARE_OFFLINE")
-			if c_ := registeredClients[cid]; c_ != nil {
-				log.Printf("DELETE %s----------------------", cid)
-				sendServerErr(c_.rwc, "YOU_ARE_OFFLINE")
+			if c_ := c.roomTable.lookupClient(cid); c_ != nil {
+				c.debugf("DELETE %s----------------------", cid)
+				sendServerErr(c_.conn(), "YOU_ARE_OFFLINE")
 			}
 			c.roomTable.remove(rid, cid)
+			c.audit(r, AuditEntry{Action: auditRemoveClient, RoomID: rid, ClientID: cid, Result: "ok"})
 		}
 	default:
 		return
 	}
 
-	io.WriteString(w, "OK\n")
+	c.httpReturnSuccess(w)
+}
+
+// httpResult is the JSON body of the responses of the room and client operations.
+type httpResult struct {
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// clearQueueResult is the JSON body of the response of a DELETE with "queueOnly=true".
+type clearQueueResult struct {
+	Result  string `json:"result"`
+	Dropped int    `json:"dropped"`
 }
 
+// httpReturnSuccess answers with { 'result': 'SUCCESS' }.
 func (c *Collider) httpReturnSuccess(w http.ResponseWriter) {
-	map_ := map[string]string{"result": "SUCCESS"}
-	str, _ := json.Marshal(map_)
-	io.WriteString(w, string(str))
+	w.Header().Set("Content-Type", "application/json")
+	send(w, httpResult{Result: "SUCCESS"})
 }
 
 // wsHandler is a WebSocket server that handles requests from the WebSocket client in the form of:
-// 1. { 'cmd': 'register', 'roomid': $ROOM, 'clientid': $CLIENT' },
-// which binds the WebSocket client to a client ID and room ID.
+// 1. { 'cmd': 'register', 'roomid': $ROOM, 'clientid': $CLIENT', 'caps': [$CMD...], 'token': $TOKEN,
+// 'resumetoken': $RESUME }, which binds the WebSocket client to a client ID and room ID. The optional 'caps'
+// lists the relayed commands the client supports, and the 'token' is checked by the Authenticate hook, if any.
+// The optional 'resumetoken', from the 'registered' frame of a previous connection, resumes its registration
+// with the queued messages under ResumeGrace.
 // A client should send this message only once right after the connection is open.
 // or
-// 2. { 'cmd': 'send', 'msg': $MSG }, which sends the message to the other client of the room.
+// 2. { 'cmd': 'send', 'msg': $MSG, 'id': $ID }, which sends the message to the other client of the room.
 // It should be sent to the server only after 'regiser' has been sent.
-// The message may be cached by the server if the other client has not joined.
+// The message may be cached by the server if the other client has not joined. With the optional 'id', the
+// sender is answered { 'cmd': 'ack', 'id': $ID, 'delivered': $DELIVERED }, where 'delivered' is true if the
+// message was relayed at once, and false if it was cached. A message neither relayed nor cached, e.g. because
+// the write to the other client failed, is answered with an error instead.
+// or
+// 3. { 'cmd': 'receipt', 'id': $ID, 'to': $CLIENT }, which confirms the receipt of the message $ID by routing
+// { 'type': 'receipt', 'id': $ID, 'from': $SELF } back to its sender, the client $CLIENT of the room or,
+// without 'to', the other client of the room. The message IDs are defined by the clients.
+// or
+// 4. { 'cmd': 'heartbeat' }, which only keeps the connection from timing out, e.g. after an idle_warning.
+// or
+// 5. { 'cmd': 'broadcast', 'msg': $MSG }, which relays the message to every other client of the room, e.g. for
+// a host to mute all the participants. A failure to relay it to one of them is reported as an error frame
+// without stopping the relay to the others.
+// or
+// 6. { 'cmd': 'list' }, which is answered { 'cmd': 'roster', 'clients': [$CLIENT...] }, the other clients
+// registered in the room.
 //
-// Unexpected messages will cause the WebSocket connection to be closed.
+// The messages follow the version of the schema negotiated as a subprotocol, protocolV1 unless the client
+// offers another supported one.
+// Unexpected messages, and frames larger than MaxMessageBytes, will cause the WebSocket connection to be closed.
 func (c *Collider) wsHandler(ws *websocket.Conn) {
+	conn := &serialConn{Conn: ws, ser: c.serializerFor(ws), tenant: tenantSlotOf(ws.Request()),
+		version: protocolVersion(ws), connectedAt: time.Now(), remoteIP: c.realIP(ws.Request())}
+	c.addConn(conn)
+	if binaryFrames(conn.ser) {
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	ws.MaxPayloadBytes = c.maxMessageBytes()
+	defer c.releaseConn(conn)
+	stopKeepalive := func() {}
+	if act := activityOf(ws); c.PingInterval > 0 && act != nil {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			c.keepalive(conn, act, stop)
+		}()
+		// Waits for the pings to stop so that none is written while the connection closes.
+		stopKeepalive = func() {
+			close(stop)
+			<-done
+		}
+	}
 	var rid, cid string
 	var thisClient *client
 	registered := false
+	// reason is why the read loop ended, unless whoever closed the connection recorded another.
+	var reason DisconnectReason
+
+	var limiter *tokenBucket
+	if c.MessagesPerSecond > 0 {
+		limiter = newTokenBucket(c.MessagesPerSecond, c.MessageBurst, time.Now())
+	}
+
+	// The connection must register by registerBy, whatever frames it sends meanwhile; the deadline of a
+	// registered one is pushed back by each frame.
+	registerBy := time.Now().Add(c.readTimeout(false))
 
 	var msg wsClientMsg
 loop:
 	for {
-		err := ws.SetReadDeadline(time.Now().Add(time.Duration(wsReadTimeoutSec) * time.Second))
+		timeout := c.readTimeout(registered)
+		deadline := time.Now().Add(timeout)
+		if !registered {
+			deadline, timeout = registerBy, time.Until(registerBy)
+		}
+		err := ws.SetReadDeadline(deadline)
 		if err != nil {
-			c.wsError("ws.SetReadDeadline error: "+err.Error(), ws)
+			c.wsError("ws.SetReadDeadline error: "+err.Error(), conn)
+			reason = DisconnectError
 			break
 		}
 
-		fmt.Println("someone want send something")
+		c.debugf("someone want send something")
 
-		err = websocket.JSON.Receive(ws, &msg)
+		var data []byte
+		cancelWarning := c.warnIdle(conn, timeout)
+		err = websocket.Message.Receive(ws, &data)
+		cancelWarning()
+		if err == websocket.ErrFrameTooLarge {
+			c.wsErrorCode(errCodeMessageTooLarge, "Message too large", conn)
+			reason = DisconnectPolicy
+			break
+		}
 		if err != nil {
 			if err.Error() != "EOF" {
-				c.wsError("websocket.JSON.Receive error: "+err.Error(), ws)
+				c.wsError("websocket.Message.Receive error: "+err.Error(), conn)
+			}
+			if reason = readErrReason(err); reason == DisconnectIdleTimeout && !registered {
+				reason = DisconnectNeverRegistered
 			}
 			break
 		}
+		if thisClient != nil {
+			thisClient.onRead(len(data))
+			if c.overQuota(thisClient) {
+				c.wsErrorCode(errCodeOverQuota, "Session byte quota exceeded", conn)
+				reason = DisconnectPolicy
+				break
+			}
+		}
+		if jsonDepthExceeds(data, c.maxJSONDepth()) {
+			c.wsErrorCode(errCodeTooDeep, "Message nested too deeply", conn)
+			continue
+		}
+		m, err := conn.decode(data)
+		if err != nil {
+			c.wsError("Invalid message: "+err.Error(), conn)
+			reason = DisconnectPolicy
+			break
+		}
+		msg = *m
+		if jsonDepthExceeds([]byte(msg.Msg), c.maxJSONDepth()) {
+			c.wsErrorCode(errCodeTooDeep, "Message 'msg' nested too deeply", conn)
+			continue
+		}
 
-		log.Printf("%+v\n", msg)
+		c.debugf("%+v", msg)
+
+		if !c.commandEnabled(msg.Cmd) {
+			c.wsErrorCode(errCodeCommandDisabled, "Command disabled: "+msg.Cmd, conn)
+			continue
+		}
+		if err := c.authorize(thisClient, msg.Cmd, &msg); err == errMessageTimeout {
+			c.wsErrorCode(errCodeMessageTimeout, "Message processing timed out", conn)
+			if c.SlowMessages == SlowMessageClose {
+				reason = DisconnectPolicy
+				break
+			}
+			continue
+		} else if err != nil {
+			c.wsErrorCode(errCodePermissionDenied, "Permission denied: "+err.Error(), conn)
+			continue
+		}
+		if registered && c.isRoomMessage(msg.Cmd) && limiter != nil && !limiter.allow(time.Now()) {
+			c.wsErrorCode(errCodeRateLimited, "Connection message rate exceeded", conn)
+			continue
+		}
+		if registered && c.isRoomMessage(msg.Cmd) && conn.tenant != "" &&
+			!c.tenants.allowMessage(conn.tenant, c.tenantLimits(conn.tenant)) {
+			c.wsErrorCode(errCodeTenantRateLimited, "Tenant message rate exceeded", conn)
+			continue
+		}
+		if registered && c.isRoomMessage(msg.Cmd) && !c.roomTable.allowMessage(rid) {
+			c.wsErrorCode(errCodeRoomRateLimited, "Room message rate exceeded", conn)
+			continue
+		}
 
 		switch msg.Cmd {
 		case "register":
-			fmt.Println("cmd == register")
+			c.debugf("cmd == register")
 			if registered {
-				c.wsError("Duplicated register request", ws)
+				c.wsError("Duplicated register request", conn)
 				//break loop
 				continue
 			}
-			if msg.RoomID == "" || msg.ClientID == "" {
-				c.wsError("Invalid register request: missing 'clientid' or 'roomid'", ws)
+			// The client may fix the request and register again.
+			if msg.RoomID == "" && msg.ClientID == "" {
+				c.wsErrorCode(errCodeMissingIDs, "Invalid register request: missing 'roomid' and 'clientid'", conn)
+				continue
+			} else if msg.RoomID == "" {
+				c.wsErrorCode(errCodeMissingRoomID, "Invalid register request: missing 'roomid'", conn)
+				continue
+			} else if msg.ClientID == "" {
+				c.wsErrorCode(errCodeMissingClientID, "Invalid register request: missing 'clientid'", conn)
+				continue
+			}
+			if c.isStopping() {
+				c.wsErrorCode(errCodeShuttingDown, "Server is shutting down", conn)
+				reason = DisconnectShutdown
 				break loop
 			}
-			if err = c.roomTable.register(msg.RoomID, msg.ClientID, ws); err != nil {
-				c.wsError(err.Error(), ws)
-				log.Println("Register Error", err)
+			if c.Authenticate != nil {
+				if err = c.Authenticate(msg.RoomID, msg.ClientID, msg.Token); err != nil {
+					c.logger().Printf("Failed to authenticate client %s in room %s: %v", msg.ClientID, msg.RoomID, err)
+					c.wsErrorCode(errCodeAuthFailed, "Authentication failed", conn)
+					reason = DisconnectPolicy
+					break loop
+				}
+			}
+			if !c.moveTenant(conn, msg.RoomID) {
+				c.wsErrorCode(errCodeTenantLimit, "Too many connections for the tenant", conn)
+				reason = DisconnectPolicy
+				break loop
+			}
+			resumed := msg.ResumeToken != "" && c.roomTable.resume(msg.RoomID, msg.ClientID, msg.ResumeToken, conn)
+			if !resumed {
+				err = c.roomTable.register(msg.RoomID, msg.ClientID, conn)
+			}
+			if errors.Is(err, errTenantLimit) {
+				c.tenants.onRefused(conn.tenant)
+			}
+			if err != nil {
+				if errorCode(err) == "" {
+					c.logger().Println("Register Error", err)
+				}
+				c.wsErrorOf("", err, conn)
+				reason = DisconnectPolicy
 				break loop
 			}
 			registered, rid, cid = true, msg.RoomID, msg.ClientID
-			thisClient = registeredClients[cid]
+			releasePending(ws)
+			releaseAccepted(ws.Request())
+			c.roomTable.setCaps(rid, cid, msg.Caps)
+			c.roomTable.setRoomType(rid, msg.RoomType)
+			// Another connection may register the client ID in another room meanwhile.
+			thisClient = c.roomTable.clientOf(rid, cid)
 			c.dash.incrWs()
+			if token := c.roomTable.resumeTokenOf(rid, cid); c.IncludeInstanceID || token != "" {
+				m := wsServerMsg{Cmd: "registered", ResumeToken: token, Resumed: resumed}
+				if c.IncludeInstanceID {
+					m.Instance = c.InstanceID
+				}
+				send(thisClient, m)
+			}
 
-			defer c.roomTable.deregister(rid, cid)
+			defer c.roomTable.deregisterConn(rid, cid, conn)
 			break
 		case "send":
-			fmt.Println("Cmd == send")
+			c.debugf("Cmd == send")
 			if thisClient == nil {
 				continue
 			}
-			fmt.Println(msg.Msg)
+			c.debugf("%v", msg.Msg)
 			if !registered {
-				c.wsError("Client not registered", ws)
+				c.wsError("Client not registered", conn)
+				reason = DisconnectPolicy
 				break loop
 			}
 			if msg.Msg == "" {
-				c.wsError("Invalid send request: missing 'msg'", ws)
+				c.wsError("Invalid send request: missing 'msg'", conn)
+				reason = DisconnectPolicy
 				break loop
 			}
-			c.roomTable.send(rid, cid, "send", msg.Msg)
+			delivered, err := c.roomTable.deliver(rid, cid, "send", msg.Msg)
+			// The failed messages are reported by the error frames instead.
+			if err != nil {
+				c.wsErrorOf("", err, conn)
+			} else if msg.ID != "" {
+				send(conn, ackMsg{Cmd: "ack", ID: msg.ID, Delivered: delivered})
+			}
 			break
-		case "video_chat":
+		case "broadcast":
 			if thisClient == nil {
 				continue
 			}
-			log.Printf("Cmd == video_chat")
-			log.Printf("clientID == %s, Msg == %s, Destinatio == %s", msg.ClientID, msg.Msg, msg.To)
-			if msg.Msg != "" && msg.To != "" {
-				if err := thisClient.sendByID(msg.To, "video_chat", msg.Msg); err == nil {
-					log.Printf("%s want vodeo_chat to %s: %s", cid, msg.To, msg.Msg)
-				} else {
-					log.Printf(err.Error())
-					sendServerErr(ws, err.Error())
-				}
-			}
-
-		case "audio_chat":
-			if thisClient == nil {
+			if msg.Msg == "" {
+				c.wsError("Invalid broadcast request: missing 'msg'", conn)
 				continue
 			}
-			log.Printf("cmd == audio_chat")
-			log.Printf("clientID == %s, Msg == %s, Destinatio == %s", msg.ClientID, msg.Msg, msg.To)
-			if msg.Msg != "" && msg.To != "" {
-				if err := thisClient.sendByID(msg.To, "audio_chat", msg.Msg); err == nil {
-					log.Printf("%s want audio_chat to %s: %s", cid, msg.To, msg.Msg)
-				} else {
-					log.Printf(err.Error())
-					sendServerErr(ws, err.Error())
+			for _, to := range c.roomTable.otherClients(rid, cid) {
+				stored, err := false, errors.New("Peer does not support broadcast")
+				if c.routable(to, "broadcast") {
+					stored, err = thisClient.sendByID(to, "broadcast", msg.Msg)
+				}
+				// The message to a peer that is offline is stored for the offline delivery.
+				if err != nil && !stored {
+					c.logger().Printf("Failed to broadcast from %s to %s in room %s: %v", cid, to, rid, err)
+					closeOnWriteErr(c.logger(), conn, sendServerErr(conn, "Failed to broadcast to "+to+": "+err.Error()))
 				}
 			}
-
-		case "chat":
+		case "receipt":
 			if thisClient == nil {
 				continue
 			}
-			fmt.Println("cmd == chat:")
-			if msg.Msg != "" && msg.To != "" {
-				if err := thisClient.sendByID(msg.To, "chat", msg.Msg); err == nil {
-					log.Printf("%s want chat to %s: %s", cid, msg.To, msg.Msg)
-				} else {
-					log.Printf(err.Error())
-					sendServerErr(ws, err.Error())
-				}
+			if msg.ID == "" {
+				c.wsError("Invalid receipt request: missing 'id'", conn)
+				continue
 			}
+			if err := c.roomTable.sendReceipt(rid, cid, msg.To, msg.ID); err != nil {
+				c.wsErrorOf("Failed to route the receipt: ", err, conn)
+			}
+		case "list":
+			if !registered {
+				c.wsError("Client not registered", conn)
+				continue
+			}
+			send(conn, rosterMsg{Cmd: "roster", Clients: c.roomTable.peers(rid, cid)})
+		case "heartbeat":
+			// Receiving it already reset the read timeout.
 		case "leave":
-			fmt.Println(" ------------------>leave")
-			c.roomTable.deregister(rid, cid)
-			break
+			c.debugf(" ------------------>leave")
+			conn.closeFor(DisconnectEOF)
+			// The deferred deregisterConn finds the connection already deregistered and does nothing.
+			c.roomTable.deregisterConn(rid, cid, conn)
+			reason = DisconnectEOF
+			break loop
 		default:
-			fmt.Println(msg.Cmd)
-			c.wsError("Invalid message: unexpected 'cmd'", ws)
+			if c.isRelayCommand(msg.Cmd) {
+				if thisClient != nil {
+					c.relayDirect(conn, rid, thisClient, msg.Cmd, msg)
+				}
+				break
+			}
+			c.debugf("%v", msg.Cmd)
+			c.wsError("Invalid message: unexpected 'cmd'", conn)
 			break
 		}
 	}
+	stopKeepalive()
+	c.dash.onDisconnect(c.disconnectReason(conn, reason))
 	// This should be unnecessary but just be safe.
 	ws.Close()
 }
 
+// maxJSONDepth returns the maximum nesting depth of the incoming messages.
+func (c *Collider) maxJSONDepth() int {
+	if c.MaxJSONDepth > 0 {
+		return c.MaxJSONDepth
+	}
+	return defaultMaxJSONDepth
+}
+
+// maxMessageBytes returns the maximum size of the incoming frames.
+func (c *Collider) maxMessageBytes() int {
+	if c.MaxMessageBytes > 0 {
+		return c.MaxMessageBytes
+	}
+	return defaultMaxMessageBytes
+}
+
+// logger returns the Logger of the Collider, or the standard logger if it has none.
+func (c *Collider) logger() *log.Logger {
+	if c == nil || c.Logger == nil {
+		return log.Default()
+	}
+	return c.Logger
+}
+
+// debugf logs to the Logger if Debug is on.
+func (c *Collider) debugf(format string, v ...interface{}) {
+	if c != nil && c.Debug {
+		c.logger().Printf(format, v...)
+	}
+}
+
+// readTimeout returns the read timeout of a connection, depending on whether its client has registered.
+func (c *Collider) readTimeout(registered bool) time.Duration {
+	if !registered && c.UnregisteredReadTimeout > 0 {
+		return c.UnregisteredReadTimeout
+	}
+	timeout := time.Duration(wsReadTimeoutSec) * time.Second
+	if c.ReadTimeout > 0 {
+		timeout = c.ReadTimeout
+	}
+	if unregistered := time.Duration(unregisteredReadTimeoutSec) * time.Second; !registered && unregistered < timeout {
+		return unregistered
+	}
+	return timeout
+}
+
+// httpError answers with the status 500 and { 'result': 'ERROR', 'message': $MSG }, and counts the error.
 func (c *Collider) httpError(msg string, w http.ResponseWriter) {
+	c.httpErrorCode(http.StatusInternalServerError, msg, w)
+}
+
+// httpErrorCode is httpError with the status |status|.
+func (c *Collider) httpErrorCode(status int, msg string, w http.ResponseWriter) {
+	c.httpErrorResult(status, httpResult{Result: "ERROR", Message: msg}, w)
+}
+
+// httpErrorOf is httpError for |err|, prefixed by |msg|, including its error code if it has one and answering
+// with the status of the code.
+func (c *Collider) httpErrorOf(msg string, err error, w http.ResponseWriter) {
+	code := errorCode(err)
+	c.httpErrorResult(httpStatusOf(code), httpResult{Result: "ERROR", Message: msg + err.Error(), Code: code}, w)
+}
+
+// httpStatusOf returns the HTTP status of an error with the error code |code|, 500 if it has none.
+func httpStatusOf(code string) int {
+	switch code {
+	case errCodeRoomFull, errCodeClientIDTaken:
+		return http.StatusConflict
+	case errCodeRoomNotFound, errCodeClientNotFound:
+		return http.StatusNotFound
+	case errCodeRoomRemoved:
+		return http.StatusGone
+	case errCodeQueueFull:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// httpErrorResult answers with the status |status| and the error |res|, and counts the error.
+func (c *Collider) httpErrorResult(status int, res httpResult, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	send(w, res)
+	c.dash.onHttpErr(errors.New(res.Message))
+	c.events.publish(event{Type: evHttpError, Msg: res.Message})
+}
+
+// wsError notifies the client of the error. If the notification cannot be written, the connection is closed
+// so that the read loop ends and the client is deregistered; the write error is returned.
+func (c *Collider) wsError(msg string, ws io.Writer) error {
 	err := errors.New(msg)
-	http.Error(w, err.Error(), http.StatusInternalServerError)
-	c.dash.onHttpErr(err)
+	c.dash.onWsErr(err)
+	c.events.publish(event{Type: evWsError, Msg: msg})
+	return closeOnWriteErr(c.logger(), ws, sendServerErr(ws, msg))
 }
 
-func (c *Collider) wsError(msg string, ws *websocket.Conn) {
+// wsErrorCode is wsError with a machine-readable error code.
+func (c *Collider) wsErrorCode(code string, msg string, ws io.Writer) error {
 	err := errors.New(msg)
-	sendServerErr(ws, msg)
 	c.dash.onWsErr(err)
+	c.events.publish(event{Type: evWsError, Msg: msg})
+	return closeOnWriteErr(c.logger(), ws, sendServerErrCode(ws, code, msg))
+}
+
+// wsErrorOf notifies the client of |err|, prefixed by |msg|, with its error code if it has one.
+func (c *Collider) wsErrorOf(msg string, err error, ws io.Writer) error {
+	if code := errorCode(err); code != "" {
+		return c.wsErrorCode(code, msg+err.Error(), ws)
+	}
+	return c.wsError(msg+err.Error(), ws)
+}
+
+// closeOnWriteErr closes the connection if |err|, the error of a write to it, is not nil, logging it to |l|,
+// and returns |err|.
+func closeOnWriteErr(l *log.Logger, ws io.Writer, err error) error {
+	if err == nil {
+		return nil
+	}
+	l.Printf("Closing the connection after a failed write: %v", err)
+	closeFor(ws, DisconnectWriteFailure)
+	return err
+}
+
+// commandEnabled returns true if the command is in EnabledCommands, or if no list is configured.
+func (c *Collider) commandEnabled(cmd string) bool {
+	if c.EnabledCommands == nil || cmd == "register" {
+		return true
+	}
+	for _, e := range c.EnabledCommands {
+		if e == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize runs the Authorizer on the command, allowing everything if none is set.
+// It returns errMessageTimeout if the Authorizer takes longer than MessageTimeout, leaving it to finish
+// in the background on a copy of the message.
+func (c *Collider) authorize(cl *client, cmd string, msg *wsClientMsg) error {
+	if c.Authorizer == nil {
+		return nil
+	}
+	if c.MessageTimeout <= 0 {
+		return c.Authorizer(cl, cmd, msg)
+	}
+
+	m := *msg
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Authorizer(cl, cmd, &m)
+	}()
+	timer := time.NewTimer(c.MessageTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		*msg = m
+		return err
+	case <-timer.C:
+		c.logger().Printf("Processing the %q message took more than %v", cmd, c.MessageTimeout)
+		c.dash.onSlowMessage()
+		return errMessageTimeout
+	}
+}
+
+// isRoomMessage returns true if the command sends a message, counting against the rate limit of the room.
+func (c *Collider) isRoomMessage(cmd string) bool {
+	switch cmd {
+	case "send", "receipt", "broadcast":
+		return true
+	}
+	return c.isRelayCommand(cmd)
+}
+
+// relayCommands returns the commands relayed to the client 'to'.
+func (c *Collider) relayCommands() []string {
+	if c.RelayCommands != nil {
+		return c.RelayCommands
+	}
+	return defaultRelayCommands
+}
+
+// isRelayCommand returns true if the command is relayed to the client 'to'.
+func (c *Collider) isRelayCommand(cmd string) bool {
+	for _, r := range c.relayCommands() {
+		if r == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// overQuota returns true if the client has used up the session byte quota.
+func (c *Collider) overQuota(cl *client) bool {
+	if c.MaxSessionBytes <= 0 {
+		return false
+	}
+	in, out := cl.bytes()
+	return in+out > c.MaxSessionBytes
+}
+
+// checkRelayTarget returns false and notifies the client if StrictRelayTarget is set and |to| is not
+// another client in the room |rid|.
+func (c *Collider) checkRelayTarget(rid string, cid string, to string, ws io.Writer) bool {
+	if !c.StrictRelayTarget {
+		return true
+	}
+	if to == "" {
+		c.wsErrorCode(errCodeMissingTo, "Invalid relay request: missing 'to'", ws)
+		return false
+	}
+	if to == cid || !c.roomTable.hasClient(rid, to) {
+		c.wsErrorCode(errCodeInvalidTo, "Invalid relay request: "+to+" is not in the room", ws)
+		return false
+	}
+	return true
+}
+
+// relayDirect relays the message |msg| of the kind |kind| from |thisClient| in the room |rid| to the client
+// msg.To, telling the sender through |ws| why it was not relayed. The messages missing 'msg' or 'to' are dropped.
+func (c *Collider) relayDirect(ws io.Writer, rid string, thisClient *client, kind string, msg wsClientMsg) {
+	c.debugf("cmd == %s, Msg == %s, Destination == %s", kind, msg.Msg, msg.To)
+	if !c.checkRelayTarget(rid, thisClient.id, msg.To, ws) {
+		return
+	}
+	if msg.Msg == "" || msg.To == "" {
+		return
+	}
+	if !c.routable(msg.To, kind) {
+		c.wsErrorCode(errCodeUnsupportedByPeer, "Peer does not support "+kind, ws)
+	} else if _, err := thisClient.sendByID(msg.To, kind, msg.Msg); err == nil {
+		c.debugf("%s want %s to %s: %s", thisClient.id, kind, msg.To, msg.Msg)
+	} else {
+		c.relayError(ws, msg.To, err)
+	}
+}
+
+// relayError tells the sender that its message to |to| was not relayed, as { 'cmd': 'error', 'reason': $CODE,
+// 'to': $CLIENT } if |err| has an error code. The connection stays open unless the notice cannot be written.
+func (c *Collider) relayError(ws io.Writer, to string, err error) {
+	c.logger().Printf("Failed to relay to %s: %v", to, err)
+	if code := errorCode(err); code != "" {
+		closeOnWriteErr(c.logger(), ws, send(ws, relayErrorMsg{Cmd: "error", Reason: code, To: to, Error: err.Error()}))
+		return
+	}
+	closeOnWriteErr(c.logger(), ws, sendServerErr(ws, err.Error()))
+}
+
+// routable returns false if capabilities are enforced and the registered client |to| does not support |cmd|.
+func (c *Collider) routable(to string, cmd string) bool {
+	if !c.EnforceCapabilities {
+		return true
+	}
+	if other := c.roomTable.lookupClient(to); other != nil {
+		return other.supports(cmd)
+	}
+	return true
 }
 
 func (c *Collider) sendDeleteError(msg string, cid string) {
-	log.Printf("sendServerErr         --------")
-	if c_ := registeredClients[cid]; c_ != nil {
-		log.Printf("DELETE %s----------------------", cid)
-		sendServerErr(c_.rwc, msg)
+	c.debugf("sendServerErr         --------")
+	if c_ := c.roomTable.lookupClient(cid); c_ != nil {
+		c.debugf("DELETE %s----------------------", cid)
+		sendServerErr(c_.conn(), msg)
 	}
 
 }
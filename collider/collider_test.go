@@ -7,14 +7,24 @@ package collider
 
 import (
 	"golang.org/x/net/websocket"
+	"collidertest"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,15 +36,28 @@ var cl *Collider
 
 var port = flag.Int("port", 8089, "The port that Collider listens to")
 
+const adminToken = "secret"
+
 func startCollider() {
 	serverAddr = "localhost:" + strconv.Itoa(*port)
 
 	cl = &Collider{
-		roomTable: newRoomTable(registerTimeout, "http://"+serverAddr),
-		dash:      newDashboard(),
+		roomTable:  newRoomTable(registerTimeout, "http://"+serverAddr),
+		dash:       newDashboard(),
+		events:     newEventBus(),
+		AdminToken: adminToken,
 	}
+	cl.roomTable.parent = cl
 
 	go cl.Run(*port, false)
+	// Waits for the listener to come up before the first test dials it.
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", serverAddr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 	fmt.Println("Test WebSocket server listening on ", serverAddr)
 }
 
@@ -51,13 +74,19 @@ func newConfig(t *testing.T, path string) *websocket.Config {
 func setup() {
 	once.Do(startCollider)
 	cl.roomTable = newRoomTable(registerTimeout, "http://"+serverAddr)
+	cl.roomTable.parent = cl
 }
 
-func addWsClient(t *testing.T, roomID string, clientID string) *websocket.Conn {
+func dial(t *testing.T) net.Conn {
 	c, err := net.Dial("tcp", serverAddr)
 	if err != nil {
 		t.Fatalf("net.Dial(tcp, %q) got error: %s, want nil", serverAddr, err.Error())
 	}
+	return c
+}
+
+func addWsClient(t *testing.T, roomID string, clientID string) *websocket.Conn {
+	c := dial(t)
 	config := newConfig(t, "/ws")
 	conn, err := websocket.NewClient(config, c)
 	if err != nil {
@@ -145,8 +174,8 @@ func expectReceiveError(t *testing.T, conn *websocket.Conn) {
 }
 
 func waitForCondition(f func() bool) bool {
-	for i := 0; i < 10 && !f(); i++ {
-		time.Sleep(1000)
+	for i := 0; i < 100 && !f(); i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
 	return f()
 }
@@ -219,14 +248,14 @@ func TestHttpHandlerSendCached(t *testing.T) {
 	m := "hello!"
 	rid, src, dest := "abc", "456", "123"
 	postSend(t, rid, src, m)
-	if !waitForCondition(func() bool { return cl.roomTable.rooms[rid] != nil }) {
-		t.Errorf("After a POST request to the room %q, cl.roomTable.rooms[%q] = nil, want non-nil", rid, rid)
+	if !waitForCondition(func() bool { return cl.roomTable.lookupRoom(rid) != nil }) {
+		t.Errorf("After a POST request to the room %q, cl.roomTable.lookupRoom(%q) = nil, want non-nil", rid, rid)
 	}
 
 	c := addWsClient(t, rid, dest)
 	expectReceiveMessage(t, c, m)
-	if !waitForCondition(func() bool { return len(cl.roomTable.rooms[rid].clients[src].msgs) == 0 }) {
-		t.Errorf("After a POST request from the room %q from client %q and registering client %q, cl.roomTable.rooms[%q].clients[%q].msgs = %v, want emtpy", rid, src, dest, rid, src, cl.roomTable.rooms[rid].clients[src].msgs)
+	if !waitForCondition(func() bool { return len(cl.roomTable.lookupRoom(rid).clients[src].msgs) == 0 }) {
+		t.Errorf("After a POST request from the room %q from client %q and registering client %q, cl.roomTable.lookupRoom(%q).clients[%q].msgs = %v, want emtpy", rid, src, dest, rid, src, cl.roomTable.lookupRoom(rid).clients[src].msgs)
 	}
 
 	c.Close()
@@ -239,15 +268,15 @@ func TestHttpHandlerDeleteConnection(t *testing.T) {
 	c := addWsClient(t, rid, cid)
 
 	// Waits until the server has registered the client.
-	if !waitForCondition(func() bool { return cl.roomTable.rooms[rid] != nil }) {
-		t.Errorf("After registering client %q in room %q, cl.roomTable.rooms[%q] = nil, want non-nil", cid, rid, rid)
+	if !waitForCondition(func() bool { return cl.roomTable.lookupRoom(rid) != nil }) {
+		t.Errorf("After registering client %q in room %q, cl.roomTable.lookupRoom(%q) = nil, want non-nil", cid, rid, rid)
 	}
 
 	// Deletes the client.
 	postDel(t, rid, cid)
 	expectConnectionClose(t, c)
-	if !waitForCondition(func() bool { return len(cl.roomTable.rooms) == 0 }) {
-		t.Errorf("After deleting client %q from room %q, cl.roomTable.rooms = %v, want empty", cid, rid, cl.roomTable.rooms)
+	if !waitForCondition(func() bool { return cl.roomTable.roomCount() == 0 }) {
+		t.Errorf("After deleting client %q from room %q, cl.roomTable.roomCount() = %d, want 0", cid, rid, cl.roomTable.roomCount())
 	}
 }
 
@@ -257,13 +286,13 @@ func TestRoomCleanedUpAfterTimeout(t *testing.T) {
 	// Sends a POST request to create a new and unregistered client.
 	r, c := "abc", "1"
 	postSend(t, r, c, "hi")
-	if !waitForCondition(func() bool { return cl.roomTable.rooms[r] != nil }) {
-		t.Errorf("After a POST request to the room %q, cl.roomTable.rooms[%q] = nil, want non-nil", r, r)
+	if !waitForCondition(func() bool { return cl.roomTable.lookupRoom(r) != nil }) {
+		t.Errorf("After a POST request to the room %q, cl.roomTable.lookupRoom(%q) = nil, want non-nil", r, r)
 	}
 	time.Sleep(registerTimeout + time.Second)
 
-	if l := len(cl.roomTable.rooms); l != 0 {
-		t.Errorf("After timeout without registering the new client, len(cl.roomTable.rooms) = %d, want 0", l)
+	if l := cl.roomTable.roomCount(); l != 0 {
+		t.Errorf("After timeout without registering the new client, cl.roomTable.roomCount() = %d, want 0", l)
 	}
 }
 
@@ -288,8 +317,8 @@ func TestDeregisteredClientNotRemovedUntilTimeout(t *testing.T) {
 
 	// Checks that the client and room are removed after the timeout.
 	time.Sleep(registerTimeout + time.Second)
-	if l := len(cl.roomTable.rooms); l != 0 {
-		t.Errorf("After timeout without re-registering the new client, len(cl.roomTable.rooms) = %d, want 0", l)
+	if l := cl.roomTable.roomCount(); l != 0 {
+		t.Errorf("After timeout without re-registering the new client, cl.roomTable.roomCount() = %d, want 0", l)
 	}
 }
 
@@ -325,3 +354,2231 @@ func TestReregisterClientBeforeTimeout(t *testing.T) {
 		t.Errorf("After addWsClient() again, client.timer = %v, want nil", c.timer)
 	}
 }
+
+func addAdminEventsClient(t *testing.T, token string) (*websocket.Conn, error) {
+	return websocket.NewClient(newConfig(t, "/admin/events?token="+token), dial(t))
+}
+
+// Tests that the lifecycle events are streamed to an admin subscriber, filtered by room.
+func TestAdminEventsStream(t *testing.T) {
+	setup()
+	admin, err := addAdminEventsClient(t, adminToken)
+	if err != nil {
+		t.Fatalf("addAdminEventsClient(t, %q) got error: %v, want nil", adminToken, err)
+	}
+	defer admin.Close()
+
+	rid, cid := "events", "1"
+	write(t, admin, adminSubscribeMsg{RoomID: rid})
+	// Gives the server a chance to apply the filter before the events are triggered.
+	time.Sleep(100 * time.Millisecond)
+
+	c := addWsClient(t, "other", "2")
+	c.Close()
+	c = addWsClient(t, rid, cid)
+	defer c.Close()
+
+	admin.SetReadDeadline(time.Now().Add(5 * time.Second))
+	want := []string{evRoomCreated, evClientRegistered}
+	for _, w := range want {
+		var e event
+		if err := websocket.JSON.Receive(admin, &e); err != nil {
+			t.Fatalf("websocket.JSON.Receive(admin) got error: %v, want nil", err)
+		}
+		if e.Type != w || e.RoomID != rid {
+			t.Errorf("Admin event = %+v, want type %q in room %q", e, w, rid)
+		}
+	}
+}
+
+// Tests that the admin event stream rejects a request without the admin token.
+func TestAdminEventsUnauthorized(t *testing.T) {
+	setup()
+	if admin, err := addAdminEventsClient(t, "wrong"); err == nil {
+		admin.Close()
+		t.Errorf("addAdminEventsClient(t, %q) got no error, want error", "wrong")
+	}
+}
+
+func adminGet(t *testing.T, path string) *http.Response {
+	urlstr := "http://" + serverAddr + path
+	req, err := http.NewRequest("GET", urlstr, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(GET, %q, nil) got error: %v, want nil", urlstr, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Client.Do(%v) got error: %v", req, err)
+	}
+	return resp
+}
+
+// Tests that a client exceeding the session byte quota gets an OVER_QUOTA error and is disconnected.
+func TestWsSessionByteQuota(t *testing.T) {
+	setup()
+	cl.MaxSessionBytes = 200
+	defer func() { cl.MaxSessionBytes = 0 }()
+
+	c := addWsClient(t, "quota", "1")
+	m := wsClientMsg{Cmd: "send", Msg: strings.Repeat("x", 64)}
+	for i := 0; i < 4; i++ {
+		write(t, c, m)
+	}
+
+	var sm wsServerMsg
+	if err := websocket.JSON.Receive(c, &sm); err != nil {
+		t.Fatalf("websocket.JSON.Receive(c) got error: %v, want nil", err)
+	}
+	if sm.Code != errCodeOverQuota {
+		t.Errorf("After exceeding the byte quota, got %+v, want code %q", sm, errCodeOverQuota)
+	}
+	expectConnectionClose(t, c)
+}
+
+// Tests that the admin room detail reports the bytes sent and received by each client.
+func TestAdminRoomDetailBytes(t *testing.T) {
+	setup()
+	rid := "detail"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	m := wsClientMsg{Cmd: "send", Msg: "hello"}
+	write(t, c1, m)
+	expectReceiveMessage(t, c2, m.Msg)
+
+	resp := adminGet(t, "/admin/rooms/"+rid)
+	defer resp.Body.Close()
+	var d roomDetail
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		t.Fatalf("Decoding the admin room detail got error: %v, want nil", err)
+	}
+	if len(d.Clients) != 2 {
+		t.Fatalf("Admin room detail clients = %+v, want 2 clients", d.Clients)
+	}
+	if d.Clients[0].BytesIn == 0 {
+		t.Errorf("Admin room detail for the sender = %+v, want non-zero bytesin", d.Clients[0])
+	}
+	if d.Clients[1].BytesOut == 0 {
+		t.Errorf("Admin room detail for the receiver = %+v, want non-zero bytesout", d.Clients[1])
+	}
+
+	resp, err := http.Get("http://" + serverAddr + "/admin/rooms/" + rid)
+	if err != nil {
+		t.Fatalf("http.Get got error: %v, want nil", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Admin room detail without the token returned status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+// Tests that the instance ID is sent in the HTTP headers and the registered frame when enabled.
+func TestInstanceID(t *testing.T) {
+	setup()
+	cl.IncludeInstanceID, cl.InstanceID = true, "instance-1"
+	defer func() { cl.IncludeInstanceID = false }()
+
+	resp, err := http.Get("http://" + serverAddr + "/status")
+	if err != nil {
+		t.Fatalf("http.Get(/status) got error: %v, want nil", err)
+	}
+	resp.Body.Close()
+	if h := resp.Header.Get("X-Collider-Instance"); h != cl.InstanceID {
+		t.Errorf("X-Collider-Instance = %q, want %q", h, cl.InstanceID)
+	}
+
+	c := addWsClient(t, "instance", "1")
+	defer c.Close()
+	var m wsServerMsg
+	if err := websocket.JSON.Receive(c, &m); err != nil {
+		t.Fatalf("websocket.JSON.Receive(c) got error: %v, want nil", err)
+	}
+	if m.Cmd != "registered" || m.Instance != cl.InstanceID {
+		t.Errorf("After registering, got %+v, want a registered frame with instance %q", m, cl.InstanceID)
+	}
+}
+
+// Tests that a direct relay is rejected when the peer declared capabilities without the relayed command.
+func TestWsRelayRespectsCapabilities(t *testing.T) {
+	setup()
+	cl.EnforceCapabilities = true
+	defer func() { cl.EnforceCapabilities = false }()
+
+	rid := "caps"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	// Registers the audio-only peer.
+	c2, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer c2.Close()
+	write(t, c2, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "2", Caps: []string{"chat", "audio_chat"}})
+	if !waitForCondition(func() bool { return cl.roomTable.lookupClient("2") != nil }) {
+		t.Fatal("The audio-only peer did not register")
+	}
+
+	write(t, c1, wsClientMsg{Cmd: "video_chat", To: "2", Msg: "offer"})
+	var m wsServerMsg
+	if err := websocket.JSON.Receive(c1, &m); err != nil {
+		t.Fatalf("websocket.JSON.Receive(c1) got error: %v, want nil", err)
+	}
+	if m.Code != errCodeUnsupportedByPeer {
+		t.Errorf("After relaying video_chat to an audio-only peer, got %+v, want code %q", m, errCodeUnsupportedByPeer)
+	}
+
+	write(t, c1, wsClientMsg{Cmd: "audio_chat", To: "2", Msg: "offer"})
+	expectReceiveMessage(t, c2, "offer")
+}
+
+// expectRelayError reads the notice that the message to |to| was not relayed for the reason |reason|.
+func expectRelayError(t *testing.T, conn *websocket.Conn, reason string, to string) {
+	var m relayErrorMsg
+	if err := json.Unmarshal([]byte(read(t, conn)), &m); err != nil {
+		t.Fatalf("Decoding the relay error got error: %v, want nil", err)
+	}
+	if m.Cmd != "error" || m.Reason != reason || m.To != to {
+		t.Errorf("Received %+v, want the error %s for %s", m, reason, to)
+	}
+}
+
+// Tests that a chat to an unknown client, or to a client of the room that is not connected, is answered with the
+// reason it was not relayed, and that the sender stays connected.
+func TestWsChatToMissingPeer(t *testing.T) {
+	setup()
+	// The client IDs are unique since the messages stored for the offline delivery outlive the test.
+	rid := "chat-missing"
+	c1 := addWsClient(t, rid, rid+"-1")
+	defer c1.Close()
+	// Client 2 is in the room, from a message sent over HTTP, but never registers.
+	cl.roomTable.send(rid, rid+"-2", "send", "hi")
+	expectReceiveMessage(t, c1, "hi")
+
+	write(t, c1, wsClientMsg{Cmd: "chat", To: rid + "-nobody", Msg: "hello"})
+	expectRelayError(t, c1, errCodeClientNotFound, rid+"-nobody")
+	write(t, c1, wsClientMsg{Cmd: "video_chat", To: rid + "-2", Msg: "offer"})
+	expectRelayError(t, c1, errCodePeerOffline, rid+"-2")
+
+	c3 := addWsClient(t, rid+"-other", rid+"-3")
+	defer c3.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid+"-other", rid+"-3") })
+	write(t, c1, wsClientMsg{Cmd: "chat", To: rid + "-3", Msg: "still connected"})
+	expectReceiveMessage(t, c3, "still connected")
+}
+
+// Tests that each kind of direct message is relayed to the target client with its kind and sender.
+func TestWsRelayDirectKinds(t *testing.T) {
+	setup()
+	rid := "relay-direct"
+	c1 := addWsClient(t, rid, rid+"-1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, rid+"-2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, rid+"-2") })
+
+	for _, kind := range []string{"chat", "video_chat", "audio_chat"} {
+		write(t, c1, wsClientMsg{Cmd: kind, To: rid + "-2", Msg: kind + " to 2"})
+		var m wsServerMsg
+		if err := json.Unmarshal([]byte(read(t, c2)), &m); err != nil {
+			t.Fatalf("Decoding the %s message got error: %v, want nil", kind, err)
+		}
+		if m.Cmd != kind || m.From != rid+"-1" || m.Msg != kind+" to 2" {
+			t.Errorf("Client 2 received %+v, want the %s message from %s", m, kind, rid+"-1")
+		}
+	}
+	// The direct messages are not echoed to the sender.
+	write(t, c2, wsClientMsg{Cmd: "chat", To: rid + "-1", Msg: "to 1"})
+	expectReceiveMessage(t, c1, "to 1")
+}
+
+// Tests that a command in RelayCommands is relayed to the target client, and that a built-in kind left out of
+// the list is rejected as an unexpected command.
+func TestWsRelayCommands(t *testing.T) {
+	setup()
+	cl.RelayCommands = []string{"screenshare", "video_chat"}
+	defer func() { cl.RelayCommands = nil }()
+	rid := "relay-commands"
+	c1 := addWsClient(t, rid, rid+"-1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, rid+"-2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, rid+"-2") })
+
+	write(t, c1, wsClientMsg{Cmd: "screenshare", To: rid + "-2", Msg: "stream"})
+	var m wsServerMsg
+	if err := json.Unmarshal([]byte(read(t, c2)), &m); err != nil {
+		t.Fatalf("Decoding the screenshare message got error: %v, want nil", err)
+	}
+	if m.Cmd != "screenshare" || m.From != rid+"-1" || m.Msg != "stream" {
+		t.Errorf("Client 2 received %+v, want the screenshare message from %s", m, rid+"-1")
+	}
+
+	write(t, c1, wsClientMsg{Cmd: "chat", To: rid + "-2", Msg: "hi"})
+	expectReceiveError(t, c1)
+	// The connection stays open.
+	write(t, c1, wsClientMsg{Cmd: "video_chat", To: rid + "-2", Msg: "offer"})
+	expectReceiveMessage(t, c2, "offer")
+}
+
+// gatedReadWriteCloser blocks every Write until a value is sent on release.
+type gatedReadWriteCloser struct {
+	collidertest.MockReadWriteCloser
+	release chan bool
+}
+
+func (g *gatedReadWriteCloser) Write(p []byte) (int, error) {
+	<-g.release
+	return len(p), nil
+}
+
+// Tests that Stop waits for the in-flight writes, which the drain report shows decreasing.
+func TestStopDrainsInFlight(t *testing.T) {
+	c := createNewCollider()
+	rwc := &gatedReadWriteCloser{release: make(chan bool)}
+	if err := c.roomTable.register("drain", "dst", rwc); err != nil {
+		t.Fatalf("roomTable.register got error: %v, want nil", err)
+	}
+	defer c.roomTable.remove("drain", "dst")
+
+	n := 3
+	// The sender looks up the receiver in the registered clients of its room table.
+	src, _ := c.roomTable.room("drain").client("src")
+	for i := 0; i < n; i++ {
+		go src.sendByID("dst", "chat", "hi")
+	}
+	if !waitForCondition(func() bool { return c.drainReport().InFlight == n }) {
+		t.Fatalf("drainReport().InFlight = %d, want %d", c.drainReport().InFlight, n)
+	}
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- c.Stop(ctx)
+	}()
+	for i := n - 1; i >= 0; i-- {
+		rwc.release <- true
+		if !waitForCondition(func() bool { return c.drainReport().InFlight == i }) {
+			t.Errorf("After releasing a write, drainReport().InFlight = %d, want %d", c.drainReport().InFlight, i)
+		}
+		if !c.drainReport().Stopping {
+			t.Error("drainReport().Stopping = false while stopping, want true")
+		}
+	}
+	// Lets the shutdown error through to the client.
+	close(rwc.release)
+
+	if err := <-done; err != nil {
+		t.Errorf("Stop() got error: %v, want nil", err)
+	}
+}
+
+// Tests that Stop gives up at the context deadline if the writes do not drain.
+func TestStopHonorsDeadline(t *testing.T) {
+	c := createNewCollider()
+	rwc := &gatedReadWriteCloser{release: make(chan bool)}
+	c.roomTable.register("stuck", "dst", rwc)
+	src, _ := c.roomTable.room("stuck").client("src")
+	go src.sendByID("dst", "chat", "hi")
+	if !waitForCondition(func() bool { return c.drainReport().InFlight == 1 }) {
+		t.Fatal("The write did not start")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Stop() with a stuck write got error: %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Lets the write through, after which Stop disconnects the client.
+	close(rwc.release)
+}
+
+// Tests that Stop shuts the server down within the deadline and disconnects with a SHUTTING_DOWN error the
+// registered clients, including those of a client ID registered in two rooms, and the connections yet to
+// register.
+func TestStopClosesConnections(t *testing.T) {
+	c := createNewCollider()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error: %v, want nil", err)
+	}
+	c.server = &http.Server{Handler: websocket.Handler(c.wsHandler)}
+	served := make(chan error)
+	go func() { served <- c.server.Serve(ln) }()
+
+	wsaddr := "ws://" + ln.Addr().String() + "/ws"
+	registered, err := websocket.Dial(wsaddr, "", "http://localhost")
+	if err != nil {
+		t.Fatalf("websocket.Dial(%q) got error: %v, want nil", wsaddr, err)
+	}
+	defer registered.Close()
+	other, err := websocket.Dial(wsaddr, "", "http://localhost")
+	if err != nil {
+		t.Fatalf("websocket.Dial(%q) got error: %v, want nil", wsaddr, err)
+	}
+	defer other.Close()
+	late, err := websocket.Dial(wsaddr, "", "http://localhost")
+	if err != nil {
+		t.Fatalf("websocket.Dial(%q) got error: %v, want nil", wsaddr, err)
+	}
+	defer late.Close()
+	write(t, registered, wsClientMsg{Cmd: "register", RoomID: "stop", ClientID: "1"})
+	write(t, other, wsClientMsg{Cmd: "register", RoomID: "stop-other", ClientID: "1"})
+	if !waitForCondition(func() bool {
+		return c.roomTable.isRegistered("stop", "1") && c.roomTable.isRegistered("stop-other", "1")
+	}) {
+		t.Fatal("The client did not register in both rooms")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		t.Errorf("Stop() got error: %v, want nil", err)
+	}
+	// Run treats http.ErrServerClosed as a clean exit rather than a fatal error.
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Serve() after Stop() got error: %v, want %v", err, http.ErrServerClosed)
+	}
+	for _, conn := range []*websocket.Conn{registered, other, late} {
+		expectReceiveErrorCode(t, conn, errCodeShuttingDown)
+		expectConnectionClose(t, conn)
+	}
+}
+
+func expectReceiveErrorCode(t *testing.T, conn *websocket.Conn, code string) {
+	var m wsServerMsg
+	if err := websocket.JSON.Receive(conn, &m); err != nil {
+		t.Fatalf("websocket.JSON.Receive(conn) got error: %v, want nil", err)
+	}
+	if m.Code != code {
+		t.Errorf("Received %+v, want error code %q", m, code)
+	}
+}
+
+// Tests that with StrictRelayTarget, relays with an empty or unknown 'to' are answered with an error
+// and the connection stays usable.
+func TestWsStrictRelayTarget(t *testing.T) {
+	setup()
+	cl.StrictRelayTarget = true
+	defer func() { cl.StrictRelayTarget = false }()
+
+	rid := "strict"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	write(t, c1, wsClientMsg{Cmd: "chat", Msg: "hi"})
+	expectReceiveErrorCode(t, c1, errCodeMissingTo)
+
+	write(t, c1, wsClientMsg{Cmd: "chat", To: "nobody", Msg: "hi"})
+	expectReceiveErrorCode(t, c1, errCodeInvalidTo)
+
+	write(t, c1, wsClientMsg{Cmd: "chat", To: "2", Msg: "hi"})
+	expectReceiveMessage(t, c2, "hi")
+}
+
+// Tests that GET / returns 200 with the landing page instead of an invalid path error.
+func TestHttpLandingPage(t *testing.T) {
+	setup()
+	defer func() { cl.LandingPage = "" }()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + serverAddr + path)
+		if err != nil {
+			t.Fatalf("http.Get(%q) got error: %v, want nil", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("/"); code != http.StatusOK || body != "OK\n" {
+		t.Errorf("GET / = %d %q, want %d %q", code, body, http.StatusOK, "OK\n")
+	}
+
+	cl.LandingPage = "collider"
+	if code, body := get("/"); code != http.StatusOK || body != "collider" {
+		t.Errorf("With LandingPage set, GET / = %d %q, want %d %q", code, body, http.StatusOK, "collider")
+	}
+
+	if code, _ := get("/room/"); code != http.StatusBadRequest {
+		t.Errorf("GET /room/ = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// Tests that the room and client operations answer with a JSON result, the errors with a meaningful status.
+func TestHttpJSONResults(t *testing.T) {
+	c := createNewCollider()
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		status  int
+		want    httpResult
+	}{
+		{c.httpHandler, "POST", "/room/1", "hi", http.StatusOK, httpResult{Result: "SUCCESS"}},
+		{c.httpHandler, "POST", "/room/1", "", http.StatusBadRequest, httpResult{Result: "ERROR", Message: "Empty request body"}},
+		{c.httpHandler, "POST", "/room/", "hi", http.StatusBadRequest, httpResult{Result: "ERROR", Message: "Invalid path: /room/"}},
+		{c.httpHandler, "DELETE", "/room/1", "", http.StatusOK, httpResult{Result: "SUCCESS"}},
+		{c.httpHandler, "DELETE", "/room/ALL", "", http.StatusOK, httpResult{Result: "SUCCESS"}},
+		{c.httpDeregister, "POST", "/room/1", "", http.StatusBadRequest, httpResult{Result: "ERROR", Message: "Invalid path: /room/1"}},
+		{c.httpDeregister, "POST", "/", "", http.StatusBadRequest, httpResult{Result: "ERROR", Message: "Invalid path: /"}},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		var got httpResult
+		dec := json.NewDecoder(rec.Body)
+		if err := dec.Decode(&got); err != nil || dec.More() {
+			t.Errorf("%s %s got body error %v or trailing data, want a single JSON result", tc.method, tc.path, err)
+		}
+		if rec.Code != tc.status || got != tc.want {
+			t.Errorf("%s %s = %d %+v, want %d %+v", tc.method, tc.path, rec.Code, got, tc.status, tc.want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s got Content-Type %q, want application/json", tc.method, tc.path, ct)
+		}
+	}
+}
+
+// Tests that the Authorizer can deny a command for a client while allowing its other commands and
+// the same command for other clients.
+func TestWsAuthorizerDeniesCommand(t *testing.T) {
+	setup()
+	cl.Authorizer = func(c *client, cmd string, msg *wsClientMsg) error {
+		if c != nil && c.id == "1" && cmd == "chat" {
+			return errors.New("guests may not chat")
+		}
+		return nil
+	}
+	defer func() { cl.Authorizer = nil }()
+
+	rid := "authz"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	write(t, c1, wsClientMsg{Cmd: "chat", To: "2", Msg: "denied"})
+	expectReceiveErrorCode(t, c1, errCodePermissionDenied)
+
+	// The connection stays open and the other commands are still allowed.
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "allowed"})
+	expectReceiveMessage(t, c2, "allowed")
+
+	write(t, c2, wsClientMsg{Cmd: "chat", To: "1", Msg: "from host"})
+	expectReceiveMessage(t, c1, "from host")
+}
+
+// Tests that a register request with a bad token is rejected and closes the connection without registering the
+// client, and that one with a good token registers.
+func TestWsAuthenticate(t *testing.T) {
+	setup()
+	cl.Authenticate = func(rid string, cid string, token string) error {
+		if token != rid+"/"+cid {
+			return errors.New("bad token")
+		}
+		return nil
+	}
+	defer func() { cl.Authenticate = nil }()
+
+	rid := "authn"
+	conn, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer conn.Close()
+	write(t, conn, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "1", Token: "forged"})
+	expectReceiveErrorCode(t, conn, errCodeAuthFailed)
+	expectConnectionClose(t, conn)
+	if cl.roomTable.hasClient(rid, "1") {
+		t.Errorf("After a register with a bad token, client 1 is in room %s, want it never registered", rid)
+	}
+
+	good, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer good.Close()
+	write(t, good, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "2", Token: rid + "/2"})
+	if !waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") }) {
+		t.Errorf("After a register with a good token, client 2 is not registered in room %s, want registered", rid)
+	}
+}
+
+// Tests that handshakes are rejected with 503 once MaxPendingConns connections have not registered,
+// and accepted again once one of them registers.
+func TestWsMaxPendingConns(t *testing.T) {
+	setup()
+	// Connections left over by the other tests count too.
+	base := cl.pendingCount()
+	cl.MaxPendingConns = base + 2
+	defer func() { cl.MaxPendingConns = 0 }()
+
+	var pending []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		config := newConfig(t, "/ws")
+		conn, err := websocket.NewClient(config, dial(t))
+		if err != nil {
+			t.Fatalf("websocket.NewClient #%d got error: %v, want nil", i, err)
+		}
+		defer conn.Close()
+		pending = append(pending, conn)
+	}
+
+	config := newConfig(t, "/ws")
+	if conn, err := websocket.NewClient(config, dial(t)); err == nil {
+		conn.Close()
+		t.Fatalf("websocket.NewClient past MaxPendingConns got no error, want the handshake rejected")
+	}
+
+	write(t, pending[0], wsClientMsg{Cmd: "register", RoomID: "pending", ClientID: "1"})
+	if !waitForCondition(func() bool { return cl.pendingCount() < cl.MaxPendingConns }) {
+		t.Fatalf("After a register, pendingCount() = %d, want < %d", cl.pendingCount(), cl.MaxPendingConns)
+	}
+	conn, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient after a register got error: %v, want nil", err)
+	}
+	conn.Close()
+}
+
+// adminPost posts |body| to the admin endpoint at |path| with the admin token.
+func adminPost(t *testing.T, path string, body string) *http.Response {
+	urlstr := "http://" + serverAddr + path
+	req, err := http.NewRequest("POST", urlstr, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest(POST, %q, %q) got error: %v, want nil", urlstr, body, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Client.Do(%v) got error: %v", req, err)
+	}
+	return resp
+}
+
+// Tests that an admin can send to one connection among several sharing a client ID: the connections of two
+// rooms, and those of two devices of a client in one room, each of which gets only what is sent to it.
+func TestAdminSendToConn(t *testing.T) {
+	setup()
+	cl.DuplicateClients = DuplicateMultiDevice
+	defer func() { cl.DuplicateClients = "" }()
+	cid := "shared-conn"
+	ca := addWsClient(t, "conn-a", cid)
+	defer ca.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered("conn-a", cid) })
+	cb := addWsClient(t, "conn-b", cid)
+	defer cb.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered("conn-b", cid) })
+	cb2 := addWsClient(t, "conn-b", cid)
+	defer cb2.Close()
+
+	waitForCondition(func() bool { return len(cl.roomTable.clientConns(cid)) == 3 })
+	connIDs := func(rid string) []string {
+		s := cl.roomTable.shard(rid)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		var ids []string
+		for _, rwc := range s.rooms[rid].clients[cid].conns() {
+			ids = append(ids, connIDOf(rwc))
+		}
+		return ids
+	}
+	ida, idb := connIDs("conn-a"), connIDs("conn-b")
+	if len(ida) != 1 || len(idb) != 2 || ida[0] == "" || idb[0] == "" || idb[1] == "" || ida[0] == idb[0] ||
+		idb[0] == idb[1] || ida[0] == idb[1] {
+		t.Fatalf("The connection IDs are %q and %q, want one in conn-a and two in conn-b, distinct and non-empty", ida,
+			idb)
+	}
+
+	// The main connection of a client comes first, so idb[1] is the second device.
+	if resp := adminPost(t, "/admin/conns/"+idb[1], "to b2"); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /admin/conns/%s got status %d, want %d", idb[1], resp.StatusCode, http.StatusOK)
+	}
+	expectReceiveMessage(t, cb2, "to b2")
+	if resp := adminPost(t, "/admin/conns/"+idb[0], "to b"); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /admin/conns/%s got status %d, want %d", idb[0], resp.StatusCode, http.StatusOK)
+	}
+	if resp := adminPost(t, "/admin/conns/"+ida[0], "to a"); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /admin/conns/%s got status %d, want %d", ida[0], resp.StatusCode, http.StatusOK)
+	}
+	expectReceiveMessage(t, ca, "to a")
+	// Had the first device got "to b2" too, it would read it before "to b".
+	expectReceiveMessage(t, cb, "to b")
+
+	if resp := adminPost(t, "/admin/conns/nobody", "hi"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /admin/conns/nobody got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// Tests that /status answers in the format asked for by the Accept header.
+func TestHttpStatusContentNegotiation(t *testing.T) {
+	setup()
+	for _, tc := range []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"", "application/json", `"openws":`},
+		{"application/json", "application/json", `"openws":`},
+		{"text/plain", "text/plain; charset=utf-8", "open websockets: "},
+		{"text/prometheus", "text/plain; version=0.0.4; charset=utf-8", "# TYPE collider_open_websockets gauge\ncollider_open_websockets "},
+	} {
+		req, err := http.NewRequest("GET", "http://"+serverAddr+"/status", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(GET, /status, nil) got error: %v, want nil", err)
+		}
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /status with Accept %q got error: %v, want nil", tc.accept, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("GET /status with Accept %q got Content-Type %q, want %q", tc.accept, ct, tc.contentType)
+		}
+		if !strings.Contains(string(body), tc.body) {
+			t.Errorf("GET /status with Accept %q got body %q, want it to contain %q", tc.accept, body, tc.body)
+		}
+	}
+}
+
+// Tests that /metrics answers in the Prometheus exposition format without an Accept header, and counts the
+// clients in the rooms.
+func TestHttpMetrics(t *testing.T) {
+	setup()
+	rid := "metrics"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	resp, err := http.Get("http://" + serverAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics got error: %v, want nil", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != prometheusContentType {
+		t.Errorf("GET /metrics got Content-Type %q, want %q", ct, prometheusContentType)
+	}
+	for _, line := range []string{"# TYPE collider_clients gauge\ncollider_clients 2\n", "# TYPE collider_websockets_total counter\n"} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("GET /metrics got body %q, want it to contain %q", body, line)
+		}
+	}
+
+	resp, err = http.Post("http://"+serverAddr+"/metrics", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST /metrics got error: %v, want nil", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /metrics got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+// Tests that the room and client operations tolerate the leading, trailing and repeated slashes.
+func TestHttpPathSlashes(t *testing.T) {
+	c := createNewCollider()
+	for _, path := range []string{"/slash/1", "/slash/1/", "//slash//1"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("hi"))
+		req.URL.Path = path
+		rec := httptest.NewRecorder()
+		c.httpHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("POST %s got status %d, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+	if n := c.roomTable.roomSize("slash"); n != 1 {
+		t.Errorf("After the POSTs, room slash has %d clients, want 1", n)
+	}
+	for _, path := range []string{"/slash", "/slash/", "//slash//"} {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.URL.Path = path
+		rec := httptest.NewRecorder()
+		c.httpDeregister(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Deregistering %s got status %d, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+	if n := c.roomTable.roomSize("slash"); n != 0 {
+		t.Errorf("After deregistering, room slash has %d clients, want 0", n)
+	}
+}
+
+// Tests that a DELETE with queueOnly=true drops the messages queued by the client without removing it, so that
+// a peer registering later receives none of them.
+func TestHttpDeleteQueueOnly(t *testing.T) {
+	setup()
+	rid := "queue-only"
+	postSend(t, rid, "1", "first")
+	postSend(t, rid, "1", "second")
+
+	req, _ := http.NewRequest("DELETE", "http://"+serverAddr+"/"+rid+"/1?queueOnly=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /%s/1?queueOnly=true got error: %v, want nil", rid, err)
+	}
+	defer resp.Body.Close()
+	var res clearQueueResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Decoding the response to DELETE /%s/1?queueOnly=true got error: %v, want nil", rid, err)
+	}
+	if res.Result != "SUCCESS" || res.Dropped != 2 {
+		t.Errorf("DELETE /%s/1?queueOnly=true = %+v, want SUCCESS with 2 dropped", rid, res)
+	}
+	if n := cl.roomTable.roomSize(rid); n != 1 {
+		t.Errorf("After clearing its queue, room %s has %d clients, want 1", rid, n)
+	}
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+	postSend(t, rid, "1", "after")
+	// The first frame received is the message sent after the queue was cleared.
+	expectReceiveMessage(t, c2, "after")
+}
+
+// Tests that httpDeregister reports whether the room existed.
+func TestHttpDeregisterReportsRemoved(t *testing.T) {
+	c := createNewCollider()
+	c.roomTable.register("exists", "1", &collidertest.MockReadWriteCloser{Closed: false})
+	for _, tc := range []struct {
+		rid  string
+		want deregisterResult
+	}{
+		{"exists", deregisterResult{Removed: true, RoomID: "exists"}},
+		{"exists", deregisterResult{Removed: false, RoomID: "exists"}},
+		{"typo", deregisterResult{Removed: false, RoomID: "typo"}},
+	} {
+		rec := httptest.NewRecorder()
+		c.httpDeregister(rec, httptest.NewRequest("POST", "/"+tc.rid, nil))
+		var got deregisterResult
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("Decoding the response to POST /%s got error: %v, want nil", tc.rid, err)
+		}
+		if rec.Code != http.StatusOK || got != tc.want {
+			t.Errorf("POST /%s = %d %+v, want %d %+v", tc.rid, rec.Code, got, http.StatusOK, tc.want)
+		}
+	}
+	if c.roomTable.roomCount() != 0 {
+		t.Errorf("After POST /exists, roomTable has %d rooms, want 0", c.roomTable.roomCount())
+	}
+}
+
+// Tests that the HTTP handlers allow every origin when AllowedOrigins is empty, and otherwise echo back only
+// the allowed origins.
+func TestHttpAllowedOrigins(t *testing.T) {
+	c := createNewCollider()
+	handlers := map[string]http.HandlerFunc{
+		"/status": c.httpStatusHandler,
+		"/":       c.httpHandler,
+		"/rid":    c.httpDeregister,
+	}
+	for _, tc := range []struct {
+		allowed []string
+		origin  string
+		want    string
+	}{
+		{nil, "https://evil.example", "*"},
+		{[]string{"https://a.example", "https://b.example"}, "https://b.example", "https://b.example"},
+		{[]string{"https://a.example", "https://b.example"}, "https://evil.example", ""},
+		{[]string{"https://a.example", "https://b.example"}, "", ""},
+	} {
+		c.AllowedOrigins = tc.allowed
+		for path, h := range handlers {
+			req := httptest.NewRequest("GET", path, nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tc.want {
+				t.Errorf("%s from origin %q with AllowedOrigins %v got Access-Control-Allow-Origin %q, want %q",
+					path, tc.origin, tc.allowed, got, tc.want)
+			}
+		}
+	}
+}
+
+// Tests that a WebSocket handshake from an origin missing from AllowedOrigins is rejected before wsHandler runs,
+// and that one from an allowed origin is accepted.
+func TestWsAllowedOrigins(t *testing.T) {
+	setup()
+	cl.AllowedOrigins = []string{"http://localhost"}
+	defer func() { cl.AllowedOrigins = nil }()
+
+	seq := atomic.LoadUint64(&cl.connSeq)
+	config := newConfig(t, "/ws")
+	config.Origin, _ = url.Parse("http://evil.example")
+	if conn, err := websocket.NewClient(config, dial(t)); err != websocket.ErrBadStatus {
+		if err == nil {
+			conn.Close()
+		}
+		t.Fatalf("A handshake from http://evil.example got error: %v, want %v", err, websocket.ErrBadStatus)
+	}
+	if n := atomic.LoadUint64(&cl.connSeq); n != seq {
+		t.Errorf("After the rejected handshake, %d connections were handled, want none", n-seq)
+	}
+
+	conn, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("A handshake from http://localhost got error: %v, want nil", err)
+	}
+	conn.Close()
+}
+
+// Tests that the 'list' command answers the other registered clients of the room, excluding the sender, and an
+// empty array when the sender is alone.
+func TestWsList(t *testing.T) {
+	setup()
+	rid := "list"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+
+	write(t, c1, wsClientMsg{Cmd: "list"})
+	if got, want := read(t, c1), `{"cmd":"roster","clients":[]}`+"\n"; got != want {
+		t.Errorf("The roster of a client alone is %q, want %q", got, want)
+	}
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+	write(t, c2, wsClientMsg{Cmd: "list"})
+	var m rosterMsg
+	if err := json.Unmarshal([]byte(read(t, c2)), &m); err != nil {
+		t.Fatalf("Decoding the roster got error: %v, want nil", err)
+	}
+	if m.Cmd != "roster" || strings.Join(m.Clients, ",") != "1" {
+		t.Errorf("The roster of client 2 is %+v, want client 1 only", m)
+	}
+}
+
+// Tests that a broadcast reaches every other client of a room of three, and that one peer failing to get it is
+// reported to the sender without keeping it from the others.
+func TestWsBroadcast(t *testing.T) {
+	setup()
+	cl.MaxRoomCapacity = 3
+	defer func() { cl.MaxRoomCapacity, cl.EnforceCapabilities = 0, false }()
+
+	rid := "broadcast"
+	host := addWsClient(t, rid, "1")
+	defer host.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	c3 := addWsClient(t, rid, "3")
+	defer c3.Close()
+	waitForCondition(func() bool { return cl.roomTable.wsCount() == 3 })
+
+	write(t, host, wsClientMsg{Cmd: "broadcast", Msg: "mute all"})
+	for _, c := range []*websocket.Conn{c2, c3} {
+		var m wsServerMsg
+		if err := json.Unmarshal([]byte(read(t, c)), &m); err != nil {
+			t.Fatalf("Decoding the broadcast got error: %v, want nil", err)
+		}
+		if m.Cmd != "broadcast" || m.From != "1" || m.Msg != "mute all" {
+			t.Errorf("Received %+v, want the broadcast of 'mute all' from 1", m)
+		}
+	}
+
+	// Client 3 does not support broadcasts; client 2 still gets them.
+	cl.EnforceCapabilities = true
+	cl.roomTable.setCaps(rid, "3", []string{"send"})
+	write(t, host, wsClientMsg{Cmd: "broadcast", Msg: "unmute all"})
+	expectReceiveError(t, host)
+	expectReceiveMessage(t, c2, "unmute all")
+}
+
+// expectPresence reads a presence frame from the connection and checks its event and client ID.
+func expectPresence(t *testing.T, conn *websocket.Conn, ev string, cid string) {
+	var m presenceMsg
+	if err := json.Unmarshal([]byte(read(t, conn)), &m); err != nil {
+		t.Fatalf("Decoding the presence frame got error: %v, want nil", err)
+	}
+	if m != (presenceMsg{Cmd: "presence", Event: ev, ClientID: cid}) {
+		t.Errorf("Received %+v, want the presence event %s of client %s", m, ev, cid)
+	}
+}
+
+// Tests that a leave ends the connection and deregisters the client exactly once, so that the client
+// registering again right after stays registered.
+func TestWsLeaveDeregistersOnce(t *testing.T) {
+	setup()
+	var buf lockedBuffer
+	cl.Logger = log.New(&buf, "", 0)
+	defer func() { cl.Logger = nil }()
+
+	rid := "leave-once"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	write(t, c1, wsClientMsg{Cmd: "leave"})
+	expectConnectionClose(t, c1)
+	waitForCondition(func() bool { return !cl.roomTable.isRegistered(rid, "1") })
+	again := addWsClient(t, rid, "1")
+	defer again.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+
+	time.Sleep(50 * time.Millisecond)
+	if n := strings.Count(buf.String(), "Deregistered client 1 from room "+rid); n != 1 {
+		t.Errorf("Leaving deregistered client 1 %d times, want 1", n)
+	}
+	if !cl.roomTable.isRegistered(rid, "1") {
+		t.Error("The client registering again after leaving is not registered, want it registered")
+	}
+}
+
+// Tests that under Presence, the client of a room is told when its peer registers, and when it leaves or
+// disconnects.
+func TestWsPresence(t *testing.T) {
+	setup()
+	cl.Presence = true
+	defer func() { cl.Presence = false }()
+
+	rid := "presence"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+
+	c2 := addWsClient(t, rid, "2")
+	expectPresence(t, c1, presenceJoin, "2")
+	write(t, c2, wsClientMsg{Cmd: "leave"})
+	expectPresence(t, c1, presenceLeave, "2")
+	c2.Close()
+
+	c3 := addWsClient(t, rid, "2")
+	expectPresence(t, c1, presenceJoin, "2")
+	c3.Close()
+	expectPresence(t, c1, presenceLeave, "2")
+}
+
+// Tests that a client ID cannot register in more rooms than MaxRoomsPerClient at once.
+func TestWsMaxRoomsPerClient(t *testing.T) {
+	setup()
+	cl.MaxRoomsPerClient = 2
+	defer func() { cl.MaxRoomsPerClient = 0 }()
+
+	cid := "many-rooms"
+	for _, rid := range []string{"rooms-1", "rooms-2"} {
+		c := addWsClient(t, rid, cid)
+		defer c.Close()
+		if !waitForCondition(func() bool { return cl.roomTable.hasClient(rid, cid) }) {
+			t.Fatalf("Client %s did not register in room %s", cid, rid)
+		}
+	}
+
+	c := addWsClient(t, "rooms-3", cid)
+	defer c.Close()
+	expectReceiveErrorCode(t, c, errCodeTooManyRooms)
+	if cl.roomTable.hasClient("rooms-3", cid) {
+		t.Errorf("Client %s registered in a third room, want rejected", cid)
+	}
+}
+
+// Tests that closing a room through the admin endpoint disconnects its clients and is audited.
+func TestAdminCloseRoomAudited(t *testing.T) {
+	setup()
+	var lock sync.Mutex
+	var entries []AuditEntry
+	cl.Audit = func(e AuditEntry) {
+		lock.Lock()
+		defer lock.Unlock()
+		entries = append(entries, e)
+	}
+	defer func() { cl.Audit = nil }()
+
+	rid := "audited"
+	c := addWsClient(t, rid, "audited-1")
+	defer c.Close()
+	waitForCondition(func() bool { return cl.roomTable.hasClient(rid, "audited-1") })
+
+	req, _ := http.NewRequest("DELETE", "http://"+serverAddr+"/admin/rooms/"+rid, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /admin/rooms/%s got error: %v, want nil", rid, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("DELETE /admin/rooms/%s got status %d, want %d", rid, resp.StatusCode, http.StatusOK)
+	}
+	if cl.roomTable.hasClient(rid, "audited-1") {
+		t.Errorf("After closing room %s, its client is still there, want removed", rid)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(entries) != 1 {
+		t.Fatalf("Audited %v, want one entry", entries)
+	}
+	if e := entries[0]; e.Action != auditCloseRoom || e.RoomID != rid || e.Result != "ok" || !strings.HasPrefix(e.Actor, "admin:") {
+		t.Errorf("Audited %+v, want a successful close_room of %s by the admin", e, rid)
+	}
+}
+
+// Tests that the clients of a room are rejected with ROOM_RATE_LIMITED once they collectively exceed the
+// room's rate, even though each of them sends only a few messages.
+func TestWsRoomRateLimit(t *testing.T) {
+	setup()
+	cl.RoomMessagesPerSecond, cl.RoomMessageBurst = 0.01, 3
+	defer func() { cl.RoomMessagesPerSecond, cl.RoomMessageBurst = 0, 0 }()
+
+	rid := "room-rate"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "1"})
+	expectReceiveMessage(t, c2, "1")
+	write(t, c2, wsClientMsg{Cmd: "send", Msg: "2"})
+	expectReceiveMessage(t, c1, "2")
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "3"})
+	expectReceiveMessage(t, c2, "3")
+
+	write(t, c2, wsClientMsg{Cmd: "send", Msg: "4"})
+	expectReceiveErrorCode(t, c2, errCodeRoomRateLimited)
+
+	// Other rooms are not affected.
+	c3 := addWsClient(t, "room-rate-other", "3")
+	defer c3.Close()
+	c4 := addWsClient(t, "room-rate-other", "4")
+	defer c4.Close()
+	write(t, c3, wsClientMsg{Cmd: "send", Msg: "5"})
+	expectReceiveMessage(t, c4, "5")
+}
+
+// Tests that a connection sending faster than MessagesPerSecond has the excess messages dropped with
+// RATE_LIMITED and stays open, while a connection within the limit has all of its messages relayed.
+func TestWsConnRateLimit(t *testing.T) {
+	setup()
+	cl.MessagesPerSecond, cl.MessageBurst = 0.01, 2
+	defer func() { cl.MessagesPerSecond, cl.MessageBurst = 0, 0 }()
+
+	rid := "conn-rate"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	// c1 bursts past the limit.
+	for _, m := range []string{"1", "2", "3"} {
+		write(t, c1, wsClientMsg{Cmd: "send", Msg: m})
+	}
+	expectReceiveMessage(t, c2, "1")
+	expectReceiveMessage(t, c2, "2")
+	expectReceiveErrorCode(t, c1, errCodeRateLimited)
+
+	// c2 stays within its own limit, and c1 is still connected.
+	for _, m := range []string{"4", "5"} {
+		write(t, c2, wsClientMsg{Cmd: "send", Msg: m})
+		expectReceiveMessage(t, c1, m)
+	}
+}
+
+// Tests that the commands missing from EnabledCommands are rejected while the listed ones still work.
+func TestWsEnabledCommands(t *testing.T) {
+	setup()
+	cl.EnabledCommands = []string{"send", "leave"}
+	defer func() { cl.EnabledCommands = nil }()
+
+	rid := "enabled-cmds"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	write(t, c1, wsClientMsg{Cmd: "chat", To: "2", Msg: "hi"})
+	expectReceiveErrorCode(t, c1, errCodeCommandDisabled)
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "still works"})
+	expectReceiveMessage(t, c2, "still works")
+}
+
+// brokenConn is a connection whose writes always fail.
+type brokenConn struct {
+	closed bool
+}
+
+func (bc *brokenConn) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func (bc *brokenConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (bc *brokenConn) Close() error {
+	bc.closed = true
+	return nil
+}
+
+// Tests that failing to notify a client of an error closes its connection, so that its read loop ends and
+// the client is deregistered.
+func TestWsErrorClosesBrokenConnection(t *testing.T) {
+	c := &Collider{dash: newDashboard(), events: newEventBus()}
+	bc := &brokenConn{}
+	if err := c.wsError("Invalid message", bc); err == nil {
+		t.Errorf("wsError on a broken connection got nil, want the write error")
+	}
+	if !bc.closed {
+		t.Errorf("After wsError failed to write, the connection is open, want closed")
+	}
+
+	bc = &brokenConn{}
+	if err := c.wsErrorCode(errCodeInvalidTo, "Invalid relay request", bc); err == nil || !bc.closed {
+		t.Errorf("wsErrorCode on a broken connection got %v and closed = %t, want the write error and closed", err, bc.closed)
+	}
+
+	ok := &collidertest.MockReadWriteCloser{}
+	if err := c.wsError("Invalid message", ok); err != nil || ok.Closed {
+		t.Errorf("wsError on a working connection got %v and closed = %t, want nil and open", err, ok.Closed)
+	}
+
+	// The read loop of the closed connection then ends, deregistering the client, which disconnected alone in
+	// its room right after registering and is removed along with the room.
+	c = createNewCollider()
+	c.QuickDisconnectWindow = time.Minute
+	rid, cid := "broken-conn", "broken-conn-1"
+	bc = &brokenConn{}
+	if err := c.roomTable.register(rid, cid, bc); err != nil {
+		t.Fatalf("roomTable.register got error: %v, want nil", err)
+	}
+	c.wsError("Invalid message", bc)
+	c.roomTable.deregisterConn(rid, cid, bc)
+	if c.roomTable.lookupRoom(rid) != nil || c.roomTable.lookupClient(cid) != nil {
+		t.Errorf("After the broken connection was deregistered, room %s or client %s is left, want both removed",
+			rid, cid)
+	}
+}
+
+// Tests that the verbose admin room detail shows when each client was last active, and that it moves
+// forward when the client sends a message.
+func TestAdminRoomDetailLastActivity(t *testing.T) {
+	setup()
+	rid := "last-activity"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+
+	lastActivity := func(path string) *time.Time {
+		resp := adminGet(t, path)
+		defer resp.Body.Close()
+		var d roomDetail
+		if err := json.NewDecoder(resp.Body).Decode(&d); err != nil || len(d.Clients) != 2 {
+			t.Fatalf("Decoding GET %s got %+v, %v, want two clients", path, d, err)
+		}
+		return d.Clients[0].LastActivity
+	}
+
+	if a := lastActivity("/admin/rooms/" + rid); a != nil {
+		t.Errorf("The non-verbose detail has lastactivity %v, want none", a)
+	}
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "first"})
+	expectReceiveMessage(t, c2, "first")
+	before := lastActivity("/admin/rooms/" + rid + "?verbose=1")
+	if before == nil {
+		t.Fatalf("After sending, the verbose detail has no lastactivity for client 1, want one")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "second"})
+	expectReceiveMessage(t, c2, "second")
+	if after := lastActivity("/admin/rooms/" + rid + "?verbose=1"); after == nil || !after.After(*before) {
+		t.Errorf("After sending again, lastactivity is %v, want after %v", after, *before)
+	}
+}
+
+// Tests that the status filtered by room reports only that room, and answers 404 for a room that does not exist.
+func TestHttpStatusRoom(t *testing.T) {
+	c := createNewCollider()
+	rid := "status-room"
+	c.roomTable.send(rid, "1", "send", "hello")
+	c.roomTable.send(rid, "1", "send", "hi")
+
+	rec := httptest.NewRecorder()
+	c.httpStatusHandler(rec, httptest.NewRequest("GET", "/status?roomid="+rid, nil))
+	var st roomStatus
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatalf("Decoding /status?roomid=%s got error: %v, want nil", rid, err)
+	}
+	if st.RoomID != rid || st.Clients != 1 || st.Registered != 0 || st.QueuedMsgs != 2 || st.QueuedBytes != 7 ||
+		st.LastActivity.IsZero() {
+		t.Errorf("/status?roomid=%s = %+v, want 1 unregistered client with 2 messages of 7 bytes queued", rid, st)
+	}
+
+	rec = httptest.NewRecorder()
+	c.httpStatusHandler(rec, httptest.NewRequest("GET", "/status?roomid=nowhere", nil))
+	var res httpResult
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || rec.Code != http.StatusNotFound ||
+		res.Result != "ERROR" {
+		t.Errorf("/status?roomid=nowhere = %d %+v with error %v, want %d and an ERROR result", rec.Code, res, err,
+			http.StatusNotFound)
+	}
+}
+
+// Tests that the verbose status pages through the rooms.
+func TestHttpStatusRoomPages(t *testing.T) {
+	setup()
+	for i := 0; i < 3; i++ {
+		cl.roomTable.room("status-page-" + strconv.Itoa(i))
+	}
+
+	get := func(query string) verboseStatusReport {
+		resp, err := http.Get("http://" + serverAddr + "/status?verbose=1&" + query)
+		if err != nil {
+			t.Fatalf("http.Get(/status?verbose=1&%s) got error: %v, want nil", query, err)
+		}
+		defer resp.Body.Close()
+		var vr verboseStatusReport
+		if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+			t.Fatalf("Decoding /status?verbose=1&%s got error: %v, want nil", query, err)
+		}
+		return vr
+	}
+
+	seen := 0
+	offset := 0
+	for {
+		vr := get("limit=2&offset=" + strconv.Itoa(offset))
+		if len(vr.Rooms) > 2 {
+			t.Fatalf("A page of limit 2 has %d rooms", len(vr.Rooms))
+		}
+		for _, r := range vr.Rooms {
+			if strings.HasPrefix(r.RoomID, "status-page-") {
+				seen += 1
+			}
+		}
+		if vr.NextOffset == 0 {
+			break
+		}
+		if vr.NextOffset != offset+2 {
+			t.Fatalf("The page at offset %d has nextoffset %d, want %d", offset, vr.NextOffset, offset+2)
+		}
+		offset = vr.NextOffset
+	}
+	if seen != 3 {
+		t.Errorf("Paging through the status listed %d of the 3 rooms", seen)
+	}
+
+	resp, err := http.Get("http://" + serverAddr + "/status?verbose=1&limit=x")
+	if err != nil {
+		t.Fatalf("http.Get(/status?verbose=1&limit=x) got error: %v, want nil", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /status?verbose=1&limit=x got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// Tests that the maintenance frame is broadcast to the clients of every room and that draining rejects new
+// connections.
+func TestAdminMaintenanceBroadcast(t *testing.T) {
+	setup()
+	defer cl.setDraining(false)
+	conns := []*websocket.Conn{
+		addWsClient(t, "maint-a", "1"),
+		addWsClient(t, "maint-a", "2"),
+		addWsClient(t, "maint-b", "3"),
+	}
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+	waitForCondition(func() bool { return cl.roomTable.wsCount() == len(conns) })
+
+	resp := adminPost(t, "/admin/maintenance", `{"message":"back soon","etaMs":60000,"drain":true}`)
+	var res maintenanceResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Decoding the maintenance result got error: %v, want nil", err)
+	}
+	resp.Body.Close()
+	if res.Sent != len(conns) || !res.Draining {
+		t.Errorf("The maintenance result is %+v, want %d sent and draining", res, len(conns))
+	}
+
+	for i, conn := range conns {
+		var m maintenanceMsg
+		if err := json.Unmarshal([]byte(read(t, conn)), &m); err != nil {
+			t.Fatalf("Decoding the frame of client %d got error: %v, want nil", i, err)
+		}
+		want := maintenanceMsg{Type: "maintenance", Message: "back soon", EtaMs: 60000}
+		if m != want {
+			t.Errorf("Client %d received %+v, want %+v", i, m, want)
+		}
+	}
+
+	if _, err := websocket.NewClient(newConfig(t, "/ws"), dial(t)); err == nil {
+		t.Errorf("websocket.NewClient while draining got no error")
+	}
+	hresp, err := http.Get("http://" + serverAddr + "/healthz")
+	if err != nil {
+		t.Fatalf("http.Get(/healthz) got error: %v, want nil", err)
+	}
+	hresp.Body.Close()
+	if hresp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz while draining got status %d, want %d", hresp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// Tests that /health answers with a fixed body, even while the room table is locked, and 503 once stopping.
+func TestHttpHealth(t *testing.T) {
+	setup()
+	cl.roomTable.lockAll()
+	got := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + serverAddr + "/health")
+		if err != nil {
+			t.Errorf("GET /health got error: %v, want nil", err)
+		}
+		got <- resp
+	}()
+	var resp *http.Response
+	select {
+	case resp = <-got:
+	case <-time.After(time.Second):
+		t.Error("GET /health blocked on the locks of the room table")
+		resp = <-got
+	}
+	cl.roomTable.unlockAll()
+	if resp == nil {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK\n" {
+		t.Errorf("GET /health got status %d and body %q, want %d and %q", resp.StatusCode, body, http.StatusOK, "OK\n")
+	}
+
+	c := createNewCollider()
+	atomic.StoreInt32(&c.stopping, 1)
+	rec := httptest.NewRecorder()
+	c.httpHealthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "STOPPING\n" {
+		t.Errorf("GET /health while stopping got status %d and body %q, want %d and %q",
+			rec.Code, rec.Body.String(), http.StatusServiceUnavailable, "STOPPING\n")
+	}
+}
+
+// Tests that a connection that does not register is closed on UnregisteredReadTimeout while a registered one
+// is kept past it.
+func TestWsUnregisteredReadTimeout(t *testing.T) {
+	setup()
+	cl.UnregisteredReadTimeout = 50 * time.Millisecond
+	defer func() { cl.UnregisteredReadTimeout = 0 }()
+
+	rid, cid := "unregistered-timeout", "1"
+	registered := addWsClient(t, rid, cid)
+	defer registered.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+
+	unregistered, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer unregistered.Close()
+	done := make(chan error, 1)
+	go func() {
+		var data string
+		var err error
+		for err == nil {
+			err = websocket.Message.Receive(unregistered, &data)
+		}
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("The unregistered connection is still open after 1s, want closed after %v", cl.UnregisteredReadTimeout)
+	}
+
+	time.Sleep(3 * cl.UnregisteredReadTimeout)
+	if !cl.roomTable.isRegistered(rid, cid) {
+		t.Errorf("After %v, client %s is not registered, want the longer read timeout", 3*cl.UnregisteredReadTimeout, cid)
+	}
+}
+
+// Tests that a connection sending frames other than a register is still closed on UnregisteredReadTimeout,
+// counted from when it was accepted rather than from its last frame.
+func TestWsUnregisteredReadTimeoutIgnoresFrames(t *testing.T) {
+	setup()
+	cl.UnregisteredReadTimeout = 100 * time.Millisecond
+	defer func() { cl.UnregisteredReadTimeout = 0 }()
+
+	ws, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer ws.Close()
+	done := make(chan error, 1)
+	go func() {
+		var data string
+		var err error
+		for err == nil {
+			err = websocket.Message.Receive(ws, &data)
+		}
+		done <- err
+	}()
+	ticker := time.NewTicker(cl.UnregisteredReadTimeout / 5)
+	defer ticker.Stop()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			t.Fatalf("The unregistered connection sending heartbeats is still open after 1s, want closed after %v",
+				cl.UnregisteredReadTimeout)
+		case <-ticker.C:
+			websocket.JSON.Send(ws, wsClientMsg{Cmd: "heartbeat"})
+		}
+	}
+}
+
+// Tests that a registered client is kept while it sends within ReadTimeout, each frame resetting the deadline,
+// and disconnected once it stays silent for ReadTimeout.
+func TestWsReadTimeout(t *testing.T) {
+	setup()
+	cl.ReadTimeout = 100 * time.Millisecond
+	defer func() { cl.ReadTimeout = 0 }()
+
+	rid, cid := "read-timeout", "1"
+	conn := addWsClient(t, rid, cid)
+	defer conn.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(cl.ReadTimeout / 2)
+		write(t, conn, wsClientMsg{Cmd: "heartbeat"})
+	}
+	if !cl.roomTable.isRegistered(rid, cid) {
+		t.Errorf("After sending every %v, client %s is not registered, want registered", cl.ReadTimeout/2, cid)
+	}
+
+	if !waitForCondition(func() bool { return !cl.roomTable.isRegistered(rid, cid) }) {
+		t.Errorf("After staying silent, client %s is still registered, want disconnected after %v", cid, cl.ReadTimeout)
+	}
+}
+
+// Tests that a receipt sent by the receiver of a message is routed back to its sender.
+func TestWsReceipt(t *testing.T) {
+	setup()
+	rid := "receipt"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: `{"id":"m1","sdp":"..."}`})
+	expectReceiveMessage(t, c2, `{"id":"m1","sdp":"..."}`)
+
+	write(t, c2, wsClientMsg{Cmd: "receipt", ID: "m1"})
+	var r receiptMsg
+	if err := json.Unmarshal([]byte(read(t, c1)), &r); err != nil {
+		t.Fatalf("Decoding the receipt got error: %v, want nil", err)
+	}
+	if want := (receiptMsg{Type: "receipt", ID: "m1", From: "2"}); r != want {
+		t.Errorf("The sender received %+v, want %+v", r, want)
+	}
+
+	write(t, c2, wsClientMsg{Cmd: "receipt"})
+	expectReceiveError(t, c2)
+
+	// A receipt to a client not in the room has the error code of ErrClientNotFound.
+	write(t, c2, wsClientMsg{Cmd: "receipt", ID: "m1", To: "nobody"})
+	expectReceiveErrorCode(t, c2, errCodeClientNotFound)
+}
+
+// Tests that the errors of the room table, wrapped or not, have their error codes, and that the others have none.
+func TestErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{ErrRoomFull, errCodeRoomFull},
+		{fmt.Errorf("Failed to register: %w", ErrClientExists), errCodeClientIDTaken},
+		{ErrRoomNotFound, errCodeRoomNotFound},
+		{ErrClientNotFound, errCodeClientNotFound},
+		{errors.New("Room is full"), ""},
+		{nil, ""},
+	} {
+		if got := errorCode(tc.err); got != tc.want {
+			t.Errorf("errorCode(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// Tests that a POST refused by the room table is answered with the status of its error code.
+func TestHttpSendStatusOfErrorCode(t *testing.T) {
+	setup()
+	rid := "http-room-full"
+	for i := 1; i <= defaultMaxRoomCapacity+1; i++ {
+		cid := strconv.Itoa(i)
+		resp, err := http.Post("http://"+serverAddr+"/"+rid+"/"+cid, "application/octet-stream", strings.NewReader("hi"))
+		if err != nil {
+			t.Fatalf("POST /%s/%s got error: %v, want nil", rid, cid, err)
+		}
+		var res httpResult
+		json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if i <= defaultMaxRoomCapacity {
+			continue
+		}
+		if resp.StatusCode != http.StatusConflict || res.Code != errCodeRoomFull {
+			t.Errorf("POST /%s/%s to a full room got status %d and code %q, want %d and %q", rid, cid,
+				resp.StatusCode, res.Code, http.StatusConflict, errCodeRoomFull)
+		}
+	}
+}
+
+// Tests that the messages queued for an absent client are delivered to it in the order they were sent, ahead of
+// the messages sent once it registered.
+func TestWsQueuedInOrder(t *testing.T) {
+	setup()
+	rid := "queued-in-order"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	for i := 1; i <= 5; i++ {
+		write(t, c1, wsClientMsg{Cmd: "send", Msg: strconv.Itoa(i)})
+	}
+	waitForCondition(func() bool { return cl.roomTable.queuedCount() == 5 })
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "6"})
+	for i := 1; i <= 6; i++ {
+		expectReceiveMessage(t, c2, strconv.Itoa(i))
+	}
+}
+
+// Tests that a send with an 'id' is acknowledged to its sender, as queued while the other client is absent and
+// as delivered once it is registered, and that a send without one is not.
+func TestWsSendAck(t *testing.T) {
+	setup()
+	rid := "ack"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	expectAck := func(want ackMsg) {
+		var a ackMsg
+		if err := json.Unmarshal([]byte(read(t, c1)), &a); err != nil {
+			t.Fatalf("Decoding the ack got error: %v, want nil", err)
+		}
+		if a != want {
+			t.Errorf("The sender received %+v, want %+v", a, want)
+		}
+	}
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "queued", ID: "m1"})
+	expectAck(ackMsg{Cmd: "ack", ID: "m1", Delivered: false})
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	expectReceiveMessage(t, c2, "queued")
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "unacknowledged"})
+	expectReceiveMessage(t, c2, "unacknowledged")
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "live", ID: "m2"})
+	expectReceiveMessage(t, c2, "live")
+	expectAck(ackMsg{Cmd: "ack", ID: "m2", Delivered: true})
+}
+
+// brokenReadWriteCloser is a registered connection whose writes always fail.
+type brokenReadWriteCloser struct {
+	collidertest.MockReadWriteCloser
+}
+
+func (b *brokenReadWriteCloser) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// Tests that a send with an 'id' failing to be written to the other client is answered with an error instead of
+// an ack, and that the sender stays connected.
+func TestWsSendAckFailedWrite(t *testing.T) {
+	setup()
+	rid := "ack-failed"
+	c1 := addWsClient(t, rid, rid+"-1")
+	defer c1.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, rid+"-1") })
+	if err := cl.roomTable.register(rid, rid+"-2", &brokenReadWriteCloser{}); err != nil {
+		t.Fatalf("roomTable.register got error: %v, want nil", err)
+	}
+	defer cl.roomTable.remove(rid, rid+"-2")
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "lost", ID: "m1"})
+	expectReceiveError(t, c1)
+	cl.roomTable.remove(rid, rid+"-2")
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "queued", ID: "m2"})
+	var a ackMsg
+	if err := json.Unmarshal([]byte(read(t, c1)), &a); err != nil || a.ID != "m2" {
+		t.Errorf("After the failed send, the sender received %+v (error %v), want the ack of m2", a, err)
+	}
+}
+
+// Tests that the admin connection list of a client ID includes each of its connections.
+func TestAdminClientConnections(t *testing.T) {
+	setup()
+	cid := "multi-device"
+	ca := addWsClient(t, "devices-a", cid)
+	defer ca.Close()
+	cb := addWsClient(t, "devices-b", cid)
+	defer cb.Close()
+	waitForCondition(func() bool {
+		return cl.roomTable.isRegistered("devices-a", cid) && cl.roomTable.isRegistered("devices-b", cid)
+	})
+
+	resp := adminGet(t, "/admin/clients/"+cid+"/connections")
+	defer resp.Body.Close()
+	var conns []connDetail
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		t.Fatalf("Decoding the connections of %q got error: %v, want nil", cid, err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("The connections of %q are %+v, want 2", cid, conns)
+	}
+	rooms := map[string]bool{}
+	for _, cd := range conns {
+		rooms[cd.RoomID] = true
+		if cd.ConnID == "" || cd.RemoteIP != "127.0.0.1" || cd.ConnectedSince.IsZero() {
+			t.Errorf("The connection %+v has no ID, remote IP 127.0.0.1 or connection time", cd)
+		}
+	}
+	if !rooms["devices-a"] || !rooms["devices-b"] {
+		t.Errorf("The connections of %q are in rooms %v, want devices-a and devices-b", cid, rooms)
+	}
+}
+
+// Tests that each device of a client ID under DuplicateMultiDevice reports the time it connected.
+func TestAdminClientConnectionsPerDevice(t *testing.T) {
+	setup()
+	cl.DuplicateClients = DuplicateMultiDevice
+	defer func() { cl.DuplicateClients = "" }()
+
+	rid, cid := "devices-same-room", "multi-device-room"
+	phone := addWsClient(t, rid, cid)
+	defer phone.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+	time.Sleep(10 * time.Millisecond)
+	laptop := addWsClient(t, rid, cid)
+	defer laptop.Close()
+	var conns []connDetail
+	waitForCondition(func() bool {
+		conns = cl.roomTable.clientConns(cid)
+		return len(conns) == 2
+	})
+	if len(conns) != 2 {
+		t.Fatalf("The connections of %q are %+v, want 2", cid, conns)
+	}
+	if d := conns[1].ConnectedSince.Sub(conns[0].ConnectedSince); d < 10*time.Millisecond {
+		t.Errorf("The devices of %q connected %v apart, want at least 10ms", cid, d)
+	}
+}
+
+// Tests that under DuplicateTakeover a second connection registering a client ID disconnects the first one.
+func TestWsDuplicateClientTakeover(t *testing.T) {
+	setup()
+	rid := "dup-takeover"
+	old := addWsClient(t, rid, "1")
+	defer old.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	newer := addWsClient(t, rid, "1")
+	defer newer.Close()
+	peer := addWsClient(t, rid, "2")
+	defer peer.Close()
+
+	expectConnectionClose(t, old)
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+	write(t, peer, wsClientMsg{Cmd: "send", Msg: "to the new connection"})
+	expectReceiveMessage(t, newer, "to the new connection")
+}
+
+// Tests that under DuplicateReject a second connection registering a client ID is rejected while the first
+// one keeps working.
+func TestWsDuplicateClientReject(t *testing.T) {
+	setup()
+	cl.DuplicateClients = DuplicateReject
+	defer func() { cl.DuplicateClients = "" }()
+
+	rid := "dup-reject"
+	first := addWsClient(t, rid, "1")
+	defer first.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	second := addWsClient(t, rid, "1")
+	defer second.Close()
+	expectReceiveErrorCode(t, second, errCodeClientIDTaken)
+
+	peer := addWsClient(t, rid, "2")
+	defer peer.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+	write(t, peer, wsClientMsg{Cmd: "send", Msg: "to the first connection"})
+	expectReceiveMessage(t, first, "to the first connection")
+}
+
+// Tests that under DuplicateMultiDevice the messages to a client ID are sent to each of its connections, and
+// that one device disconnecting leaves the other registered.
+func TestWsDuplicateClientMultiDevice(t *testing.T) {
+	setup()
+	cl.DuplicateClients = DuplicateMultiDevice
+	defer func() { cl.DuplicateClients = "" }()
+
+	rid := "dup-multi"
+	phone := addWsClient(t, rid, "1")
+	defer phone.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	laptop := addWsClient(t, rid, "1")
+	defer laptop.Close()
+	waitForCondition(func() bool { return len(cl.roomTable.clientConns("1")) >= 2 })
+	peer := addWsClient(t, rid, "2")
+	defer peer.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "2") })
+
+	write(t, peer, wsClientMsg{Cmd: "send", Msg: "over ws"})
+	expectReceiveMessage(t, phone, "over ws")
+	expectReceiveMessage(t, laptop, "over ws")
+	postSend(t, rid, "2", "over http")
+	expectReceiveMessage(t, phone, "over http")
+	expectReceiveMessage(t, laptop, "over http")
+
+	// Either device may answer.
+	write(t, laptop, wsClientMsg{Cmd: "send", Msg: "from the laptop"})
+	expectReceiveMessage(t, peer, "from the laptop")
+
+	phone.Close()
+	waitForCondition(func() bool { return len(cl.roomTable.clientConns("1")) == 1 })
+	if !cl.roomTable.isRegistered(rid, "1") {
+		t.Fatalf("After one device disconnected, client 1 is not registered, want registered through the other")
+	}
+	write(t, peer, wsClientMsg{Cmd: "send", Msg: "to the laptop"})
+	expectReceiveMessage(t, laptop, "to the laptop")
+}
+
+// Tests that messages nested deeper than MaxJSONDepth, in the frame or in its 'msg', are rejected with an error
+// and the connection stays usable.
+func TestWsMaxJSONDepth(t *testing.T) {
+	setup()
+	cl.MaxJSONDepth = 8
+	defer func() { cl.MaxJSONDepth = 0 }()
+	rid := "deep"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	deep := strings.Repeat("[", 100000) + strings.Repeat("]", 100000)
+	if _, err := c1.Write([]byte(`{"cmd":"send","msg":"hi","x":` + deep + `}`)); err != nil {
+		t.Fatalf("Writing the nested frame got error: %v, want nil", err)
+	}
+	expectReceiveErrorCode(t, c1, errCodeTooDeep)
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: `{"a":` + deep + `}`})
+	expectReceiveErrorCode(t, c1, errCodeTooDeep)
+
+	// Brackets inside strings do not count.
+	msg := `{"sdp":"` + strings.Repeat("[{", 20) + `"}`
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: msg})
+	expectReceiveMessage(t, c2, msg)
+}
+
+// Tests that the admin subnet report counts the active connections by remote subnet.
+func TestAdminSubnets(t *testing.T) {
+	setup()
+	rid := "subnets"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	resp := adminGet(t, "/admin/subnets?bits=8&top=1")
+	defer resp.Body.Close()
+	var rp subnetReport
+	if err := json.NewDecoder(resp.Body).Decode(&rp); err != nil {
+		t.Fatalf("Decoding the subnet report got error: %v, want nil", err)
+	}
+	if len(rp.Subnets) != 1 || rp.Subnets[0].Subnet != "127.0.0.0/8" || rp.Subnets[0].Conns < 2 {
+		t.Errorf("The subnet report is %+v, want at least 2 connections from 127.0.0.0/8", rp)
+	}
+
+	resp = adminGet(t, "/admin/subnets?bits=33")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /admin/subnets?bits=33 got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// Tests that a WebSocket upgrade to a path other than /ws is rejected with 404 and not handled as a room or
+// client operation.
+func TestWsUpgradeWrongPath(t *testing.T) {
+	setup()
+	errs := cl.dash.getReport(cl.roomTable).HttpErrs
+	for _, path := range []string{"/wss", "/upgrade/room/client", "/room/client"} {
+		req, err := http.NewRequest("GET", "http://"+serverAddr+path, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(GET, %q, nil) got error: %v, want nil", path, err)
+		}
+		req.Header.Set("Connection", "keep-alive, Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Client.Do(%v) got error: %v", req, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Upgrading at %q got status %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+	if n := cl.dash.getReport(cl.roomTable).HttpErrs; n != errs {
+		t.Errorf("After upgrading at the wrong paths, getReport().HttpErrs = %d, want %d", n, errs)
+	}
+}
+
+// Tests that a message whose Authorizer hangs past MessageTimeout is skipped, or closes the connection under
+// SlowMessageClose, without wedging the read loop.
+func TestWsMessageTimeout(t *testing.T) {
+	setup()
+	release := make(chan struct{})
+	defer close(release)
+	cl.Authorizer = func(c *client, cmd string, msg *wsClientMsg) error {
+		if msg.Msg == "hang" {
+			<-release
+		}
+		return nil
+	}
+	cl.MessageTimeout = 50 * time.Millisecond
+	defer func() { cl.Authorizer, cl.MessageTimeout, cl.SlowMessages = nil, 0, "" }()
+	slow := cl.dash.getReport(cl.roomTable).SlowMsgs
+
+	rid := "slow"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "hang"})
+	expectReceiveErrorCode(t, c1, errCodeMessageTimeout)
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "after the slow one"})
+	expectReceiveMessage(t, c2, "after the slow one")
+
+	cl.SlowMessages = SlowMessageClose
+	write(t, c2, wsClientMsg{Cmd: "send", Msg: "hang"})
+	expectReceiveErrorCode(t, c2, errCodeMessageTimeout)
+	expectConnectionClose(t, c2)
+
+	if n := cl.dash.getReport(cl.roomTable).SlowMsgs; n != slow+2 {
+		t.Errorf("getReport().SlowMsgs = %d, want %d", n, slow+2)
+	}
+}
+
+// Tests that the connection IDs come from ConnIDFunc, and that a duplicate one is replaced with a default ID.
+func TestWsConnIDFunc(t *testing.T) {
+	setup()
+	var lock sync.Mutex
+	ids := []string{"eu-west-1-a", "eu-west-1-a"}
+	cl.ConnIDFunc = func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	defer func() { cl.ConnIDFunc = nil }()
+
+	rid := "conn-id-func"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	d := cl.roomTable.roomDetail(rid, false, false)
+	if len(d.Clients) != 2 {
+		t.Fatalf("The room detail lists %d clients, want 2", len(d.Clients))
+	}
+	if id := d.Clients[0].ConnID; id != "eu-west-1-a" {
+		t.Errorf("The connection ID of client 1 is %q, want eu-west-1-a", id)
+	}
+	if id := d.Clients[1].ConnID; !strings.HasPrefix(id, cl.InstanceID+"-") {
+		t.Errorf("The connection ID of client 2 is %q, want a default one replacing the duplicate", id)
+	}
+
+	resp := adminPost(t, "/admin/conns/eu-west-1-a", "to the custom ID")
+	resp.Body.Close()
+	expectReceiveMessage(t, c1, "to the custom ID")
+}
+
+// Tests that a register request missing the room ID, the client ID or both is answered with a distinct error,
+// and that the client may then register on the same connection.
+func TestWsRegisterMissingIDs(t *testing.T) {
+	setup()
+	conn, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		rid, cid string
+		code     string
+	}{
+		{"", "", errCodeMissingIDs},
+		{"", "1", errCodeMissingRoomID},
+		{"missing-ids", "", errCodeMissingClientID},
+	} {
+		write(t, conn, wsClientMsg{Cmd: "register", RoomID: tc.rid, ClientID: tc.cid})
+		expectReceiveErrorCode(t, conn, tc.code)
+	}
+
+	write(t, conn, wsClientMsg{Cmd: "register", RoomID: "missing-ids", ClientID: "1"})
+	if !waitForCondition(func() bool { return cl.roomTable.isRegistered("missing-ids", "1") }) {
+		t.Errorf("After registering with both IDs, the client is not registered, want registered")
+	}
+}
+
+// Tests that many connections may register and deregister concurrently. Run with -race.
+func TestWsConcurrentRegistrations(t *testing.T) {
+	setup()
+	const n = 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+			if err != nil {
+				t.Errorf("websocket.NewClient got error: %v, want nil", err)
+				return
+			}
+			defer conn.Close()
+			rid, cid := "concurrent-"+strconv.Itoa(i/2), "c"+strconv.Itoa(i)
+			write(t, conn, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: cid})
+			if !waitForCondition(func() bool { return cl.roomTable.lookupClient(cid) != nil }) {
+				t.Errorf("Client %s did not register", cid)
+			}
+			write(t, conn, wsClientMsg{Cmd: "leave"})
+		}(i)
+	}
+	wg.Wait()
+
+	if !waitForCondition(func() bool { return len(cl.roomTable.registeredClients()) == 0 }) {
+		t.Errorf("After the clients left, %d are registered, want 0", len(cl.roomTable.registeredClients()))
+	}
+}
+
+// Tests that the debug logs of a client go to the Logger rather than the standard logger.
+func TestWsLogger(t *testing.T) {
+	setup()
+	var buf, std lockedBuffer
+	cl.Logger, cl.Debug = log.New(&buf, "", 0), true
+	log.SetOutput(&std)
+	defer func() {
+		cl.Logger, cl.Debug = nil, false
+		log.SetOutput(os.Stderr)
+	}()
+
+	rid, cid := "logger", "1"
+	c := addWsClient(t, rid, cid)
+	defer c.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+
+	for _, line := range []string{"cmd == register", "Client 1 registered in room logger"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("The Logger got %q, want the line %q", buf.String(), line)
+		}
+	}
+	if strings.Contains(std.String(), rid) {
+		t.Errorf("The standard logger got %q, want nothing about room %s", std.String(), rid)
+	}
+}
+
+// Tests that with Debug off, registering and sending log nothing, the message bodies included.
+func TestWsNoDebugLogs(t *testing.T) {
+	setup()
+	var buf lockedBuffer
+	cl.Logger = log.New(&buf, "", 0)
+	defer func() { cl.Logger = nil }()
+
+	rid := "no-debug"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "private"})
+	expectReceiveMessage(t, c2, "private")
+
+	// The earlier tests may still be logging their teardown.
+	if out := buf.String(); strings.Contains(out, rid) || strings.Contains(out, "private") {
+		t.Errorf("With Debug off, registering and sending logged %q, want nothing", out)
+	}
+}
+
+// Tests that a client whose queue holds MaxQueuedBytes is refused further messages with a QUEUE_FULL error,
+// and that /status shows the queue depth.
+func TestWsMaxQueuedBytes(t *testing.T) {
+	setup()
+	cl.MaxQueuedBytes = 10
+	defer func() { cl.MaxQueuedBytes = 0 }()
+
+	rid := "queue-cap"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "12345"})
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "67890"})
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "x"})
+	expectReceiveErrorCode(t, c1, errCodeQueueFull)
+
+	if r := cl.statusReport(); r.QueuedMsgs != 2 || r.QueuedBytes != 10 {
+		t.Errorf("The status shows %d queued messages of %d bytes, want 2 of 10", r.QueuedMsgs, r.QueuedBytes)
+	}
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	expectReceiveMessage(t, c2, "12345")
+	expectReceiveMessage(t, c2, "67890")
+	if r := cl.statusReport(); r.QueuedMsgs != 0 || r.QueuedBytes != 0 {
+		t.Errorf("After delivery, the status shows %d queued messages of %d bytes, want none", r.QueuedMsgs, r.QueuedBytes)
+	}
+}
+
+// Tests that a frame larger than MaxMessageBytes is rejected with a MESSAGE_TOO_LARGE error and closes the
+// connection, while a frame of MaxMessageBytes is processed.
+func TestWsMaxMessageBytes(t *testing.T) {
+	setup()
+	cl.MaxMessageBytes = 256
+	defer func() { cl.MaxMessageBytes = 0 }()
+
+	rid := "too-large"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	// frame returns a send frame of |size| bytes and its 'msg'.
+	frame := func(size int) (string, string) {
+		overhead := len(`{"cmd":"send","msg":""}`)
+		m := strings.Repeat("a", size-overhead)
+		return `{"cmd":"send","msg":"` + m + `"}`, m
+	}
+	fits, m := frame(cl.MaxMessageBytes)
+	if err := websocket.Message.Send(c1, fits); err != nil {
+		t.Fatalf("Sending a frame of %d bytes got error: %v, want nil", len(fits), err)
+	}
+	expectReceiveMessage(t, c2, m)
+
+	tooLarge, _ := frame(cl.MaxMessageBytes + 1)
+	if err := websocket.Message.Send(c1, tooLarge); err != nil {
+		t.Fatalf("Sending a frame of %d bytes got error: %v, want nil", len(tooLarge), err)
+	}
+	expectReceiveErrorCode(t, c1, errCodeMessageTooLarge)
+	expectConnectionClose(t, c1)
+}
+
+// Tests that a server mounted under PathPrefix relays a message POSTed under the prefix to a client connected
+// under it.
+func TestPathPrefix(t *testing.T) {
+	c := createNewCollider()
+	c.PathPrefix = "/signal"
+	s := httptest.NewServer(c.Handler())
+	defer s.Close()
+
+	addr := strings.TrimPrefix(s.URL, "http://")
+	config, err := websocket.NewConfig("ws://"+addr+"/signal/ws", "http://localhost")
+	if err != nil {
+		t.Fatalf("websocket.NewConfig got error: %v, want nil", err)
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Connecting to /signal/ws got error: %v, want nil", err)
+	}
+	defer conn.Close()
+	rid := "prefixed"
+	write(t, conn, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "1"})
+	waitForCondition(func() bool { return c.roomTable.isRegistered(rid, "1") })
+
+	resp, err := http.Post(s.URL+"/signal/"+rid+"/2", "application/octet-stream", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatalf("POST /signal/%s/2 got error: %v, want nil", rid, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /signal/%s/2 got status %d, want %d", rid, resp.StatusCode, http.StatusOK)
+	}
+	expectReceiveMessage(t, conn, "hi")
+}
+
+// Tests that two Colliders serve their own handlers in one process, each routing to its own rooms.
+func TestIndependentHandlers(t *testing.T) {
+	c1, c2 := createNewCollider(), createNewCollider()
+	s1, s2 := httptest.NewServer(c1.Handler()), httptest.NewServer(c2.Handler())
+	defer s1.Close()
+	defer s2.Close()
+
+	resp, err := http.Post(s1.URL+"/independent/1", "application/octet-stream", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatalf("POST /independent/1 got error: %v, want nil", err)
+	}
+	resp.Body.Close()
+	if c1.roomTable.roomSize("independent") != 1 || c2.roomTable.roomSize("independent") != 0 {
+		t.Errorf("After POST /independent/1 to the first Collider, the rooms have %d and %d clients, want 1 and 0",
+			c1.roomTable.roomSize("independent"), c2.roomTable.roomSize("independent"))
+	}
+}
+
+// Tests that the middleware wraps the handlers in the order added, sees the matched path and may answer without
+// reaching the handler.
+func TestUseMiddleware(t *testing.T) {
+	c := createNewCollider()
+	var order []string
+	c.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			order = append(order, "count "+r.URL.Path)
+			h.ServeHTTP(w, r)
+		})
+	})
+	c.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/status" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			order = append(order, "allow "+r.URL.Path)
+			h.ServeHTTP(w, r)
+		})
+	})
+	h := c.Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /status got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/middleware/1", strings.NewReader("hi")))
+	if rec.Code != http.StatusOK || c.roomTable.roomSize("middleware") != 1 {
+		t.Errorf("POST /middleware/1 got status %d with %d clients in the room, want %d with 1", rec.Code,
+			c.roomTable.roomSize("middleware"), http.StatusOK)
+	}
+	if got, want := strings.Join(order, ", "), "count /status, count /middleware/1, allow /middleware/1"; got != want {
+		t.Errorf("The middleware saw %q, want %q", got, want)
+	}
+}
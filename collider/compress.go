@@ -0,0 +1,155 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// deflateProtocol is the subprotocol of the connections whose frames are deflated one by one.
+	deflateProtocol = "collider.deflate"
+	// deflateDictProtocol is deflateProtocol with the preset dictionary of CompressionDictionary.
+	deflateDictProtocol = "collider.deflate-dict"
+	// maxInflatedSize bounds the size of an inflated frame, so that a small frame cannot inflate into
+	// a huge one.
+	maxInflatedSize = 1 << 20
+)
+
+var errInflatedTooLarge = errors.New("Inflated message too large")
+
+// framePhrases, msgPhrases and sdpPhrases make up the default dictionary. The messages relayed by the server
+// are JSON frames whose 'msg' carries the JSON of the RTCSessionDescription or the RTCIceCandidate, whose
+// 'sdp' or 'candidate' in turn carries the SDP, so each level is escaped once more than the previous one.
+const framePhrases = `{"cmd":"send","msg":"{"cmd":"","from":"","msg":"","error":"","time":"`
+
+const msgPhrases = `{"type":"candidate","label":0,"id":"0","candidate":"` +
+	`{"type":"answer","sdp":"{"type":"offer","sdp":"`
+
+const sdpPhrases = "v=0\r\no=- 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=group:BUNDLE 0 1\r\n" +
+	"a=extmap-allow-mixed\r\na=msid-semantic: WMS\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 63 103 104 9 0 8 106 105 13 110 112 113 126\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103 104 105 106 107 108 109 127 125 39 40 45 46 98 99 100 101\r\n" +
+	"c=IN IP4 0.0.0.0\r\na=rtcp:9 IN IP4 0.0.0.0\r\na=setup:actpass\r\na=setup:active\r\n" +
+	"a=fingerprint:sha-256 \r\na=ice-options:trickle\r\na=sendrecv\r\na=recvonly\r\na=sendonly\r\n" +
+	"a=rtcp-mux\r\na=rtcp-rsize\r\na=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\n" +
+	"a=extmap:2 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time\r\n" +
+	"a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\n" +
+	"a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid\r\n" +
+	"a=extmap:5 urn:ietf:params:rtp-hdrext:toffset\r\n" +
+	"a=extmap:9 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id\r\n" +
+	"a=extmap:10 urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\na=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+	"a=rtpmap:9 G722/8000\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\n" +
+	"a=rtpmap:96 VP8/90000\r\na=rtpmap:98 VP9/90000\r\na=rtpmap:102 H264/90000\r\n" +
+	"a=rtpmap:97 rtx/90000\r\na=fmtp:97 apt=96\r\na=rtpmap:45 AV1/90000\r\n" +
+	"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f\r\n" +
+	"a=rtcp-fb:96 goog-remb\r\na=rtcp-fb:96 transport-cc\r\na=rtcp-fb:96 ccm fir\r\n" +
+	"a=rtcp-fb:96 nack\r\na=rtcp-fb:96 nack pli\r\na=rtcp-fb:111 transport-cc\r\n" +
+	"a=ssrc-group:FID \r\na=ssrc: cname:\r\na=ssrc: msid:\r\na=msid:- \r\n" +
+	"a=mid:0\r\na=mid:1\r\na=ice-ufrag:\r\na=ice-pwd:\r\n" +
+	"candidate: 1 udp 2122260223 typ host generation 0 network-id 1\r\n" +
+	"candidate: 1 tcp 1518280447 typ host tcptype passive generation 0 network-id 1\r\n" +
+	"candidate: 1 udp 1686052607 typ srflx raddr rport generation 0 network-id 1 network-cost 10\r\n" +
+	"candidate: 1 udp 41885439 typ relay raddr rport generation 0 ufrag network-id 1 network-cost 10"
+
+// defaultDictionary is the default of CompressionDictionary, tuned for the frames relaying the SDP and the ICE
+// candidates. The most common phrases come last, where they are cheapest to refer to.
+var defaultDictionary = []byte(framePhrases + escapeJSON(msgPhrases) + escapeJSON(escapeJSON(sdpPhrases)))
+
+// escapeJSON returns |s| escaped as within a JSON string.
+func escapeJSON(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// deflateSerializer deflates the frames encoded by the serializer it wraps, each on its own with the preset
+// dictionary |dict|, and inflates the frames before they are decoded.
+type deflateSerializer struct {
+	serializer
+	dict    []byte
+	writers *sync.Pool
+}
+
+func newDeflateSerializer(s serializer, dict []byte) deflateSerializer {
+	return deflateSerializer{s, dict, &sync.Pool{}}
+}
+
+func (ds deflateSerializer) Decode(data []byte) (*wsClientMsg, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), ds.dict)
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxInflatedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxInflatedSize {
+		return nil, errInflatedTooLarge
+	}
+	return ds.serializer.Decode(b)
+}
+
+func (ds deflateSerializer) Encode(v interface{}) ([]byte, error) {
+	b, err := ds.serializer.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, _ := ds.writers.Get().(*flate.Writer)
+	if w == nil {
+		if w, err = flate.NewWriterDict(&buf, flate.BestCompression, ds.dict); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer ds.writers.Put(w)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// binaryFrames returns true if the frames encoded by |s| are binary rather than text.
+func binaryFrames(s serializer) bool {
+	switch ss := s.(type) {
+	case deflateSerializer:
+		return true
+	case renamingSerializer:
+		return binaryFrames(ss.serializer)
+	}
+	return false
+}
+
+// deflater returns the deflate serializer of the subprotocol |proto|, or nil if it is not a deflate one.
+// The serializers are shared by the connections, reusing their writers.
+func (c *Collider) deflater(proto string) serializer {
+	c.deflateOnce.Do(func() {
+		c.deflaters = map[string]serializer{
+			deflateProtocol:     newDeflateSerializer(jsonSerializer{}, nil),
+			deflateDictProtocol: newDeflateSerializer(jsonSerializer{}, c.compressionDictionary()),
+		}
+	})
+	return c.deflaters[proto]
+}
+
+// compressionDictionary returns the preset dictionary of the deflateDictProtocol connections.
+func (c *Collider) compressionDictionary() []byte {
+	if c.CompressionDictionary == nil {
+		return defaultDictionary
+	}
+	return c.CompressionDictionary
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// sampleOffer is the offer of a browser sending audio and video, as the 'msg' of a frame.
+const sampleOffer = "v=0\r\no=- 4611731400430051336 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\na=extmap-allow-mixed\r\na=msid-semantic: WMS 5b3c1e8a\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 63 9 0 8 13 110 126\r\nc=IN IP4 0.0.0.0\r\na=rtcp:9 IN IP4 0.0.0.0\r\n" +
+	"a=ice-ufrag:Fz1X\r\na=ice-pwd:x9cml/YzichV2+XlhiMu8g2e\r\na=ice-options:trickle\r\n" +
+	"a=fingerprint:sha-256 7B:8B:F0:65:5F:78:E2:51:3B:AC:6F:F3:3F:46:1B:35:DC:B8:5F:64:1A:24:C2:43:F0:A1:58:D0:A1:2C:19:08\r\n" +
+	"a=setup:actpass\r\na=mid:0\r\na=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\n" +
+	"a=extmap:2 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time\r\n" +
+	"a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\n" +
+	"a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid\r\na=sendrecv\r\na=msid:5b3c1e8a 1f9a0c2d\r\n" +
+	"a=rtcp-mux\r\na=rtpmap:111 opus/48000/2\r\na=rtcp-fb:111 transport-cc\r\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\r\na=rtpmap:9 G722/8000\r\na=rtpmap:0 PCMU/8000\r\n" +
+	"a=rtpmap:8 PCMA/8000\r\na=ssrc:3735928559 cname:q2Ww5Gz0\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103\r\nc=IN IP4 0.0.0.0\r\na=rtcp:9 IN IP4 0.0.0.0\r\n" +
+	"a=ice-ufrag:Fz1X\r\na=ice-pwd:x9cml/YzichV2+XlhiMu8g2e\r\na=ice-options:trickle\r\n" +
+	"a=setup:actpass\r\na=mid:1\r\na=extmap:5 urn:ietf:params:rtp-hdrext:toffset\r\na=sendrecv\r\n" +
+	"a=rtcp-mux\r\na=rtcp-rsize\r\na=rtpmap:96 VP8/90000\r\na=rtcp-fb:96 goog-remb\r\n" +
+	"a=rtcp-fb:96 transport-cc\r\na=rtcp-fb:96 ccm fir\r\na=rtcp-fb:96 nack\r\na=rtcp-fb:96 nack pli\r\n" +
+	"a=rtpmap:97 rtx/90000\r\na=fmtp:97 apt=96\r\na=rtpmap:102 H264/90000\r\n" +
+	"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f\r\n" +
+	"a=ssrc-group:FID 2882400001 2882400002\r\na=ssrc:2882400001 cname:q2Ww5Gz0\r\n"
+
+// sampleCandidate is an ICE candidate, as the 'msg' of a frame.
+const sampleCandidate = "candidate:842163049 1 udp 1686052607 203.0.113.7 47609 typ srflx raddr 192.168.1.7 " +
+	"rport 47609 generation 0 ufrag Fz1X network-id 1 network-cost 10"
+
+// sampleFrames returns the frames relaying sampleOffer and sampleCandidate as the browsers send them.
+func sampleFrames() []wsServerMsg {
+	offer, _ := json.Marshal(map[string]string{"type": "offer", "sdp": sampleOffer})
+	candidate, _ := json.Marshal(map[string]interface{}{
+		"type": "candidate", "label": 0, "id": "0", "candidate": sampleCandidate})
+	return []wsServerMsg{
+		{Cmd: "send", From: "1", Msg: string(offer)},
+		{Cmd: "send", From: "1", Msg: string(candidate)},
+	}
+}
+
+// Tests that the deflate serializers round-trip a message, with and without a dictionary.
+func TestDeflateSerializerRoundTrip(t *testing.T) {
+	m := wsClientMsg{Cmd: "send", Msg: sampleCandidate, To: "2"}
+	for _, ds := range []deflateSerializer{
+		newDeflateSerializer(jsonSerializer{}, nil),
+		newDeflateSerializer(jsonSerializer{}, defaultDictionary),
+	} {
+		// Encodes twice to reuse the pooled writer.
+		for i := 0; i < 2; i++ {
+			b, err := ds.Encode(m)
+			if err != nil {
+				t.Fatalf("deflateSerializer.Encode(%v) got error: %v, want nil", m, err)
+			}
+			d, err := ds.Decode(b)
+			if err != nil {
+				t.Fatalf("deflateSerializer.Decode(%q) got error: %v, want nil", b, err)
+			}
+			if d.Cmd != m.Cmd || d.Msg != m.Msg || d.To != m.To {
+				t.Errorf("deflateSerializer round trip of %+v = %+v", m, *d)
+			}
+		}
+	}
+}
+
+// Tests that a frame inflating beyond maxInflatedSize is rejected.
+func TestDeflateSerializerInflatedTooLarge(t *testing.T) {
+	ds := newDeflateSerializer(jsonSerializer{}, nil)
+	b, _ := ds.Encode(wsClientMsg{Cmd: "send", Msg: strings.Repeat("a", maxInflatedSize)})
+	if _, err := ds.Decode(b); err != errInflatedTooLarge {
+		t.Errorf("Decoding a frame of %d bytes inflating beyond %d got error: %v, want %v",
+			len(b), maxInflatedSize, err, errInflatedTooLarge)
+	}
+}
+
+// Tests that the default dictionary deflates the SDP and the ICE candidates better than plain deflate.
+func TestDeflateDictionaryRatio(t *testing.T) {
+	plain := newDeflateSerializer(jsonSerializer{}, nil)
+	dict := newDeflateSerializer(jsonSerializer{}, defaultDictionary)
+	for _, f := range sampleFrames() {
+		p, _ := plain.Encode(f)
+		d, _ := dict.Encode(f)
+		if len(d) >= len(p) {
+			t.Errorf("%q deflated to %d bytes with the dictionary and %d without, want fewer with it", f.Msg, len(d), len(p))
+		}
+	}
+}
+
+// Tests that a connection negotiating the deflate subprotocol with the dictionary receives the relayed frames
+// deflated in binary frames, and has its deflated frames relayed to a plain client as JSON.
+func TestWsDeflateSubprotocol(t *testing.T) {
+	setup()
+	config := newConfig(t, "/ws")
+	config.Protocol = []string{deflateDictProtocol}
+	c1, err := websocket.NewClient(config, dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient(%v) got error: %v, want nil", config, err)
+	}
+	defer c1.Close()
+	ds := newDeflateSerializer(jsonSerializer{}, defaultDictionary)
+	writeDeflated := func(m wsClientMsg) {
+		b, _ := ds.Encode(m)
+		if err := websocket.Message.Send(c1, b); err != nil {
+			t.Fatalf("websocket.Message.Send got error: %v, want nil", err)
+		}
+	}
+	rid := "deflate"
+	writeDeflated(wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "1"})
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	write(t, c2, wsClientMsg{Cmd: "send", Msg: sampleCandidate})
+	fr, err := c1.NewFrameReader()
+	if err != nil {
+		t.Fatalf("c1.NewFrameReader() got error: %v, want nil", err)
+	}
+	if fr.PayloadType() != websocket.BinaryFrame {
+		t.Errorf("The deflate client received a frame of type %d, want binary", fr.PayloadType())
+	}
+	data, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("Reading the frame from the deflate client got error: %v, want nil", err)
+	}
+	m, err := ds.Decode(data)
+	if err != nil {
+		t.Fatalf("Inflating %q from the deflate client got error: %v, want nil", data, err)
+	}
+	if m.Msg != sampleCandidate {
+		t.Errorf("The deflate client received %+v, want msg %q", m, sampleCandidate)
+	}
+
+	writeDeflated(wsClientMsg{Cmd: "send", Msg: "to json"})
+	expectReceiveMessage(t, c2, "to json")
+}
+
+// Benchmarks deflating the sample frames with and without the default dictionary, reporting the compressed
+// size as a share of the original.
+func BenchmarkDeflateRatio(b *testing.B) {
+	frames := sampleFrames()
+	for _, bc := range []struct {
+		name string
+		dict []byte
+	}{{"plain", nil}, {"sdp-dictionary", defaultDictionary}} {
+		b.Run(bc.name, func(b *testing.B) {
+			ds := newDeflateSerializer(jsonSerializer{}, bc.dict)
+			var in, out int
+			for i := 0; i < b.N; i++ {
+				for _, f := range frames {
+					raw, _ := jsonSerializer{}.Encode(f)
+					d, err := ds.Encode(f)
+					if err != nil {
+						b.Fatalf("deflateSerializer.Encode got error: %v, want nil", err)
+					}
+					in += len(raw)
+					out += len(d)
+				}
+			}
+			b.ReportMetric(float64(out)/float64(in), "ratio")
+		})
+	}
+}
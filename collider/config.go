@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// redacted replaces the value of the secret configuration fields that are set.
+const redacted = "[REDACTED]"
+
+// secretFields are the configuration fields whose values are never shown.
+var secretFields = map[string]bool{
+	"AdminToken": true,
+}
+
+// effectiveDefaults returns the values the configuration fields with a default take when they are zero.
+func (c *Collider) effectiveDefaults() map[string]interface{} {
+	cert, key := c.certFiles()
+	return map[string]interface{}{
+		"ReadTimeout":             c.readTimeout(true),
+		"UnregisteredReadTimeout": c.readTimeout(false),
+		"MaxJSONDepth":            c.maxJSONDepth(),
+		"RelayCommands":           c.relayCommands(),
+		"MaxMessageBytes":         c.maxMessageBytes(),
+		"MaxMissedPings":          c.maxMissedPings(),
+		"MaxRoomCapacity":         c.roomTable.roomCapacity(),
+		"DuplicateClients":        c.roomTable.duplicatePolicy(),
+		"RoomServerTimeout":       c.roomTable.roomSrvTimeout(),
+		"RegisterTimeout":         c.roomTable.regTimeout(),
+		"AcceptQueueTimeout":      c.acceptQueueTimeout(),
+		"SlowMessages":            SlowMessageSkip,
+		"MaxQueuedMessages":       defaultMaxQueuedMsgs,
+		"MaxQueuedBytes":          defaultMaxQueuedBytes,
+		"CertFile":                cert,
+		"KeyFile":                 key,
+	}
+}
+
+// configReport returns the effective configuration, built from the exported fields of the Collider: the zero
+// fields with a default show the default, the durations are formatted, the hooks and the logger show whether
+// they are set, the byte slices show their length, and the secrets are redacted.
+func (c *Collider) configReport() map[string]interface{} {
+	defaults := c.effectiveDefaults()
+	rp := make(map[string]interface{})
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" || f.Anonymous {
+			continue
+		}
+		fv := v.Field(i)
+		var val interface{}
+		switch {
+		case secretFields[f.Name]:
+			val = ""
+			if !fv.IsZero() {
+				val = redacted
+			}
+		case f.Type.Kind() == reflect.Func || f.Type.Kind() == reflect.Ptr:
+			val = !fv.IsNil()
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Uint8:
+			val = fv.Len()
+		default:
+			val = fv.Interface()
+			if d, ok := defaults[f.Name]; ok && fv.IsZero() {
+				val = d
+			}
+		}
+		if d, ok := val.(time.Duration); ok {
+			val = d.String()
+		}
+		rp[f.Name] = val
+	}
+	return rp
+}
+
+// httpAdminConfigHandler is a HTTP handler that returns the effective configuration, with the secrets redacted.
+func (c *Collider) httpAdminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c.configReport()); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the admin config endpoint returns the effective configuration with the admin token redacted.
+func TestAdminConfig(t *testing.T) {
+	c := createNewCollider()
+	c.AdminToken = "hunter2"
+	c.ReadTimeout = 5 * time.Second
+	c.MaxRoomCapacity = 4
+	c.EnabledCommands = []string{"send"}
+	c.Authorizer = func(cl *client, cmd string, msg *wsClientMsg) error { return nil }
+
+	rec := httptest.NewRecorder()
+	c.httpAdminConfigHandler(rec, httptest.NewRequest("GET", "/admin/config", nil))
+	if strings.Contains(rec.Body.String(), c.AdminToken) {
+		t.Errorf("The config %s shows the admin token, want it redacted", rec.Body.String())
+	}
+	var cfg map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&cfg); err != nil {
+		t.Fatalf("Decoding the config got error: %v, want nil", err)
+	}
+
+	for name, want := range map[string]interface{}{
+		"AdminToken":      redacted,
+		"ReadTimeout":     "5s",
+		"MaxRoomCapacity": float64(4),
+		"EnabledCommands": []interface{}{"send"},
+		"Authorizer":      true,
+		"ConnIDFunc":      false,
+		// The zero fields show their defaults.
+		"MaxJSONDepth":     float64(defaultMaxJSONDepth),
+		"DuplicateClients": string(DuplicateTakeover),
+	} {
+		if !reflect.DeepEqual(cfg[name], want) {
+			t.Errorf("The config has %s = %v, want %v", name, cfg[name], want)
+		}
+	}
+}
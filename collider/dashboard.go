@@ -6,12 +6,19 @@
 package collider
 
 import (
+	"fmt"
+	"io"
+	"sort"
 	"sync"
 	"time"
 )
 
 const maxErrLogLen = 128
 
+// The upper bounds, in milliseconds, of the buckets of the register-to-first-message latency histogram.
+// Latencies above the last bound are counted in an extra overflow bucket.
+var firstMsgBucketsMs = []int64{50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
 type errEvent struct {
 	Time time.Time `json:"t"`
 	Err  string    `json:"e"`
@@ -27,6 +34,50 @@ type dashboard struct {
 	totalSendMsgs int
 	wsErrs        int
 	httpErrs      int
+	tlsErrs       int
+	discardedMsgs int
+	// firstMsgCounts has one count per bucket of firstMsgBucketsMs, plus the overflow bucket.
+	firstMsgCounts []int
+	firstMsgSum    time.Duration
+	// roomTypes holds the message and lifetime counters of each room type.
+	roomTypes map[string]*roomTypeStats
+	// disconnects counts the ended WebSocket connections by reason.
+	disconnects map[DisconnectReason]int
+	// roomSrvErrs and roomSrvSkipped count the failed room server calls and those skipped by the circuit breaker.
+	roomSrvErrs    int
+	roomSrvSkipped int
+	// slowMsgs counts the messages whose processing exceeded MessageTimeout.
+	slowMsgs int
+	// broadcasts and broadcastSum are the number of broadcasts sent and the sum of their durations.
+	broadcasts   int
+	broadcastSum time.Duration
+	// longLockHolds counts the holds of the room table lock beyond LockHoldWarning by operation.
+	longLockHolds map[string]int
+}
+
+// roomTypeStats are the metrics of the rooms of one type.
+type roomTypeStats struct {
+	Rooms    int `json:"rooms"`
+	Messages int `json:"messages"`
+	// ClosedRooms and DurationSec are the number of removed rooms and the sum of their lifetimes.
+	ClosedRooms int     `json:"closedrooms"`
+	DurationSec float64 `json:"durationsec"`
+}
+
+// latencyHistogram is a histogram of latencies in the status report.
+type latencyHistogram struct {
+	BucketsMs []int64 `json:"bucketsms"`
+	Counts    []int   `json:"counts"`
+	Count     int     `json:"count"`
+	SumMs     float64 `json:"summs"`
+}
+
+// broadcastStats are the metrics of the broadcasts in the status report.
+type broadcastStats struct {
+	Queue acceptQueueStats `json:"queue"`
+	// Sent and DurationMs are the number of broadcasts sent and the sum of their durations, waits included.
+	Sent       int     `json:"sent"`
+	DurationMs float64 `json:"durationms"`
 }
 
 type statusReport struct {
@@ -35,24 +86,166 @@ type statusReport struct {
 	TotalWs   int     `json:"totalws"`
 	WsErrs    int     `json:"wserrors"`
 	HttpErrs  int     `json:"httperrors"`
+	// Clients is the number of clients in the rooms, registered or waiting to be.
+	Clients int `json:"clients"`
+	// TLSErrs is the number of failed TLS handshakes.
+	TLSErrs int `json:"tlserrors"`
+	// RoomSrvErrs is the number of failed room server calls, and RoomSrvSkipped the number of those skipped
+	// while the room server kept failing.
+	RoomSrvErrs    int `json:"roomservererrors"`
+	RoomSrvSkipped int `json:"roomserverskipped"`
+	// SlowMsgs is the number of messages whose processing exceeded MessageTimeout.
+	SlowMsgs int `json:"slowmessages"`
+	// DiscardedMsgs is the number of queued messages dropped along with their client or room.
+	DiscardedMsgs int `json:"discardedmsgs"`
+	// OrphanedMsgs is the number of queued messages held by clients outside of any room.
+	OrphanedMsgs int `json:"orphanedmsgs"`
+	// QueuedMsgs and QueuedBytes are the number and size of the messages queued in the rooms.
+	QueuedMsgs  int `json:"queuedmsgs"`
+	QueuedBytes int `json:"queuedbytes"`
+	// FirstMsgLatency is the histogram of the time from a client's register to its first routed message.
+	FirstMsgLatency latencyHistogram `json:"firstmsglatency"`
+	// RoomTypes are the metrics of the rooms of each type.
+	RoomTypes map[string]roomTypeStats `json:"roomtypes"`
+	// AcceptQueue shows the WebSocket connections processed and waiting to be processed.
+	AcceptQueue acceptQueueStats `json:"acceptqueue"`
+	// Broadcasts shows the broadcasts sent, in progress and waiting for their turn.
+	Broadcasts broadcastStats `json:"broadcasts"`
+	// Disconnects is the number of ended WebSocket connections by DisconnectReason.
+	Disconnects map[string]int `json:"disconnects"`
+	// LongLockHolds is the number of holds of the room table lock beyond LockHoldWarning by operation.
+	LongLockHolds map[string]int `json:"longlockholds"`
+	// MemoryGuard shows the heap usage and the load it caused to be shed.
+	MemoryGuard memGuardStats `json:"memoryguard"`
+}
+
+// verboseStatusReport is the status report with a page of the rooms.
+type verboseStatusReport struct {
+	statusReport
+	Rooms []roomSummary `json:"rooms"`
+	// NextOffset is the offset of the next page of rooms, or 0 if this is the last page.
+	NextOffset int `json:"nextoffset,omitempty"`
+}
+
+// roomSummary describes a room in the verbose status.
+type roomSummary struct {
+	RoomID     string `json:"roomid"`
+	Clients    int    `json:"clients"`
+	Registered int    `json:"registered"`
+}
+
+// roomStatus is the status report of a single room.
+type roomStatus struct {
+	roomSummary
+	QueuedMsgs  int `json:"queuedmsgs"`
+	QueuedBytes int `json:"queuedbytes"`
+	// LastActivity is the time of the last register or message in the room.
+	LastActivity time.Time `json:"lastactivity"`
+}
+
+// drainReport is the verbose health report, showing how much is left to deliver while stopping.
+type drainReport struct {
+	Stopping bool `json:"stopping"`
+	Draining bool `json:"draining"`
+	Queued   int  `json:"queued"`
+	InFlight int  `json:"inflight"`
 }
 
 func newDashboard() *dashboard {
-	return &dashboard{startTime: time.Now()}
+	return &dashboard{
+		startTime:      time.Now(),
+		firstMsgCounts: make([]int, len(firstMsgBucketsMs)+1),
+		roomTypes:      make(map[string]*roomTypeStats),
+		disconnects:    make(map[DisconnectReason]int),
+		longLockHolds:  make(map[string]int),
+	}
 }
 
+// getReport returns the status report. The room table and the dashboard are each locked only to copy
+// their counters, never both at once.
 func (db *dashboard) getReport(rs *roomTable) statusReport {
+	ts := rs.stats()
+	aq := rs.acceptStats()
+	bq := rs.broadcastStats()
+	mg := rs.memStats()
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	upTime := time.Since(db.startTime)
 	return statusReport{
 		UpTimeSec: upTime.Seconds(),
-		OpenWs:    rs.wsCount(),
+		OpenWs:    ts.openWs,
+		Clients:   ts.clients,
 		TotalWs:   db.totalWs,
 		WsErrs:    db.wsErrs,
 		HttpErrs:  db.httpErrs,
+		TLSErrs:   db.tlsErrs,
+
+		RoomSrvErrs:    db.roomSrvErrs,
+		RoomSrvSkipped: db.roomSrvSkipped,
+		SlowMsgs:       db.slowMsgs,
+
+		DiscardedMsgs: db.discardedMsgs,
+		OrphanedMsgs:  ts.orphanedMsgs,
+		QueuedMsgs:    ts.queuedMsgs,
+		QueuedBytes:   ts.queuedBytes,
+
+		FirstMsgLatency: db.firstMsgLatencyLocked(),
+		RoomTypes:       db.roomTypesLocked(ts.roomsByType),
+		AcceptQueue:     aq,
+		Broadcasts:      broadcastStats{Queue: bq, Sent: db.broadcasts, DurationMs: db.broadcastSum.Seconds() * 1000},
+		Disconnects:     db.disconnectsLocked(),
+		LongLockHolds:   copyCounts(db.longLockHolds),
+		MemoryGuard:     mg,
+	}
+}
+
+// disconnectsLocked returns a copy of the disconnect counts. The caller must hold the lock.
+func (db *dashboard) disconnectsLocked() map[string]int {
+	m := make(map[string]int)
+	for r, n := range db.disconnects {
+		m[string(r)] = n
 	}
+	return m
+}
+
+// copyCounts returns a copy of the counts.
+func copyCounts(counts map[string]int) map[string]int {
+	m := make(map[string]int)
+	for k, n := range counts {
+		m[k] = n
+	}
+	return m
+}
+
+// roomTypesLocked returns the metrics of each room type, given the current number of rooms of each type.
+// The caller must hold the lock.
+func (db *dashboard) roomTypesLocked(rooms map[string]int) map[string]roomTypeStats {
+	m := make(map[string]roomTypeStats)
+	for t, s := range db.roomTypes {
+		m[t] = *s
+	}
+	for t, n := range rooms {
+		s := m[t]
+		s.Rooms = n
+		m[t] = s
+	}
+	return m
+}
+
+// firstMsgLatencyLocked returns a copy of the first message latency histogram. The caller must hold the lock.
+func (db *dashboard) firstMsgLatencyLocked() latencyHistogram {
+	h := latencyHistogram{
+		BucketsMs: firstMsgBucketsMs,
+		Counts:    make([]int, len(db.firstMsgCounts)),
+		SumMs:     db.firstMsgSum.Seconds() * 1000,
+	}
+	copy(h.Counts, db.firstMsgCounts)
+	for _, n := range h.Counts {
+		h.Count += n
+	}
+	return h
 }
 
 func (db *dashboard) incrWs() {
@@ -74,3 +267,222 @@ func (db *dashboard) onHttpErr(err error) {
 
 	db.httpErrs += 1
 }
+
+func (db *dashboard) onRoomSrvErr(skipped bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if skipped {
+		db.roomSrvSkipped += 1
+	} else {
+		db.roomSrvErrs += 1
+	}
+}
+
+func (db *dashboard) onSlowMessage() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.slowMsgs += 1
+}
+
+func (db *dashboard) onTLSErr() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.tlsErrs += 1
+}
+
+// roomTypeLocked returns the counters of the room type, creating them if needed. The caller must hold the lock.
+func (db *dashboard) roomTypeLocked(t string) *roomTypeStats {
+	s := db.roomTypes[t]
+	if s == nil {
+		s = &roomTypeStats{}
+		db.roomTypes[t] = s
+	}
+	return s
+}
+
+func (db *dashboard) onRoomMessage(t string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.roomTypeLocked(t).Messages += 1
+}
+
+func (db *dashboard) onRoomClosed(t string, d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	s := db.roomTypeLocked(t)
+	s.ClosedRooms += 1
+	s.DurationSec += d.Seconds()
+}
+
+func (db *dashboard) onDisconnect(r DisconnectReason) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.disconnects[r] += 1
+}
+
+func (db *dashboard) onBroadcast(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.broadcasts += 1
+	db.broadcastSum += d
+}
+
+func (db *dashboard) onLongLockHold(op string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.longLockHolds[op] += 1
+}
+
+func (db *dashboard) onQueuedDiscarded(n int) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.discardedMsgs += n
+}
+
+// onFirstMsg records the time from a client's register to its first routed message.
+func (db *dashboard) onFirstMsg(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	i := sort.Search(len(firstMsgBucketsMs), func(i int) bool {
+		return d <= time.Duration(firstMsgBucketsMs[i])*time.Millisecond
+	})
+	db.firstMsgCounts[i] += 1
+	db.firstMsgSum += d
+}
+
+// writeText writes the report as a human-readable summary, one "name: value" line per field.
+func (rp statusReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "uptime: %.0fs\n", rp.UpTimeSec)
+	fmt.Fprintf(w, "open websockets: %d\n", rp.OpenWs)
+	fmt.Fprintf(w, "total websockets: %d\n", rp.TotalWs)
+	fmt.Fprintf(w, "websocket errors: %d\n", rp.WsErrs)
+	fmt.Fprintf(w, "http errors: %d\n", rp.HttpErrs)
+	fmt.Fprintf(w, "tls errors: %d\n", rp.TLSErrs)
+	fmt.Fprintf(w, "room server errors: %d (%d skipped)\n", rp.RoomSrvErrs, rp.RoomSrvSkipped)
+	fmt.Fprintf(w, "slow messages: %d\n", rp.SlowMsgs)
+	fmt.Fprintf(w, "discarded messages: %d\n", rp.DiscardedMsgs)
+	fmt.Fprintf(w, "orphaned messages: %d\n", rp.OrphanedMsgs)
+	h := rp.FirstMsgLatency
+	if h.Count > 0 {
+		fmt.Fprintf(w, "first message latency: %d clients, %.0fms average\n", h.Count, h.SumMs/float64(h.Count))
+	} else {
+		fmt.Fprintf(w, "first message latency: 0 clients\n")
+	}
+	fmt.Fprintf(w, "disconnects:")
+	for _, r := range sortedKeys(rp.Disconnects) {
+		fmt.Fprintf(w, " %s=%d", r, rp.Disconnects[r])
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// sortedKeys returns the keys of the map in order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writePrometheus writes the report in the Prometheus text exposition format.
+func (rp statusReport) writePrometheus(w io.Writer) {
+	metric := func(name string, typ string, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, v)
+	}
+	metric("collider_uptime_seconds", "gauge", "Time since the server started.", rp.UpTimeSec)
+	metric("collider_open_websockets", "gauge", "Number of registered WebSocket connections.", float64(rp.OpenWs))
+	metric("collider_clients", "gauge", "Number of clients in the rooms, registered or not.", float64(rp.Clients))
+	metric("collider_websockets_total", "counter", "Number of WebSocket registrations.", float64(rp.TotalWs))
+	metric("collider_websocket_errors_total", "counter", "Number of WebSocket errors.", float64(rp.WsErrs))
+	metric("collider_http_errors_total", "counter", "Number of HTTP errors.", float64(rp.HttpErrs))
+	metric("collider_tls_errors_total", "counter", "Number of failed TLS handshakes.", float64(rp.TLSErrs))
+	metric("collider_room_server_errors_total", "counter", "Number of failed room server calls.", float64(rp.RoomSrvErrs))
+	metric("collider_room_server_skipped_total", "counter", "Number of room server calls skipped by the circuit breaker.",
+		float64(rp.RoomSrvSkipped))
+	metric("collider_slow_messages_total", "counter", "Number of messages whose processing timed out.", float64(rp.SlowMsgs))
+	metric("collider_discarded_messages_total", "counter", "Number of queued messages dropped.", float64(rp.DiscardedMsgs))
+	metric("collider_orphaned_messages", "gauge", "Number of queued messages outside of any room.", float64(rp.OrphanedMsgs))
+	metric("collider_accept_active", "gauge", "Number of WebSocket connections processed.", float64(rp.AcceptQueue.Active))
+	metric("collider_accept_queue_depth", "gauge", "Number of WebSocket connections waiting to be processed.",
+		float64(rp.AcceptQueue.Depth))
+	metric("collider_accept_rejected_total", "counter", "Number of WebSocket connections rejected by the full accept queue.",
+		float64(rp.AcceptQueue.Rejected))
+	metric("collider_accept_wait_seconds_sum", "counter", "Time the WebSocket connections waited in the accept queue.",
+		rp.AcceptQueue.WaitMs/1000)
+	metric("collider_accept_wait_seconds_count", "counter", "Number of WebSocket connections that waited in the accept queue.",
+		float64(rp.AcceptQueue.Waits))
+	metric("collider_broadcasts_active", "gauge", "Number of broadcasts in progress.", float64(rp.Broadcasts.Queue.Active))
+	metric("collider_broadcast_queue_depth", "gauge", "Number of broadcasts waiting for their turn.",
+		float64(rp.Broadcasts.Queue.Depth))
+	metric("collider_broadcasts_rejected_total", "counter", "Number of broadcasts rejected by the full broadcast queue.",
+		float64(rp.Broadcasts.Queue.Rejected))
+	metric("collider_broadcast_duration_seconds_sum", "counter", "Time the broadcasts took, waits included.",
+		rp.Broadcasts.DurationMs/1000)
+	metric("collider_broadcast_duration_seconds_count", "counter", "Number of broadcasts sent.", float64(rp.Broadcasts.Sent))
+	metric("collider_heap_bytes", "gauge", "Heap usage last read by the memory guard.", float64(rp.MemoryGuard.HeapBytes))
+	metric("collider_shed_stage", "gauge", "Load shedding stage engaged by the memory guard, 0 for none.",
+		float64(rp.MemoryGuard.Stage))
+	metric("collider_shed_refused_queued_total", "counter", "Number of messages not queued while shedding load.",
+		float64(rp.MemoryGuard.RefusedQueued))
+	metric("collider_shed_refused_connections_total", "counter", "Number of WebSocket connections rejected while shedding load.",
+		float64(rp.MemoryGuard.RefusedConns))
+	metric("collider_shed_dropped_messages_total", "counter", "Number of best-effort messages dropped while shedding load.",
+		float64(rp.MemoryGuard.DroppedBestEffort))
+
+	const disconnects = "collider_disconnects_total"
+	fmt.Fprintf(w, "# HELP %s Number of ended WebSocket connections by reason.\n# TYPE %s counter\n", disconnects, disconnects)
+	for _, r := range sortedKeys(rp.Disconnects) {
+		fmt.Fprintf(w, "%s{reason=%q} %d\n", disconnects, r, rp.Disconnects[r])
+	}
+
+	const holds = "collider_long_lock_holds_total"
+	fmt.Fprintf(w, "# HELP %s Number of holds of the room table lock beyond the warning threshold by operation.\n# TYPE %s counter\n",
+		holds, holds)
+	for _, op := range sortedKeys(rp.LongLockHolds) {
+		fmt.Fprintf(w, "%s{op=%q} %d\n", holds, op, rp.LongLockHolds[op])
+	}
+
+	const name = "collider_first_message_latency_seconds"
+	h := rp.FirstMsgLatency
+	fmt.Fprintf(w, "# HELP %s Time from a client's register to its first routed message.\n# TYPE %s histogram\n", name, name)
+	cumulative := 0
+	for i, b := range h.BucketsMs {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, float64(b)/1000, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.SumMs/1000, name, h.Count)
+
+	types := make([]string, 0, len(rp.RoomTypes))
+	for t := range rp.RoomTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	labelled := func(name string, typ string, help string, v func(roomTypeStats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, t := range types {
+			fmt.Fprintf(w, "%s{type=%q} %g\n", name, t, v(rp.RoomTypes[t]))
+		}
+	}
+	labelled("collider_rooms", "gauge", "Number of rooms.", func(s roomTypeStats) float64 { return float64(s.Rooms) })
+	labelled("collider_room_messages_total", "counter", "Number of messages sent in the rooms.",
+		func(s roomTypeStats) float64 { return float64(s.Messages) })
+
+	const duration = "collider_room_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Lifetime of the removed rooms.\n# TYPE %s summary\n", duration, duration)
+	for _, t := range types {
+		s := rp.RoomTypes[t]
+		fmt.Fprintf(w, "%s_sum{type=%q} %g\n%s_count{type=%q} %d\n", duration, t, s.DurationSec, duration, t, s.ClosedRooms)
+	}
+}
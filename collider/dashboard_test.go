@@ -6,10 +6,14 @@
 package collider
 
 import (
+	"bytes"
 	"collidertest"
 	"errors"
 	"log"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -100,3 +104,147 @@ func TestDashboardHttpErr(t *testing.T) {
 		t.Errorf("db.getReport().HttpErrs is %d, want 1", r.HttpErrs)
 	}
 }
+
+func TestDashboardFirstMsgLatency(t *testing.T) {
+	c := createNewCollider()
+	rid := "latency"
+	for _, cid := range []string{"1", "2"} {
+		if err := c.roomTable.register(rid, cid, &collidertest.MockReadWriteCloser{Closed: false}); err != nil {
+			t.Fatalf("roomTable.register(%q, %q, ...) got error: %v, want nil", rid, cid, err)
+		}
+	}
+	r := c.dash.getReport(c.roomTable)
+	if r.FirstMsgLatency.Count != 0 {
+		t.Errorf("Before any message, db.getReport().FirstMsgLatency.Count is %d, want 0", r.FirstMsgLatency.Count)
+	}
+
+	// The first message is recorded for both the sender and the receiver, the next one for neither.
+	for i := 0; i < 2; i++ {
+		if err := c.roomTable.send(rid, "1", "send", "hi"); err != nil {
+			t.Fatalf("roomTable.send(%q, 1, send, hi) got error: %v, want nil", rid, err)
+		}
+	}
+	r = c.dash.getReport(c.roomTable)
+	if r.FirstMsgLatency.Count != 2 {
+		t.Errorf("After two sends, db.getReport().FirstMsgLatency.Count is %d, want 2", r.FirstMsgLatency.Count)
+	}
+	if n := r.FirstMsgLatency.Counts[0]; n != 2 {
+		t.Errorf("After two immediate sends, the first latency bucket is %d, want 2", n)
+	}
+}
+
+func TestStatusReportCached(t *testing.T) {
+	c := createNewCollider()
+	c.StatusCacheInterval = time.Hour
+	c.roomTable.register("cached", "1", &collidertest.MockReadWriteCloser{Closed: false})
+	if r := c.statusReport(); r.OpenWs != 1 {
+		t.Fatalf("statusReport().OpenWs is %d, want 1", r.OpenWs)
+	}
+
+	c.roomTable.register("cached", "2", &collidertest.MockReadWriteCloser{Closed: false})
+	if r := c.statusReport(); r.OpenWs != 1 {
+		t.Errorf("Within StatusCacheInterval, statusReport().OpenWs is %d, want the cached 1", r.OpenWs)
+	}
+	c.StatusCacheInterval = 0
+	if r := c.statusReport(); r.OpenWs != 2 {
+		t.Errorf("Without StatusCacheInterval, statusReport().OpenWs is %d, want 2", r.OpenWs)
+	}
+}
+
+// benchmarkSend measures the latency of relaying a message between two clients while |reporters|
+// goroutines keep building the status report.
+func benchmarkSend(b *testing.B, reporters int) {
+	c := createNewCollider()
+	rid := "bench"
+	for _, cid := range []string{"1", "2"} {
+		if err := c.roomTable.register(rid, cid, &collidertest.MockReadWriteCloser{Closed: false}); err != nil {
+			b.Fatalf("roomTable.register(%q, %q) got error: %v, want nil", rid, cid, err)
+		}
+	}
+	// Other rooms make each report walk a busy table.
+	for i := 0; i < 1000; i++ {
+		if err := c.roomTable.send("idle"+strconv.Itoa(i), "1", "send", "hi"); err != nil {
+			b.Fatalf("roomTable.send to idle room %d got error: %v, want nil", i, err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < reporters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					c.dash.getReport(c.roomTable)
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.roomTable.send(rid, "1", "send", "hi"); err != nil {
+			b.Fatalf("roomTable.send got error: %v, want nil", err)
+		}
+	}
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkSend(b *testing.B) {
+	benchmarkSend(b, 0)
+}
+
+// Compare with BenchmarkSend: concurrent status reports should only add a small constant to the send latency.
+func BenchmarkSendUnderStatusLoad(b *testing.B) {
+	benchmarkSend(b, 4)
+}
+
+func TestDashboardRoomTypeMetrics(t *testing.T) {
+	c := createNewCollider()
+	c.RoomTypes = []string{"call", "broadcast"}
+	for _, r := range []struct{ rid, typ string }{{"a", "call"}, {"b", "call"}, {"c", "broadcast"}, {"d", "bogus"}, {"e", ""}} {
+		c.roomTable.register(r.rid, "1", &collidertest.MockReadWriteCloser{Closed: false})
+		c.roomTable.setRoomType(r.rid, r.typ)
+	}
+	c.roomTable.allowMessage("a")
+	c.roomTable.allowMessage("b")
+	c.roomTable.allowMessage("c")
+	c.roomTable.closeRoom("c")
+
+	r := c.dash.getReport(c.roomTable)
+	want := map[string]roomTypeStats{
+		"call":          {Rooms: 2, Messages: 2},
+		"broadcast":     {Rooms: 0, Messages: 1, ClosedRooms: 1},
+		otherRoomType:   {Rooms: 1},
+		defaultRoomType: {Rooms: 1},
+	}
+	for typ, w := range want {
+		got := r.RoomTypes[typ]
+		got.DurationSec = 0
+		if got != w {
+			t.Errorf("db.getReport().RoomTypes[%q] is %+v, want %+v", typ, got, w)
+		}
+	}
+	if len(r.RoomTypes) != len(want) {
+		t.Errorf("db.getReport().RoomTypes is %v, want only the types %v", r.RoomTypes, want)
+	}
+
+	var buf bytes.Buffer
+	r.writePrometheus(&buf)
+	for _, line := range []string{
+		`collider_rooms{type="call"} 2`,
+		`collider_room_messages_total{type="broadcast"} 1`,
+		`collider_room_duration_seconds_count{type="broadcast"} 1`,
+		`collider_rooms{type="other"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("The Prometheus exposition is missing %q:\n%s", line, buf.String())
+		}
+	}
+}
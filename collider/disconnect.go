@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"io"
+	"net"
+)
+
+// DisconnectReason is why a WebSocket connection ended. It labels the disconnect metrics.
+type DisconnectReason string
+
+const (
+	// DisconnectEOF is the client closing the connection or leaving.
+	DisconnectEOF DisconnectReason = "eof"
+	// DisconnectIdleTimeout is the client sending nothing until the read deadline, or missing its pings.
+	DisconnectIdleTimeout DisconnectReason = "idle_timeout"
+	// DisconnectNeverRegistered is the client sending no register request until the read deadline.
+	DisconnectNeverRegistered DisconnectReason = "never_registered"
+	// DisconnectPolicy is the client sending an invalid message or exceeding a limit.
+	DisconnectPolicy DisconnectReason = "policy_violation"
+	// DisconnectKicked is the server removing the client, e.g. when an admin closes its room.
+	DisconnectKicked DisconnectReason = "kicked"
+	// DisconnectTakeover is another connection registering or resuming the client ID in the room.
+	DisconnectTakeover DisconnectReason = "takeover"
+	// DisconnectRoomExpired is the room being removed after RoomTTL without activity.
+	DisconnectRoomExpired DisconnectReason = "room_expired"
+	// DisconnectStalled is the room being closed under CloseStalledRooms once a call stalled.
+	DisconnectStalled DisconnectReason = "call_stalled"
+	// DisconnectShutdown is the server stopping.
+	DisconnectShutdown DisconnectReason = "shutdown"
+	// DisconnectWriteFailure is a write to the client failing.
+	DisconnectWriteFailure DisconnectReason = "write_failure"
+	// DisconnectError is any other error reading from the connection.
+	DisconnectError DisconnectReason = "error"
+)
+
+// closeFor closes the connection, recording |r| as the reason unless one is already recorded.
+// Writers other than a serialConn are closed if they can be.
+func closeFor(w io.Writer, r DisconnectReason) {
+	if sc, ok := w.(*serialConn); ok {
+		sc.closeFor(r)
+	} else if cl, ok := w.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// readErrReason returns the reason a connection ended when reading from it failed with |err|.
+func readErrReason(err error) DisconnectReason {
+	if err == io.EOF {
+		return DisconnectEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return DisconnectIdleTimeout
+	}
+	return DisconnectError
+}
+
+// disconnectReason returns why the connection ended: the reason recorded by whoever closed it if any,
+// or shutdown while the server is stopping, or else |r|, the reason the read loop ended.
+func (c *Collider) disconnectReason(conn *serialConn, r DisconnectReason) DisconnectReason {
+	if cr := conn.closeReason(); cr != "" {
+		return cr
+	}
+	if c.isStopping() {
+		return DisconnectShutdown
+	}
+	return r
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"errors"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestReadErrReason(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want DisconnectReason
+	}{
+		{io.EOF, DisconnectEOF},
+		{timeoutErr{}, DisconnectIdleTimeout},
+		{errors.New("connection reset by peer"), DisconnectError},
+	} {
+		if got := readErrReason(tc.err); got != tc.want {
+			t.Errorf("readErrReason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+// Tests that the ended connections are counted by reason.
+func TestDisconnectMetricsByReason(t *testing.T) {
+	setup()
+	cl.UnregisteredReadTimeout = 50 * time.Millisecond
+	defer func() { cl.UnregisteredReadTimeout = 0 }()
+
+	before := cl.dash.getReport(cl.roomTable).Disconnects
+	want := map[DisconnectReason]int{}
+
+	// The client closes the connection.
+	rid := "disconnect-reasons"
+	c1 := addWsClient(t, rid, "1")
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	c1.Close()
+	want[DisconnectEOF] += 1
+
+	// The client sends an invalid message.
+	c2, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer c2.Close()
+	websocket.Message.Send(c2, "not json")
+	want[DisconnectPolicy] += 1
+
+	// An admin closes the room of the client.
+	c3 := addWsClient(t, rid+"-kicked", "3")
+	defer c3.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid+"-kicked", "3") })
+	req, _ := http.NewRequest("DELETE", "http://"+serverAddr+"/admin/rooms/"+rid+"-kicked", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("DELETE /admin/rooms/%s-kicked got error: %v, want nil", rid, err)
+	} else {
+		resp.Body.Close()
+	}
+	want[DisconnectKicked] += 1
+
+	// Another connection takes the client ID over.
+	c5 := addWsClient(t, rid+"-takeover", "5")
+	defer c5.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid+"-takeover", "5") })
+	c6 := addWsClient(t, rid+"-takeover", "5")
+	defer c6.Close()
+	want[DisconnectTakeover] += 1
+
+	// The client never registers.
+	c4, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer c4.Close()
+	want[DisconnectNeverRegistered] += 1
+
+	counted := func() bool {
+		got := cl.dash.getReport(cl.roomTable).Disconnects
+		for r, n := range want {
+			if got[string(r)]-before[string(r)] != n {
+				return false
+			}
+		}
+		return true
+	}
+	if !waitForCondition(counted) {
+		got := cl.dash.getReport(cl.roomTable).Disconnects
+		for r, n := range want {
+			if d := got[string(r)] - before[string(r)]; d != n {
+				t.Errorf("%d disconnects counted for %q, want %d", d, r, n)
+			}
+		}
+	}
+}
+
+// Tests that the connections are given 10 seconds to register by default, or the read timeout if shorter.
+func TestUnregisteredReadTimeoutDefault(t *testing.T) {
+	c := createNewCollider()
+	for _, tc := range []struct {
+		read, unregistered, want time.Duration
+	}{
+		{0, 0, 10 * time.Second},
+		{time.Second, 0, time.Second},
+		{time.Minute, 0, 10 * time.Second},
+		{time.Minute, 30 * time.Second, 30 * time.Second},
+	} {
+		c.ReadTimeout, c.UnregisteredReadTimeout = tc.read, tc.unregistered
+		if got := c.readTimeout(false); got != tc.want {
+			t.Errorf("With ReadTimeout %v and UnregisteredReadTimeout %v, readTimeout(false) = %v, want %v",
+				tc.read, tc.unregistered, got, tc.want)
+		}
+	}
+}
+
+// Tests that a connection sending nothing after the handshake is closed on the pre-register deadline and
+// counted as never registered.
+func TestWsSilentConnectionReaped(t *testing.T) {
+	setup()
+	cl.UnregisteredReadTimeout = 50 * time.Millisecond
+	defer func() { cl.UnregisteredReadTimeout = 0 }()
+	before := cl.dash.getReport(cl.roomTable).Disconnects[string(DisconnectNeverRegistered)]
+
+	silent, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer silent.Close()
+	closed := make(chan bool)
+	go func() {
+		var data string
+		for websocket.Message.Receive(silent, &data) == nil {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("The silent connection is still open after 1s, want closed after %v", cl.UnregisteredReadTimeout)
+	}
+
+	counted := func() bool {
+		return cl.dash.getReport(cl.roomTable).Disconnects[string(DisconnectNeverRegistered)] == before+1
+	}
+	if !waitForCondition(counted) {
+		t.Errorf("The silent connection was not counted as a %q disconnect", DisconnectNeverRegistered)
+	}
+}
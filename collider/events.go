@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of events buffered for an admin subscriber before it is considered too slow and dropped.
+const maxEventSubBuffer = 64
+
+// Event types published on the event bus.
+const (
+	evRoomCreated        = "room_created"
+	evRoomRemoved        = "room_removed"
+	evClientRegistered   = "client_registered"
+	evClientDeregistered = "client_deregistered"
+	evClientRemoved      = "client_removed"
+	evWsError            = "ws_error"
+	evHttpError          = "http_error"
+)
+
+// event is a lifecycle or error event streamed to admin subscribers.
+type event struct {
+	Time     time.Time `json:"t"`
+	Type     string    `json:"type"`
+	RoomID   string    `json:"roomid,omitempty"`
+	ClientID string    `json:"clientid,omitempty"`
+	Msg      string    `json:"msg,omitempty"`
+}
+
+// eventSub is a single subscriber of the event bus with its optional filters.
+type eventSub struct {
+	ch     chan event
+	roomID string
+	types  map[string]bool
+	closed bool
+}
+
+// matches returns true if the event passes the subscriber's filters.
+func (s *eventSub) matches(e event) bool {
+	if s.roomID != "" && s.roomID != e.RoomID {
+		return false
+	}
+	if len(s.types) > 0 && !s.types[e.Type] {
+		return false
+	}
+	return true
+}
+
+// A thread-safe fan-out of events to the admin subscribers.
+type eventBus struct {
+	lock sync.Mutex
+	subs map[*eventSub]bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*eventSub]bool)}
+}
+
+// subscribe adds a subscriber that receives every event until a filter is set.
+func (eb *eventBus) subscribe() *eventSub {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	s := &eventSub{ch: make(chan event, maxEventSubBuffer)}
+	eb.subs[s] = true
+	return s
+}
+
+// setFilter restricts the subscriber to the room |rid| and the event |types|. Empty values match everything.
+func (eb *eventBus) setFilter(s *eventSub, rid string, types []string) {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	s.roomID = rid
+	s.types = nil
+	if len(types) > 0 {
+		s.types = make(map[string]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+}
+
+// unsubscribe removes the subscriber and closes its channel. It is safe to call more than once.
+func (eb *eventBus) unsubscribe(s *eventSub) {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	eb.unsubscribeLocked(s)
+}
+
+func (eb *eventBus) unsubscribeLocked(s *eventSub) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(eb.subs, s)
+	close(s.ch)
+}
+
+// publish delivers the event to the matching subscribers without blocking.
+// A subscriber whose buffer is full is dropped so that it cannot stall the server.
+func (eb *eventBus) publish(e event) {
+	if eb == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	for s := range eb.subs {
+		if !s.matches(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			eb.unsubscribeLocked(s)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"testing"
+)
+
+// Tests that events are delivered only to the subscribers whose filters match.
+func TestEventBusFilter(t *testing.T) {
+	eb := newEventBus()
+	all := eb.subscribe()
+	room := eb.subscribe()
+	eb.setFilter(room, "a", []string{evClientRegistered})
+
+	eb.publish(event{Type: evClientRegistered, RoomID: "a"})
+	eb.publish(event{Type: evClientRegistered, RoomID: "b"})
+	eb.publish(event{Type: evRoomCreated, RoomID: "a"})
+
+	if l := len(all.ch); l != 3 {
+		t.Errorf("Unfiltered subscriber got %d events, want 3", l)
+	}
+	if l := len(room.ch); l != 1 {
+		t.Errorf("Subscriber filtered on room %q got %d events, want 1", "a", l)
+	}
+}
+
+// Tests that a subscriber that does not drain its buffer is dropped.
+func TestEventBusDropsSlowSubscriber(t *testing.T) {
+	eb := newEventBus()
+	s := eb.subscribe()
+	for i := 0; i <= maxEventSubBuffer; i++ {
+		eb.publish(event{Type: evRoomCreated})
+	}
+
+	if len(eb.subs) != 0 {
+		t.Errorf("After overflowing the subscriber buffer, eventBus.subs = %v, want empty", eb.subs)
+	}
+	n := 0
+	for range s.ch {
+		n++
+	}
+	if n != maxEventSubBuffer {
+		t.Errorf("Slow subscriber drained %d events, want %d", n, maxEventSubBuffer)
+	}
+}
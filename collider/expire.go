@@ -0,0 +1,65 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"io"
+	"time"
+)
+
+// How often the rooms are checked against RoomTTL, unless half of RoomTTL is shorter.
+const roomSweepInterval = 10 * time.Second
+
+// touch records activity in the room. The caller must hold the lock of the shard of the room.
+func (rm *room) touch() {
+	rm.lastActive = time.Now()
+}
+
+// sweepRooms removes the rooms idle for |ttl| until |stop| is closed.
+func (c *Collider) sweepRooms(ttl time.Duration, stop <-chan struct{}) {
+	d := roomSweepInterval
+	if ttl/2 < d {
+		d = ttl / 2
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		c.roomTable.expireRooms(ttl, time.Now())
+	}
+}
+
+// expireRooms disconnects the clients of the rooms without a register or a message since |ttl| before |now|,
+// sending them a ROOM_EXPIRED error, and removes the rooms. It returns the number of rooms removed. Each room
+// is checked and removed under the lock of its shard, so a concurrent message keeps the room; the clients are
+// written to once the locks are released.
+func (rt *roomTable) expireRooms(ttl time.Duration, now time.Time) int {
+	n := 0
+	var conns []io.ReadWriteCloser
+	rt.eachShard(func(s *roomShard) {
+		for rid, r := range s.rooms {
+			if now.Sub(r.lastActive) < ttl {
+				continue
+			}
+			rt.logger().Printf("Removing room %s, idle since %s", rid, r.lastActive.Format(time.RFC3339))
+			for _, c := range r.clients {
+				conns = append(conns, c.detachConns()...)
+				c.deregister(DisconnectRoomExpired)
+			}
+			rt.removeRoomLocked(rid)
+			n += 1
+		}
+	})
+	for _, rwc := range conns {
+		sendServerErrCode(rwc, errCodeRoomExpired, "Room expired")
+		closeFor(rwc, DisconnectRoomExpired)
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"collidertest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that only the rooms idle for the TTL are removed, their clients told and disconnected, and that a
+// message keeps a room.
+func TestExpireRooms(t *testing.T) {
+	c := createNewCollider()
+	rt := c.roomTable
+	idle, busy := collidertest.MockReadWriteCloser{}, collidertest.MockReadWriteCloser{}
+	rt.register("idle", "1", &idle)
+	rt.register("busy", "1", &busy)
+	past := time.Now().Add(-time.Hour)
+	rt.lookupRoom("idle").lastActive = past
+	rt.lookupRoom("busy").lastActive = past
+	rt.send("busy", "1", "send", "still here")
+
+	if n := rt.expireRooms(time.Minute, time.Now()); n != 1 {
+		t.Errorf("expireRooms got %d rooms removed, want 1", n)
+	}
+	if rt.lookupRoom("idle") != nil {
+		t.Error("After expireRooms, the idle room exists, want it removed")
+	}
+	if !idle.Closed || !strings.Contains(idle.Msg, errCodeRoomExpired) {
+		t.Errorf("The client of the idle room got %q and closed = %t, want a %s error and closed",
+			idle.Msg, idle.Closed, errCodeRoomExpired)
+	}
+	if rt.lookupRoom("busy") == nil || busy.Closed {
+		t.Error("After expireRooms, the room with a recent message is removed, want it kept")
+	}
+}
+
+// Tests that the sweeper removes the rooms idle for the TTL and returns once stopped.
+func TestSweepRooms(t *testing.T) {
+	c := createNewCollider()
+	rwc := collidertest.MockReadWriteCloser{}
+	c.roomTable.register("abandoned", "1", &rwc)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		c.sweepRooms(20*time.Millisecond, stop)
+	}()
+	if !waitForCondition(func() bool { return c.roomTable.roomCount() == 0 }) {
+		t.Errorf("After the TTL, the table has %d rooms, want the idle room removed", c.roomTable.roomCount())
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("sweepRooms did not return once stopped")
+	}
+}
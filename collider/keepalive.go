@@ -0,0 +1,176 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The number of consecutive pings a client may leave unanswered when MaxMissedPings is not set.
+const defaultMaxMissedPings = 3
+
+// The size of the read and write buffers of a WebSocket connection when ReadBufferSize or WriteBufferSize
+// is not set, the same as the HTTP server's.
+const defaultConnBufferSize = 4096
+
+// connActivity counts the reads from a WebSocket connection, including the control frames such as pongs
+// that the websocket package handles without surfacing them.
+type connActivity struct {
+	// reads is the number of reads that returned data. Accessed atomically.
+	reads uint64
+}
+
+type connActivityKey struct{}
+
+// activityReader counts the reads from the connection in its connActivity.
+type activityReader struct {
+	r   *bufio.Reader
+	act *connActivity
+}
+
+func (ar activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&ar.act.reads, 1)
+	}
+	return n, err
+}
+
+// activityWriter is a ResponseWriter whose hijacked connection counts its reads and is buffered with
+// buffers of the configured sizes.
+type activityWriter struct {
+	http.ResponseWriter
+	act   *connActivity
+	rsize int
+	wsize int
+}
+
+func (w activityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking not supported")
+	}
+	conn, buf, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The HTTP server's reader may already hold the first frames, so it is wrapped rather than replaced.
+	// Once it is empty, reads at least as large as its buffer bypass it.
+	buf.Reader = bufio.NewReaderSize(activityReader{r: buf.Reader, act: w.act}, w.rsize)
+	if err := buf.Writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	buf.Writer = bufio.NewWriterSize(conn, w.wsize)
+	return conn, buf, nil
+}
+
+// trackActivity wraps the WebSocket handler so that keepalive can tell whether the client answered its pings,
+// and sizes the buffers of the connection.
+func (c *Collider) trackActivity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		act := &connActivity{}
+		aw := activityWriter{w, act, bufferSize(c.ReadBufferSize), bufferSize(c.WriteBufferSize)}
+		h.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), connActivityKey{}, act)))
+	})
+}
+
+// bufferSize returns the configured connection buffer size, or the default one if it is not set.
+func bufferSize(n int) int {
+	if n > 0 {
+		return n
+	}
+	return defaultConnBufferSize
+}
+
+// activityOf returns the activity counter of the connection, or nil if it is not tracked.
+func activityOf(ws *websocket.Conn) *connActivity {
+	act, _ := ws.Request().Context().Value(connActivityKey{}).(*connActivity)
+	return act
+}
+
+// maxMissedPings returns the number of consecutive pings a client may leave unanswered.
+func (c *Collider) maxMissedPings() int {
+	if c.MaxMissedPings > 0 {
+		return c.MaxMissedPings
+	}
+	return defaultMaxMissedPings
+}
+
+// pingWatch counts the pings a connection left unanswered in a row. Any frame received from the client since
+// the previous ping, a pong or otherwise, resets the count.
+type pingWatch struct {
+	act    *connActivity
+	last   uint64
+	missed int
+}
+
+func newPingWatch(act *connActivity) *pingWatch {
+	return &pingWatch{act: act, last: atomic.LoadUint64(&act.reads)}
+}
+
+// onPing is called before each ping and returns the number of pings left unanswered in a row.
+func (pw *pingWatch) onPing() int {
+	if reads := atomic.LoadUint64(&pw.act.reads); reads != pw.last {
+		pw.last, pw.missed = reads, 0
+	} else {
+		pw.missed += 1
+	}
+	return pw.missed
+}
+
+// checkPings is called before each ping of the connection. Once the client has left maxMissedPings pings in
+// a row unanswered, it is sent a PING_TIMEOUT error, the connection is closed and false is returned.
+func (c *Collider) checkPings(conn *serialConn, pw *pingWatch) bool {
+	if missed := pw.onPing(); missed >= c.maxMissedPings() {
+		c.logger().Printf("Closing connection %s after %d missed pings", conn.id, missed)
+		c.wsErrorCode(errCodePingTimeout, "Ping timeout", conn)
+		conn.closeFor(DisconnectIdleTimeout)
+		return false
+	}
+	return true
+}
+
+// keepalive pings the connection every PingInterval until |stop| is closed, disconnecting the client once it
+// leaves too many pings unanswered (see checkPings).
+func (c *Collider) keepalive(conn *serialConn, act *connActivity, stop <-chan struct{}) {
+	t := time.NewTicker(c.PingInterval)
+	defer t.Stop()
+
+	pw := newPingWatch(act)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if !c.checkPings(conn, pw) {
+			return
+		}
+		if err := conn.ping(c.PingInterval); err != nil {
+			return
+		}
+	}
+}
+
+// warnIdle sends the connection an idle_warning frame IdleWarning before its read timeout of |timeout|
+// expires, unless the returned func is called first.
+func (c *Collider) warnIdle(conn *serialConn, timeout time.Duration) func() {
+	if c.IdleWarning <= 0 || c.IdleWarning >= timeout {
+		return func() {}
+	}
+	t := time.AfterFunc(timeout-c.IdleWarning, func() {
+		send(conn, idleWarningMsg{Type: "idle_warning", TimeoutMs: int64(c.IdleWarning / time.Millisecond)})
+	})
+	return func() { t.Stop() }
+}
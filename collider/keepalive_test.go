@@ -0,0 +1,364 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests that a frame received from the client resets the count of missed pings, and that a client leaving
+// MaxMissedPings pings in a row unanswered is sent PING_TIMEOUT and disconnected.
+func TestCheckPingsDisconnectsAfterMissedPings(t *testing.T) {
+	setup()
+	cl.MaxMissedPings = 2
+	defer func() { cl.MaxMissedPings = 0 }()
+	checked := make(chan []bool, 1)
+	srv := httptest.NewServer(cl.trackActivity(websocket.Handler(func(ws *websocket.Conn) {
+		conn := &serialConn{Conn: ws, ser: jsonSerializer{}}
+		pw := newPingWatch(activityOf(ws))
+		// The first ping is missed, then the frame of the client resets the count before the next two are.
+		got := []bool{cl.checkPings(conn, pw)}
+		var data string
+		websocket.Message.Receive(ws, &data)
+		for i := 0; i < 3; i++ {
+			got = append(got, cl.checkPings(conn, pw))
+		}
+		checked <- got
+	})))
+	defer srv.Close()
+
+	config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/", "http://localhost/")
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("websocket.DialConfig got error: %v, want nil", err)
+	}
+	defer ws.Close()
+	write(t, ws, wsClientMsg{Cmd: "heartbeat"})
+
+	want := []bool{true, true, true, false}
+	if got := <-checked; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("checkPings got %v, want %v", got, want)
+	}
+	expectReceiveErrorCode(t, ws, errCodePingTimeout)
+	var data string
+	if err := websocket.Message.Receive(ws, &data); err == nil {
+		t.Errorf("After PING_TIMEOUT, websocket.Message.Receive got %q, want the connection closed", data)
+	}
+}
+
+// Tests that a client leaving MaxMissedPings pings in a row unanswered is sent PING_TIMEOUT and disconnected.
+func TestKeepaliveDisconnectsAfterMissedPings(t *testing.T) {
+	setup()
+	cl.PingInterval, cl.MaxMissedPings = 20*time.Millisecond, 2
+	defer func() { cl.PingInterval, cl.MaxMissedPings = 0, 0 }()
+
+	s := cl.events.subscribe()
+	defer cl.events.unsubscribe(s)
+	cl.events.setFilter(s, "", []string{evWsError})
+
+	rid, cid := "keepalive-missed", "1"
+	c := addWsClient(t, rid, cid)
+	defer c.Close()
+
+	// The client does not read, so it never answers the pings.
+	if !waitForCondition(func() bool { return cl.roomTable.hasClient(rid, cid) && !cl.roomTable.isRegistered(rid, cid) }) {
+		t.Fatalf("After missing %d pings, client %s is still registered, want disconnected", cl.MaxMissedPings, cid)
+	}
+	select {
+	case e := <-s.ch:
+		if e.Msg != "Ping timeout" {
+			t.Errorf("Got event %+v, want the ping timeout", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("No ws_error event for the ping timeout")
+	}
+	// The pings still buffered are answered, failing once the client reaches the closed connection.
+	var data string
+	for i := 0; i < 10; i++ {
+		if err := websocket.Message.Receive(c, &data); err != nil {
+			return
+		}
+	}
+	t.Errorf("After PING_TIMEOUT, websocket.Message.Receive keeps receiving, want the connection closed")
+}
+
+// Tests that a client answering the pings stays connected.
+func TestKeepaliveKeepsAnsweringClient(t *testing.T) {
+	setup()
+	cl.PingInterval, cl.MaxMissedPings = 20*time.Millisecond, 2
+	defer func() { cl.PingInterval, cl.MaxMissedPings = 0, 0 }()
+
+	rid, cid := "keepalive-answered", "1"
+	c := addWsClient(t, rid, cid)
+	defer c.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+
+	// Reading makes the client answer the pings with pongs.
+	go func() {
+		var data string
+		for websocket.Message.Receive(c, &data) == nil {
+		}
+	}()
+	time.Sleep(10 * cl.PingInterval)
+	if !cl.roomTable.isRegistered(rid, cid) {
+		t.Errorf("After answering the pings, client %s is not registered, want registered", cid)
+	}
+}
+
+// Tests that the pings of the server do not corrupt the pongs it writes while the client is pinging it.
+func TestSerialConnPingWhileClientPings(t *testing.T) {
+	const pings = 200
+	pinged := make(chan error, 1)
+	var overlaps int64
+	srv := httptest.NewUnstartedServer(websocket.Handler(func(ws *websocket.Conn) {
+		conn := &serialConn{Conn: ws, ser: jsonSerializer{}}
+		// Reading answers the pings of the client with pongs.
+		go func() {
+			var data string
+			for websocket.Message.Receive(ws, &data) == nil {
+			}
+		}()
+		for i := 0; i < pings; i++ {
+			if err := conn.ping(time.Second); err != nil {
+				pinged <- err
+				return
+			}
+		}
+		pinged <- nil
+		conn.Write([]byte("done"))
+		var data string
+		websocket.Message.Receive(ws, &data)
+	}))
+	srv.Listener = overlapListener{srv.Listener, &overlaps}
+	srv.Start()
+	defer srv.Close()
+
+	config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/", "http://localhost/")
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("websocket.DialConfig got error: %v, want nil", err)
+	}
+	defer ws.Close()
+	received := make(chan error, 1)
+	go func() {
+		var data string
+		err := websocket.Message.Receive(ws, &data)
+		if err == nil && data != "done" {
+			err = fmt.Errorf("got %q, want \"done\"", data)
+		}
+		received <- err
+	}()
+
+	ws.PayloadType = websocket.PingFrame
+	payload := bytes.Repeat([]byte("p"), 125)
+	for i := 0; i < pings; i++ {
+		if _, err := ws.Write(payload); err != nil {
+			t.Fatalf("Writing ping %d got error: %v, want nil", i, err)
+		}
+	}
+	if err := <-pinged; err != nil {
+		t.Errorf("ping got error: %v, want nil", err)
+	}
+	if err := <-received; err != nil {
+		t.Errorf("After the pings, websocket.Message.Receive got error: %v, want the frames intact", err)
+	}
+	if n := atomic.LoadInt64(&overlaps); n != 0 {
+		t.Errorf("Got %d frames written while another was, want none", n)
+	}
+}
+
+// countingListener counts the reads from the connections it accepts.
+type countingListener struct {
+	net.Listener
+	reads *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, l.reads}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	reads *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	atomic.AddInt64(c.reads, 1)
+	return c.Conn.Read(p)
+}
+
+// overlapListener counts the writes to the connections it accepts that start while another is in progress.
+type overlapListener struct {
+	net.Listener
+	overlaps *int64
+}
+
+func (l overlapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &overlapConn{Conn: conn, overlaps: l.overlaps}, nil
+}
+
+type overlapConn struct {
+	net.Conn
+	writing  int32
+	overlaps *int64
+}
+
+func (c *overlapConn) Write(p []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		defer atomic.StoreInt32(&c.writing, 0)
+	} else {
+		atomic.AddInt64(c.overlaps, 1)
+	}
+	// Widens the window in which another write may start.
+	time.Sleep(50 * time.Microsecond)
+	return c.Conn.Write(p)
+}
+
+// burstConn holds the writes while holding is set, then sends them in a single write.
+type burstConn struct {
+	net.Conn
+	lock    sync.Mutex
+	holding bool
+	buf     bytes.Buffer
+}
+
+func (c *burstConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.holding {
+		return c.buf.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *burstConn) hold() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.holding = true
+}
+
+func (c *burstConn) flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.holding = false
+	_, err := c.buf.WriteTo(c.Conn)
+	return err
+}
+
+// Measures the reads from the connection, each a syscall, taken to receive a burst of ICE candidates
+// with different read buffer sizes.
+func BenchmarkReadBufferCandidateBurst(b *testing.B) {
+	const burst = 40
+	cand := wsClientMsg{
+		Cmd: "send",
+		Msg: `{"type":"candidate","candidate":"candidate:842163049 1 udp 1677729535 203.0.113.7 3478 typ srflx ` +
+			`raddr 10.0.0.2 rport 52000 generation 0 ufrag Xy12 network-cost 999","sdpMid":"0","sdpMLineIndex":0}`,
+	}
+	for _, size := range []int{1024, 4096, 16384, 65536} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			c := &Collider{ReadBufferSize: size}
+			var reads int64
+			srv := httptest.NewUnstartedServer(c.trackActivity(websocket.Handler(func(ws *websocket.Conn) {
+				var data []byte
+				for {
+					for i := 0; i < burst; i++ {
+						if websocket.Message.Receive(ws, &data) != nil {
+							return
+						}
+					}
+					websocket.Message.Send(ws, "ok")
+				}
+			})))
+			srv.Listener = countingListener{srv.Listener, &reads}
+			srv.Start()
+			defer srv.Close()
+
+			config, err := websocket.NewConfig("ws"+srv.URL[len("http"):], "http://localhost")
+			if err != nil {
+				b.Fatalf("websocket.NewConfig got error: %v", err)
+			}
+			tcp, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				b.Fatalf("net.Dial got error: %v", err)
+			}
+			bc := &burstConn{Conn: tcp}
+			ws, err := websocket.NewClient(config, bc)
+			if err != nil {
+				b.Fatalf("websocket.NewClient got error: %v", err)
+			}
+			defer ws.Close()
+
+			frame, _ := json.Marshal(cand)
+			var ack string
+			start := atomic.LoadInt64(&reads)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bc.hold()
+				for j := 0; j < burst; j++ {
+					websocket.Message.Send(ws, frame)
+				}
+				if err := bc.flush(); err != nil {
+					b.Fatalf("Writing the burst got error: %v", err)
+				}
+				if err := websocket.Message.Receive(ws, &ack); err != nil {
+					b.Fatalf("websocket.Message.Receive got error: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&reads)-start)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// Tests that a silent client is warned before its read timeout, and that a heartbeat in response keeps it
+// connected past the timeout.
+func TestWsIdleWarning(t *testing.T) {
+	setup()
+	cl.ReadTimeout, cl.IdleWarning = 200*time.Millisecond, 150*time.Millisecond
+	defer func() { cl.ReadTimeout, cl.IdleWarning = 0, 0 }()
+
+	rid, cid := "idle-warning", "1"
+	conn := addWsClient(t, rid, cid)
+	defer conn.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		var m idleWarningMsg
+		if err := websocket.JSON.Receive(conn, &m); err != nil {
+			t.Fatalf("Receiving the idle warning got error: %v, want nil", err)
+		}
+		if m != (idleWarningMsg{Type: "idle_warning", TimeoutMs: 150}) {
+			t.Errorf("Received %+v, want an idle_warning with timeoutMs 150", m)
+		}
+		write(t, conn, wsClientMsg{Cmd: "heartbeat"})
+	}
+	if d := time.Since(start); d < cl.ReadTimeout {
+		t.Errorf("Received 6 warnings in %v, want the heartbeats to keep the connection past %v", d, cl.ReadTimeout)
+	}
+	if !cl.roomTable.isRegistered(rid, cid) {
+		t.Errorf("After answering the idle warnings, the client is not registered, want registered")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timedMutex is a mutex reporting the operations that hold it longer than a threshold, to find the contention
+// hotspots of the room table. It only reports the long holds, never cutting them short.
+type timedMutex struct {
+	sync.Mutex
+	// threshold returns the hold time beyond which an operation is reported. Nil or zero reports nothing.
+	threshold func() time.Duration
+	// onLongHold is called with the operation and its hold time, once the mutex is released.
+	onLongHold func(op string, d time.Duration)
+	// at is when the mutex was acquired, or zero if the hold is not timed. Guarded by the mutex.
+	at time.Time
+}
+
+func (m *timedMutex) Lock() {
+	m.Mutex.Lock()
+	m.at = time.Time{}
+	if m.threshold != nil && m.threshold() > 0 {
+		m.at = time.Now()
+	}
+}
+
+func (m *timedMutex) Unlock() {
+	m.unlock(1)
+}
+
+// unlock releases the mutex, reporting a long hold as the operation of the function |skip| frames up the
+// stack from the caller of unlock.
+func (m *timedMutex) unlock(skip int) {
+	at := m.at
+	if at.IsZero() {
+		m.Mutex.Unlock()
+		return
+	}
+	d := time.Since(at)
+	if d <= m.threshold() || m.onLongHold == nil {
+		m.Mutex.Unlock()
+		return
+	}
+	// The caller is looked up before unlocking, but reported after so that the report may take other locks.
+	op := callerName(2 + skip)
+	m.Mutex.Unlock()
+	m.onLongHold(op, d)
+}
+
+// callerName returns the name of the function |skip| frames up the stack, without its package and receiver.
+func callerName(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// lockHoldWarning returns the hold time of the room table lock beyond which the operation is reported.
+func (rt *roomTable) lockHoldWarning() time.Duration {
+	if rt.parent == nil {
+		return 0
+	}
+	return rt.parent.LockHoldWarning
+}
+
+// onLongLockHold logs and counts an operation that held the room table lock for |d|.
+func (rt *roomTable) onLongLockHold(op string, d time.Duration) {
+	rt.logger().Printf("Room table lock held for %v by %s, over the %v warning threshold", d, op, rt.lockHoldWarning())
+	if rt.parent != nil {
+		rt.parent.dash.onLongLockHold(op)
+	}
+}
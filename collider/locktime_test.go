@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that an operation holding the room table lock beyond LockHoldWarning is logged and counted, and
+// that the quick ones are not.
+func TestLongLockHoldWarning(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := createNewCollider()
+	c.LockHoldWarning = 20 * time.Millisecond
+	// The grace period is looked up under the lock when the room is created.
+	c.ReconnectGrace = func(rid string) time.Duration {
+		if rid == "slow" {
+			time.Sleep(3 * c.LockHoldWarning)
+		}
+		return 0
+	}
+	c.roomTable.room("quick")
+	c.roomTable.room("slow")
+
+	if holds := c.dash.getReport(c.roomTable).LongLockHolds; len(holds) != 1 || holds["room"] != 1 {
+		t.Errorf("getReport().LongLockHolds = %v, want 1 hold by room", holds)
+	}
+	if !strings.Contains(buf.String(), "Room table lock held for") || !strings.Contains(buf.String(), "by room") {
+		t.Errorf("The log is %q, want the long hold by room reported", buf.String())
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// maintenanceMsg is the frame broadcast to every client to warn of an upcoming maintenance.
+type maintenanceMsg struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	EtaMs   int64  `json:"etaMs"`
+}
+
+// maintenanceRequest is the body of a POST to "/admin/maintenance".
+type maintenanceRequest struct {
+	Message string `json:"message"`
+	// EtaMs is the time left before the maintenance starts, in milliseconds.
+	EtaMs int64 `json:"etaMs"`
+	// Drain puts the server in draining mode, rejecting new WebSocket connections.
+	Drain bool `json:"drain"`
+}
+
+// maintenanceResult is the response to a POST to "/admin/maintenance".
+type maintenanceResult struct {
+	// Sent is the number of clients the maintenance frame was written to.
+	Sent     int  `json:"sent"`
+	Draining bool `json:"draining"`
+}
+
+// httpAdminMaintenanceHandler is a HTTP handler that handles POST requests to "/admin/maintenance" with a body
+// of { 'message': $MSG, 'etaMs': $ETA, 'drain': $DRAIN }. It broadcasts
+// { 'type': 'maintenance', 'message': $MSG, 'etaMs': $ETA } to the registered clients of every room and,
+// if 'drain' is true, first puts the server in draining mode.
+func (c *Collider) httpAdminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req maintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Drains before broadcasting so that no client connects in between and misses the warning.
+	if req.Drain {
+		c.setDraining(true)
+	}
+	n, err := c.roomTable.broadcast(maintenanceMsg{Type: "maintenance", Message: req.Message, EtaMs: req.EtaMs})
+	if err != nil {
+		c.audit(r, AuditEntry{Action: auditMaintenance, Result: "error: " + err.Error()})
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	c.audit(r, AuditEntry{Action: auditMaintenance, Result: "ok"})
+
+	w.Header().Set("Content-Type", "application/json")
+	send(w, maintenanceResult{Sent: n, Draining: c.isDraining()})
+}
+
+// setDraining turns draining mode on or off. While draining, the new WebSocket connections are rejected
+// with 503 and /healthz reports 503, but the connected clients are kept.
+func (c *Collider) setDraining(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.draining, v)
+}
+
+// isDraining returns true while the server is in draining mode.
+func (c *Collider) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// refuseDraining wraps the WebSocket handler to reject the handshake with 503 while the server is draining.
+func (c *Collider) refuseDraining(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.isDraining() {
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
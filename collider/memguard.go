@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The load shedding stages, each including the ones before it.
+const (
+	shedNone = iota
+	// shedQueueing refuses to queue the messages of the clients whose peer has not joined.
+	shedQueueing
+	// shedConns also rejects the new WebSocket connections with 503.
+	shedConns
+	// shedBestEffort also drops the best-effort messages, i.e. the presence notifications.
+	shedBestEffort
+)
+
+// The fractions of MaxHeapBytes at which the shedding stages engage, indexed by stage.
+var shedStageFractions = [...]float64{shedQueueing: 0.8, shedConns: 0.9, shedBestEffort: 1}
+
+// How often the heap usage is read when MemoryCheckInterval is not set.
+const defaultMemoryCheckInterval = time.Second
+
+// memGuard tracks the heap usage and the load shedding stage it calls for.
+type memGuard struct {
+	lock sync.Mutex
+	// read returns the heap usage in bytes. Nil reads it from the runtime.
+	read  func() uint64
+	heap  uint64
+	stage int
+	at    time.Time
+	// shed counts what each stage refused or dropped, indexed by stage.
+	shed [shedBestEffort + 1]int
+}
+
+// memGuardStats is the state of the memory guard shown in the status report.
+type memGuardStats struct {
+	HeapBytes uint64 `json:"heapbytes"`
+	Stage     int    `json:"stage"`
+	// RefusedQueued, RefusedConns and DroppedBestEffort count what each shedding stage refused or dropped.
+	RefusedQueued     int `json:"refusedqueued"`
+	RefusedConns      int `json:"refusedconns"`
+	DroppedBestEffort int `json:"droppedbesteffort"`
+}
+
+// readHeap returns the bytes of heap allocated by the process.
+func readHeap() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// update returns the shedding stage for a heap limit of |max| bytes, reading the heap usage again if it is
+// older than |interval|. Changes of stage are logged to |l|.
+func (mg *memGuard) update(max uint64, interval time.Duration, l *log.Logger) int {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+
+	if time.Since(mg.at) < interval {
+		return mg.stage
+	}
+	read := mg.read
+	if read == nil {
+		read = readHeap
+	}
+	mg.heap, mg.at = read(), time.Now()
+
+	stage := shedNone
+	for s := shedQueueing; s <= shedBestEffort; s++ {
+		if float64(mg.heap) >= shedStageFractions[s]*float64(max) {
+			stage = s
+		}
+	}
+	if stage != mg.stage {
+		l.Printf("Heap at %d of %d bytes, load shedding stage %d -> %d", mg.heap, max, mg.stage, stage)
+		mg.stage = stage
+	}
+	return stage
+}
+
+// onShed counts a message or connection refused or dropped by the shedding stage.
+func (mg *memGuard) onShed(stage int) {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	mg.shed[stage] += 1
+}
+
+func (mg *memGuard) stats() memGuardStats {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	return memGuardStats{
+		HeapBytes:         mg.heap,
+		Stage:             mg.stage,
+		RefusedQueued:     mg.shed[shedQueueing],
+		RefusedConns:      mg.shed[shedConns],
+		DroppedBestEffort: mg.shed[shedBestEffort],
+	}
+}
+
+// shedStage returns the load shedding stage called for by the heap usage, or shedNone if MaxHeapBytes is not set.
+func (c *Collider) shedStage() int {
+	if c.MaxHeapBytes == 0 {
+		return shedNone
+	}
+	interval := c.MemoryCheckInterval
+	if interval <= 0 {
+		interval = defaultMemoryCheckInterval
+	}
+	return c.mem.update(c.MaxHeapBytes, interval, c.logger())
+}
+
+// sheds returns true, counting the refusal, if the shedding stage |stage| is engaged.
+func (c *Collider) sheds(stage int) bool {
+	if c.shedStage() < stage {
+		return false
+	}
+	c.mem.onShed(stage)
+	return true
+}
+
+// shedConnections wraps the WebSocket handler to reject the handshake with 503 while the heap usage calls
+// for shedding the new connections.
+func (c *Collider) shedConnections(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.sheds(shedConns) {
+			http.Error(w, "Server is shedding load", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"collidertest"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the shedding stages engage in order as the heap grows towards MaxHeapBytes, and disengage
+// as it shrinks.
+func TestMemGuardShedsInStages(t *testing.T) {
+	c := createNewCollider()
+	c.MaxHeapBytes, c.MemoryCheckInterval = 1000, time.Nanosecond
+	var heap uint64
+	c.mem.read = func() uint64 { return heap }
+
+	cl, err := c.roomTable.room("shed").client("1")
+	if err != nil {
+		t.Fatalf("Creating the client got error: %v, want nil", err)
+	}
+	h := c.shedConnections(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	connect := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/ws", nil))
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		heap     uint64
+		stage    int
+		queues   bool
+		connCode int
+		delivers bool
+	}{
+		{100, shedNone, true, http.StatusOK, true},
+		{800, shedQueueing, false, http.StatusOK, true},
+		{900, shedConns, false, http.StatusServiceUnavailable, true},
+		{1000, shedBestEffort, false, http.StatusServiceUnavailable, false},
+		{500, shedNone, true, http.StatusOK, true},
+	} {
+		heap = tc.heap
+		if s := c.shedStage(); s != tc.stage {
+			t.Errorf("With a heap of %d bytes, the shedding stage is %d, want %d", tc.heap, s, tc.stage)
+		}
+		if err := cl.enqueue("m"); (err == nil) != tc.queues {
+			t.Errorf("With a heap of %d bytes, enqueue got error %v, want queued = %t", tc.heap, err, tc.queues)
+		}
+		if code := connect(); code != tc.connCode {
+			t.Errorf("With a heap of %d bytes, connecting got status %d, want %d", tc.heap, code, tc.connCode)
+		}
+		if shed := c.roomTable.sheds(shedBestEffort); shed == tc.delivers {
+			t.Errorf("With a heap of %d bytes, sheds(shedBestEffort) = %t, want %t", tc.heap, shed, !tc.delivers)
+		}
+	}
+
+	s := c.dash.getReport(c.roomTable).MemoryGuard
+	if s.HeapBytes != 500 || s.RefusedQueued != 3 || s.RefusedConns != 2 || s.DroppedBestEffort != 1 {
+		t.Errorf("The memory guard report is %+v, want 500 heap bytes, 3 refused queued, 2 refused conns and "+
+			"1 dropped best-effort", s)
+	}
+}
+
+// Tests that the presence notices are dropped once the heap calls for shedding the best-effort messages.
+func TestMemGuardShedsPresence(t *testing.T) {
+	c := createNewCollider()
+	c.Presence = true
+	c.MaxHeapBytes, c.MemoryCheckInterval = 1000, time.Nanosecond
+	var heap uint64
+	c.mem.read = func() uint64 { return heap }
+
+	for _, tc := range []struct {
+		heap     uint64
+		notified bool
+	}{
+		{100, true},
+		{1000, false},
+	} {
+		heap = tc.heap
+		rid := fmt.Sprintf("shed-presence-%d", tc.heap)
+		first := collidertest.MockReadWriteCloser{}
+		if err := c.roomTable.register(rid, rid+"-1", &first); err != nil {
+			t.Fatalf("Registering the first client got error: %v, want nil", err)
+		}
+		first.Msg = ""
+		second := collidertest.MockReadWriteCloser{}
+		if err := c.roomTable.register(rid, rid+"-2", &second); err != nil {
+			t.Fatalf("Registering the second client got error: %v, want nil", err)
+		}
+		if notified := strings.Contains(first.Msg, `"presence"`); notified != tc.notified {
+			t.Errorf("With a heap of %d bytes, the first client got %q, want notified = %t", tc.heap, first.Msg,
+				tc.notified)
+		}
+	}
+}
+
+// Tests that the memory guard is off without MaxHeapBytes.
+func TestMemGuardDisabled(t *testing.T) {
+	c := createNewCollider()
+	c.mem.read = func() uint64 { return 1 << 40 }
+	if s := c.shedStage(); s != shedNone {
+		t.Errorf("Without MaxHeapBytes, the shedding stage is %d, want %d", s, shedNone)
+	}
+}
@@ -6,7 +6,7 @@
 package collider
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -14,12 +14,80 @@ import (
 
 type JSONTime time.Time
 
+const jsonTimeFormat = "2006-01-02 15:04:05"
+
 func (t JSONTime) MarshalJSON() ([]byte, error) {
-	var TimeFormat = "2006-01-02 15:04:05"
-	ts := fmt.Sprintf("\"%s\"", time.Time(t).Format(TimeFormat))
+	ts := fmt.Sprintf("\"%s\"", time.Time(t).Format(jsonTimeFormat))
 	return []byte(ts), nil
 }
 
+func (t *JSONTime) UnmarshalJSON(b []byte) error {
+	pt, err := time.ParseInLocation("\""+jsonTimeFormat+"\"", string(b), time.Local)
+	if err != nil {
+		return err
+	}
+	*t = JSONTime(pt)
+	return nil
+}
+
+// Error codes sent in wsServerMsg.Code so that clients can handle errors programmatically.
+const (
+	errCodeOverQuota         = "OVER_QUOTA"
+	errCodeUnsupportedByPeer = "UNSUPPORTED_BY_PEER"
+	errCodeMissingTo         = "MISSING_TO"
+	errCodeInvalidTo         = "INVALID_TO"
+	errCodePermissionDenied  = "PERMISSION_DENIED"
+	errCodeTooManyRooms      = "TOO_MANY_ROOMS"
+	errCodePingTimeout       = "PING_TIMEOUT"
+	errCodeRoomRateLimited   = "ROOM_RATE_LIMITED"
+	errCodeCommandDisabled   = "COMMAND_DISABLED"
+	errCodeClientIDTaken     = "CLIENT_ID_TAKEN"
+	errCodeTooDeep           = "TOO_DEEP"
+	errCodeMessageTimeout    = "MESSAGE_TIMEOUT"
+	errCodeMissingRoomID     = "MISSING_ROOMID"
+	errCodeMissingClientID   = "MISSING_CLIENTID"
+	errCodeMissingIDs        = "MISSING_IDS"
+	errCodeRoomRemoved       = "ROOM_REMOVED"
+	errCodeShuttingDown      = "SHUTTING_DOWN"
+	errCodeRoomFull          = "ROOM_FULL"
+	errCodeTenantLimit       = "TENANT_LIMIT"
+	errCodeTenantRateLimited = "TENANT_RATE_LIMITED"
+	errCodeAuthFailed        = "AUTH_FAILED"
+	errCodeQueueFull         = "QUEUE_FULL"
+	errCodeMessageTooLarge   = "MESSAGE_TOO_LARGE"
+	errCodeRoomExpired       = "ROOM_EXPIRED"
+	errCodeRateLimited       = "RATE_LIMITED"
+	errCodeRoomNotFound      = "ROOM_NOT_FOUND"
+	errCodeClientNotFound    = "CLIENT_NOT_FOUND"
+	errCodePeerOffline       = "PEER_OFFLINE"
+)
+
+// errorCodes are the error codes of the errors returned by the room table.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrRoomFull, errCodeRoomFull},
+	{ErrClientExists, errCodeClientIDTaken},
+	{errTooManyRooms, errCodeTooManyRooms},
+	{errTenantLimit, errCodeTenantLimit},
+	{errRoomRemoved, errCodeRoomRemoved},
+	{errQueueFull, errCodeQueueFull},
+	{ErrRoomNotFound, errCodeRoomNotFound},
+	{ErrClientNotFound, errCodeClientNotFound},
+	{errPeerOffline, errCodePeerOffline},
+}
+
+// errorCode returns the error code of |err|, or "" if it has none.
+func errorCode(err error) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return ""
+}
+
 // WebSocket message from the client.
 type wsClientMsg struct {
 	Cmd      string `json:"cmd"`
@@ -27,6 +95,24 @@ type wsClientMsg struct {
 	To       string `json:"to"`
 	ClientID string `json:"clientid"`
 	Msg      string `json:"msg"`
+	// Caps is the list of relayed commands the client supports, sent with register. Empty means all.
+	Caps []string `json:"caps"`
+	// RoomType is the type of the room, sent with register. The first client to register with one decides it.
+	RoomType string `json:"roomtype"`
+	// ID is the application-defined ID of the received message, sent with receipt, or of the message sent with
+	// send, to have it acknowledged.
+	ID string `json:"id"`
+	// Token proves the identity of the client to the Authenticate hook, sent with register.
+	Token string `json:"token"`
+	// ResumeToken is the token of the 'registered' frame of the previous connection, sent with register to
+	// resume the registration with the queued messages within ResumeGrace.
+	ResumeToken string `json:"resumetoken"`
+}
+
+// adminSubscribeMsg narrows the events streamed to an admin subscriber.
+type adminSubscribeMsg struct {
+	RoomID string   `json:"roomid"`
+	Types  []string `json:"types"`
 }
 
 // wsServerMsg is a message sent to a client on behalf of another client.
@@ -35,7 +121,89 @@ type wsServerMsg struct {
 	From  string   `json:"from"`
 	Msg   string   `json:"msg"`
 	Error string   `json:"error"`
+	Code  string   `json:"code,omitempty"`
 	Time  JSONTime `json:"time"`
+	// Instance is the server instance ID sent in the 'registered' frame.
+	Instance string `json:"instance,omitempty"`
+	// ResumeToken is the token to resume the registration with, sent in the 'registered' frame under
+	// ResumeGrace, and Resumed whether the registration was resumed.
+	ResumeToken string `json:"resumetoken,omitempty"`
+	Resumed     bool   `json:"resumed,omitempty"`
+}
+
+// receiptMsg is the receipt of a message, routed back to its sender.
+type receiptMsg struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	From string `json:"from"`
+}
+
+// ackMsg acknowledges a send carrying an 'id' to its sender. Delivered is true if the message was relayed to the
+// other clients of the room, and false if it was queued for a client that has not registered.
+type ackMsg struct {
+	Cmd       string `json:"cmd"`
+	ID        string `json:"id"`
+	Delivered bool   `json:"delivered"`
+}
+
+// relayErrorMsg tells the sender of a chat that it was not relayed to the client To, for the reason Reason.
+type relayErrorMsg struct {
+	Cmd    string `json:"cmd"`
+	Reason string `json:"reason"`
+	To     string `json:"to"`
+	Error  string `json:"error"`
+}
+
+// rosterMsg answers the 'list' command with the other clients registered in the room.
+type rosterMsg struct {
+	Cmd     string   `json:"cmd"`
+	Clients []string `json:"clients"`
+}
+
+// presenceMsg tells the clients of a room that the client ClientID joined or left it.
+type presenceMsg struct {
+	Cmd      string `json:"cmd"`
+	Event    string `json:"event"`
+	ClientID string `json:"clientid"`
+}
+
+// The events of a presenceMsg.
+const (
+	presenceJoin  = "join"
+	presenceLeave = "leave"
+)
+
+// idleWarningMsg warns a silent client that its connection times out in TimeoutMs unless it sends something.
+type idleWarningMsg struct {
+	Type      string `json:"type"`
+	TimeoutMs int64  `json:"timeoutMs"`
+}
+
+// jsonDepthExceeds returns true if the JSON text nests objects and arrays more than |max| levels deep.
+// It only scans the brackets outside of strings, so that the check costs a single pass whatever the payload.
+func jsonDepthExceeds(data []byte, max int) bool {
+	depth, inString, escaped := 0, false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if b == '\\' {
+				escaped = true
+			} else if b == '"' {
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			if depth += 1; depth > max {
+				return true
+			}
+		case b == '}' || b == ']':
+			depth -= 1
+		}
+	}
+	return false
 }
 
 // sendServerMsg sends a wsServerMsg composed from |msg| to the connection.
@@ -55,11 +223,21 @@ func sendServerErr(w io.Writer, errMsg string) error {
 	return send(w, m)
 }
 
-// send writes a generic object as JSON to the writer.
+// sendServerErrCode sends a wsServerMsg composed from |errMsg| and the machine-readable |code| to the connection.
+func sendServerErrCode(w io.Writer, code string, errMsg string) error {
+	m := wsServerMsg{
+		Error: errMsg,
+		Code:  code,
+	}
+	return send(w, m)
+}
+
+// send writes a generic object to the writer, encoded by the writer's serializer or as JSON.
 func send(w io.Writer, data interface{}) error {
-	enc := json.NewEncoder(w)
-	if err := enc.Encode(data); err != nil {
+	b, err := serializerOf(w).Encode(data)
+	if err != nil {
 		return err
 	}
-	return nil
+	_, err = w.Write(b)
+	return err
 }
@@ -0,0 +1,71 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"errors"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"strings"
+)
+
+const (
+	// protocolV1 is the version of the message schema of the connections negotiating no version.
+	protocolV1 = "collider.v1"
+	// versionPrefix starts the subprotocols naming a version of the message schema.
+	versionPrefix = "collider.v"
+)
+
+// protocolVersions are the versions of the message schema the server speaks.
+var protocolVersions = map[string]bool{
+	protocolV1: true,
+}
+
+// errUnsupportedVersion rejects the handshake of a client offering only versions the server does not speak.
+var errUnsupportedVersion = errors.New("Unsupported protocol version")
+
+// wsHandshake checks the Origin of a WebSocket handshake and negotiates its subprotocol.
+func (c *Collider) wsHandshake(config *websocket.Config, r *http.Request) error {
+	if err := c.checkWsOrigin(config, r); err != nil {
+		return err
+	}
+	return c.negotiateProtocol(config)
+}
+
+// negotiateProtocol selects the first subprotocol offered by the client that the server supports, a version
+// or a serializer, which implies protocolV1. It returns errUnsupportedVersion if the client offers versions
+// but none that is supported. Otherwise the offer is left as is.
+func (c *Collider) negotiateProtocol(config *websocket.Config) error {
+	offersVersion := false
+	for _, p := range config.Protocol {
+		if protocolVersions[p] || c.serializers[p] != nil || c.deflater(p) != nil {
+			config.Protocol = []string{p}
+			return nil
+		}
+		offersVersion = offersVersion || strings.HasPrefix(p, versionPrefix)
+	}
+	if offersVersion {
+		c.logger().Printf("Rejecting the WebSocket handshake offering %v", config.Protocol)
+		return errUnsupportedVersion
+	}
+	return nil
+}
+
+// protocolVersion returns the version of the message schema negotiated by the connection.
+func protocolVersion(ws *websocket.Conn) string {
+	if p := ws.Config().Protocol; len(p) == 1 && protocolVersions[p[0]] {
+		return p[0]
+	}
+	return protocolV1
+}
+
+// decode parses a frame of the client according to the negotiated version.
+func (sc *serialConn) decode(data []byte) (*wsClientMsg, error) {
+	switch sc.version {
+	default: // protocolV1
+		return sc.ser.Decode(data)
+	}
+}
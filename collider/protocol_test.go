@@ -0,0 +1,68 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"golang.org/x/net/websocket"
+	"reflect"
+	"testing"
+)
+
+// Tests that the first supported subprotocol offered is selected, and that only offers of unsupported versions
+// are rejected.
+func TestNegotiateProtocol(t *testing.T) {
+	c := createNewCollider()
+	for _, tc := range []struct {
+		offer   []string
+		want    []string
+		wantErr error
+	}{
+		{nil, nil, nil},
+		{[]string{protocolV1}, []string{protocolV1}, nil},
+		{[]string{"collider.v9", protocolV1}, []string{protocolV1}, nil},
+		{[]string{"chat", deflateProtocol, protocolV1}, []string{deflateProtocol}, nil},
+		{[]string{"chat"}, []string{"chat"}, nil},
+		{[]string{"collider.v9"}, []string{"collider.v9"}, errUnsupportedVersion},
+		{[]string{"chat", "collider.v9"}, []string{"chat", "collider.v9"}, errUnsupportedVersion},
+	} {
+		config := &websocket.Config{Protocol: append([]string(nil), tc.offer...)}
+		err := c.negotiateProtocol(config)
+		if err != tc.wantErr || !reflect.DeepEqual(config.Protocol, tc.want) {
+			t.Errorf("negotiateProtocol(%v) = %v with %v, want %v with %v", tc.offer, err, config.Protocol,
+				tc.wantErr, tc.want)
+		}
+	}
+}
+
+// Tests that a client offering a supported version among unsupported ones is answered with it and relays as
+// before, while a client offering only unsupported versions is rejected.
+func TestWsProtocolVersion(t *testing.T) {
+	setup()
+	config := newConfig(t, "/ws")
+	config.Protocol = []string{"collider.v9", protocolV1}
+	c1, err := websocket.NewClient(config, dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient offering %v got error: %v, want nil", config.Protocol, err)
+	}
+	defer c1.Close()
+	if p := c1.Config().Protocol; !reflect.DeepEqual(p, []string{protocolV1}) {
+		t.Errorf("The negotiated subprotocol is %v, want %v", p, []string{protocolV1})
+	}
+	rid := "protocol-version"
+	write(t, c1, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "1"})
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") })
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "hi"})
+	expectReceiveMessage(t, c2, "hi")
+
+	config = newConfig(t, "/ws")
+	config.Protocol = []string{"collider.v9"}
+	if c, err := websocket.NewClient(config, dial(t)); err == nil {
+		c.Close()
+		t.Errorf("websocket.NewClient offering %v got no error, want the handshake rejected", config.Protocol)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !tb.allow(now) {
+			t.Fatalf("tokenBucket.allow() #%d within the burst = false, want true", i)
+		}
+	}
+	if tb.allow(now) {
+		t.Errorf("tokenBucket.allow() past the burst = true, want false")
+	}
+
+	// Two tokens per second refill one token in half a second.
+	now = now.Add(500 * time.Millisecond)
+	if !tb.allow(now) {
+		t.Errorf("tokenBucket.allow() after the refill = false, want true")
+	}
+	if tb.allow(now) {
+		t.Errorf("tokenBucket.allow() after taking the refilled token = true, want false")
+	}
+
+	// The bucket never holds more than the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		tb.allow(now)
+	}
+	if tb.allow(now) {
+		t.Errorf("tokenBucket.allow() past the burst after an hour = true, want false")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// realIP returns the IP address the request comes from: the address of its peer or, if the peer is one of
+// TrustedProxies, the last address of its X-Forwarded-For header that is not a trusted proxy, or its X-Real-IP
+// header without one. It returns "" if the request is nil.
+func (c *Collider) realIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !c.trustedProxy(ip) {
+		return ip
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			// A malformed hop was not written by a trusted proxy, so the hops before it cannot be trusted.
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !c.trustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+// trustedProxy returns true if the IP address |ip| is one of TrustedProxies, given as addresses or CIDR ranges.
+func (c *Collider) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, p := range c.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(addr) {
+				return true
+			}
+		} else if pa := net.ParseIP(p); pa != nil && pa.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
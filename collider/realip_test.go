@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests that the forwarded client address is taken from the trusted proxies only, skipping the trusted hops.
+func TestRealIP(t *testing.T) {
+	c := createNewCollider()
+	c.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	for _, tc := range []struct {
+		remote string
+		fwd    string
+		real   string
+		want   string
+	}{
+		{"203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"192.0.2.1:1234", "198.51.100.7, 10.0.0.9", "", "198.51.100.7"},
+		{"10.1.2.3:1234", "1.2.3.4, 198.51.100.7", "", "198.51.100.7"},
+		{"10.1.2.3:1234", "bogus, 10.0.0.9", "", "10.0.0.9"},
+		{"10.1.2.3:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tc.remote
+		if tc.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tc.fwd)
+		}
+		if tc.real != "" {
+			r.Header.Set("X-Real-IP", tc.real)
+		}
+		if got := c.realIP(r); got != tc.want {
+			t.Errorf("realIP() from %s with X-Forwarded-For %q and X-Real-IP %q = %q, want %q", tc.remote, tc.fwd,
+				tc.real, got, tc.want)
+		}
+	}
+}
+
+// Tests that the connections through a trusted proxy are counted in the subnet of the client it forwarded.
+func TestWsRealIPBehindProxy(t *testing.T) {
+	setup()
+	cl.TrustedProxies = []string{"127.0.0.1"}
+	defer func() { cl.TrustedProxies = nil }()
+
+	config := newConfig(t, "/ws")
+	config.Header.Set("X-Forwarded-For", "198.51.100.7")
+	conn, err := websocket.NewClient(config, dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	defer conn.Close()
+	rid, cid := "real-ip", "proxied"
+	write(t, conn, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: cid})
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+
+	found := false
+	for _, ip := range cl.roomTable.remoteIPs() {
+		found = found || ip == "198.51.100.7"
+	}
+	if !found {
+		t.Errorf("The remote IPs are %v, want them to include the forwarded 198.51.100.7", cl.roomTable.remoteIPs())
+	}
+}
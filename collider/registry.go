@@ -0,0 +1,159 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import "sync"
+
+// clientRegistry maps the client IDs to their registered client. It has its own lock so that the lookups by
+// client ID from the connections do not contend on the room table lock. It may be locked while holding the
+// room table lock, never the other way around.
+type clientRegistry struct {
+	lock    sync.RWMutex
+	clients map[string]*client
+}
+
+// lookupClient returns the registered client with the ID |cid|, or nil.
+func (rt *roomTable) lookupClient(cid string) *client {
+	if rt == nil {
+		return nil
+	}
+	rt.registry.lock.RLock()
+	defer rt.registry.lock.RUnlock()
+	return rt.registry.clients[cid]
+}
+
+// storeClient records the client as the registered client of its ID.
+func (rt *roomTable) storeClient(c *client) {
+	if rt == nil {
+		return
+	}
+	rt.registry.lock.Lock()
+	defer rt.registry.lock.Unlock()
+	rt.registry.clients[c.id] = c
+}
+
+// deleteClient forgets the client, unless another client has registered with the same ID since.
+func (rt *roomTable) deleteClient(c *client) {
+	if rt == nil {
+		return
+	}
+	rt.registry.lock.Lock()
+	defer rt.registry.lock.Unlock()
+	if rt.registry.clients[c.id] == c {
+		delete(rt.registry.clients, c.id)
+	}
+}
+
+// registeredClients returns the registered clients.
+func (rt *roomTable) registeredClients() []*client {
+	rt.registry.lock.RLock()
+	defer rt.registry.lock.RUnlock()
+
+	cs := make([]*client, 0, len(rt.registry.clients))
+	for _, c := range rt.registry.clients {
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// clientRooms holds the rooms each client ID is registered in, so that MaxRoomsPerClient is checked without
+// locking every shard. Like the registry, it has its own lock, which may be locked while holding the lock of a
+// shard, never the other way around.
+type clientRooms struct {
+	lock sync.Mutex
+	// rooms maps the client IDs to the client registered in each of their rooms, or to nil for a room they
+	// are registering in.
+	rooms map[string]map[string]*client
+}
+
+// reserveRoom records the client ID |cid| as registering in the room |rid| and returns true, or returns false
+// if it is already registered in |max| other rooms. Zero |max| is unlimited.
+func (rt *roomTable) reserveRoom(cid string, rid string, max int) bool {
+	cr := &rt.clientRooms
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	rooms := cr.rooms[cid]
+	if _, ok := rooms[rid]; ok {
+		return true
+	}
+	if max > 0 && len(rooms) >= max {
+		return false
+	}
+	if rooms == nil {
+		if cr.rooms == nil {
+			cr.rooms = make(map[string]map[string]*client)
+		}
+		rooms = make(map[string]*client)
+		cr.rooms[cid] = rooms
+	}
+	rooms[rid] = nil
+	return true
+}
+
+// unreserveRoom forgets the reservation of reserveRoom if the client has not registered since.
+func (rt *roomTable) unreserveRoom(cid string, rid string) {
+	rt.dropRoom(cid, rid, nil)
+}
+
+// bindRoom records the client as registered in its room.
+func (rt *roomTable) bindRoom(c *client) {
+	if rt == nil {
+		return
+	}
+	cr := &rt.clientRooms
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if cr.rooms == nil {
+		cr.rooms = make(map[string]map[string]*client)
+	}
+	if cr.rooms[c.id] == nil {
+		cr.rooms[c.id] = make(map[string]*client)
+	}
+	cr.rooms[c.id][c.parent.id] = c
+}
+
+// releaseRoom forgets the registration of the client in its room, unless another client has registered with
+// the same ID in the room since.
+func (rt *roomTable) releaseRoom(c *client) {
+	if rt == nil {
+		return
+	}
+	rt.dropRoom(c.id, c.parent.id, c)
+}
+
+// boundClients returns the clients recorded as registered in their rooms, those of every room of a client ID.
+func (rt *roomTable) boundClients() []*client {
+	cr := &rt.clientRooms
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	var cs []*client
+	for _, rooms := range cr.rooms {
+		for _, c := range rooms {
+			if c != nil {
+				cs = append(cs, c)
+			}
+		}
+	}
+	return cs
+}
+
+// dropRoom forgets the room |rid| of the client ID |cid| if it is recorded for |c|.
+func (rt *roomTable) dropRoom(cid string, rid string, c *client) {
+	cr := &rt.clientRooms
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	rooms := cr.rooms[cid]
+	if oc, ok := rooms[rid]; ok && oc == c {
+		delete(rooms, rid)
+		if len(rooms) == 0 {
+			delete(cr.rooms, cid)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// resumeGrace returns how long a disconnected client is kept with its queued messages for it to resume, or 0.
+func (rt *roomTable) resumeGrace() time.Duration {
+	if rt == nil || rt.parent == nil {
+		return 0
+	}
+	return rt.parent.ResumeGrace
+}
+
+// newResumeToken returns a random token for a client to resume its registration with.
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// resume re-attaches the client |cid| of the room |rid| to the connection |rwc| if |token| is the token it was
+// issued when registering, keeping the messages it queued, and sends it the messages queued for it. A previous
+// connection still registered is closed. It returns false if the client is unknown or the token does not match.
+func (rt *roomTable) resume(rid string, cid string, token string, rwc io.ReadWriteCloser) bool {
+	s := rt.shard(rid)
+	// Deferred first, so that the presence notice is sent once the lock is released.
+	var notice presenceNotice
+	defer notice.send()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil || !r.resume(cid, token, rwc) {
+		return false
+	}
+	notice = r.presenceNotice(cid, presenceJoin)
+	delete(s.removed, roomClient{rid, cid})
+	rt.publish(event{Type: evClientRegistered, RoomID: rid, ClientID: cid})
+	return true
+}
+
+// resume re-attaches the client to |rwc| if |token| matches its resume token, like register but without
+// replacing the client and its queue.
+func (rm *room) resume(clientID string, token string, rwc io.ReadWriteCloser) bool {
+	c := rm.clients[clientID]
+	if c == nil || c.resumeToken == "" || subtle.ConstantTimeCompare([]byte(c.resumeToken), []byte(token)) != 1 {
+		return false
+	}
+	rm.touch()
+	// The previous connection may not have been found dead yet.
+	if c.registered() {
+		c.deregister(DisconnectTakeover)
+	}
+	if err := c.register(rwc); err != nil {
+		return false
+	}
+	c.resumeToken = newResumeToken()
+	rm.parent.logger().Printf("Client %s resumed in room %s", clientID, rm.id)
+
+	for _, otherClient := range rm.clients {
+		if otherClient != c && otherClient.sendQueued(c) != nil {
+			break
+		}
+	}
+	rm.watchStall(c)
+	return true
+}
+
+// resumeTokenOf returns the token the client |cid| of the room |rid| may resume with, or "".
+func (rt *roomTable) resumeTokenOf(rid string, cid string) string {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil {
+		if c := r.clients[cid]; c != nil {
+			return c.resumeToken
+		}
+	}
+	return ""
+}
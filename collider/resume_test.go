@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// resumeWsClient registers the client over a new connection with the resume token |token|, and returns the
+// connection, the 'registered' frame and the messages received before it, queued for the client.
+func resumeWsClient(t *testing.T, rid string, cid string, token string) (*websocket.Conn, wsServerMsg, []string) {
+	conn, err := websocket.NewClient(newConfig(t, "/ws"), dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient got error: %v, want nil", err)
+	}
+	write(t, conn, wsClientMsg{Cmd: "register", RoomID: rid, ClientID: cid, ResumeToken: token})
+	var queued []string
+	for {
+		var m wsServerMsg
+		if err := json.Unmarshal([]byte(read(t, conn)), &m); err != nil {
+			t.Fatalf("Decoding the frame got error: %v, want nil", err)
+		}
+		if m.Cmd != "registered" {
+			queued = append(queued, m.Msg)
+			continue
+		}
+		if m.ResumeToken == "" {
+			t.Fatalf("Registering got %+v, want a resume token", m)
+		}
+		return conn, m, queued
+	}
+}
+
+// Tests that under ResumeGrace, a client reconnecting with its resume token keeps the messages it queued, and
+// receives those queued for it while it was disconnected.
+func TestWsResume(t *testing.T) {
+	setup()
+	cl.ResumeGrace = time.Minute
+	defer func() { cl.ResumeGrace = 0 }()
+	rid := "resume"
+
+	c1, reg, _ := resumeWsClient(t, rid, "1", "")
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "offer"})
+	waitForCondition(func() bool { return cl.roomTable.queuedCount() == 1 })
+	c1.Close()
+	waitForCondition(func() bool { return !cl.roomTable.isRegistered(rid, "1") })
+
+	c1, reg, _ = resumeWsClient(t, rid, "1", reg.ResumeToken)
+	if !reg.Resumed {
+		t.Errorf("Registering with the resume token got %+v, want it resumed", reg)
+	}
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	expectReceiveMessage(t, c2, "offer")
+
+	c1.Close()
+	waitForCondition(func() bool { return !cl.roomTable.isRegistered(rid, "1") })
+	write(t, c2, wsClientMsg{Cmd: "send", Msg: "while away"})
+	waitForCondition(func() bool { return cl.roomTable.queuedCount() == 1 })
+
+	c1, reg, queued := resumeWsClient(t, rid, "1", reg.ResumeToken)
+	defer c1.Close()
+	if !reg.Resumed {
+		t.Errorf("Registering with the resume token got %+v, want it resumed", reg)
+	}
+	if want := []string{"while away"}; !reflect.DeepEqual(queued, want) {
+		t.Errorf("Resuming received %q, want %q", queued, want)
+	}
+}
+
+// Tests that a register with an unknown resume token registers the client afresh.
+func TestWsResumeBadToken(t *testing.T) {
+	setup()
+	cl.ResumeGrace = time.Minute
+	defer func() { cl.ResumeGrace = 0 }()
+	rid := "resume-bad-token"
+
+	c1, first, _ := resumeWsClient(t, rid, "1", "")
+	defer c1.Close()
+	c2, reg, _ := resumeWsClient(t, rid, "1", "not-"+first.ResumeToken)
+	defer c2.Close()
+	if reg.Resumed || reg.ResumeToken == first.ResumeToken {
+		t.Errorf("Registering with a bad resume token got %+v, want a fresh registration", reg)
+	}
+	expectConnectionClose(t, c1)
+}
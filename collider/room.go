@@ -9,12 +9,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"time"
 )
 
-const maxRoomCapacity = 2
+// The default number of clients a room may hold.
+const defaultMaxRoomCapacity = 2
+
+// ErrRoomFull is returned when registering a client in a room holding MaxRoomCapacity clients.
+var ErrRoomFull = errors.New("Room is full")
+
+// The metric label of the rooms without a type, and of those whose type is not in Collider.RoomTypes.
+const (
+	defaultRoomType = "default"
+	otherRoomType   = "other"
+)
+
+// DuplicateClientPolicy decides what happens when a connection registers a client ID that is already
+// registered in the room through another connection.
+type DuplicateClientPolicy string
+
+const (
+	// DuplicateTakeover disconnects the registered connection in favor of the new one.
+	DuplicateTakeover DuplicateClientPolicy = "takeover"
+	// DuplicateReject rejects the new connection with a CLIENT_ID_TAKEN error.
+	DuplicateReject DuplicateClientPolicy = "reject"
+	// DuplicateMultiDevice keeps both connections, every message to the client being sent to each of them.
+	DuplicateMultiDevice DuplicateClientPolicy = "multidevice"
+)
+
+// ErrClientExists is returned by register under DuplicateReject when the client ID is already registered.
+var ErrClientExists = errors.New("Client ID already registered")
 
 type room struct {
 	parent *roomTable
@@ -24,10 +48,37 @@ type room struct {
 	clientsID       []string
 	registerTimeout time.Duration
 	roomSrvUrl      string
+	// limiter limits the aggregate rate of the messages sent by the clients of the room, or is nil.
+	limiter *tokenBucket
+	// typ is the room type labelling the metrics of the room, one of Collider.RoomTypes or "other".
+	// Empty until a client registers with a type.
+	typ     string
+	created time.Time
+	// tenant is the tenant of the client that created the room by registering, counted against its MaxRooms.
+	tenant string
+	// lastActive is the time of the last register or message in the room, checked against RoomTTL.
+	lastActive time.Time
 }
 
 func newRoom(p *roomTable, id string, to time.Duration, rs string) *room {
-	return &room{parent: p, id: id, clients: make(map[string]*client), registerTimeout: to, roomSrvUrl: rs}
+	now := time.Now()
+	return &room{
+		parent:          p,
+		id:              id,
+		clients:         make(map[string]*client),
+		registerTimeout: to,
+		roomSrvUrl:      rs,
+		created:         now,
+		lastActive:      now,
+	}
+}
+
+// label returns the room type used as the metric label of the room.
+func (rm *room) label() string {
+	if rm.typ == "" {
+		return defaultRoomType
+	}
+	return rm.typ
 }
 
 // client returns the client, or creates it if it does not exist and the room is not full.
@@ -35,33 +86,42 @@ func (rm *room) client(clientID string) (*client, error) {
 	if c, ok := rm.clients[clientID]; ok {
 		return c, nil
 	}
-	if len(rm.clients) >= maxRoomCapacity {
-		log.Printf("Room %s is full, not adding client %s", rm.id, clientID)
-		return nil, errors.New("Max room capacity reached")
+	if len(rm.clients) >= rm.parent.roomCapacity() {
+		rm.parent.logger().Printf("Room %s is full, not adding client %s", rm.id, clientID)
+		return nil, ErrRoomFull
 	}
 
-	var timer *time.Timer
+	c := newClient(clientID, nil)
+	c.parent = rm
 	if rm.parent != nil {
-		timer = time.AfterFunc(rm.registerTimeout, func() {
-			if c := rm.clients[clientID]; c != nil {
-				rm.parent.removeIfUnregistered(rm.id, c)
-			}
-		})
+		// removeIfUnregistered checks under the table lock that |c| is still the room's client.
+		c.setTimer(time.AfterFunc(rm.registerTimeout, func() {
+			rm.parent.removeIfUnregistered(rm.id, c)
+		}))
 	}
-	rm.clients[clientID] = newClient(clientID, timer)
+	rm.clients[clientID] = c
 
-	log.Printf("Added client %s to room %s", clientID, rm.id)
+	rm.parent.debugf("Added client %s to room %s", clientID, rm.id)
 
 	return rm.clients[clientID], nil
 }
 
 // register binds a client to the ReadWriteCloser.
 func (rm *room) register(clientID string, rwc io.ReadWriteCloser) error {
+	rm.touch()
 	//在这加上点修改，如果这个ID存在的话，就把原来的断掉
-	//if _, ok := rm.clients[clientID]; ok {
-	//	return errors.New("someone has registered using this " + clientID + " ID")
-	//}
-	rm.remove(clientID)
+	if c, ok := rm.clients[clientID]; ok && c.registered() {
+		switch rm.parent.duplicatePolicy() {
+		case DuplicateReject:
+			rm.parent.logger().Printf("Not registering client %s in room %s, already registered", clientID, rm.id)
+			return ErrClientExists
+		case DuplicateMultiDevice:
+			c.addConn(rwc)
+			rm.parent.debugf("Client %s registered another device in room %s", clientID, rm.id)
+			return nil
+		}
+	}
+	rm.remove(clientID, DisconnectTakeover)
 	c, err := rm.client(clientID)
 	if err != nil {
 		return err
@@ -69,56 +129,116 @@ func (rm *room) register(clientID string, rwc io.ReadWriteCloser) error {
 	if err = c.register(rwc); err != nil {
 		return err
 	}
+	if rm.parent.resumeGrace() > 0 {
+		c.resumeToken = newResumeToken()
+	}
 
-	log.Printf("Client %s registered in room %s", clientID, rm.id)
+	rm.parent.debugf("Client %s registered in room %s", clientID, rm.id)
 
-	// Sends the queued messages from the other client of the room.
-	if len(rm.clients) > 1 {
-		for _, otherClient := range rm.clients {
-			otherClient.sendQueued(c)
+	// Sends the queued messages from the other clients of the room before returning, so that the client gets
+	// them ahead of any new message. A failed write leaves the rest queued.
+	for _, otherClient := range rm.clients {
+		if otherClient != c && otherClient.sendQueued(c) != nil {
+			break
 		}
 	}
+	rm.watchStall(c)
 	return nil
 }
 
-// send sends the message to the other client of the room, or queues the message if the other client has not joined.
+// send sends the message to the other clients of the room, or queues the message if no other client has joined.
+// In a room of more than two clients, the message is also queued once for the clients that have not registered
+// yet, and delivered to the first of them to register.
 func (rm *room) send(srcClientID string, cmd string, msg string) error {
+	_, err := rm.deliver(srcClientID, cmd, msg)
+	return err
+}
+
+// deliver is send, also returning true if the message was relayed to every other client of the room, or false
+// if it was queued for any of them.
+func (rm *room) deliver(srcClientID string, cmd string, msg string) (bool, error) {
+	rm.touch()
 	src, err := rm.client(srcClientID)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Queue the message if the other client has not joined.
 	if len(rm.clients) == 1 {
-		return rm.clients[srcClientID].enqueue(msg)
+		return false, rm.clients[srcClientID].enqueue(msg)
 	}
 
-	// Send the message to the other client of the room.
+	// Send the message to the other clients of the room.
+	var sent, queued bool
 	for _, oc := range rm.clients {
-		if oc.id != srcClientID {
-			return src.send(oc, cmd, msg)
+		if oc.id == srcClientID {
+			continue
+		}
+		if !oc.registered() {
+			queued = true
+			continue
+		}
+		if serr := src.send(oc, cmd, msg); serr != nil && err == nil {
+			err = serr
+		}
+		sent = true
+	}
+	if queued {
+		if qerr := src.enqueue(msg); qerr != nil && err == nil {
+			err = qerr
 		}
 	}
+	if !sent && !queued {
+		// The room must be corrupted.
+		return false, errors.New(fmt.Sprintf("Corrupted room %+v", rm))
+	}
+	return err == nil && !queued, err
+}
 
-	// The room must be corrupted.
-	return errors.New(fmt.Sprintf("Corrupted room %+v", rm))
+// presenceNotice is a presence frame for the other registered clients of a room, sent once the lock of the shard
+// of the room is released.
+type presenceNotice struct {
+	targets []*client
+	msg     presenceMsg
+}
+
+// presenceNotice returns the notice telling the other registered clients of the room that the client |clientID|
+// joined or left, without targets if Presence is not set. The caller must hold the lock of the shard of the room.
+func (rm *room) presenceNotice(clientID string, ev string) presenceNotice {
+	n := presenceNotice{msg: presenceMsg{Cmd: "presence", Event: ev, ClientID: clientID}}
+	if !rm.parent.presence() {
+		return n
+	}
+	for _, oc := range rm.clients {
+		if oc.id != clientID && oc.registered() {
+			n.targets = append(n.targets, oc)
+		}
+	}
+	return n
+}
+
+// send sends the notice to its targets, unless the memory guard sheds the best-effort messages. It must be called
+// without the lock of the shard of the room.
+func (n *presenceNotice) send() {
+	for _, oc := range n.targets {
+		if oc.table().sheds(shedBestEffort) {
+			continue
+		}
+		send(oc, n.msg)
+	}
 }
 
 // remove closes the client connection and removes the client specified by the |clientID|.
-func (rm *room) remove(clientID string) {
+func (rm *room) remove(clientID string, r DisconnectReason) {
 	if c, ok := rm.clients[clientID]; ok {
-		c.deregister()
+		c.deregister(r)
+		rm.parent.onQueuedDiscarded(c.discardQueued())
 		delete(rm.clients, clientID)
-		log.Printf("Removed client %s from room %s", clientID, rm.id)
+		rm.parent.logger().Printf("Removed client %s from room %s", clientID, rm.id)
+		rm.parent.publish(event{Type: evClientRemoved, RoomID: rm.id, ClientID: clientID})
 
 		// Send bye to the room Server.
-		resp, err := http.Post(rm.roomSrvUrl+"/bye/"+rm.id+"/"+clientID, "text", nil)
-		if err != nil {
-			log.Printf("Failed to post BYE to room server %s: %v", rm.roomSrvUrl, err)
-		}
-		if resp != nil && resp.Body != nil {
-			resp.Body.Close()
-		}
+		rm.parent.notifyRoomServer(rm.roomSrvUrl + "/bye/" + rm.id + "/" + clientID)
 	}
 }
 
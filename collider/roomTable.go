@@ -6,135 +6,1115 @@
 package collider
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// A thread-safe map of rooms.
+// errRoomRemoved is returned by send when the sender's room was removed while it was registered.
+var errRoomRemoved = errors.New("Room removed")
+
+// errTooManyBroadcasts is returned by broadcast when MaxBroadcasts broadcasts are in progress and the queue
+// of BroadcastQueueSize places is full.
+var errTooManyBroadcasts = errors.New("Too many broadcasts in progress")
+
+// errTooManyRooms is returned by register when the client ID is already registered in MaxRoomsPerClient rooms.
+var errTooManyRooms = errors.New("Registered in too many rooms")
+
+// ErrRoomNotFound is returned by the operations on a room that does not exist.
+var ErrRoomNotFound = errors.New("Room not found")
+
+// ErrClientNotFound is returned by the operations on a client that is not registered in the room.
+var ErrClientNotFound = errors.New("Client not found")
+
+// The maximum number of connections a broadcast writes to at once.
+const maxBroadcastFanOut = 32
+
+// The number of shards of a room table.
+const roomTableShards = 64
+
+// A thread-safe map of rooms, partitioned into shards by a hash of the room ID so that the operations on
+// different rooms seldom contend on the same lock.
 type roomTable struct {
-	lock            sync.Mutex
-	rooms           map[string]*room
+	shards          []*roomShard
 	registerTimeout time.Duration
 	roomSrvUrl      string
+	// parent is the Collider owning the table, or nil if the table is used standalone.
+	parent *Collider
+	// inflight is the number of writes to client connections in progress. Accessed atomically.
+	inflight int64
+	// rsBreaker skips the room server calls while the room server keeps failing.
+	rsBreaker roomSrvBreaker
+	// registry holds the registered clients by ID.
+	registry clientRegistry
+	// clientRooms holds the rooms each client ID is registered in.
+	clientRooms clientRooms
+}
+
+// roomShard holds the rooms whose ID hashes to it. The operations on a room only lock its shard; those
+// across the rooms lock the shards one after the other, or all of them at once when they must be atomic.
+type roomShard struct {
+	lock  timedMutex
+	rooms map[string]*room
+	// removed holds the clients registered in a room when it was removed, until they register again or their
+	// connection closes, so that their sends fail instead of recreating the room.
+	removed map[roomClient]bool
+}
+
+// roomClient identifies a client within a room.
+type roomClient struct {
+	rid, cid string
 }
 
 func newRoomTable(to time.Duration, rs string) *roomTable {
-	return &roomTable{rooms: make(map[string]*room), registerTimeout: to, roomSrvUrl: rs}
+	return newShardedRoomTable(to, rs, roomTableShards)
+}
+
+// newShardedRoomTable returns a room table of |n| shards.
+func newShardedRoomTable(to time.Duration, rs string, n int) *roomTable {
+	rt := &roomTable{registerTimeout: to, roomSrvUrl: rs}
+	for i := 0; i < n; i++ {
+		s := &roomShard{rooms: make(map[string]*room), removed: make(map[roomClient]bool)}
+		s.lock.threshold, s.lock.onLongHold = rt.lockHoldWarning, rt.onLongLockHold
+		rt.shards = append(rt.shards, s)
+	}
+	rt.registry.clients = make(map[string]*client)
+	return rt
+}
+
+// shard returns the shard of the room |rid|, picked by the FNV-1a hash of the ID.
+func (rt *roomTable) shard(rid string) *roomShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(rid); i++ {
+		h ^= uint32(rid[i])
+		h *= 16777619
+	}
+	return rt.shards[h%uint32(len(rt.shards))]
+}
+
+// lockAll locks every shard, always in the same order so that two callers cannot deadlock.
+func (rt *roomTable) lockAll() {
+	for _, s := range rt.shards {
+		s.lock.Lock()
+	}
+}
+
+func (rt *roomTable) unlockAll() {
+	for i := len(rt.shards) - 1; i >= 0; i-- {
+		rt.shards[i].lock.unlock(1)
+	}
+}
+
+// eachShard calls |f| with every shard in turn, holding the lock of the shard during the call.
+func (rt *roomTable) eachShard(f func(s *roomShard)) {
+	for _, s := range rt.shards {
+		s.lock.Lock()
+		f(s)
+		s.lock.unlock(1)
+	}
 }
 
 // room returns the room specified by |id|, or creates the room if it does not exist.
 func (rt *roomTable) room(id string) *room {
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+	s := rt.shard(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	return rt.roomLocked(id)
 }
 
-// roomLocked gets or creates the room without acquiring the lock. Used when the caller already acquired the lock.
+// roomLocked gets or creates the room without acquiring the lock. Used when the caller already acquired the
+// lock of the shard of the room.
 func (rt *roomTable) roomLocked(id string) *room {
-	if r, ok := rt.rooms[id]; ok {
+	s := rt.shard(id)
+	if r, ok := s.rooms[id]; ok {
 		return r
 	}
-	rt.rooms[id] = newRoom(rt, id, rt.registerTimeout, rt.roomSrvUrl)
+	s.rooms[id] = newRoom(rt, id, rt.graceFor(id), rt.roomSrvUrl)
 	//在这里从数据库添加其它client到这个room里面
-	log.Printf("Created room %s", id)
+	rt.debugf("Created room %s", id)
+	rt.publish(event{Type: evRoomCreated, RoomID: id})
+
+	return s.rooms[id]
+}
+
+// lookupRoom returns the room |rid|, or nil if it does not exist.
+func (rt *roomTable) lookupRoom(rid string) *room {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.rooms[rid]
+}
+
+// roomCount returns the number of rooms.
+func (rt *roomTable) roomCount() int {
+	n := 0
+	rt.eachShard(func(s *roomShard) {
+		n += len(s.rooms)
+	})
+	return n
+}
+
+// graceFor returns the reconnect grace period of the room |id|, falling back to the register timeout.
+func (rt *roomTable) graceFor(id string) time.Duration {
+	if rt.parent != nil && rt.parent.ReconnectGrace != nil {
+		if d := rt.parent.ReconnectGrace(id); d > 0 {
+			return d
+		}
+	}
+	return rt.regTimeout()
+}
 
-	return rt.rooms[id]
+// regTimeout returns how long a client may stay unregistered in a room before it is removed.
+func (rt *roomTable) regTimeout() time.Duration {
+	if rt.parent != nil && rt.parent.RegisterTimeout > 0 {
+		return rt.parent.RegisterTimeout
+	}
+	return rt.registerTimeout
 }
 
 // remove removes the client. If the room becomes empty, it also removes the room.
 func (rt *roomTable) remove(rid string, cid string) {
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rt.removeLocked(rid, cid, DisconnectKicked)
+}
+
+// clearQueue drops the messages queued by the client |cid| of the room |rid|, leaving it registered and
+// connected, and returns how many were dropped.
+func (rt *roomTable) clearQueue(rid string, cid string) int {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil || r.clients[cid] == nil {
+		return 0
+	}
+	n := r.clients[cid].discardQueued()
+	rt.onQueuedDiscarded(n)
+	return n
+}
 
-	rt.removeLocked(rid, cid)
+// kick notifies the connections of the client |cid| of the room |rid| with { 'cmd': 'kicked' } and removes the
+// client, closing its connections and discarding its queued messages. It returns false if the client does not
+// exist.
+func (rt *roomTable) kick(rid string, cid string) bool {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	r := s.rooms[rid]
+	if r == nil || r.clients[cid] == nil {
+		s.lock.Unlock()
+		return false
+	}
+	// A client that only has queued messages has no connection to notify.
+	conns := r.clients[cid].detachConns()
+	rt.removeLocked(rid, cid, DisconnectKicked)
+	s.lock.Unlock()
+
+	for _, rwc := range conns {
+		sendServerMsg(rwc, "kicked", "")
+		closeFor(rwc, DisconnectKicked)
+	}
+	return true
 }
 
-// removeLocked removes the client without acquiring the lock. Used when the caller already acquired the lock.
-func (rt *roomTable) removeLocked(rid string, cid string) {
-	if r := rt.rooms[rid]; r != nil {
-		r.remove(cid)
+// removeLocked removes the client without acquiring the lock. Used when the caller already acquired the lock
+// of the shard of the room.
+func (rt *roomTable) removeLocked(rid string, cid string, reason DisconnectReason) {
+	s := rt.shard(rid)
+	if r := s.rooms[rid]; r != nil {
+		r.remove(cid, reason)
 		if r.empty() {
-			delete(rt.rooms, rid)
-			log.Printf("Removed room %s", rid)
+			delete(s.rooms, rid)
+			rt.logger().Printf("Removed room %s", rid)
+			rt.onRoomClosed(r)
+			rt.publish(event{Type: evRoomRemoved, RoomID: rid})
 		}
 	}
 }
 
-func (rt *roomTable) removeRoom(rid string) {
-	if r := rt.rooms[rid]; r != nil {
-		for index, _ := range r.clients {
+// removeRoom removes the room and discards the messages queued in it. The sends in progress in the room
+// complete first, and the later sends of its registered clients fail with errRoomRemoved. It returns false if
+// the room does not exist.
+func (rt *roomTable) removeRoom(rid string) bool {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return rt.removeRoomLocked(rid)
+}
+
+// removeRoomLocked removes the room without acquiring the lock. Used when the caller already acquired the
+// lock of the shard of the room.
+func (rt *roomTable) removeRoomLocked(rid string) bool {
+	s := rt.shard(rid)
+	r := s.rooms[rid]
+	if r != nil {
+		for index, c := range r.clients {
+			if c.registered() {
+				s.removed[roomClient{rid, index}] = true
+			}
+			c.setTimer(nil)
+			rt.releaseRoom(c)
+			rt.onQueuedDiscarded(c.discardQueued())
 			delete(r.clients, index)
 		}
-		delete(rt.rooms, rid)
+		delete(s.rooms, rid)
+		rt.onRoomClosed(r)
+		rt.publish(event{Type: evRoomRemoved, RoomID: rid})
+	}
+	return r != nil
+}
+
+// closeRoom disconnects the clients of the room and removes it like removeRoom. It returns false if the room
+// does not exist.
+func (rt *roomTable) closeRoom(rid string) bool {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil {
+		return false
+	}
+	for _, c := range r.clients {
+		c.deregister(DisconnectKicked)
+	}
+	rt.removeRoomLocked(rid)
+	return true
+}
+
+// closeAll sends the error |code| to every connection of the clients of the rooms, and to the connections
+// |others| not among them, e.g. those yet to register, then closes them. The connections are collected under
+// the locks and written to once they are released. The clients deregister themselves as their read loops end.
+func (rt *roomTable) closeAll(others []io.ReadWriteCloser, code string, msg string) {
+	seen := make(map[io.ReadWriteCloser]bool)
+	var conns []io.ReadWriteCloser
+	add := func(rwc io.ReadWriteCloser) {
+		if !seen[rwc] {
+			seen[rwc] = true
+			conns = append(conns, rwc)
+		}
+	}
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			for _, c := range r.clients {
+				for _, rwc := range c.conns() {
+					add(rwc)
+				}
+			}
+		}
+	})
+	for _, rwc := range others {
+		add(rwc)
+	}
+	for _, rwc := range conns {
+		sendServerErrCode(rwc, code, msg)
+		closeFor(rwc, DisconnectShutdown)
 	}
 }
 
 // send forwards the message to the room. If the room does not exist, it will create one.
+// If the sender's queue is full, OnQueueOverflow is called once the lock is released.
 func (rt *roomTable) send(rid string, srcID string, cmd string, msg string) error {
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+	_, err := rt.deliver(rid, srcID, cmd, msg)
+	return err
+}
+
+// deliver is send, also returning true if the message was relayed to every other client of the room, or false
+// if it was queued for any of them.
+func (rt *roomTable) deliver(rid string, srcID string, cmd string, msg string) (bool, error) {
+	delivered, src, dropped, err := rt.route(rid, srcID, cmd, msg)
+	if err == errQueueFull && rt.parent != nil && rt.parent.OnQueueOverflow != nil {
+		rt.parent.OnQueueOverflow(src, rid, dropped)
+	}
+	return delivered, err
+}
+
+// route forwards the message to the room under the lock, returning whether it was delivered. If the sender's
+// queue is full, it also returns the sender and the number of messages refused since its queue filled up.
+func (rt *roomTable) route(rid string, srcID string, cmd string, msg string) (bool, *client, int, error) {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
+	if s.removed[roomClient{rid, srcID}] {
+		return false, nil, 0, errRoomRemoved
+	}
 	r := rt.roomLocked(rid)
-	return r.send(srcID, cmd, msg)
+	delivered, err := r.deliver(srcID, cmd, msg)
+	if err != errQueueFull {
+		return delivered, nil, 0, err
+	}
+	src := r.clients[srcID]
+	return false, src, src.overflowed, errQueueFull
 }
 
 // register forwards the register request to the room. If the room does not exist, it will create one.
+// The capacity check and the insertion happen under the lock of the shard of the room, so concurrent registers
+// cannot overfill a room. Under MaxRoomsPerClient, the room is reserved for the client ID first, and a new room
+// is counted against the MaxRooms of the tenant before it is created, so that concurrent registers in different
+// rooms cannot exceed the limits either.
 func (rt *roomTable) register(rid string, cid string, rwc io.ReadWriteCloser) error {
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+	t := tenantOfConn(rwc)
+	s := rt.shard(rid)
+	// Deferred first, so that the presence notice is sent once the lock is released.
+	var notice presenceNotice
+	defer notice.send()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
+	if !rt.reserveRoom(cid, rid, rt.maxRoomsPerClient()) {
+		rt.logger().Printf("Client %s is registered in too many rooms, not registering in room %s", cid, rid)
+		return errTooManyRooms
+	}
+	// Forgets the reservation if the register fails; a successful one has bound the room to the client by then.
+	defer rt.unreserveRoom(cid, rid)
+	created := s.rooms[rid] == nil
+	if t != "" && created && !rt.parent.tenants.acquireRoom(t, rt.parent.tenantLimits(t)) {
+		rt.logger().Printf("Tenant %s has too many rooms, not registering client %s in room %s", t, cid, rid)
+		return errTenantLimit
+	}
 	r := rt.roomLocked(rid)
-	return r.register(cid, rwc)
+	if r.tenant == "" && t != "" {
+		// A room created before a client of a tenant registered is counted then, without being limited.
+		if !created {
+			rt.parent.tenants.acquireRoom(t, TenantLimits{})
+		}
+		r.tenant = t
+	}
+	// A takeover or another device of a registered client is no news to the room.
+	joined := r.clients[cid] == nil || !r.clients[cid].registered()
+	if err := r.register(cid, rwc); err != nil {
+		return err
+	}
+	if joined {
+		notice = r.presenceNotice(cid, presenceJoin)
+	}
+	delete(s.removed, roomClient{rid, cid})
+	rt.publish(event{Type: evClientRegistered, RoomID: rid, ClientID: cid})
+	return nil
+}
+
+// maxRoomsPerClient returns the number of rooms a client ID may be registered in at once, or 0 if unlimited.
+func (rt *roomTable) maxRoomsPerClient() int {
+	if rt.parent == nil {
+		return 0
+	}
+	return rt.parent.MaxRoomsPerClient
+}
+
+// allowMessage returns false if the clients of the room |rid| have collectively sent messages faster than
+// RoomMessagesPerSecond, beyond the RoomMessageBurst. Otherwise it counts the message in the metrics of the
+// room type and returns true.
+func (rt *roomTable) allowMessage(rid string) bool {
+	if rt.parent == nil {
+		return true
+	}
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil {
+		return true
+	}
+	r.touch()
+	if rt.parent.RoomMessagesPerSecond > 0 {
+		now := time.Now()
+		if r.limiter == nil {
+			r.limiter = newTokenBucket(rt.parent.RoomMessagesPerSecond, rt.parent.RoomMessageBurst, now)
+		}
+		if !r.limiter.allow(now) {
+			return false
+		}
+	}
+	rt.parent.dash.onRoomMessage(r.label())
+	return true
+}
+
+// setRoomType sets the type of the room |rid| if it has none yet, so the first client to register with a
+// type decides it. Types missing from Collider.RoomTypes are labelled "other".
+func (rt *roomTable) setRoomType(rid string, typ string) {
+	if typ == "" || rt.parent == nil {
+		return
+	}
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil && r.typ == "" {
+		r.typ = otherRoomType
+		for _, t := range rt.parent.RoomTypes {
+			if t == typ {
+				r.typ = typ
+			}
+		}
+	}
+}
+
+// onRoomClosed records the lifetime of the removed room in the metrics of its type.
+func (rt *roomTable) onRoomClosed(r *room) {
+	if rt.parent != nil {
+		rt.parent.dash.onRoomClosed(r.label(), time.Since(r.created))
+		if r.tenant != "" {
+			rt.parent.tenants.releaseRoom(r.tenant)
+		}
+	}
+}
+
+// setCaps records the relayed commands supported by the client.
+func (rt *roomTable) setCaps(rid string, cid string, caps []string) {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil {
+		if c := r.clients[cid]; c != nil {
+			c.setCaps(caps)
+		}
+	}
 }
 
 // deregister clears the client's websocket registration.
-// We keep the client around until after a timeout, so that users roaming between networks can seamlessly reconnect.
+// We keep the client around until after the room's reconnect grace period, or ResumeGrace if longer, so that users roaming between networks can seamlessly reconnect.
+// A client disconnecting alone in its room within QuickDisconnectWindow of registering is removed at once instead, unless it may resume.
 func (rt *roomTable) deregister(rid string, cid string) {
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+	s := rt.shard(rid)
+	s.lock.Lock()
+	notice := rt.deregisterLocked(rid, cid)
+	s.lock.Unlock()
+	notice.send()
+}
+
+// deregisterConn ends the registration of the connection |rwc| of the client. The client stays registered if
+// it has the connections of other devices left; nothing happens if |rwc| is no longer one of its connections,
+// e.g. because another connection took the client ID over or |rwc| was already deregistered, so that calling
+// it twice is harmless.
+func (rt *roomTable) deregisterConn(rid string, cid string, rwc io.ReadWriteCloser) {
+	s := rt.shard(rid)
+	// Deferred first, so that the presence notice is sent once the lock is released.
+	var notice presenceNotice
+	defer notice.send()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.removed, roomClient{rid, cid})
+	if r := s.rooms[rid]; r != nil {
+		if c := r.clients[cid]; c != nil && c.hasConn(rwc) {
+			if c.removeConn(rwc) {
+				rt.logger().Printf("Deregistered a connection of client %s from room %s", cid, rid)
+				return
+			}
+			notice = rt.deregisterLocked(rid, cid)
+		}
+	}
+}
 
-	if r := rt.rooms[rid]; r != nil {
+// deregisterLocked deregisters the client without acquiring the lock. Used when the caller already acquired the
+// lock of the shard of the room. It returns the presence notice to send once the lock is released. The last
+// connection of the client has ended, its read loop counting why, so it is closed as if the client left.
+func (rt *roomTable) deregisterLocked(rid string, cid string) presenceNotice {
+	if r := rt.shard(rid).rooms[rid]; r != nil {
 		if c := r.clients[cid]; c != nil {
 			if c.registered() {
-				c.deregister()
-				c.setTimer(time.AfterFunc(rt.registerTimeout, func() {
+				grace := rt.resumeGrace()
+				if len(r.clients) == 1 && rt.quickDisconnect(c) && grace == 0 {
+					rt.logger().Printf("Removing client %s from room %s, disconnected right after registering", c.id, rid)
+					rt.removeLocked(rid, cid, DisconnectEOF)
+					return presenceNotice{}
+				}
+				if grace < r.registerTimeout {
+					grace = r.registerTimeout
+				}
+				c.deregister(DisconnectEOF)
+				c.setTimer(time.AfterFunc(grace, func() {
 					rt.removeIfUnregistered(rid, c)
 				}))
+				notice := r.presenceNotice(cid, presenceLeave)
 
-				log.Printf("Deregistered client %s from room %s", c.id, rid)
-				return
+				rt.logger().Printf("Deregistered client %s from room %s", c.id, rid)
+				rt.publish(event{Type: evClientDeregistered, RoomID: rid, ClientID: cid})
+				return notice
 			}
 		}
 	}
+	return presenceNotice{}
+}
+
+// logger returns the logger of the Collider owning the table, or the standard logger.
+func (rt *roomTable) logger() *log.Logger {
+	if rt == nil {
+		return log.Default()
+	}
+	return rt.parent.logger()
+}
+
+// debugf logs to the logger of the Collider owning the table if its Debug is on.
+func (rt *roomTable) debugf(format string, v ...interface{}) {
+	if rt != nil {
+		rt.parent.debugf(format, v...)
+	}
+}
+
+// duplicatePolicy returns the DuplicateClientPolicy of the Collider owning the table, or DuplicateTakeover.
+func (rt *roomTable) duplicatePolicy() DuplicateClientPolicy {
+	if rt != nil && rt.parent != nil && rt.parent.DuplicateClients != "" {
+		return rt.parent.DuplicateClients
+	}
+	return DuplicateTakeover
+}
+
+// roomCapacity returns the MaxRoomCapacity of the Collider owning the table, or the default.
+func (rt *roomTable) roomCapacity() int {
+	if rt != nil && rt.parent != nil && rt.parent.MaxRoomCapacity > 0 {
+		return rt.parent.MaxRoomCapacity
+	}
+	return defaultMaxRoomCapacity
+}
+
+// queueLimits returns the number of messages and of bytes the queue of a client may hold.
+func (rt *roomTable) queueLimits() (msgs int, bytes int) {
+	msgs, bytes = defaultMaxQueuedMsgs, defaultMaxQueuedBytes
+	if rt == nil || rt.parent == nil {
+		return
+	}
+	if rt.parent.MaxQueuedMessages > 0 {
+		msgs = rt.parent.MaxQueuedMessages
+	}
+	if rt.parent.MaxQueuedBytes > 0 {
+		bytes = rt.parent.MaxQueuedBytes
+	}
+	return
+}
+
+// presence returns true if the Collider owning the table notifies the rooms of the joins and leaves.
+func (rt *roomTable) presence() bool {
+	return rt != nil && rt.parent != nil && rt.parent.Presence
+}
+
+// quickDisconnect returns true if the client registered less than QuickDisconnectWindow ago.
+func (rt *roomTable) quickDisconnect(c *client) bool {
+	return rt.parent != nil && time.Since(c.connectedAt) < rt.parent.QuickDisconnectWindow
 }
 
 // removeIfUnregistered removes the client if it has not registered.
 func (rt *roomTable) removeIfUnregistered(rid string, c *client) {
-	log.Printf("Removing client %s from room %s due to timeout", c.id, rid)
+	rt.logger().Printf("Removing client %s from room %s due to timeout", c.id, rid)
 
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	if r := rt.rooms[rid]; r != nil {
+	if r := s.rooms[rid]; r != nil {
 		if c == r.clients[c.id] {
 			if !c.registered() {
-				rt.removeLocked(rid, c.id)
+				rt.removeLocked(rid, c.id, DisconnectIdleTimeout)
 				return
 			}
 		}
 	}
 }
 
-func (rt *roomTable) wsCount() int {
-	rt.lock.Lock()
-	defer rt.lock.Unlock()
+// hasClient returns true if the client |cid| is in the room |rid|.
+func (rt *roomTable) hasClient(rid string, cid string) bool {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil {
+		_, ok := r.clients[cid]
+		return ok
+	}
+	return false
+}
+
+// clientOf returns the client |cid| of the room |rid|, or nil.
+func (rt *roomTable) clientOf(rid string, cid string) *client {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil {
+		return r.clients[cid]
+	}
+	return nil
+}
+
+// isRegistered returns true if the client |cid| of the room |rid| has a connection.
+func (rt *roomTable) isRegistered(rid string, cid string) bool {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil {
+		if c := r.clients[cid]; c != nil {
+			return c.registered()
+		}
+	}
+	return false
+}
+
+// otherClients returns the IDs of the clients of the room |rid| other than |cid|, sorted.
+func (rt *roomTable) otherClients(rid string, cid string) []string {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ids []string
+	if r := s.rooms[rid]; r != nil {
+		for id := range r.clients {
+			if id != cid {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// peers returns the IDs of the registered clients of the room |rid| other than |excludeCid|, sorted, or an
+// empty slice if there is none.
+func (rt *roomTable) peers(rid string, excludeCid string) []string {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
+	ids := []string{}
+	if r := s.rooms[rid]; r != nil {
+		for id, c := range r.clients {
+			if id != excludeCid && c.registered() {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// roomSize returns the number of clients in the room |rid|, or 0 if it does not exist.
+func (rt *roomTable) roomSize(rid string) int {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r := s.rooms[rid]; r != nil {
+		return len(r.clients)
+	}
+	return 0
+}
+
+func (rt *roomTable) wsCount() int {
 	count := 0
-	for _, r := range rt.rooms {
-		count = count + r.wsCount()
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			count = count + r.wsCount()
+		}
+	})
+	return count
+}
+
+// roomPage returns the summaries of up to |limit| rooms from |offset| in the order of the room IDs, and the
+// offset of the next page, or 0 if there are no more rooms.
+func (rt *roomTable) roomPage(offset int, limit int) ([]roomSummary, int) {
+	var all []roomSummary
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			all = append(all, roomSummary{RoomID: r.id, Clients: len(r.clients), Registered: r.wsCount()})
+		}
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].RoomID < all[j].RoomID })
+
+	page := []roomSummary{}
+	if offset >= len(all) {
+		return page, 0
+	}
+	// Clamped first, so that offset+limit cannot overflow.
+	if limit > len(all)-offset {
+		limit = len(all) - offset
+	}
+	for i := offset; i < offset+limit; i++ {
+		page = append(page, all[i])
+	}
+	if offset+limit < len(all) {
+		return page, offset + limit
+	}
+	return page, 0
+}
+
+// roomStatus returns the status report of the room |rid|, or nil if the room does not exist.
+func (rt *roomTable) roomStatus(rid string) *roomStatus {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil {
+		return nil
+	}
+	st := &roomStatus{
+		roomSummary:  roomSummary{RoomID: r.id, Clients: len(r.clients), Registered: r.wsCount()},
+		LastActivity: r.lastActive,
+	}
+	for _, c := range r.clients {
+		st.QueuedMsgs += len(c.msgs)
+		st.QueuedBytes += c.queuedBytes
+	}
+	return st
+}
+
+// roomDetail returns the detail of the room |rid|, or nil if the room does not exist.
+// If |verbose| is true, the detail includes the last activity of the clients, and if |previews| is true,
+// the previews of the queued messages.
+func (rt *roomTable) roomDetail(rid string, verbose bool, previews bool) *roomDetail {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil {
+		return nil
+	}
+	d := &roomDetail{RoomID: rid, Clients: []clientDetail{}}
+	for _, c := range r.clients {
+		in, out := c.bytes()
+		cd := clientDetail{
+			ClientID:   c.id,
+			ConnID:     c.connID(),
+			Registered: c.registered(),
+			QueuedMsgs: len(c.msgs),
+			BytesIn:    in,
+			BytesOut:   out,
+		}
+		if t := c.lastActive(); verbose && !t.IsZero() {
+			cd.LastActivity = &t
+		}
+		if previews {
+			for _, m := range c.msgs {
+				cd.Queued = append(cd.Queued, newQueuedPreview(m))
+			}
+		}
+		d.Clients = append(d.Clients, cd)
+	}
+	sort.Slice(d.Clients, func(i, j int) bool { return d.Clients[i].ClientID < d.Clients[j].ClientID })
+	return d
+}
+
+// queueDetail returns the messages queued by the client |cid| of the room |rid|, oldest first, or nil if the
+// client does not exist. The messages stay queued. If |previews| is true, the detail includes their previews.
+func (rt *roomTable) queueDetail(rid string, cid string, previews bool) *queueDetail {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil || r.clients[cid] == nil {
+		return nil
+	}
+	c := r.clients[cid]
+	d := &queueDetail{RoomID: rid, ClientID: cid, Count: len(c.msgs), Messages: []queuedMsgDetail{}}
+	now := time.Now()
+	for i, m := range c.msgs {
+		p := newQueuedPreview(m)
+		md := queuedMsgDetail{Type: p.Type, Size: p.Size}
+		if i < len(c.queuedAt) {
+			md.AgeMs = now.Sub(c.queuedAt[i]).Nanoseconds() / int64(time.Millisecond)
+		}
+		if previews {
+			md.Preview, md.Truncated = p.Preview, p.Truncated
+		}
+		d.Messages = append(d.Messages, md)
+	}
+	return d
+}
+
+// clientConns returns the connections registered with the client ID |cid| across the rooms, oldest first.
+func (rt *roomTable) clientConns(cid string) []connDetail {
+	conns := []connDetail{}
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			if c := r.clients[cid]; c != nil {
+				for _, rwc := range c.conns() {
+					conns = append(conns, connDetail{
+						ConnID:         connIDOf(rwc),
+						RoomID:         r.id,
+						ConnectedSince: connectedAtOf(c, rwc),
+						RemoteIP:       remoteIPOf(rwc),
+					})
+				}
+			}
+		}
+	})
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectedSince.Before(conns[j].ConnectedSince) })
+	return conns
+}
+
+// sendReceipt routes the receipt of the message |id| from the client |cid| to the client |to| of the room
+// |rid|, or to the other client of the room if |to| is empty. It returns ErrRoomNotFound or ErrClientNotFound if
+// there is no such room or registered client.
+func (rt *roomTable) sendReceipt(rid string, cid string, to string, id string) error {
+	oc, err := rt.receiptRecipient(rid, cid, to)
+	if err != nil {
+		return err
+	}
+	return send(oc, receiptMsg{Type: "receipt", ID: id, From: cid})
+}
+
+// receiptRecipient returns the registered client of the room |rid| a receipt from the client |cid| to |to| goes
+// to, looked up under the lock so that the receipt is sent without it.
+func (rt *roomTable) receiptRecipient(rid string, cid string, to string) (*client, error) {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.rooms[rid]
+	if r == nil {
+		return nil, ErrRoomNotFound
 	}
+	for _, oc := range r.clients {
+		if oc.id != cid && (to == "" || oc.id == to) && oc.registered() {
+			return oc, nil
+		}
+	}
+	return nil, ErrClientNotFound
+}
+
+// sendToConn sends the message to the connection |connID| alone, whatever its client ID and whether it is the
+// main connection of its client or that of another device. It returns false if no registered client uses that
+// connection. The connection is looked up under the lock and written to once it is released.
+func (rt *roomTable) sendToConn(connID string, cmd string, msg string) (bool, error) {
+	var target io.ReadWriteCloser
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			for _, c := range r.clients {
+				for _, rwc := range c.conns() {
+					if target == nil && connIDOf(rwc) == connID {
+						target = rwc
+					}
+				}
+			}
+		}
+	})
+	if target == nil {
+		return false, nil
+	}
+	rt.beginWrite()
+	defer rt.endWrite()
+	return true, sendServerMsg(target, cmd, msg)
+}
+
+// broadcast sends |v| to the registered clients of every room and returns the number of clients it was
+// written to. The connections are written to outside of the lock, at most maxBroadcastFanOut at once, so that
+// a slow client holds up neither the table nor the rest of the broadcast. Beyond MaxBroadcasts broadcasts in
+// progress, it waits for its turn, or returns errTooManyBroadcasts if the queue is full.
+func (rt *roomTable) broadcast(v interface{}) (int, error) {
+	if c := rt.parent; c != nil {
+		start := time.Now()
+		if !c.broadcasts.acquire(context.Background(), c.MaxBroadcasts, c.BroadcastQueueSize) {
+			return 0, errTooManyBroadcasts
+		}
+		defer func() {
+			c.broadcasts.release()
+			c.dash.onBroadcast(time.Since(start))
+		}()
+	}
+
+	type target struct {
+		c  *client
+		rw io.ReadWriteCloser
+	}
+	var targets []target
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			for _, c := range r.clients {
+				for _, rwc := range c.conns() {
+					targets = append(targets, target{c, rwc})
+				}
+			}
+		}
+	})
+
+	var sent int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxBroadcastFanOut)
+	for _, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t target) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rt.beginWrite()
+			defer rt.endWrite()
+
+			b, err := serializerOf(t.rw).Encode(v)
+			if err != nil {
+				rt.logger().Printf("Failed to encode the broadcast to %s: %v", t.c.id, err)
+				return
+			}
+			n, err := t.rw.Write(b)
+			atomic.AddInt64(&t.c.bytesOut, int64(n))
+			if err != nil {
+				rt.logger().Printf("Failed to broadcast to %s: %v", t.c.id, err)
+				return
+			}
+			t.c.touch()
+			atomic.AddInt64(&sent, 1)
+		}(t)
+	}
+	wg.Wait()
+	return int(sent), nil
+}
+
+// tableStats is a snapshot of the room table counters shown in the status report.
+type tableStats struct {
+	openWs int
+	// clients is the number of clients in the rooms, registered or not.
+	clients int
+	// orphanedMsgs is the number of messages still queued on registered clients that no longer belong to
+	// their room. It should always be zero; anything else means queued messages outlived their room.
+	orphanedMsgs int
+	// roomsByType is the number of rooms of each room type.
+	roomsByType map[string]int
+	// queuedMsgs and queuedBytes are the number and size of the messages queued in the rooms.
+	queuedMsgs  int
+	queuedBytes int
+}
+
+// stats returns the counters of the status report, taken in a single pass over each shard under its lock so
+// that a status request holds the locks as briefly as possible.
+func (rt *roomTable) stats() tableStats {
+	s := tableStats{roomsByType: make(map[string]int)}
+	rt.eachShard(func(sh *roomShard) {
+		for _, r := range sh.rooms {
+			s.openWs += r.wsCount()
+			s.clients += len(r.clients)
+			s.roomsByType[r.label()] += 1
+			for _, c := range r.clients {
+				s.queuedMsgs += len(c.msgs)
+				s.queuedBytes += c.queuedBytes
+			}
+		}
+	})
+	// The registry holds one client per ID, so the clients of the other rooms of an ID are found bound to them.
+	seen := make(map[*client]bool)
+	for _, c := range append(rt.registeredClients(), rt.boundClients()...) {
+		if !seen[c] {
+			seen[c] = true
+			s.orphanedMsgs += rt.orphanedMsgs(c)
+		}
+	}
+	if s.orphanedMsgs > 0 {
+		rt.logger().Printf("Found %d queued messages outside of any room", s.orphanedMsgs)
+	}
+	return s
+}
+
+// acceptStats returns the state of the accept queue of the Collider owning the table.
+func (rt *roomTable) acceptStats() acceptQueueStats {
+	if rt.parent == nil {
+		return acceptQueueStats{}
+	}
+	return rt.parent.accept.stats()
+}
+
+// broadcastStats returns the state of the broadcast queue of the Collider owning the table.
+func (rt *roomTable) broadcastStats() acceptQueueStats {
+	if rt.parent == nil {
+		return acceptQueueStats{}
+	}
+	return rt.parent.broadcasts.stats()
+}
+
+// memStats returns the state of the memory guard of the Collider owning the table.
+func (rt *roomTable) memStats() memGuardStats {
+	if rt.parent == nil {
+		return memGuardStats{}
+	}
+	return rt.parent.mem.stats()
+}
+
+// sheds returns true, counting the refusal, if the Collider owning the table engaged the shedding stage |stage|.
+func (rt *roomTable) sheds(stage int) bool {
+	return rt != nil && rt.parent != nil && rt.parent.sheds(stage)
+}
+
+// orphanedMsgs returns the number of messages queued by the client if it is no longer the client of its ID in
+// its room, or 0. The client is resolved through its room, so that the clients of the same ID in other rooms
+// are told apart.
+func (rt *roomTable) orphanedMsgs(c *client) int {
+	r := c.parent
+	if r == nil {
+		return len(c.msgs)
+	}
+	s := rt.shard(r.id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.rooms[r.id] == r && r.clients[c.id] == c {
+		return 0
+	}
+	return len(c.msgs)
+}
+
+// onQueuedDiscarded accounts for |n| queued messages dropped with their client or room.
+func (rt *roomTable) onQueuedDiscarded(n int) {
+	if rt != nil && rt.parent != nil && n > 0 {
+		rt.parent.dash.onQueuedDiscarded(n)
+	}
+}
+
+// onFirstMsg records the register-to-first-message latency of a client in the dashboard.
+func (rt *roomTable) onFirstMsg(d time.Duration) {
+	if rt != nil && rt.parent != nil {
+		rt.parent.dash.onFirstMsg(d)
+	}
+}
+
+// queuedCount returns the number of messages queued in all rooms.
+func (rt *roomTable) queuedCount() int {
+	count := 0
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			for _, c := range r.clients {
+				count += len(c.msgs)
+			}
+		}
+	})
 	return count
 }
+
+// beginWrite and endWrite track the writes to client connections in progress.
+func (rt *roomTable) beginWrite() {
+	if rt != nil {
+		atomic.AddInt64(&rt.inflight, 1)
+	}
+}
+
+func (rt *roomTable) endWrite() {
+	if rt != nil {
+		atomic.AddInt64(&rt.inflight, -1)
+	}
+}
+
+// inflightCount returns the number of writes to client connections in progress.
+func (rt *roomTable) inflightCount() int {
+	return int(atomic.LoadInt64(&rt.inflight))
+}
+
+// publish forwards the event to the owning Collider's event bus, if any.
+func (rt *roomTable) publish(e event) {
+	if rt != nil && rt.parent != nil {
+		rt.parent.events.publish(e)
+	}
+}
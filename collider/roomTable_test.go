@@ -0,0 +1,437 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"collidertest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createNewCollider returns a Collider around a fresh room table, without starting the server.
+func createNewCollider() *Collider {
+	c := &Collider{
+		roomTable: createNewRoomTable(),
+		dash:      newDashboard(),
+		events:    newEventBus(),
+	}
+	c.roomTable.parent = c
+	return c
+}
+
+// Tests that the queued messages are freed when the room is removed.
+func TestRemoveRoomDiscardsQueued(t *testing.T) {
+	c := createNewCollider()
+	rid, cid := "a", "1"
+	for _, m := range []string{"hi", "there"} {
+		if err := c.roomTable.send(rid, cid, "send", m); err != nil {
+			t.Fatalf("roomTable.send(%q, %q, send, %q) got error: %v, want nil", rid, cid, m, err)
+		}
+	}
+	src := c.roomTable.lookupRoom(rid).clients[cid]
+
+	c.roomTable.removeRoom(rid)
+	if src.msgs != nil {
+		t.Errorf("After roomTable.removeRoom(%q), client.msgs = %v, want nil", rid, src.msgs)
+	}
+	r := c.dash.getReport(c.roomTable)
+	if r.DiscardedMsgs != 2 {
+		t.Errorf("After roomTable.removeRoom(%q), getReport().DiscardedMsgs = %d, want 2", rid, r.DiscardedMsgs)
+	}
+	if r.OrphanedMsgs != 0 {
+		t.Errorf("After roomTable.removeRoom(%q), getReport().OrphanedMsgs = %d, want 0", rid, r.OrphanedMsgs)
+	}
+}
+
+// Tests that the messages queued on a client whose room is gone are reported, even when its client ID has
+// registered in another room since.
+func TestOrphanedMsgsOfSharedClientID(t *testing.T) {
+	c := createNewCollider()
+	cid := "orphan"
+	if err := c.roomTable.register("a", cid, &collidertest.MockReadWriteCloser{}); err != nil {
+		t.Fatalf("Registering in room a got error: %v, want nil", err)
+	}
+	if err := c.roomTable.send("a", cid, "send", "hi"); err != nil {
+		t.Fatalf("roomTable.send got error: %v, want nil", err)
+	}
+	if err := c.roomTable.register("b", cid, &collidertest.MockReadWriteCloser{}); err != nil {
+		t.Fatalf("Registering in room b got error: %v, want nil", err)
+	}
+	// Loses room a without cleaning up its client, as a bug would.
+	s := c.roomTable.shard("a")
+	s.lock.Lock()
+	delete(s.rooms, "a")
+	s.lock.Unlock()
+
+	if r := c.dash.getReport(c.roomTable); r.OrphanedMsgs != 1 {
+		t.Errorf("After losing room a, getReport().OrphanedMsgs = %d, want 1", r.OrphanedMsgs)
+	}
+}
+
+// Tests that the queued messages are freed when the room is cleaned up because it became empty.
+func TestRemoveLastClientDiscardsQueued(t *testing.T) {
+	c := createNewCollider()
+	rid, cid := "a", "1"
+	c.roomTable.send(rid, cid, "send", "hi")
+	src := c.roomTable.lookupRoom(rid).clients[cid]
+
+	c.roomTable.remove(rid, cid)
+	if c.roomTable.lookupRoom(rid) != nil {
+		t.Errorf("After roomTable.remove(%q, %q), the room still exists, want removed", rid, cid)
+	}
+	if src.msgs != nil {
+		t.Errorf("After roomTable.remove(%q, %q), client.msgs = %v, want nil", rid, cid, src.msgs)
+	}
+	if r := c.dash.getReport(c.roomTable); r.DiscardedMsgs != 1 {
+		t.Errorf("After roomTable.remove(%q, %q), getReport().DiscardedMsgs = %d, want 1", rid, cid, r.DiscardedMsgs)
+	}
+}
+
+// Tests that concurrent registers into the same room never exceed its capacity.
+func TestConcurrentRegisterRespectsCapacity(t *testing.T) {
+	rt := createNewRoomTable()
+	rid, n := "race", 20
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(cid string) {
+			defer wg.Done()
+			if err := rt.register(rid, cid, &collidertest.MockReadWriteCloser{}); err == nil {
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			}
+			if size := rt.roomSize(rid); size > defaultMaxRoomCapacity {
+				t.Errorf("After concurrent registers, room has %d clients, want at most %d", size, defaultMaxRoomCapacity)
+			}
+		}("c" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	if succeeded != defaultMaxRoomCapacity {
+		t.Errorf("%d of %d concurrent registers succeeded, want %d", succeeded, n, defaultMaxRoomCapacity)
+	}
+}
+
+// Tests that concurrent registers of a client ID in different rooms never exceed MaxRoomsPerClient, and that
+// deregistering frees a room for the client ID.
+func TestConcurrentRegisterRespectsMaxRoomsPerClient(t *testing.T) {
+	c := createNewCollider()
+	c.MaxRoomsPerClient = 2
+	cid, n := "roaming", 10
+
+	var wg sync.WaitGroup
+	registered := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(rid string) {
+			defer wg.Done()
+			if err := c.roomTable.register(rid, cid, &collidertest.MockReadWriteCloser{}); err == nil {
+				registered <- rid
+			}
+		}("roaming-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(registered)
+
+	var rids []string
+	for rid := range registered {
+		rids = append(rids, rid)
+	}
+	if len(rids) != c.MaxRoomsPerClient {
+		t.Fatalf("%d of %d concurrent registers succeeded, want %d", len(rids), n, c.MaxRoomsPerClient)
+	}
+	if err := c.roomTable.register("roaming-more", cid, &collidertest.MockReadWriteCloser{}); err != errTooManyRooms {
+		t.Errorf("roomTable.register in a third room got error: %v, want %v", err, errTooManyRooms)
+	}
+	c.roomTable.deregister(rids[0], cid)
+	if err := c.roomTable.register("roaming-more", cid, &collidertest.MockReadWriteCloser{}); err != nil {
+		t.Errorf("After roomTable.deregister(%q, %q), roomTable.register in a third room got error: %v, want nil",
+			rids[0], cid, err)
+	}
+}
+
+// Tests that removing a room with DELETE ALL while its clients send lets each send either complete or fail
+// with errRoomRemoved. Run with -race.
+func TestDeleteAllRacesSends(t *testing.T) {
+	c := createNewCollider()
+	rid := "delete-race"
+	c.roomTable.register(rid, "1", &collidertest.MockReadWriteCloser{})
+	c.roomTable.register(rid, "2", &collidertest.MockReadWriteCloser{})
+
+	var wg sync.WaitGroup
+	for _, cid := range []string{"1", "2"} {
+		wg.Add(1)
+		go func(cid string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := c.roomTable.send(rid, cid, "send", "m"+strconv.Itoa(i)); err != nil && err != errRoomRemoved {
+					t.Errorf("roomTable.send(%q, %q) got error: %v, want nil or %v", rid, cid, err, errRoomRemoved)
+				}
+			}
+		}(cid)
+	}
+	rec := httptest.NewRecorder()
+	c.httpHandler(rec, httptest.NewRequest("DELETE", "/"+rid+"/ALL", nil))
+	wg.Wait()
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("DELETE /%s/ALL got status %d, want %d", rid, rec.Code, http.StatusOK)
+	}
+	if err := c.roomTable.send(rid, "1", "send", "late"); err != errRoomRemoved {
+		t.Errorf("After DELETE ALL, roomTable.send got error: %v, want %v", err, errRoomRemoved)
+	}
+	if n := c.roomTable.roomSize(rid); n != 0 {
+		t.Errorf("After DELETE ALL, the room has %d clients, want 0", n)
+	}
+
+	// Registering again joins a new room.
+	c.roomTable.register(rid, "1", &collidertest.MockReadWriteCloser{})
+	if err := c.roomTable.send(rid, "1", "send", "again"); err != nil {
+		t.Errorf("After registering again, roomTable.send got error: %v, want nil", err)
+	}
+}
+
+// Tests that OnQueueOverflow is called for each message refused by a full queue, with the count of the messages
+// refused since it filled up, and that the count restarts once the queue is emptied.
+func TestQueueOverflowHook(t *testing.T) {
+	c := createNewCollider()
+	var got []int
+	c.OnQueueOverflow = func(cl *client, rid string, dropped int) {
+		if cl == nil || cl.id != "1" || rid != "congested" {
+			t.Errorf("OnQueueOverflow got client %v in room %q, want client 1 in room congested", cl, rid)
+		}
+		got = append(got, dropped)
+	}
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			c.roomTable.send("congested", "1", "send", "m")
+		}
+	}
+	send(defaultMaxQueuedMsgs + 3)
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnQueueOverflow got dropped counts %v, want %v", got, want)
+	}
+
+	c.roomTable.removeRoom("congested")
+	got = nil
+	send(defaultMaxQueuedMsgs + 1)
+	if want := []int{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("After the queue is emptied, OnQueueOverflow got dropped counts %v, want %v", got, want)
+	}
+}
+
+// Tests that at most MaxBroadcasts broadcasts are sent at once, the others waiting in the queue until it is
+// full, and that the broadcasts are counted.
+func TestMaxBroadcasts(t *testing.T) {
+	c := createNewCollider()
+	c.MaxBroadcasts, c.BroadcastQueueSize = 2, 6
+	rwc := &gatedReadWriteCloser{release: make(chan bool)}
+	if err := c.roomTable.register("broadcast", "1", rwc); err != nil {
+		t.Fatalf("roomTable.register got error: %v, want nil", err)
+	}
+
+	n := 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := c.roomTable.broadcast(maintenanceMsg{Type: "maintenance"})
+			errs <- err
+		}()
+	}
+	if !waitForCondition(func() bool {
+		q := c.roomTable.broadcastStats()
+		return q.Active == 2 && q.Depth == 6 && q.Rejected == 2
+	}) {
+		t.Fatalf("The broadcast queue is %+v, want 2 active, 6 waiting and 2 rejected", c.roomTable.broadcastStats())
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != errTooManyBroadcasts {
+			t.Errorf("broadcast beyond the queue got error: %v, want %v", err, errTooManyBroadcasts)
+		}
+	}
+
+	for i := 0; i < n-2; i++ {
+		rwc.release <- true
+		if q := c.roomTable.broadcastStats(); q.Active > 2 {
+			t.Errorf("The broadcast queue is %+v, want at most 2 active", q)
+		}
+	}
+	for i := 0; i < n-2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("broadcast got error: %v, want nil", err)
+		}
+	}
+	if b := c.dash.getReport(c.roomTable).Broadcasts; b.Sent != n-2 || b.Queue.Active != 0 || b.Queue.Depth != 0 {
+		t.Errorf("getReport().Broadcasts = %+v, want %d sent and none in progress", b, n-2)
+	}
+}
+
+// Tests that each room removes a disconnected client after its own reconnect grace period.
+func TestPerRoomReconnectGrace(t *testing.T) {
+	c := createNewCollider()
+	c.ReconnectGrace = func(rid string) time.Duration {
+		if rid == "quick" {
+			return 10 * time.Millisecond
+		}
+		return 0
+	}
+	for _, rid := range []string{"quick", "persistent"} {
+		if err := c.roomTable.register(rid, "1", &collidertest.MockReadWriteCloser{Closed: false}); err != nil {
+			t.Fatalf("roomTable.register(%q, 1, ...) got error: %v, want nil", rid, err)
+		}
+		c.roomTable.deregister(rid, "1")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if c.roomTable.hasClient("quick", "1") {
+		t.Errorf("After the 10ms grace of room quick, the client is still in the room, want removed")
+	}
+	if !c.roomTable.hasClient("persistent", "1") {
+		t.Errorf("Within the 1s default grace of room persistent, the client was removed, want kept")
+	}
+}
+
+// Tests that a client disconnecting alone right after registering is removed with its room at once, while
+// one with a peer, or one that registered before QuickDisconnectWindow, is kept for the reconnect grace.
+func TestQuickDisconnectRemovesLoneClient(t *testing.T) {
+	c := createNewCollider()
+	c.QuickDisconnectWindow = 50 * time.Millisecond
+
+	c.roomTable.register("lone", "1", &collidertest.MockReadWriteCloser{Closed: false})
+	c.roomTable.deregister("lone", "1")
+	if c.roomTable.lookupRoom("lone") != nil {
+		t.Errorf("After a quick disconnect, room lone still exists, want removed")
+	}
+
+	c.roomTable.register("pair", "1", &collidertest.MockReadWriteCloser{Closed: false})
+	c.roomTable.register("pair", "2", &collidertest.MockReadWriteCloser{Closed: false})
+	c.roomTable.deregister("pair", "1")
+	if !c.roomTable.hasClient("pair", "1") {
+		t.Errorf("After a quick disconnect with a peer, the client was removed, want kept for the grace period")
+	}
+
+	c.roomTable.register("settled", "1", &collidertest.MockReadWriteCloser{Closed: false})
+	time.Sleep(2 * c.QuickDisconnectWindow)
+	c.roomTable.deregister("settled", "1")
+	if !c.roomTable.hasClient("settled", "1") {
+		t.Errorf("After a disconnect past QuickDisconnectWindow, the client was removed, want kept for the grace period")
+	}
+}
+
+// Tests that the rooms are paged in the order of their IDs, with the offset of the next page.
+func TestRoomPage(t *testing.T) {
+	rt := createNewRoomTable()
+	for i := 0; i < 5; i++ {
+		rt.room("r" + strconv.Itoa(i))
+	}
+
+	maxInt := int(^uint(0) >> 1)
+	for _, tc := range []struct {
+		offset, limit int
+		ids           []string
+		next          int
+	}{
+		{0, 2, []string{"r0", "r1"}, 2},
+		{2, 2, []string{"r2", "r3"}, 4},
+		{4, 2, []string{"r4"}, 0},
+		{0, 5, []string{"r0", "r1", "r2", "r3", "r4"}, 0},
+		{7, 2, nil, 0},
+		{3, maxInt, []string{"r3", "r4"}, 0},
+		{maxInt, maxInt, nil, 0},
+	} {
+		page, next := rt.roomPage(tc.offset, tc.limit)
+		var ids []string
+		for _, r := range page {
+			ids = append(ids, r.RoomID)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) || next != tc.next {
+			t.Errorf("roomTable.roomPage(%d, %d) = %v, %d, want %v, %d", tc.offset, tc.limit, ids, next, tc.ids, tc.next)
+		}
+	}
+}
+
+// Tests that the rooms are spread over the shards, and that the operations across the rooms see all of them.
+func TestRoomTableShards(t *testing.T) {
+	rt := newShardedRoomTable(time.Hour, "", 8)
+	for i := 0; i < 100; i++ {
+		rt.send(strconv.Itoa(i), "1", "send", "hi")
+	}
+	used := 0
+	for _, s := range rt.shards {
+		if len(s.rooms) > 0 {
+			used += 1
+		}
+	}
+	if used < 2 {
+		t.Errorf("100 rooms are in %d of the 8 shards, want them spread", used)
+	}
+	if n := rt.roomCount(); n != 100 {
+		t.Errorf("roomCount() = %d, want 100", n)
+	}
+	if n := rt.queuedCount(); n != 100 {
+		t.Errorf("queuedCount() = %d, want 100", n)
+	}
+	page, next := rt.roomPage(0, 3)
+	if next != 3 || len(page) != 3 || page[0].RoomID != "0" || page[1].RoomID != "1" || page[2].RoomID != "10" {
+		t.Errorf("roomPage(0, 3) = %v, %d, want rooms 0, 1 and 10, then offset 3", page, next)
+	}
+}
+
+// Benchmarks the room operations from concurrent goroutines on a table of many rooms, with a single lock and
+// with the shards of the default table.
+func BenchmarkRoomTableShards(b *testing.B) {
+	const rooms = 100000
+	for _, bc := range []struct {
+		name   string
+		shards int
+	}{{"single-lock", 1}, {"sharded", roomTableShards}} {
+		b.Run(bc.name, func(b *testing.B) {
+			rt := newShardedRoomTable(time.Hour, "", bc.shards)
+			for i := 0; i < rooms; i++ {
+				rt.send("room-"+strconv.Itoa(i), "1", "send", "hi")
+			}
+			var seq int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&seq, 1)
+					rt.roomSize("room-" + strconv.FormatInt(i%rooms, 10))
+					// Creates a room with a queued message, then removes it.
+					rid := "new-" + strconv.FormatInt(i, 10)
+					rt.send(rid, "1", "send", "hi")
+					rt.removeRoom(rid)
+				}
+			})
+		})
+	}
+}
+
+// Tests that a client that never registers is removed with its room after RegisterTimeout rather than the
+// timeout of the table.
+func TestRegisterTimeout(t *testing.T) {
+	c := createNewCollider()
+	c.RegisterTimeout = 50 * time.Millisecond
+	c.roomTable.send("half-formed", "1", "send", "hi")
+	if c.roomTable.roomCount() != 1 {
+		t.Fatalf("After roomTable.send, the table has %d rooms, want 1", c.roomTable.roomCount())
+	}
+	// The table times out after a second.
+	time.Sleep(300 * time.Millisecond)
+	if n := c.roomTable.roomCount(); n != 0 {
+		t.Errorf("After RegisterTimeout, the table has %d rooms, want the half-formed room removed", n)
+	}
+}
@@ -7,6 +7,7 @@ package collider
 
 import (
 	"collidertest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -47,8 +48,8 @@ func TestGetOrCreateClient(t *testing.T) {
 	// Adding the third client should fail.
 	id3 := "3"
 	_, err = r.client(id3)
-	if err == nil {
-		t.Errorf("After calling room.client(%q), and room.client(%q), room.client(%q) got no error, want error", id1, id2, id3)
+	if err != ErrRoomFull {
+		t.Errorf("After calling room.client(%q), and room.client(%q), room.client(%q) got error %v, want %v", id1, id2, id3, err, ErrRoomFull)
 	}
 }
 
@@ -80,7 +81,7 @@ func TestRoomSendQueued(t *testing.T) {
 	r := createNewRoom("a")
 	id := "1"
 	m := "hi"
-	if err := r.send(id, m); err != nil {
+	if err := r.send(id, "send", m); err != nil {
 		t.Errorf("room.send(%q, %q) got error: %s, want nil", id, m, err.Error())
 	}
 
@@ -97,7 +98,7 @@ func TestRoomSendImmediately(t *testing.T) {
 	id1, id2, m := "1", "2", "hi"
 	r.register(id2, &rwc)
 
-	if err := r.send(id1, m); err != nil {
+	if err := r.send(id1, "send", m); err != nil {
 		t.Errorf("room.send(%q, %q) got error: %s, want nil", id1, m, err.Error())
 	}
 	c, _ := r.client("1")
@@ -109,6 +110,36 @@ func TestRoomSendImmediately(t *testing.T) {
 	}
 }
 
+// Tests that in a room of MaxRoomCapacity 4, a message from one client reaches the other three, and a fifth
+// client is rejected.
+func TestRoomSendFanOut(t *testing.T) {
+	c := createNewCollider()
+	c.MaxRoomCapacity = 4
+	rid, m := "group", "hi all"
+	rwcs := make(map[string]*collidertest.MockReadWriteCloser)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		rwcs[id] = &collidertest.MockReadWriteCloser{Closed: false}
+		if err := c.roomTable.register(rid, id, rwcs[id]); err != nil {
+			t.Fatalf("roomTable.register(%q, %q) got error: %v, want nil", rid, id, err)
+		}
+	}
+	if err := c.roomTable.register(rid, "5", &collidertest.MockReadWriteCloser{}); err != ErrRoomFull {
+		t.Errorf("Registering a fifth client in a room of capacity 4 got error: %v, want %v", err, ErrRoomFull)
+	}
+
+	if err := c.roomTable.send(rid, "1", "send", m); err != nil {
+		t.Errorf("roomTable.send(%q, %q, %q) got error: %v, want nil", rid, "1", m, err)
+	}
+	for _, id := range []string{"2", "3", "4"} {
+		if !strings.Contains(rwcs[id].Msg, m) {
+			t.Errorf("After client 1 sent %q, client %s received %q, want the message", m, id, rwcs[id].Msg)
+		}
+	}
+	if rwcs["1"].Msg != "" {
+		t.Errorf("After client 1 sent %q, it received %q itself, want nothing", m, rwcs["1"].Msg)
+	}
+}
+
 // Tests that the client is closed and removed by room.remove.
 func TestRoomDelete(t *testing.T) {
 	r := createNewRoom("a")
@@ -116,7 +147,7 @@ func TestRoomDelete(t *testing.T) {
 	id := "1"
 	r.register(id, &rwc)
 
-	r.remove(id)
+	r.remove(id, DisconnectKicked)
 	if !rwc.Closed {
 		t.Errorf("After room.register(%q, &rwc) and room.remove(%q), rwc.Closed = false, want true", id, id)
 	}
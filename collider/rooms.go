@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// roomListing is a room listed by /rooms.
+type roomListing struct {
+	RoomID         string   `json:"roomid"`
+	Clients        []string `json:"clients"`
+	QueuedMessages int      `json:"queuedMessages"`
+}
+
+// roomList returns the rooms with their client IDs and the number of messages queued in them, sorted by
+// room ID. Each shard is locked while its rooms are listed.
+func (rt *roomTable) roomList() []roomListing {
+	rooms := []roomListing{}
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			l := roomListing{RoomID: r.id, Clients: make([]string, 0, len(r.clients))}
+			for _, c := range r.clients {
+				l.Clients = append(l.Clients, c.id)
+				l.QueuedMessages += len(c.msgs)
+			}
+			sort.Strings(l.Clients)
+			rooms = append(rooms, l)
+		}
+	})
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+	return rooms
+}
+
+// httpRoomsHandler is a HTTP handler that lists the rooms, their clients and their queued messages as JSON.
+func (c *Collider) httpRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	c.allowOrigin(w, r)
+	w.Header().Add("Access-Control-Allow-Methods", "GET")
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c.roomTable.roomList()); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"collidertest"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Tests that /rooms lists the rooms with their clients and queued messages, and only answers GET.
+func TestHttpRooms(t *testing.T) {
+	c := createNewCollider()
+	c.roomTable.register("b", "2", &collidertest.MockReadWriteCloser{})
+	c.roomTable.register("b", "1", &collidertest.MockReadWriteCloser{})
+	c.roomTable.send("a", "1", "send", "hi")
+	c.roomTable.send("a", "1", "send", "there")
+
+	rec := httptest.NewRecorder()
+	c.httpRoomsHandler(rec, httptest.NewRequest("GET", "/rooms", nil))
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "*" {
+		t.Errorf("GET /rooms got Access-Control-Allow-Origin %q, want *", o)
+	}
+	var got []roomListing
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Decoding GET /rooms got error: %v, want nil", err)
+	}
+	want := []roomListing{
+		{RoomID: "a", Clients: []string{"1"}, QueuedMessages: 2},
+		{RoomID: "b", Clients: []string{"1", "2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /rooms = %+v, want %+v", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	c.httpRoomsHandler(rec, httptest.NewRequest("DELETE", "/rooms", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /rooms got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
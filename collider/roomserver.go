@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The timeout of the room server calls when RoomServerTimeout is not set.
+const defaultRoomSrvTimeout = 5 * time.Second
+
+// The number of consecutive failed room server calls that opens the circuit breaker, and how long it
+// then skips the calls before trying again.
+const (
+	roomSrvBreakerFailures = 5
+	roomSrvBreakerCooldown = 30 * time.Second
+)
+
+// roomSrvBreaker is a circuit breaker skipping the room server calls for a while after consecutive failures,
+// so that an unavailable room server is not flooded with calls bound to time out.
+type roomSrvBreaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns false while the breaker is open.
+func (b *roomSrvBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+// onResult records the result of a call, opening the breaker after roomSrvBreakerFailures failures in a row.
+// It returns true if it opened the breaker.
+func (b *roomSrvBreaker) onResult(err error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	if b.failures += 1; b.failures >= roomSrvBreakerFailures {
+		b.openUntil = time.Now().Add(roomSrvBreakerCooldown)
+		b.failures = 0
+		return true
+	}
+	return false
+}
+
+// roomSrvTimeout returns the timeout of the room server calls.
+func (rt *roomTable) roomSrvTimeout() time.Duration {
+	if rt != nil && rt.parent != nil && rt.parent.RoomServerTimeout > 0 {
+		return rt.parent.RoomServerTimeout
+	}
+	return defaultRoomSrvTimeout
+}
+
+// notifyRoomServer posts to |url| on the room server in the background, so that a slow or failing room server
+// never holds up signaling. The calls are skipped while the circuit breaker is open.
+func (rt *roomTable) notifyRoomServer(url string) {
+	var breaker *roomSrvBreaker
+	if rt != nil {
+		breaker = &rt.rsBreaker
+		if !breaker.allow() {
+			rt.onRoomSrvErr(true)
+			return
+		}
+	}
+	client := &http.Client{Timeout: rt.roomSrvTimeout()}
+	go func() {
+		resp, err := client.Post(url, "text", nil)
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode >= 500 {
+			err = errors.New(resp.Status)
+		}
+		if breaker != nil && breaker.onResult(err) {
+			rt.logger().Printf("Skipping the room server calls for %v after %d failures", roomSrvBreakerCooldown,
+				roomSrvBreakerFailures)
+		}
+		if err != nil {
+			rt.logger().Printf("Failed to post to the room server %s: %v", url, err)
+			rt.onRoomSrvErr(false)
+		}
+	}()
+}
+
+// onRoomSrvErr accounts for a failed room server call, or one skipped by the circuit breaker.
+func (rt *roomTable) onRoomSrvErr(skipped bool) {
+	if rt != nil && rt.parent != nil {
+		rt.parent.dash.onRoomSrvErr(skipped)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"collidertest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the messages are delivered to the peer while the room server hangs or fails, and that the
+// failures are counted.
+func TestSendWithFailingRoomServer(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/slow/") {
+			<-release
+		}
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := createNewCollider()
+	c.roomTable.roomSrvUrl = srv.URL
+	peer := &collidertest.MockReadWriteCloser{}
+	c.roomTable.register("a", "1", &collidertest.MockReadWriteCloser{})
+	c.roomTable.register("a", "2", peer)
+
+	// Removing clients posts bye to the room server, which hangs for one room and fails for the other.
+	start := time.Now()
+	for _, rid := range []string{"slow", "failing"} {
+		c.roomTable.register(rid, "x", &collidertest.MockReadWriteCloser{})
+		c.roomTable.remove(rid, "x")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Removing the clients took %v while the room server hangs, want it not to wait", d)
+	}
+
+	if err := c.roomTable.send("a", "1", "send", "hi"); err != nil {
+		t.Errorf("roomTable.send got error: %v, want nil", err)
+	}
+	if !strings.Contains(peer.Msg, `"msg":"hi"`) {
+		t.Errorf("The peer received %q, want the message", peer.Msg)
+	}
+	if !waitForCondition(func() bool { return c.dash.getReport(c.roomTable).RoomSrvErrs == 1 }) {
+		t.Errorf("getReport().RoomSrvErrs = %d, want 1", c.dash.getReport(c.roomTable).RoomSrvErrs)
+	}
+}
+
+// Tests that the room server calls are skipped once the circuit breaker opens.
+func TestRoomServerCircuitBreaker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := createNewCollider()
+	for i := 0; i < roomSrvBreakerFailures; i++ {
+		c.roomTable.notifyRoomServer(srv.URL + "/bye/r/" + strconv.Itoa(i))
+	}
+	if !waitForCondition(func() bool { return c.dash.getReport(c.roomTable).RoomSrvErrs == roomSrvBreakerFailures }) {
+		t.Fatalf("getReport().RoomSrvErrs = %d, want %d", c.dash.getReport(c.roomTable).RoomSrvErrs, roomSrvBreakerFailures)
+	}
+
+	c.roomTable.notifyRoomServer(srv.URL + "/bye/r/skipped")
+	if rp := c.dash.getReport(c.roomTable); rp.RoomSrvSkipped != 1 {
+		t.Errorf("After %d failures, getReport().RoomSrvSkipped = %d, want 1", roomSrvBreakerFailures, rp.RoomSrvSkipped)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"io"
+	"sync"
+	"time"
+)
+
+// serializer encodes and decodes the WebSocket frames of a connection.
+type serializer interface {
+	Decode(data []byte) (*wsClientMsg, error)
+	Encode(v interface{}) ([]byte, error)
+}
+
+// jsonSerializer is the default serializer, framing every message as a line of JSON.
+type jsonSerializer struct{}
+
+func (jsonSerializer) Decode(data []byte) (*wsClientMsg, error) {
+	var m wsClientMsg
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (jsonSerializer) Encode(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// renamingSerializer encodes the wsServerMsg frames with their fields renamed, leaving the other frames as is.
+type renamingSerializer struct {
+	serializer
+	// names maps the default field names to the ones to use instead.
+	names map[string]string
+}
+
+func (rs renamingSerializer) Encode(v interface{}) ([]byte, error) {
+	m, ok := v.(wsServerMsg)
+	if !ok {
+		return rs.serializer.Encode(v)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for k, f := range fields {
+		if n, ok := rs.names[k]; ok {
+			k = n
+		}
+		renamed[k] = f
+	}
+	return rs.serializer.Encode(renamed)
+}
+
+// serialConn is a WebSocket connection together with the serializer chosen for it.
+type serialConn struct {
+	*websocket.Conn
+	ser serializer
+	// id is the server-side ID of the connection, unique within the server instance.
+	id string
+	// tenant is the tenant the connection is counted against, or "".
+	tenant string
+	// version is the version of the message schema negotiated by the connection.
+	version string
+	// connectedAt is the time the connection was accepted.
+	connectedAt time.Time
+	// remoteIP is the IP address the connection comes from, behind TrustedProxies that of the client.
+	remoteIP string
+	// wlock serializes the frames written by Write and ping.
+	wlock sync.Mutex
+	// rlock guards reason, the reason recorded by closeFor.
+	rlock  sync.Mutex
+	reason DisconnectReason
+}
+
+func (sc *serialConn) serializer() serializer {
+	return sc.ser
+}
+
+func (sc *serialConn) Write(p []byte) (int, error) {
+	sc.wlock.Lock()
+	defer sc.wlock.Unlock()
+	return sc.Conn.Write(p)
+}
+
+// ping writes a ping control frame, which the client answers with a pong, giving up after |timeout|.
+// The frame is written by the connection itself, whose writer lock also serializes it with the pongs and
+// the close frame written by the reader.
+func (sc *serialConn) ping(timeout time.Duration) error {
+	sc.wlock.Lock()
+	defer sc.wlock.Unlock()
+
+	sc.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer sc.Conn.SetWriteDeadline(time.Time{})
+	payloadType := sc.Conn.PayloadType
+	sc.Conn.PayloadType = websocket.PingFrame
+	defer func() { sc.Conn.PayloadType = payloadType }()
+	_, err := sc.Conn.Write(nil)
+	return err
+}
+
+// closeFor closes the connection, recording |r| as the reason unless one is already recorded.
+func (sc *serialConn) closeFor(r DisconnectReason) error {
+	sc.rlock.Lock()
+	if sc.reason == "" {
+		sc.reason = r
+	}
+	sc.rlock.Unlock()
+	return sc.Close()
+}
+
+// closeReason returns the reason recorded by closeFor, or "" if the connection was not closed by it.
+func (sc *serialConn) closeReason() DisconnectReason {
+	sc.rlock.Lock()
+	defer sc.rlock.Unlock()
+	return sc.reason
+}
+
+// serializerOf returns the serializer of the writer, or the JSON serializer if it has none.
+func serializerOf(w io.Writer) serializer {
+	if sw, ok := w.(interface {
+		serializer() serializer
+	}); ok {
+		return sw.serializer()
+	}
+	return jsonSerializer{}
+}
+
+// registerSerializer makes |s| the serializer of the connections negotiating the subprotocol |proto|.
+func (c *Collider) registerSerializer(proto string, s serializer) {
+	if c.serializers == nil {
+		c.serializers = make(map[string]serializer)
+	}
+	c.serializers[proto] = s
+}
+
+// serializerFor returns the serializer of the first subprotocol of the connection that has one, registered or
+// deflate, or the JSON serializer, renaming the fields as configured by FieldNames.
+func (c *Collider) serializerFor(ws *websocket.Conn) serializer {
+	var s serializer = jsonSerializer{}
+	for _, p := range ws.Config().Protocol {
+		if ps, ok := c.serializers[p]; ok {
+			s = ps
+			break
+		}
+		if ds := c.deflater(p); ds != nil {
+			s = ds
+			break
+		}
+	}
+	if len(c.FieldNames) > 0 {
+		return renamingSerializer{s, c.FieldNames}
+	}
+	return s
+}
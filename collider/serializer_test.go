@@ -0,0 +1,125 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"testing"
+)
+
+const b64Protocol = "collider.b64"
+
+// b64Serializer is a mock serializer framing the JSON messages in base64.
+type b64Serializer struct{}
+
+func (b64Serializer) Decode(data []byte) (*wsClientMsg, error) {
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return jsonSerializer{}.Decode(b)
+}
+
+func (b64Serializer) Encode(v interface{}) ([]byte, error) {
+	b, err := jsonSerializer{}.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+// Tests that the default serializer round-trips a message.
+func TestJSONSerializerRoundTrip(t *testing.T) {
+	m := wsClientMsg{Cmd: "send", Msg: "hello", To: "2"}
+	b, err := jsonSerializer{}.Encode(m)
+	if err != nil {
+		t.Fatalf("jsonSerializer.Encode(%v) got error: %v, want nil", m, err)
+	}
+	d, err := jsonSerializer{}.Decode(b)
+	if err != nil {
+		t.Fatalf("jsonSerializer.Decode(%q) got error: %v, want nil", b, err)
+	}
+	if d.Cmd != m.Cmd || d.Msg != m.Msg || d.To != m.To {
+		t.Errorf("jsonSerializer round trip of %+v = %+v", m, *d)
+	}
+}
+
+// Tests that a connection negotiating the subprotocol of a serializer has its frames decoded and encoded by it,
+// while a plain connection in the same room keeps using JSON.
+func TestWsSerializerBySubprotocol(t *testing.T) {
+	setup()
+	cl.registerSerializer(b64Protocol, b64Serializer{})
+
+	config := newConfig(t, "/ws")
+	config.Protocol = []string{b64Protocol}
+	c1, err := websocket.NewClient(config, dial(t))
+	if err != nil {
+		t.Fatalf("websocket.NewClient(%v) got error: %v, want nil", config, err)
+	}
+	defer c1.Close()
+	writeB64 := func(m wsClientMsg) {
+		b, _ := b64Serializer{}.Encode(m)
+		if err := websocket.Message.Send(c1, string(b)); err != nil {
+			t.Fatalf("websocket.Message.Send got error: %v, want nil", err)
+		}
+	}
+	rid := "serializer"
+	writeB64(wsClientMsg{Cmd: "register", RoomID: rid, ClientID: "1"})
+
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+
+	// JSON from the plain client reaches the base64 client encoded in base64.
+	write(t, c2, wsClientMsg{Cmd: "send", Msg: "to b64"})
+	var data string
+	if err := websocket.Message.Receive(c1, &data); err != nil {
+		t.Fatalf("websocket.Message.Receive(c1) got error: %v, want nil", err)
+	}
+	m, err := b64Serializer{}.Decode([]byte(data))
+	if err != nil {
+		t.Fatalf("Decoding %q from the base64 client got error: %v, want nil", data, err)
+	}
+	if m.Msg != "to b64" {
+		t.Errorf("The base64 client received %+v, want msg %q", m, "to b64")
+	}
+
+	// Base64 from the other client reaches the plain client as JSON.
+	writeB64(wsClientMsg{Cmd: "send", Msg: "to json"})
+	expectReceiveMessage(t, c2, "to json")
+}
+
+// Tests that the relayed frames use the field names configured by FieldNames.
+func TestWsFieldNames(t *testing.T) {
+	setup()
+	cl.FieldNames = map[string]string{"cmd": "type", "msg": "data"}
+	defer func() { cl.FieldNames = nil }()
+
+	rid := "field-names"
+	c1 := addWsClient(t, rid, "1")
+	defer c1.Close()
+	c2 := addWsClient(t, rid, "2")
+	defer c2.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, "1") && cl.roomTable.isRegistered(rid, "2") })
+
+	write(t, c1, wsClientMsg{Cmd: "send", Msg: "renamed"})
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(read(t, c2)), &fields); err != nil {
+		t.Fatalf("Decoding the relayed frame got error: %v, want nil", err)
+	}
+	if fields["type"] != "send" || fields["data"] != "renamed" {
+		t.Errorf("The relayed frame is %v, want type %q and data %q", fields, "send", "renamed")
+	}
+	for _, f := range []string{"cmd", "msg"} {
+		if _, ok := fields[f]; ok {
+			t.Errorf("The relayed frame %v has the default field %q, want it renamed", fields, f)
+		}
+	}
+	if _, ok := fields["from"]; !ok {
+		t.Errorf("The relayed frame %v has no field %q, want the unmapped fields kept", fields, "from")
+	}
+}
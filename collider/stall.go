@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// callStalledMsg notifies the clients of a room that the client ClientID registered StalledMs ago and has
+// neither sent nor received a routed message since.
+type callStalledMsg struct {
+	Type      string `json:"type"`
+	ClientID  string `json:"clientId"`
+	StalledMs int64  `json:"stalledMs"`
+}
+
+// callStallTimeout returns how long a registered client may go without a routed message, or 0 if unlimited.
+func (rt *roomTable) callStallTimeout() time.Duration {
+	if rt == nil || rt.parent == nil {
+		return 0
+	}
+	return rt.parent.CallStallTimeout
+}
+
+// watchStall starts the timer reporting the client |c| of the room as stalled if it has neither sent nor
+// received a routed message CallStallTimeout after registering. It must be called after c registers.
+func (rm *room) watchStall(c *client) {
+	d := rm.parent.callStallTimeout()
+	// A client already routed a queued message when registering is not stalled.
+	at := atomic.LoadInt64(&c.registeredAt)
+	if d <= 0 || at == 0 {
+		return
+	}
+	c.setStallTimer(time.AfterFunc(d, func() {
+		rm.parent.onCallStalled(rm.id, c, at)
+	}))
+}
+
+// onCallStalled sends a call_stalled frame to the registered clients of the room |rid| if the client |c|
+// registered at the UnixNano time |at| is still there without having routed a message, then closes the room
+// under CloseStalledRooms. The recipients are collected under the lock and written to once it is released.
+func (rt *roomTable) onCallStalled(rid string, c *client, at int64) {
+	s := rt.shard(rid)
+	s.lock.Lock()
+	r := s.rooms[rid]
+	if r == nil || r.clients[c.id] != c || !c.registered() || atomic.LoadInt64(&c.registeredAt) != at {
+		s.lock.Unlock()
+		return
+	}
+	stalled := time.Since(time.Unix(0, at))
+	rt.logger().Printf("Client %s of room %s has routed no message %v after registering", c.id, rid, stalled)
+	m := callStalledMsg{Type: "call_stalled", ClientID: c.id, StalledMs: int64(stalled / time.Millisecond)}
+	var recipients []*client
+	var conns []io.ReadWriteCloser
+	if rt.parent.CloseStalledRooms {
+		for _, oc := range r.clients {
+			conns = append(conns, oc.detachConns()...)
+			oc.deregister(DisconnectStalled)
+		}
+		rt.removeRoomLocked(rid)
+	} else {
+		for _, oc := range r.clients {
+			if oc.registered() {
+				recipients = append(recipients, oc)
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	for _, oc := range recipients {
+		send(oc, m)
+	}
+	for _, rwc := range conns {
+		send(rwc, m)
+		closeFor(rwc, DisconnectStalled)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"golang.org/x/net/websocket"
+	"testing"
+	"time"
+)
+
+// Tests that a registered client sending heartbeats but no relayed message is reported as stalled to its room.
+func TestWsCallStalled(t *testing.T) {
+	setup()
+	cl.CallStallTimeout = 100 * time.Millisecond
+	defer func() { cl.CallStallTimeout = 0 }()
+
+	rid, cid := "call-stalled", "1"
+	conn := addWsClient(t, rid, cid)
+	defer conn.Close()
+	waitForCondition(func() bool { return cl.roomTable.isRegistered(rid, cid) })
+	write(t, conn, wsClientMsg{Cmd: "heartbeat"})
+
+	var m callStalledMsg
+	if err := websocket.JSON.Receive(conn, &m); err != nil {
+		t.Fatalf("Receiving the call_stalled frame got error: %v, want nil", err)
+	}
+	if m.Type != "call_stalled" || m.ClientID != cid || m.StalledMs < 100 {
+		t.Errorf("Received %+v, want a call_stalled of client %s after at least 100ms", m, cid)
+	}
+	if !cl.roomTable.isRegistered(rid, cid) {
+		t.Errorf("After the call_stalled frame, the client is not registered, want it kept without CloseStalledRooms")
+	}
+}
+
+// Tests that a room whose call stalls is closed under CloseStalledRooms, after the clients are notified.
+func TestWsCallStalledClosesRoom(t *testing.T) {
+	setup()
+	cl.CallStallTimeout, cl.CloseStalledRooms = 100*time.Millisecond, true
+	defer func() { cl.CallStallTimeout, cl.CloseStalledRooms = 0, false }()
+
+	rid, cid := "call-stalled-close", "1"
+	conn := addWsClient(t, rid, cid)
+	defer conn.Close()
+
+	var m callStalledMsg
+	if err := websocket.JSON.Receive(conn, &m); err != nil || m.Type != "call_stalled" {
+		t.Fatalf("Received %+v with error %v, want a call_stalled frame", m, err)
+	}
+	expectConnectionClose(t, conn)
+	if !waitForCondition(func() bool { return cl.roomTable.roomSize(rid) == 0 }) {
+		t.Errorf("After the call stalled, room %s exists, want it removed", rid)
+	}
+}
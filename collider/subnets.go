@@ -0,0 +1,137 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The defaults of the prefix lengths the connections are grouped by, and of the number of subnets reported.
+const (
+	defaultSubnetBits  = 24
+	defaultSubnet6Bits = 64
+	defaultSubnetTop   = 20
+	maxSubnetTop       = 1000
+)
+
+// subnetCount is the number of active connections from a subnet.
+type subnetCount struct {
+	Subnet string `json:"subnet"`
+	Conns  int    `json:"conns"`
+}
+
+// subnetReport is the admin report of the active connections grouped by subnet.
+type subnetReport struct {
+	// Total counts the connections with a known remote IP, including those of the subnets left out of Subnets.
+	Total   int           `json:"total"`
+	Subnets []subnetCount `json:"subnets"`
+}
+
+// subnetOf returns the subnet of |ip| in CIDR notation, masking IPv4 addresses to |bits| bits and IPv6
+// addresses to |bits6| bits, or "" if |ip| is not a valid IP address.
+func subnetOf(ip string, bits int, bits6 int) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	mask := net.CIDRMask(bits6, 8*net.IPv6len)
+	if v4 := addr.To4(); v4 != nil {
+		addr, mask = v4, net.CIDRMask(bits, 8*net.IPv4len)
+	}
+	n := net.IPNet{IP: addr.Mask(mask), Mask: mask}
+	return n.String()
+}
+
+// countSubnets groups |ips| by subnet and returns the |top| subnets with the most connections.
+func countSubnets(ips []string, bits int, bits6 int, top int) subnetReport {
+	counts := make(map[string]int)
+	rp := subnetReport{Subnets: []subnetCount{}}
+	for _, ip := range ips {
+		if s := subnetOf(ip, bits, bits6); s != "" {
+			counts[s] += 1
+			rp.Total += 1
+		}
+	}
+	for s, n := range counts {
+		rp.Subnets = append(rp.Subnets, subnetCount{Subnet: s, Conns: n})
+	}
+	sort.Slice(rp.Subnets, func(i, j int) bool {
+		if rp.Subnets[i].Conns != rp.Subnets[j].Conns {
+			return rp.Subnets[i].Conns > rp.Subnets[j].Conns
+		}
+		return rp.Subnets[i].Subnet < rp.Subnets[j].Subnet
+	})
+	if len(rp.Subnets) > top {
+		rp.Subnets = rp.Subnets[:top]
+	}
+	return rp
+}
+
+// remoteIPs returns the remote IP addresses of the active connections.
+func (rt *roomTable) remoteIPs() []string {
+	ips := []string{}
+	rt.eachShard(func(s *roomShard) {
+		for _, r := range s.rooms {
+			for _, c := range r.clients {
+				for _, rwc := range c.conns() {
+					if ip := remoteIPOf(rwc); ip != "" {
+						ips = append(ips, ip)
+					}
+				}
+			}
+		}
+	})
+	return ips
+}
+
+// intParam returns the integer query parameter |name| of the request, or |def| if it is not set.
+// It returns false if the parameter is not an integer within [min, max].
+func intParam(r *http.Request, name string, def int, min int, max int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+// httpAdminSubnetsHandler is a HTTP handler that handles GET requests to "/admin/subnets" and reports the
+// active connections grouped by remote subnet, busiest first. The optional "bits" and "bits6" query parameters
+// set the prefix lengths of the IPv4 and IPv6 subnets, /24 and /64 by default, and "top" bounds the number
+// of subnets reported, 20 by default.
+func (c *Collider) httpAdminSubnetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bits, ok := intParam(r, "bits", defaultSubnetBits, 0, 8*net.IPv4len)
+	if !ok {
+		http.Error(w, "Invalid bits: "+r.URL.Query().Get("bits"), http.StatusBadRequest)
+		return
+	}
+	bits6, ok := intParam(r, "bits6", defaultSubnet6Bits, 0, 8*net.IPv6len)
+	if !ok {
+		http.Error(w, "Invalid bits6: "+r.URL.Query().Get("bits6"), http.StatusBadRequest)
+		return
+	}
+	top, ok := intParam(r, "top", defaultSubnetTop, 1, maxSubnetTop)
+	if !ok {
+		http.Error(w, "Invalid top: "+r.URL.Query().Get("top"), http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(countSubnets(c.roomTable.remoteIPs(), bits, bits6, top)); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that the connections are grouped by subnet, busiest first, and bounded to the top subnets.
+func TestCountSubnets(t *testing.T) {
+	ips := []string{
+		"10.0.1.5", "10.0.1.77", "10.0.1.200",
+		"10.0.2.9", "10.0.2.10",
+		"192.168.7.1",
+		"2001:db8:0:1::5", "2001:db8:0:1:ffff::1",
+		"not an ip",
+	}
+
+	rp := countSubnets(ips, 24, 64, 3)
+	want := subnetReport{Total: 8, Subnets: []subnetCount{
+		{"10.0.1.0/24", 3},
+		{"10.0.2.0/24", 2},
+		{"2001:db8:0:1::/64", 2},
+	}}
+	if !reflect.DeepEqual(rp, want) {
+		t.Errorf("countSubnets(ips, 24, 64, 3) = %+v, want %+v", rp, want)
+	}
+
+	rp = countSubnets(ips, 16, 32, 10)
+	want = subnetReport{Total: 8, Subnets: []subnetCount{
+		{"10.0.0.0/16", 5},
+		{"2001:db8::/32", 2},
+		{"192.168.0.0/16", 1},
+	}}
+	if !reflect.DeepEqual(rp, want) {
+		t.Errorf("countSubnets(ips, 16, 32, 10) = %+v, want %+v", rp, want)
+	}
+}
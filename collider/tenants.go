@@ -0,0 +1,262 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TenantLimits are the limits of the connections and rooms of a tenant. Zero fields are unlimited.
+type TenantLimits struct {
+	// MaxConns is the number of WebSocket connections of the tenant open at once. Further connections are
+	// rejected with 503, or with a TENANT_LIMIT error if they are attributed to the tenant when registering.
+	MaxConns int `json:"maxConns,omitempty"`
+	// MaxRooms is the number of rooms the clients of the tenant may have created at once. Registering in one
+	// more room is rejected with a TENANT_LIMIT error.
+	MaxRooms int `json:"maxRooms,omitempty"`
+	// MessagesPerSecond is the rate of the room messages the clients of the tenant may send collectively,
+	// beyond MessageBurst. Further messages are rejected with a TENANT_RATE_LIMITED error.
+	MessagesPerSecond float64 `json:"messagesPerSecond,omitempty"`
+	MessageBurst      int     `json:"messageBurst,omitempty"`
+}
+
+// errTenantLimit is returned by register when the tenant of the client has MaxRooms rooms.
+var errTenantLimit = errors.New("Tenant limit reached")
+
+// tenantUsage is what a tenant uses of its limits.
+type tenantUsage struct {
+	conns int
+	// rooms is the number of rooms of the tenant.
+	rooms int
+	// messages is the number of room messages sent, and rateLimited those rejected by MessagesPerSecond.
+	messages    int
+	rateLimited int
+	// refused is the number of connections and registrations rejected by MaxConns and MaxRooms.
+	refused int
+	limiter *tokenBucket
+}
+
+// tenantTable tracks the usage of the tenants.
+type tenantTable struct {
+	lock  sync.Mutex
+	usage map[string]*tenantUsage
+}
+
+// usageLocked returns the usage of the tenant |t|, creating it if needed. The caller must hold the lock.
+func (tt *tenantTable) usageLocked(t string) *tenantUsage {
+	if tt.usage == nil {
+		tt.usage = make(map[string]*tenantUsage)
+	}
+	u := tt.usage[t]
+	if u == nil {
+		u = &tenantUsage{}
+		tt.usage[t] = u
+	}
+	return u
+}
+
+// acquireConn counts a connection of the tenant |t| and returns true, or returns false if the tenant has
+// MaxConns connections.
+func (tt *tenantTable) acquireConn(t string, l TenantLimits) bool {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	u := tt.usageLocked(t)
+	if l.MaxConns > 0 && u.conns >= l.MaxConns {
+		u.refused += 1
+		return false
+	}
+	u.conns += 1
+	return true
+}
+
+// releaseConn uncounts a connection of the tenant |t|.
+func (tt *tenantTable) releaseConn(t string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	tt.usageLocked(t).conns -= 1
+}
+
+// acquireRoom counts a room of the tenant |t| and returns true, or returns false if the tenant has MaxRooms
+// rooms.
+func (tt *tenantTable) acquireRoom(t string, l TenantLimits) bool {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	u := tt.usageLocked(t)
+	if l.MaxRooms > 0 && u.rooms >= l.MaxRooms {
+		return false
+	}
+	u.rooms += 1
+	return true
+}
+
+// releaseRoom uncounts a room of the tenant |t|.
+func (tt *tenantTable) releaseRoom(t string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	tt.usageLocked(t).rooms -= 1
+}
+
+// onRefused counts a registration of the tenant |t| rejected by its limits.
+func (tt *tenantTable) onRefused(t string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	tt.usageLocked(t).refused += 1
+}
+
+// allowMessage returns false if the clients of the tenant |t| have collectively sent room messages faster
+// than MessagesPerSecond, beyond the MessageBurst. Otherwise it counts the message and returns true.
+func (tt *tenantTable) allowMessage(t string, l TenantLimits) bool {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	u := tt.usageLocked(t)
+	if l.MessagesPerSecond > 0 {
+		now := time.Now()
+		if u.limiter == nil {
+			u.limiter = newTokenBucket(l.MessagesPerSecond, l.MessageBurst, now)
+		}
+		if !u.limiter.allow(now) {
+			u.rateLimited += 1
+			return false
+		}
+	}
+	u.messages += 1
+	return true
+}
+
+// tenantReport is the usage of a tenant shown by the admin API.
+type tenantReport struct {
+	Tenant      string       `json:"tenant"`
+	Conns       int          `json:"conns"`
+	Rooms       int          `json:"rooms"`
+	Messages    int          `json:"messages"`
+	RateLimited int          `json:"rateLimited"`
+	Refused     int          `json:"refused"`
+	Limits      TenantLimits `json:"limits"`
+}
+
+// tenantSlot is the tenant a WebSocket connection is counted against, stored in the context of its request.
+// It changes if the connection is attributed to another tenant when registering.
+type tenantSlot struct {
+	tenant string
+}
+
+type tenantSlotKey struct{}
+
+// tenantOf returns the tenant of the request and the room |rid|, or "" if the request has none.
+func (c *Collider) tenantOf(r *http.Request, rid string) string {
+	if c.TenantFunc == nil || r == nil {
+		return ""
+	}
+	return c.TenantFunc(r, rid)
+}
+
+// tenantLimits returns the limits of the tenant |t|.
+func (c *Collider) tenantLimits(t string) TenantLimits {
+	if l, ok := c.Tenants[t]; ok {
+		return l
+	}
+	return c.DefaultTenantLimits
+}
+
+// limitTenants wraps the WebSocket handler to reject the handshake with 503 once the tenant of the request
+// has MaxConns connections, and to count the connection against its tenant until it ends.
+func (c *Collider) limitTenants(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &tenantSlot{tenant: c.tenantOf(r, "")}
+		if s.tenant != "" && !c.tenants.acquireConn(s.tenant, c.tenantLimits(s.tenant)) {
+			http.Error(w, "Too many connections for the tenant", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() {
+			if s.tenant != "" {
+				c.tenants.releaseConn(s.tenant)
+			}
+		}()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantSlotKey{}, s)))
+	})
+}
+
+// moveTenant attributes the connection to the tenant of the room |rid| if it differs from the one it is
+// counted against, and returns false if that tenant has MaxConns connections.
+func (c *Collider) moveTenant(conn *serialConn, rid string) bool {
+	s, ok := conn.Request().Context().Value(tenantSlotKey{}).(*tenantSlot)
+	if !ok {
+		return true
+	}
+	t := c.tenantOf(conn.Request(), rid)
+	if t == s.tenant {
+		return true
+	}
+	if t != "" && !c.tenants.acquireConn(t, c.tenantLimits(t)) {
+		return false
+	}
+	if s.tenant != "" {
+		c.tenants.releaseConn(s.tenant)
+	}
+	s.tenant, conn.tenant = t, t
+	return true
+}
+
+// tenantSlotOf returns the tenant the connection was counted against when accepted, or "".
+func tenantSlotOf(r *http.Request) string {
+	if s, ok := r.Context().Value(tenantSlotKey{}).(*tenantSlot); ok {
+		return s.tenant
+	}
+	return ""
+}
+
+// tenantOfConn returns the tenant of the connection, or "" if it has none.
+func tenantOfConn(rwc io.ReadWriteCloser) string {
+	if sc, ok := rwc.(*serialConn); ok {
+		return sc.tenant
+	}
+	return ""
+}
+
+// tenantReports returns the usage of the tenants, sorted by tenant.
+func (c *Collider) tenantReports() []tenantReport {
+	c.tenants.lock.Lock()
+	defer c.tenants.lock.Unlock()
+	rps := make([]tenantReport, 0, len(c.tenants.usage))
+	for t, u := range c.tenants.usage {
+		rps = append(rps, tenantReport{
+			Tenant:      t,
+			Conns:       u.conns,
+			Rooms:       u.rooms,
+			Messages:    u.messages,
+			RateLimited: u.rateLimited,
+			Refused:     u.refused,
+			Limits:      c.tenantLimits(t),
+		})
+	}
+	sort.Slice(rps, func(i, j int) bool { return rps[i].Tenant < rps[j].Tenant })
+	return rps
+}
+
+// httpAdminTenantsHandler is a HTTP handler that lists the usage of the tenants and their limits.
+func (c *Collider) httpAdminTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c.tenantReports()); err != nil {
+		c.httpError("Failed to encode to JSON: err="+err.Error(), w)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"testing"
+)
+
+// Tests that a tenant refused beyond MaxConns is counted, and that releasing a connection makes room for another.
+func TestTenantTableConns(t *testing.T) {
+	var tt tenantTable
+	l := TenantLimits{MaxConns: 1}
+	if !tt.acquireConn("a", l) {
+		t.Fatal("acquireConn(a) with no connection got false, want true")
+	}
+	if tt.acquireConn("a", l) {
+		t.Error("acquireConn(a) with MaxConns connections got true, want false")
+	}
+	if !tt.acquireConn("b", l) {
+		t.Error("acquireConn(b) with tenant a full got false, want true")
+	}
+	tt.releaseConn("a")
+	if !tt.acquireConn("a", l) {
+		t.Error("acquireConn(a) after releaseConn(a) got false, want true")
+	}
+	if u := tt.usage["a"]; u.conns != 1 || u.refused != 1 {
+		t.Errorf("The usage of tenant a is %+v, want 1 connection and 1 refused", *u)
+	}
+}
+
+// Tests that a tenant with MaxRooms rooms may not create another one until one of its rooms is removed.
+func TestTenantTableRooms(t *testing.T) {
+	var tt tenantTable
+	l := TenantLimits{MaxRooms: 1}
+	if !tt.acquireRoom("a", l) {
+		t.Fatal("acquireRoom(a) with no room got false, want true")
+	}
+	if tt.acquireRoom("a", l) {
+		t.Error("acquireRoom(a) with MaxRooms rooms got true, want false")
+	}
+	if !tt.acquireRoom("b", l) {
+		t.Error("acquireRoom(b) with tenant a full got false, want true")
+	}
+	tt.releaseRoom("a")
+	if !tt.acquireRoom("a", l) {
+		t.Error("acquireRoom(a) after releaseRoom(a) got false, want true")
+	}
+	if u := tt.usage["a"]; u.rooms != 1 {
+		t.Errorf("The usage of tenant a is %+v, want 1 room", *u)
+	}
+}
+
+// dialTenant opens a WebSocket connection for the tenant |tenant|, returning the handshake error if any.
+func dialTenant(t *testing.T, tenant string) (*websocket.Conn, error) {
+	config := newConfig(t, "/ws")
+	config.Header = http.Header{"X-Tenant": {tenant}}
+	return websocket.NewClient(config, dial(t))
+}
+
+// Tests that two tenants hit their connection caps, room quotas and message rates independently of each other,
+// and that the admin API shows their usage.
+func TestWsTenantLimits(t *testing.T) {
+	setup()
+	limits := TenantLimits{MaxConns: 2, MaxRooms: 1, MessagesPerSecond: 0.001, MessageBurst: 1}
+	cl.TenantFunc = func(r *http.Request, rid string) string { return r.Header.Get("X-Tenant") }
+	cl.Tenants = map[string]TenantLimits{"tenant-a": limits, "tenant-b": limits}
+	defer func() { cl.TenantFunc, cl.Tenants = nil, nil }()
+
+	conns := make(map[string][]*websocket.Conn)
+	for _, tenant := range []string{"tenant-a", "tenant-b"} {
+		for i := 0; i < 2; i++ {
+			c, err := dialTenant(t, tenant)
+			if err != nil {
+				t.Fatalf("Connection %d of %s got error: %v, want nil", i+1, tenant, err)
+			}
+			defer c.Close()
+			conns[tenant] = append(conns[tenant], c)
+		}
+	}
+	// Tenant a is at MaxConns, as is tenant b.
+	if c, err := dialTenant(t, "tenant-a"); err == nil {
+		c.Close()
+		t.Error("A third connection of tenant-a got no error, want the handshake rejected")
+	}
+
+	// Tenant a creates a room, then may not create another one; tenant b creates its own room.
+	a, b := conns["tenant-a"], conns["tenant-b"]
+	write(t, a[0], wsClientMsg{Cmd: "register", RoomID: "tenant-a-1", ClientID: "1"})
+	write(t, b[0], wsClientMsg{Cmd: "register", RoomID: "tenant-b-1", ClientID: "1"})
+	waitForCondition(func() bool {
+		return cl.roomTable.isRegistered("tenant-a-1", "1") && cl.roomTable.isRegistered("tenant-b-1", "1")
+	})
+	write(t, a[1], wsClientMsg{Cmd: "register", RoomID: "tenant-a-2", ClientID: "2"})
+	expectReceiveErrorCode(t, a[1], errCodeTenantLimit)
+	// Joining the existing room of the tenant creates no room.
+	write(t, b[1], wsClientMsg{Cmd: "register", RoomID: "tenant-b-1", ClientID: "2"})
+	waitForCondition(func() bool { return cl.roomTable.isRegistered("tenant-b-1", "2") })
+
+	// Tenant a exhausts its message burst; tenant b still sends.
+	write(t, a[0], wsClientMsg{Cmd: "send", Msg: "first"})
+	write(t, a[0], wsClientMsg{Cmd: "send", Msg: "second"})
+	expectReceiveErrorCode(t, a[0], errCodeTenantRateLimited)
+	write(t, b[0], wsClientMsg{Cmd: "send", Msg: "hi"})
+	expectReceiveMessage(t, b[1], "hi")
+
+	resp := adminGet(t, "/admin/tenants")
+	defer resp.Body.Close()
+	var rps []tenantReport
+	if err := json.NewDecoder(resp.Body).Decode(&rps); err != nil {
+		t.Fatalf("Decoding GET /admin/tenants got error: %v, want nil", err)
+	}
+	got := make(map[string]tenantReport)
+	for _, rp := range rps {
+		got[rp.Tenant] = rp
+	}
+	if rp := got["tenant-a"]; rp.Rooms != 1 || rp.Messages != 1 || rp.RateLimited != 1 || rp.Refused != 2 ||
+		rp.Limits != limits {
+		t.Errorf("The usage of tenant-a is %+v, want 1 room, 1 message, 1 rate limited and 2 refused", rp)
+	}
+	if rp := got["tenant-b"]; rp.Conns != 2 || rp.Rooms != 1 || rp.Messages != 1 || rp.RateLimited != 0 ||
+		rp.Refused != 0 {
+		t.Errorf("The usage of tenant-b is %+v, want 2 connections, 1 room, 1 message and nothing refused", rp)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The paths of the TLS certificate and key when CertFile and KeyFile are not set.
+const (
+	defaultCertFile = "/cert/cert.pem"
+	defaultKeyFile  = "/cert/key.pem"
+)
+
+// The prefix net/http logs a failed TLS handshake with, followed by the remote address and the error.
+const tlsHandshakeErrPrefix = "http: TLS handshake error from "
+
+// tlsHandshakes remembers the TLS versions offered by the clients whose handshake is in progress,
+// so that a failed handshake can be logged with what the client attempted.
+type tlsHandshakes struct {
+	lock     sync.Mutex
+	versions map[string][]uint16
+}
+
+// newTLSConfig returns the TLS configuration of the server, a copy of TLSConfig if set, recording the versions
+// offered by each client.
+func (c *Collider) newTLSConfig() *tls.Config {
+	cfg := defaultTLSConfig()
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c.handshakes.offered(hello.Conn.RemoteAddr().String(), hello.SupportedVersions)
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return cfg
+}
+
+// defaultTLSConfig returns the TLS configuration of the server when TLSConfig is not set.
+func defaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		// Only allow ciphers that support forward secrecy for iOS9 compatibility:
+		// https://developer.apple.com/library/prerelease/ios/technotes/App-Transport-Security-Technote/
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			//tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		},
+		PreferServerCipherSuites: true,
+	}
+}
+
+// certFiles returns the paths of the TLS certificate and key, or empty paths if TLSConfig supplies the
+// certificates and CertFile and KeyFile are not set.
+func (c *Collider) certFiles() (cert string, key string) {
+	if c.CertFile == "" && c.KeyFile == "" && c.TLSConfig != nil &&
+		(len(c.TLSConfig.Certificates) > 0 || c.TLSConfig.GetCertificate != nil) {
+		return "", ""
+	}
+	cert, key = c.CertFile, c.KeyFile
+	if cert == "" {
+		cert = defaultCertFile
+	}
+	if key == "" {
+		key = defaultKeyFile
+	}
+	return cert, key
+}
+
+// checkCertFiles returns an error naming the TLS certificate or key file that cannot be read, so that a
+// missing file is reported as such rather than as a TLS failure.
+func checkCertFiles(cert string, key string) error {
+	for _, f := range []struct{ what, path string }{{"certificate", cert}, {"key", key}} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("Cannot read the TLS %s file: %v", f.what, err)
+		}
+	}
+	return nil
+}
+
+// tlsConnState forgets the versions offered by a client once its connection is past the handshake.
+// A failed handshake is logged before the connection is closed, so its offer is still known then.
+func (c *Collider) tlsConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateActive, http.StateHijacked, http.StateClosed:
+		c.handshakes.take(conn.RemoteAddr().String())
+	}
+}
+
+// tlsErrorLog returns the logger receiving the errors of the HTTP server, which counts and logs the
+// failed TLS handshakes with the client address and the versions it offered.
+func (c *Collider) tlsErrorLog() *log.Logger {
+	return log.New(tlsErrorWriter{c}, "", 0)
+}
+
+// tlsErrorWriter is the output of the HTTP server error log.
+type tlsErrorWriter struct {
+	c *Collider
+}
+
+func (w tlsErrorWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if !strings.HasPrefix(line, tlsHandshakeErrPrefix) {
+		w.c.logger().Print(line)
+		return len(p), nil
+	}
+	addr, err := line[len(tlsHandshakeErrPrefix):], ""
+	if i := strings.Index(addr, ": "); i >= 0 {
+		addr, err = addr[:i], addr[i+2:]
+	}
+	w.c.onTLSHandshakeErr(addr, err)
+	return len(p), nil
+}
+
+// onTLSHandshakeErr logs and counts a failed TLS handshake.
+func (c *Collider) onTLSHandshakeErr(addr string, errMsg string) {
+	versions := c.handshakes.take(addr)
+	c.logger().Printf("TLS handshake failed: client=%s offered=%s err=%q", addr, tlsVersionNames(versions), errMsg)
+	c.dash.onTLSErr()
+}
+
+// offered records the versions offered by the client at |addr|.
+func (th *tlsHandshakes) offered(addr string, versions []uint16) {
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	if th.versions == nil {
+		th.versions = make(map[string][]uint16)
+	}
+	th.versions[addr] = versions
+}
+
+// take returns and forgets the versions offered by the client at |addr|.
+func (th *tlsHandshakes) take(addr string) []uint16 {
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	v := th.versions[addr]
+	delete(th.versions, addr)
+	return v
+}
+
+// tlsVersionNames returns the comma-separated names of the TLS versions, or "unknown".
+func tlsVersionNames(versions []uint16) string {
+	if len(versions) == 0 {
+		return "unknown"
+	}
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = tls.VersionName(v)
+	}
+	return strings.Join(names, ",")
+}
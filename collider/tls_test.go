@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a buffer safe for the concurrent writes of the log package.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// Tests that a TLS handshake failing on the protocol version is logged with the offered versions and counted,
+// while a successful handshake is not.
+func TestTLSHandshakeFailureLoggedAndCounted(t *testing.T) {
+	c := createNewCollider()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = c.newTLSConfig()
+	srv.Config.ErrorLog = c.tlsErrorLog()
+	srv.Config.ConnState = c.tlsConnState
+	srv.StartTLS()
+	defer srv.Close()
+
+	var out lockedBuffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	addr := srv.Listener.Addr().String()
+	old := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	if conn, err := tls.Dial("tcp", addr, old); err == nil {
+		conn.Close()
+		t.Fatalf("tls.Dial with TLS 1.1 at most got no error, want a handshake failure")
+	}
+
+	if !waitForCondition(func() bool { return c.dash.getReport(c.roomTable).TLSErrs == 1 }) {
+		t.Errorf("After a failed handshake, getReport().TLSErrs = %d, want 1", c.dash.getReport(c.roomTable).TLSErrs)
+	}
+	if s := out.String(); !strings.Contains(s, "TLS handshake failed") || !strings.Contains(s, "offered=TLS 1.1,TLS 1.0") {
+		t.Errorf("After a failed handshake, the log is %q, want the failure with the offered versions", s)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial with the default config got error: %v, want nil", err)
+	}
+	conn.Close()
+	if n := c.dash.getReport(c.roomTable).TLSErrs; n != 1 {
+		t.Errorf("After a successful handshake, getReport().TLSErrs = %d, want 1", n)
+	}
+}
+
+// Tests that the TLS certificate and key default to /cert, unless TLSConfig supplies the certificates, and that
+// a missing file is reported by name.
+func TestCertFiles(t *testing.T) {
+	c := createNewCollider()
+	if cert, key := c.certFiles(); cert != defaultCertFile || key != defaultKeyFile {
+		t.Errorf("certFiles() = %q, %q, want %q, %q", cert, key, defaultCertFile, defaultKeyFile)
+	}
+	c.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+	if cert, key := c.certFiles(); cert != "" || key != "" {
+		t.Errorf("With TLSConfig supplying the certificates, certFiles() = %q, %q, want none", cert, key)
+	}
+	c.CertFile = "cert.pem"
+	if cert, key := c.certFiles(); cert != "cert.pem" || key != defaultKeyFile {
+		t.Errorf("With CertFile set, certFiles() = %q, %q, want %q, %q", cert, key, "cert.pem", defaultKeyFile)
+	}
+
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir got error: %v, want nil", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cert, nil, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(%q) got error: %v, want nil", cert, err)
+	}
+	if err := checkCertFiles(cert, key); err == nil || !strings.Contains(err.Error(), "TLS key file") ||
+		!strings.Contains(err.Error(), key) {
+		t.Errorf("checkCertFiles with a missing key got error: %v, want one naming %q", err, key)
+	}
+	if err := checkCertFiles(cert, ""); err != nil {
+		t.Errorf("checkCertFiles(%q, \"\") got error: %v, want nil", cert, err)
+	}
+}
+
+// Tests that the server uses a copy of TLSConfig, still recording the versions offered by the clients.
+func TestCustomTLSConfig(t *testing.T) {
+	c := createNewCollider()
+	c.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS13}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = c.newTLSConfig()
+	srv.Config.ErrorLog = c.tlsErrorLog()
+	srv.Config.ConnState = c.tlsConnState
+	srv.StartTLS()
+	defer srv.Close()
+	if c.TLSConfig.GetConfigForClient != nil || len(c.TLSConfig.Certificates) > 0 {
+		t.Error("Serving TLS modified TLSConfig, want it copied")
+	}
+
+	var out lockedBuffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	addr := srv.Listener.Addr().String()
+	tls12 := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	if conn, err := tls.Dial("tcp", addr, tls12); err == nil {
+		conn.Close()
+		t.Fatal("tls.Dial with TLS 1.2 at most got no error, want the MinVersion of TLSConfig to refuse it")
+	}
+	if !waitForCondition(func() bool { return strings.Contains(out.String(), "offered=TLS 1.2") }) {
+		t.Errorf("After a failed handshake, the log is %q, want the failure with the offered versions", out.String())
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// The build metadata reported by /version, set at build time with e.g.
+// go build -ldflags "-X collider.Version=1.2.0 -X collider.Commit=$(git rev-parse HEAD)".
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// versionInfo is the build and runtime information reported by /version.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goversion"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	NumCPU    int    `json:"numcpu"`
+}
+
+// httpVersionHandler is a HTTP handler that returns the build metadata of the server and the runtime it
+// runs on as JSON, so that the binaries can be compared across a fleet.
+func (c *Collider) httpVersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	send(w, versionInfo{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+	})
+}
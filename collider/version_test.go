@@ -0,0 +1,35 @@
+// Copyright (c) 2014 The WebRTC project authors. All Rights Reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package collider
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// Tests that /version reports the build metadata and the runtime information.
+func TestHttpVersionHandler(t *testing.T) {
+	c := createNewCollider()
+	rec := httptest.NewRecorder()
+	c.httpVersionHandler(rec, httptest.NewRequest("GET", "/version", nil))
+
+	var v versionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("Decoding the version got error: %v, want nil", err)
+	}
+	want := versionInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+	}
+	if v != want || v.GoVersion == "" || v.NumCPU < 1 {
+		t.Errorf("/version returned %+v, want %+v", v, want)
+	}
+}
@@ -9,12 +9,30 @@ import (
 	"collider"
 	"flag"
 	"log"
+	"os"
+	"strings"
 )
 
 var tls = flag.Bool("tls", false, "whether TLS is used")
+var certFile = flag.String("tls-cert", "", "The TLS certificate file when -tls is set; empty for /cert/cert.pem")
+var keyFile = flag.String("tls-key", "", "The TLS key file when -tls is set; empty for /cert/key.pem")
 var port = flag.Int("port", 6067, "The TCP port that the server listens on")
 //var roomSrv = flag.String("room-server", "https://apprtc.appspot.com", "The origin of the room server")
 var roomSrv = flag.String("room-server", "http://60.205.93.75:6060", "The origin of the room server")
+var adminToken = flag.String("admin-token", "", "The token guarding the admin endpoints; they are disabled when empty")
+var auditLog = flag.String("audit-log", "", "The file the admin operations are audited to as JSON lines; \"-\" for stderr")
+var readBufferSize = flag.Int("read-buffer-size", 0, "The size in bytes of the read buffer of each WebSocket connection; 0 for 4096")
+var writeBufferSize = flag.Int("write-buffer-size", 0, "The size in bytes of the write buffer of each WebSocket connection; 0 for 4096")
+var readTimeout = flag.Duration("read-timeout", 0, "How long a registered client may stay silent before it is disconnected; 0 for one day")
+var unregisteredReadTimeout = flag.Duration("unregistered-read-timeout", 0, "How long a WebSocket connection may stay silent before registering; 0 for 10s, or the session read timeout if shorter")
+var registerTimeout = flag.Duration("register-timeout", 0, "How long a client of a room may take to register before it is removed; 0 for 10s")
+var maxHeapBytes = flag.Uint64("max-heap-bytes", 0, "The heap size towards which load is shed to avoid running out of memory; 0 disables the guard")
+var pingInterval = flag.Duration("ping-interval", 0, "How often the WebSocket connections are pinged to detect the dead peers; 0 disables the pings")
+var debug = flag.Bool("debug", false, "Whether every frame and message is logged, the message bodies included")
+var allowedOrigins = flag.String("allowed-origins", "", "The comma-separated origins the browsers may call the HTTP endpoints and open WebSockets from; empty allows every origin")
+var instanceID = flag.String("instance-id", "", "The instance ID reported in the X-Collider-Instance header and the registered frame; \"auto\" generates one")
+var trustedProxies = flag.String("trusted-proxies", "", "The comma-separated addresses or CIDR ranges of the reverse proxies whose X-Forwarded-For header is trusted; empty trusts none")
+var pathPrefix = flag.String("path-prefix", "", "The path the handlers are served under, e.g. /signal for /signal/ws; empty for the root")
 
 func main() {
 	flag.Parse()
@@ -22,5 +40,36 @@ func main() {
 	log.Printf("Starting collider: tls = %t, port = %d, room-server=%s", *tls, *port, *roomSrv)
 
 	c := collider.NewCollider(*roomSrv)
-	c.Run(*port, *tls)
+	if *instanceID != "" {
+		c.IncludeInstanceID = true
+		if *instanceID != "auto" {
+			c.InstanceID = *instanceID
+		}
+	}
+	c.AdminToken = *adminToken
+	c.CertFile, c.KeyFile = *certFile, *keyFile
+	c.ReadBufferSize, c.WriteBufferSize = *readBufferSize, *writeBufferSize
+	c.ReadTimeout, c.UnregisteredReadTimeout = *readTimeout, *unregisteredReadTimeout
+	c.RegisterTimeout = *registerTimeout
+	c.MaxHeapBytes = *maxHeapBytes
+	c.PingInterval = *pingInterval
+	c.Debug = *debug
+	c.PathPrefix = *pathPrefix
+	if *allowedOrigins != "" {
+		c.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
+	if *trustedProxies != "" {
+		c.TrustedProxies = strings.Split(*trustedProxies, ",")
+	}
+	if *auditLog == "-" {
+		c.Audit = collider.NewJSONAuditSink(os.Stderr)
+	} else if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open the audit log: %v", err)
+		}
+		defer f.Close()
+		c.Audit = collider.NewJSONAuditSink(f)
+	}
+	c.MustRun(*port, *tls)
 }